@@ -0,0 +1,43 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/clawio/lib"
+	"github.com/gorilla/mux"
+	"net/http"
+	"net/http/pprof"
+)
+
+// handleDebugEndpoints adds to the router of the admin listener the
+// profiles of net/http/pprof and the nodes in the registry.
+// They are never served publicly.
+func handleDebugEndpoints(router *mux.Router, registryDriver lib.RegistryDriver) {
+	router.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	router.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	router.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	router.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	// the index serves the other profiles, e.g. /debug/pprof/heap
+	router.PathPrefix("/debug/pprof/").HandlerFunc(pprof.Index)
+	router.Handle("/registry", registryHandler(registryDriver)).Methods("GET")
+}
+
+// registryHandler serves the nodes in the registry, only the ones
+// of a role if the role query parameter is set.
+func registryHandler(registryDriver lib.RegistryDriver) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		nodes, err := listRegistryNodes(r.Context(), registryDriver)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		rol := r.URL.Query().Get("role")
+		views := []*registryNodeView{}
+		for _, n := range nodes {
+			if rol == "" || n.Rol() == rol {
+				views = append(views, newRegistryNodeView(n))
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(views)
+	}
+}
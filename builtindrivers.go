@@ -0,0 +1,134 @@
+package main
+
+import (
+	"github.com/clawio/clawiod/drivers"
+	"github.com/clawio/lib"
+	"github.com/clawio/lib/dummyregistrydriver"
+	"github.com/clawio/lib/fsdatadriver"
+	"github.com/clawio/lib/fsmdatadriver"
+	"github.com/clawio/lib/jwttokendriver"
+	"github.com/clawio/lib/ldapuserdriver"
+	"github.com/clawio/lib/memuserdriver"
+	"github.com/clawio/lib/ocfsdatadriver"
+	"github.com/clawio/lib/ocfsmdatadriver"
+)
+
+// the drivers shipped with clawiod, other drivers are
+// compiled in by importing their packages.
+func init() {
+	drivers.RegisterUserDriver("memuserdriver", newMemUserDriver)
+	drivers.RegisterUserDriver("ldapuserdriver", newLDAPUserDriver)
+	drivers.RegisterTokenDriver("jwttokendriver", newJWTTokenDriver)
+	drivers.RegisterDataDriver("fsdatadriver", newFSDataDriver)
+	drivers.RegisterDataDriver("ocfsdatadriver", newOCFSDataDriver)
+	drivers.RegisterMetaDataDriver("fsmdatadriver", newFSMDataDriver)
+	drivers.RegisterMetaDataDriver("ocfsmdatadriver", newOCFSMDataDriver)
+	drivers.RegisterRegistryDriver("etcd", newETCDRegistryDriver)
+	drivers.RegisterRegistryDriver("file", newFileRegistryDriver)
+	drivers.RegisterRegistryDriver("dns", newDNSRegistryDriver)
+	drivers.RegisterRegistryDriver("dummy", newDummyRegistryDriver)
+}
+
+func newMemUserDriver(c drivers.Components) (lib.UserDriver, error) {
+	return memuserdriver.New(c.Config().GetMemUserDriverUsers()), nil
+}
+
+func newLDAPUserDriver(c drivers.Components) (lib.UserDriver, error) {
+	config := c.Config()
+	logger, err := c.Logger()
+	if err != nil {
+		return nil, err
+	}
+	return ldapuserdriver.New(logger,
+		config.GetLDAPUserDriverBindUsername(),
+		config.GetLDAPUserDriverBindPassword(),
+		config.GetLDAPUserDriverHostname(),
+		config.GetLDAPUserDriverPort(),
+		config.GetLDAPUserDriverBaseDN(),
+		config.GetLDAPUserDriverFilter())
+}
+
+func newJWTTokenDriver(c drivers.Components) (lib.TokenDriver, error) {
+	cm, err := c.ContextManager()
+	if err != nil {
+		return nil, err
+	}
+	logger, err := c.Logger()
+	if err != nil {
+		return nil, err
+	}
+	return jwttokendriver.New(c.Config().GetJWTTokenDriverKey(), cm, logger), nil
+}
+
+func newFSDataDriver(c drivers.Components) (lib.DataDriver, error) {
+	config := c.Config()
+	logger, err := c.Logger()
+	if err != nil {
+		return nil, err
+	}
+	return fsdatadriver.New(
+		logger,
+		config.GetFSDataDriverDataFolder(),
+		config.GetFSDataDriverTemporaryFolder(),
+		config.GetFSDataDriverChecksum(),
+		config.GetFSDataDriverVerifyClientChecksum())
+}
+
+func newOCFSDataDriver(c drivers.Components) (lib.DataDriver, error) {
+	config := c.Config()
+	logger, err := c.Logger()
+	if err != nil {
+		return nil, err
+	}
+	metaDataDriver, err := c.MetaDataDriver()
+	if err != nil {
+		return nil, err
+	}
+	return ocfsdatadriver.New(logger,
+		config.GetOCFSDataDriverDataFolder(),
+		config.GetOCFSDataDriverTemporaryFolder(),
+		config.GetOCFSDataDriverChunksFolder(),
+		config.GetOCFSDataDriverChecksum(),
+		config.GetOCFSDataDriverVerifyClientChecksum(),
+		metaDataDriver)
+}
+
+func newFSMDataDriver(c drivers.Components) (lib.MetaDataDriver, error) {
+	config := c.Config()
+	logger, err := c.Logger()
+	if err != nil {
+		return nil, err
+	}
+	return fsmdatadriver.New(
+		logger,
+		config.GetFSMDataDriverDataFolder(),
+		config.GetFSMDataDriverTemporaryFolder())
+}
+
+func newOCFSMDataDriver(c drivers.Components) (lib.MetaDataDriver, error) {
+	config := c.Config()
+	logger, err := c.Logger()
+	if err != nil {
+		return nil, err
+	}
+	return ocfsmdatadriver.New(logger,
+		nil,
+		config.GetOCFSMDataDriverMaxSQLIddle(),
+		config.GetOCFSMDataDriverMaxSQLConcurrent(),
+		config.GetOCFSMDataDriverDataFolder(),
+		config.GetOCFSMDataDriverTemporaryFolder(),
+		config.GetOCFSMDataDriverDSN())
+}
+
+func newDummyRegistryDriver(c drivers.Components) (lib.RegistryDriver, error) {
+	return &dummyRegistryDriver{dummyregistrydriver.New()}, nil
+}
+
+// dummyRegistryDriver does not keep the nodes, so there is nothing to remove.
+type dummyRegistryDriver struct {
+	lib.RegistryDriver
+}
+
+func (d *dummyRegistryDriver) IsReadOnly() bool {
+	return true
+}
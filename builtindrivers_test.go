@@ -0,0 +1,46 @@
+package main
+
+import (
+	"github.com/clawio/clawiod/drivers"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestBuiltinDrivers(t *testing.T) {
+	want := map[string][]string{
+		drivers.KindUser:     {"ldapuserdriver", "memuserdriver"},
+		drivers.KindToken:    {"jwttokendriver"},
+		drivers.KindData:     {"fsdatadriver", "ocfsdatadriver"},
+		drivers.KindMetaData: {"fsmdatadriver", "ocfsmdatadriver"},
+		drivers.KindRegistry: {"dns", "dummy", "etcd", "file"},
+	}
+	for _, kind := range drivers.Kinds() {
+		if names := drivers.Names(kind); !reflect.DeepEqual(names, want[kind]) {
+			t.Errorf("%s drivers = %v, want %v", kind, names, want[kind])
+		}
+	}
+}
+
+func TestUnknownDriver(t *testing.T) {
+	c := newContainer(&configuration{
+		UserDriver:     "nonexistent",
+		TokenDriver:    "nonexistent",
+		DataDriver:     "nonexistent",
+		MetaDataDriver: "nonexistent",
+	})
+	tests := []struct {
+		kind string
+		get  func() error
+	}{
+		{"user", func() error { _, err := getUserDriver(c); return err }},
+		{"token", func() error { _, err := getTokenDriver(c); return err }},
+		{"data", func() error { _, err := getDataDriver(c); return err }},
+		{"metadata", func() error { _, err := getMetaDataDriver(c); return err }},
+	}
+	for _, tt := range tests {
+		if err := tt.get(); err == nil || !strings.Contains(err.Error(), "does not exist") {
+			t.Errorf("%s driver %q = %v, want it does not exist", tt.kind, "nonexistent", err)
+		}
+	}
+}
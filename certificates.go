@@ -0,0 +1,226 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"github.com/go-kit/kit/log/levels"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// tls modes
+const (
+	tlsModeFile = "file"
+	tlsModeACME = "acme"
+)
+
+var tlsModes = []string{tlsModeFile, tlsModeACME}
+
+// getTLSConfig returns the tls configuration of the listener. The certificate
+// is read from files, reloaded when they are rotated, or issued and renewed
+// by an ACME server. The returned closer, if any, stops the reloads.
+func getTLSConfig(config *configuration, logger levels.Levels) (*tls.Config, io.Closer, error) {
+	switch config.GetTLSMode() {
+	case tlsModeFile:
+		reloader, err := newCertificateReloader(config.GetTLSCertificate(), config.GetTLSPrivateKey(), config.GetTLSCertificateReloadInterval(), logger)
+		if err != nil {
+			return nil, nil, err
+		}
+		return &tls.Config{
+			GetCertificate: reloader.GetCertificate,
+			NextProtos:     []string{"h2", "http/1.1"},
+		}, reloader, nil
+	case tlsModeACME:
+		m, err := newACMEManager(config)
+		if err != nil {
+			return nil, nil, err
+		}
+		logger.Info().Log("msg", "certificates issued by acme server", "directory", config.GetTLSACMEDirectoryURL(), "hosts", config.GetTLSACMEHosts())
+		return m.TLSConfig(), nil, nil
+	default:
+		return nil, nil, fmt.Errorf("tls mode %q does not exist", config.GetTLSMode())
+	}
+}
+
+// newACMEManager creates the manager that obtains the certificates of the
+// configured hosts from the ACME server and caches them on disk. Certificates
+// are renewed before they expire while the server handles TLS handshakes.
+// The challenge is solved with TLS-ALPN-01, so the ACME server must reach
+// this listener on the port it validates, 443 for public servers.
+func newACMEManager(config *configuration) (*autocert.Manager, error) {
+	hosts := []string{}
+	for _, host := range strings.Split(config.GetTLSACMEHosts(), ",") {
+		if host = strings.TrimSpace(host); host != "" {
+			hosts = append(hosts, host)
+		}
+	}
+	if len(hosts) == 0 {
+		return nil, errors.New("tls acme hosts is empty")
+	}
+	httpClient, err := getACMEHTTPClient(config.GetTLSACMECACertificate())
+	if err != nil {
+		return nil, err
+	}
+	return &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		Cache:      autocert.DirCache(config.GetTLSACMECacheDir()),
+		HostPolicy: autocert.HostWhitelist(hosts...),
+		Email:      config.GetTLSACMEEmail(),
+		Client: &acme.Client{
+			DirectoryURL: config.GetTLSACMEDirectoryURL(),
+			HTTPClient:   httpClient,
+		},
+	}, nil
+}
+
+// getACMEHTTPClient returns the client to talk to the ACME server. A private
+// ACME server, e.g. Pebble or a local CA, is trusted with the PEM certificate
+// of its CA.
+func getACMEHTTPClient(caCertificate string) (*http.Client, error) {
+	if caCertificate == "" {
+		return http.DefaultClient, nil
+	}
+	pool, err := loadCertPool(caCertificate, false)
+	if err != nil {
+		return nil, err
+	}
+	return &http.Client{
+		Transport: &http.Transport{
+			Proxy:           http.ProxyFromEnvironment,
+			TLSClientConfig: &tls.Config{RootCAs: pool},
+		},
+		Timeout: time.Minute,
+	}, nil
+}
+
+// loadCertPool returns a pool with the PEM certificates of filename,
+// added to the ones of the system if system is true.
+func loadCertPool(filename string, system bool) (*x509.CertPool, error) {
+	pem, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if system {
+		if systemPool, err := x509.SystemCertPool(); err == nil {
+			pool = systemPool
+		}
+	}
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("%s has no PEM certificates", filename)
+	}
+	return pool, nil
+}
+
+// certificateReloader serves a certificate read from files and reads them
+// again when they change, so rotated certificates are used without a restart.
+type certificateReloader struct {
+	logger   levels.Levels
+	certFile string
+	keyFile  string
+
+	mu      sync.RWMutex
+	cert    *tls.Certificate
+	modTime time.Time
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+func newCertificateReloader(certFile, keyFile string, interval time.Duration, logger levels.Levels) (*certificateReloader, error) {
+	r := &certificateReloader{
+		logger:   logger,
+		certFile: certFile,
+		keyFile:  keyFile,
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	if _, err := r.load(); err != nil {
+		return nil, err
+	}
+	go r.poll(interval)
+	return r, nil
+}
+
+// GetCertificate returns the last valid certificate read.
+func (r *certificateReloader) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.cert, nil
+}
+
+// GetClientCertificate returns the last valid certificate read
+// to authenticate the connections to other servers.
+func (r *certificateReloader) GetClientCertificate(info *tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.cert, nil
+}
+
+// Close stops polling the files.
+func (r *certificateReloader) Close() error {
+	close(r.stop)
+	<-r.done
+	return nil
+}
+
+func (r *certificateReloader) poll(interval time.Duration) {
+	defer close(r.done)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			changed, err := r.load()
+			if err != nil {
+				// the certificate and the key may be written one after the other
+				r.logger.Error().Log("msg", "error loading certificate, keeping the previous one", "certificate", r.certFile, "error", err)
+				continue
+			}
+			if changed {
+				r.logger.Info().Log("msg", "certificate reloaded", "certificate", r.certFile)
+			}
+		case <-r.stop:
+			return
+		}
+	}
+}
+
+// load reads the files if any of them changed since the last time they were read.
+func (r *certificateReloader) load() (bool, error) {
+	modTime := time.Time{}
+	for _, filename := range []string{r.certFile, r.keyFile} {
+		info, err := os.Stat(filename)
+		if err != nil {
+			return false, err
+		}
+		if info.ModTime().After(modTime) {
+			modTime = info.ModTime()
+		}
+	}
+	r.mu.RLock()
+	unchanged := r.cert != nil && modTime.Equal(r.modTime)
+	r.mu.RUnlock()
+	if unchanged {
+		return false, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return false, err
+	}
+	r.mu.Lock()
+	r.cert = &cert
+	r.modTime = modTime
+	r.mu.Unlock()
+	return true, nil
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/levels"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testCertificate is a self-signed certificate and its key in PEM.
+type testCertificate struct {
+	cert []byte
+	key  []byte
+}
+
+func newTestCertificate(t *testing.T, name string) *testCertificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{"localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCertificate{
+		cert: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		key:  pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}),
+	}
+}
+
+// writeTestFile writes data with a modification time later than the previous one,
+// so the change is seen even by file systems with a coarse resolution.
+func writeTestFile(t *testing.T, filename string, data []byte, modTime time.Time) {
+	if err := ioutil.WriteFile(filename, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(filename, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// getServedCertificate returns the common name of the certificate served by the server at addr.
+func getServedCertificate(t *testing.T, addr string) string {
+	conn, err := tls.Dial("tcp", addr, &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	return conn.ConnectionState().PeerCertificates[0].Subject.CommonName
+}
+
+func TestCertificateReloader(t *testing.T) {
+	dir, err := ioutil.TempDir("", "clawiod")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+
+	first := newTestCertificate(t, "first")
+	second := newTestCertificate(t, "second")
+	third := newTestCertificate(t, "third")
+	modTime := time.Now().Add(-time.Hour)
+	writeTestFile(t, certFile, first.cert, modTime)
+	writeTestFile(t, keyFile, first.key, modTime)
+
+	r, err := newCertificateReloader(certFile, keyFile, 10*time.Millisecond, levels.New(log.NewNopLogger()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{GetCertificate: r.GetCertificate})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go http.Serve(l, http.NotFoundHandler())
+	addr := l.Addr().String()
+
+	if served := getServedCertificate(t, addr); served != "first" {
+		t.Fatalf("serving certificate %q, want first", served)
+	}
+
+	tests := []struct {
+		name string
+		cert []byte
+		key  []byte
+		want string
+	}{
+		{"rotated", second.cert, second.key, "second"},
+		// the new certificate is written before its key
+		{"certificate without its key", third.cert, second.key, "second"},
+		{"key written", third.cert, third.key, "third"},
+		{"invalid certificate", []byte("not a certificate"), third.key, "third"},
+	}
+	for _, tt := range tests {
+		modTime = modTime.Add(time.Minute)
+		writeTestFile(t, certFile, tt.cert, modTime)
+		writeTestFile(t, keyFile, tt.key, modTime)
+
+		deadline := time.Now().Add(2 * time.Second)
+		served := getServedCertificate(t, addr)
+		for served != tt.want && time.Now().Before(deadline) {
+			time.Sleep(10 * time.Millisecond)
+			served = getServedCertificate(t, addr)
+		}
+		// a certificate kept must still be served after some polls
+		time.Sleep(50 * time.Millisecond)
+		if served = getServedCertificate(t, addr); served != tt.want {
+			t.Fatalf("%s: serving certificate %q, want %q", tt.name, served, tt.want)
+		}
+	}
+}
+
+func TestNewCertificateReloaderFailsWithoutFiles(t *testing.T) {
+	if _, err := newCertificateReloader("/nonexistent/cert.pem", "/nonexistent/key.pem", time.Second, levels.New(log.NewNopLogger())); err == nil {
+		t.Fatal("newCertificateReloader() without files = nil error, want one")
+	}
+}
+
+func TestNewACMEManager(t *testing.T) {
+	dir, err := ioutil.TempDir("", "clawiod")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// a private ACME server trusted with the certificate of its CA
+	requests := make(chan string, 10)
+	acmeServer := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests <- r.URL.Path
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"newNonce": "%[1]s/nonce", "newAccount": "%[1]s/account", "newOrder": "%[1]s/order",
+			"new-reg": "%[1]s/account", "new-authz": "%[1]s/authz", "new-cert": "%[1]s/cert"}`, "https://"+r.Host)
+	}))
+	defer acmeServer.Close()
+	caFile := filepath.Join(dir, "ca.pem")
+	ca := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: acmeServer.TLS.Certificates[0].Certificate[0]})
+	writeTestFile(t, caFile, ca, time.Now())
+
+	cacheDir := filepath.Join(dir, "cache")
+	m, err := newACMEManager(&configuration{
+		TLSMode:              tlsModeACME,
+		TLSACMEDirectoryURL:  acmeServer.URL + "/directory",
+		TLSACMEHosts:         "files.example.com, webdav.example.com,",
+		TLSACMEEmail:         "admin@example.com",
+		TLSACMECacheDir:      cacheDir,
+		TLSACMECACertificate: caFile,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Client.DirectoryURL != acmeServer.URL+"/directory" {
+		t.Errorf("directory url = %q, want %q", m.Client.DirectoryURL, acmeServer.URL+"/directory")
+	}
+	if m.Email != "admin@example.com" {
+		t.Errorf("email = %q, want admin@example.com", m.Email)
+	}
+	if _, err := m.Client.Discover(context.Background()); err != nil {
+		t.Fatalf("Discover() = %v, want the directory of the private ACME server", err)
+	}
+	if path := <-requests; path != "/directory" {
+		t.Fatalf("ACME server asked for %q, want /directory", path)
+	}
+
+	for host, allowed := range map[string]bool{
+		"files.example.com":  true,
+		"webdav.example.com": true,
+		"other.example.com":  false,
+		"":                   false,
+	} {
+		if err := m.HostPolicy(context.Background(), host); (err == nil) != allowed {
+			t.Errorf("HostPolicy(%q) = %v, want allowed %t", host, err, allowed)
+		}
+	}
+
+	if m.Cache != autocert.DirCache(cacheDir) {
+		t.Fatalf("cache = %v, want the folder %s", m.Cache, cacheDir)
+	}
+	if err := m.Cache.Put(context.Background(), "files.example.com", []byte("certificate")); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := ioutil.ReadFile(filepath.Join(cacheDir, "files.example.com")); err != nil || string(data) != "certificate" {
+		t.Fatalf("cached certificate = %q, %v, want it on disk", data, err)
+	}
+}
+
+func TestNewACMEManagerDefaults(t *testing.T) {
+	m, err := newACMEManager(&configuration{TLSMode: tlsModeACME, TLSACMEHosts: "files.example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Client.DirectoryURL != acme.LetsEncryptURL {
+		t.Errorf("directory url = %q, want %q", m.Client.DirectoryURL, acme.LetsEncryptURL)
+	}
+	if m.Client.HTTPClient != http.DefaultClient {
+		t.Error("http client is not the default one without a CA certificate")
+	}
+	if m.Cache != autocert.DirCache("acme") {
+		t.Errorf("cache = %v, want the folder acme", m.Cache)
+	}
+
+	if _, err := newACMEManager(&configuration{TLSMode: tlsModeACME, TLSACMEHosts: " , "}); err == nil {
+		t.Error("newACMEManager() without hosts = nil error, want one")
+	}
+	if _, err := newACMEManager(&configuration{TLSMode: tlsModeACME, TLSACMEHosts: "files.example.com", TLSACMECACertificate: "/nonexistent/ca.pem"}); err == nil {
+		t.Error("newACMEManager() with a missing CA certificate = nil error, want one")
+	}
+}
+
+func TestGetTLSConfigACME(t *testing.T) {
+	dir, err := ioutil.TempDir("", "clawiod")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	config, closer, err := getTLSConfig(&configuration{
+		TLSMode:             tlsModeACME,
+		TLSACMEDirectoryURL: "https://127.0.0.1:1/directory",
+		TLSACMEHosts:        "files.example.com",
+		TLSACMECacheDir:     dir,
+	}, levels.New(log.NewNopLogger()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if closer != nil {
+		t.Error("closer is not nil, the manager has nothing to stop")
+	}
+	// hosts out of the whitelist are refused before asking the ACME server
+	if _, err := config.GetCertificate(&tls.ClientHelloInfo{ServerName: "other.example.com"}); err == nil {
+		t.Fatal("GetCertificate() for a host not configured = nil error, want one")
+	}
+}
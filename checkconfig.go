@@ -0,0 +1,520 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"github.com/clawio/clawiod/drivers"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// handleCheckConfig loads the configuration and prints every problem found.
+// It exits with a non-zero code if the configuration is not valid.
+func handleCheckConfig() {
+	configurationSource, err := getConfigurationSource(flagConfigurationSource)
+	if err != nil {
+		fmt.Println(err)
+		fmt.Println("can not instantiate configuration source")
+		os.Exit(1)
+	}
+	config, err := loadConfiguration(configurationSource)
+	if err != nil {
+		fmt.Println(err)
+		fmt.Println("can not load configuration")
+		os.Exit(1)
+	}
+	problems := checkConfiguration(config)
+	if len(problems) > 0 {
+		fmt.Printf("configuration from %s has %d problem(s):\n", flagConfigurationSource, len(problems))
+		for _, p := range problems {
+			fmt.Printf("- %s\n", p)
+		}
+		os.Exit(1)
+	}
+	fmt.Printf("configuration from %s is valid\n", flagConfigurationSource)
+	os.Exit(0)
+}
+
+// configurationChecker collects the problems found in a configuration.
+type configurationChecker struct {
+	config   *configuration
+	problems []error
+}
+
+// add records a problem once, no matter how many web services share the faulty component.
+func (c *configurationChecker) add(format string, a ...interface{}) {
+	err := fmt.Errorf(format, a...)
+	for _, p := range c.problems {
+		if p.Error() == err.Error() {
+			return
+		}
+	}
+	c.problems = append(c.problems, err)
+}
+
+// checkConfiguration validates the configuration semantically and returns all the problems found.
+// Only the components used by the enabled web services are validated.
+func checkConfiguration(config *configuration) []error {
+	c := &configurationChecker{config: config}
+
+	if config.GetPort() < 1 || config.GetPort() > 65535 {
+		c.add("port %d is out of range 1-65535", config.GetPort())
+	}
+	if _, err := getCPU(config.GetCPU()); err != nil {
+		c.add("cpu %q: %s", config.GetCPU(), err)
+	}
+	c.checkLoggers()
+	c.checkListeners()
+	c.checkMutualTLS()
+	c.checkCORS()
+
+	enabledWebServices := strings.Split(config.GetEnabledWebServices(), ",")
+	if config.GetEnabledWebServices() == "" {
+		c.add("enabled_web_services is empty")
+		enabledWebServices = []string{}
+	}
+	for _, ws := range enabledWebServices {
+		switch ws {
+		case "authentication":
+			c.checkWebService(ws, config.GetAuthenticationWebService(), "local", "proxied")
+		case "data":
+			c.checkWebService(ws, config.GetDataWebService(), "local", "proxied")
+		case "metadata":
+			c.checkWebService(ws, config.GetMetaDataWebService(), "local", "proxied")
+		case "owncloud":
+			c.checkWebService(ws, config.GetOCWebService(), "local", "proxied", "remote")
+		default:
+			c.add("enabled web service %q does not exist", ws)
+		}
+	}
+	c.checkMounts(enabledWebServices)
+	for ws, strategy := range getLoadBalancingStrategies(config) {
+		if !find(strategy, loadBalancingStrategies) {
+			c.add("%s web service load balancer %q does not exist, use one of %s", ws, strategy, strings.Join(loadBalancingStrategies, ", "))
+		}
+	}
+	if config.UpstreamHealthCheckInterval < 0 || config.UpstreamHealthCheckTimeout < 0 ||
+		config.UpstreamOutlierConsecutiveFailures < 0 || config.UpstreamOutlierCooldown < 0 {
+		c.add("upstream health check interval, timeout, outlier consecutive failures and cooldown can not be negative")
+	}
+	for ws, policy := range getRetryPolicies(config) {
+		if policy == nil {
+			continue
+		}
+		if err := policy.validate(); err != nil {
+			c.add("%s web service retry policy: %s", ws, err)
+		}
+	}
+	if config.RetryBudgetPercent < 0 || config.RetryBudgetMinPerSecond < 0 {
+		c.add("retry budget percent and min per second can not be negative")
+	}
+	if config.HTTPReadHeaderTimeout < 0 || config.HTTPIdleTimeout < 0 ||
+		config.HTTPMaxHeaderBytes < 0 || config.HTTPMaxConnections < 0 {
+		c.add("http read header timeout, idle timeout, max header bytes and max connections can not be negative")
+	}
+	if config.HTTP2MaxConcurrentStreams < 0 {
+		c.add("http2 max concurrent streams can not be negative")
+	}
+	if size := config.GetHTTP2MaxReadFrameSize(); size < http2MinFrameSize || size > http2MaxFrameSize {
+		c.add("http2 max read frame size must be between %d and %d", http2MinFrameSize, http2MaxFrameSize)
+	}
+	if size := config.GetHTTP2ConnectionWindowSize(); size < http2MinWindowSize || size > http2MaxWindowSize {
+		c.add("http2 connection window size must be between %d and %d", http2MinWindowSize, http2MaxWindowSize)
+	}
+	if size := config.GetHTTP2StreamWindowSize(); size < http2MinWindowSize || size > http2MaxWindowSize {
+		c.add("http2 stream window size must be between %d and %d", http2MinWindowSize, http2MaxWindowSize)
+	}
+	for ws, timeout := range getBodyReadTimeouts(config) {
+		if timeout < 0 {
+			c.add("%s web service body read timeout can not be negative", ws)
+		}
+	}
+	c.checkRegistryDriver()
+	if err := getHeartbeatSettings(config).validate(); err != nil {
+		c.add("%s", err)
+	}
+	return c.problems
+}
+
+// checkMounts checks the path prefixes and hosts of the web services and
+// that no two enabled web services are mounted to serve the same requests.
+func (c *configurationChecker) checkMounts(enabledWebServices []string) {
+	mounts := getWebServiceMounts(c.config)
+	for _, ws := range webServiceNames {
+		if err := mounts[ws].validate(); err != nil {
+			c.add("%s web service: %s", ws, err)
+		}
+	}
+	for i, ws := range webServiceNames {
+		if !find(ws, enabledWebServices) {
+			continue
+		}
+		for _, other := range webServiceNames[i+1:] {
+			if find(other, enabledWebServices) && mounts[ws].conflicts(mounts[other]) {
+				c.add("%s and %s web services are mounted on the same path prefix %q for the same hosts", ws, other, mounts[ws].pathPrefix)
+			}
+		}
+	}
+}
+
+func (c *configurationChecker) checkWebService(name, kind string, kinds ...string) {
+	if !find(kind, kinds) {
+		c.add("%s web service %q does not exist, use one of %s", name, kind, strings.Join(kinds, ", "))
+		return
+	}
+	if kind == "proxied" {
+		c.requireRegistry(name + " web service is proxied")
+		return
+	}
+
+	switch name {
+	case "authentication":
+		c.checkUserDriver()
+		c.checkTokenDriver()
+	case "data":
+		c.checkDataDriver()
+		c.checkTokenDriver()
+		if c.config.GetDataWebServiceMaxUploadFileSize() < 0 {
+			c.add("data web service max upload file size can not be negative")
+		}
+	case "metadata":
+		c.checkMetaDataDriver()
+		c.checkTokenDriver()
+	case "owncloud":
+		c.checkBasicAuthMiddleware()
+		if kind == "remote" {
+			c.requireRegistry("owncloud web service is remote")
+			c.checkWebServiceClient("owncloud web service is remote")
+			if c.config.GetRemoteOCWebServiceMaxUploadFileSize() < 0 {
+				c.add("remote owncloud web service max upload file size can not be negative")
+			}
+			return
+		}
+		c.checkDataDriver()
+		c.checkMetaDataDriver()
+		if c.config.GetOCWebServiceMaxUploadFileSize() < 0 {
+			c.add("owncloud web service max upload file size can not be negative")
+		}
+	}
+}
+
+func (c *configurationChecker) checkUserDriver() {
+	switch c.config.GetUserDriver() {
+	case "memuserdriver":
+		if c.config.GetMemUserDriverUsers() == "" {
+			c.add("memuserdriver has no users")
+		}
+	case "ldapuserdriver":
+		if c.config.GetLDAPUserDriverHostname() == "" {
+			c.add("ldapuserdriver hostname is empty")
+		}
+		if c.config.GetLDAPUserDriverPort() < 1 || c.config.GetLDAPUserDriverPort() > 65535 {
+			c.add("ldapuserdriver port %d is out of range 1-65535", c.config.GetLDAPUserDriverPort())
+		}
+		if c.config.GetLDAPUserDriverBaseDN() == "" {
+			c.add("ldapuserdriver base dn is empty")
+		}
+	default:
+		if _, ok := drivers.UserDriver(c.config.GetUserDriver()); !ok {
+			c.add("user driver %q does not exist, use one of %s", c.config.GetUserDriver(), strings.Join(drivers.Names(drivers.KindUser), ", "))
+		}
+	}
+}
+
+func (c *configurationChecker) checkTokenDriver() {
+	switch c.config.GetTokenDriver() {
+	case "jwttokendriver":
+		if c.config.GetJWTTokenDriverKey() == "" {
+			c.add("jwttokendriver key is empty")
+		}
+	default:
+		if _, ok := drivers.TokenDriver(c.config.GetTokenDriver()); !ok {
+			c.add("token driver %q does not exist, use one of %s", c.config.GetTokenDriver(), strings.Join(drivers.Names(drivers.KindToken), ", "))
+		}
+	}
+}
+
+func (c *configurationChecker) checkDataDriver() {
+	switch c.config.GetDataDriver() {
+	case "fsdatadriver":
+		c.checkFolder("fsdatadriver data folder", c.config.GetFSDataDriverDataFolder())
+		c.checkFolder("fsdatadriver temporary folder", c.config.GetFSDataDriverTemporaryFolder())
+	case "ocfsdatadriver":
+		c.checkFolder("ocfsdatadriver data folder", c.config.GetOCFSDataDriverDataFolder())
+		c.checkFolder("ocfsdatadriver temporary folder", c.config.GetOCFSDataDriverTemporaryFolder())
+		c.checkFolder("ocfsdatadriver chunks folder", c.config.GetOCFSDataDriverChunksFolder())
+		if c.config.GetMetaDataDriver() != "ocfsmdatadriver" {
+			c.add("ocfsdatadriver needs ocfsmdatadriver as metadata driver, got %q", c.config.GetMetaDataDriver())
+		}
+		// the data driver uses the metadata driver
+		c.checkMetaDataDriver()
+	default:
+		if _, ok := drivers.DataDriver(c.config.GetDataDriver()); !ok {
+			c.add("data driver %q does not exist, use one of %s", c.config.GetDataDriver(), strings.Join(drivers.Names(drivers.KindData), ", "))
+		}
+	}
+}
+
+func (c *configurationChecker) checkMetaDataDriver() {
+	switch c.config.GetMetaDataDriver() {
+	case "fsmdatadriver":
+		c.checkFolder("fsmdatadriver data folder", c.config.GetFSMDataDriverDataFolder())
+		c.checkFolder("fsmdatadriver temporary folder", c.config.GetFSMDataDriverTemporaryFolder())
+	case "ocfsmdatadriver":
+		c.checkFolder("ocfsmdatadriver data folder", c.config.GetOCFSMDataDriverDataFolder())
+		c.checkFolder("ocfsmdatadriver temporary folder", c.config.GetOCFSMDataDriverTemporaryFolder())
+		if c.config.GetOCFSMDataDriverDSN() == "" {
+			c.add("ocfsmdatadriver dsn is empty")
+		}
+		if c.config.GetOCFSMDataDriverMaxSQLIddle() < 0 {
+			c.add("ocfsmdatadriver max sql iddle can not be negative")
+		}
+		if c.config.GetOCFSMDataDriverMaxSQLConcurrent() < 0 {
+			c.add("ocfsmdatadriver max sql concurrent can not be negative")
+		}
+	default:
+		if _, ok := drivers.MetaDataDriver(c.config.GetMetaDataDriver()); !ok {
+			c.add("metadata driver %q does not exist, use one of %s", c.config.GetMetaDataDriver(), strings.Join(drivers.Names(drivers.KindMetaData), ", "))
+		}
+	}
+}
+
+func (c *configurationChecker) checkBasicAuthMiddleware() {
+	switch c.config.GetBasicAuthMiddleware() {
+	case "local":
+		c.checkUserDriver()
+		c.checkTokenDriver()
+	case "remote":
+		c.checkTokenDriver()
+		c.requireRegistry("basic auth middleware is remote")
+		c.checkWebServiceClient("basic auth middleware is remote")
+	default:
+		c.add("basic auth middleware %q does not exist", c.config.GetBasicAuthMiddleware())
+	}
+}
+
+// checkWebServiceClient reports a problem if the web service clients of lib,
+// used for reason, can not reach the nodes.
+func (c *configurationChecker) checkWebServiceClient(reason string) {
+	if c.config.IsMTLSEnabled() {
+		c.add("%s but mtls is enabled, the web service clients can not present the node certificate", reason)
+	}
+}
+
+// requireRegistry reports a problem if there is no real registry to discover other nodes.
+func (c *configurationChecker) requireRegistry(reason string) {
+	if name := c.config.GetRegistryDriver(); name == "" || name == "dummy" {
+		c.add("%s but registry driver %q can not discover other nodes", reason, c.config.GetRegistryDriver())
+	}
+}
+
+func (c *configurationChecker) checkRegistryDriver() {
+	switch c.config.GetRegistryDriver() {
+	case "etcd":
+		urls := c.config.GetETCDRegistryDriverUrls()
+		if urls == "" {
+			c.add("etcd registry driver urls are empty")
+		}
+		for _, u := range strings.Split(urls, ",") {
+			if u == "" {
+				continue
+			}
+			if parsed, err := url.Parse(u); err != nil || parsed.Scheme == "" || parsed.Host == "" {
+				c.add("etcd registry driver url %q is not valid", u)
+			}
+		}
+		if c.config.GetETCDRegistryDriverKey() == "" {
+			c.add("etcd registry driver key is empty")
+		}
+	case "file":
+		if c.config.GetFileRegistryDriverFile() == "" {
+			c.add("file registry driver file is empty")
+		} else if _, err := readFileRegistryNodes(c.config.GetFileRegistryDriverFile()); err != nil {
+			c.add("file registry driver: %s", err)
+		}
+	case "dns":
+		if c.config.GetDNSRegistryDriverDomain() == "" {
+			c.add("dns registry driver domain is empty")
+		}
+		if scheme := c.config.GetDNSRegistryDriverScheme(); scheme != "http" && scheme != "https" {
+			c.add("dns registry driver scheme %q must be http or https", scheme)
+		}
+		if _, err := getDNSServers(c.config.GetDNSRegistryDriverServers()); err != nil {
+			c.add("dns registry driver servers: %s", err)
+		}
+	case "", "dummy":
+	default:
+		if _, ok := drivers.RegistryDriver(c.config.GetRegistryDriver()); !ok {
+			c.add("registry driver %q does not exist, use one of %s", c.config.GetRegistryDriver(), strings.Join(drivers.Names(drivers.KindRegistry), ", "))
+		}
+	}
+}
+
+func (c *configurationChecker) checkLoggers() {
+	if c.config.GetAppLoggerMaxSize() < 0 || c.config.GetAppLoggerMaxAge() < 0 || c.config.GetAppLoggerMaxBackups() < 0 {
+		c.add("app logger max size, max age and max backups can not be negative")
+	}
+	if c.config.GetHTTPAccessLoggerMaxSize() < 0 || c.config.GetHTTPAccessLoggerMaxAge() < 0 || c.config.GetHTTPAccessLoggerMaxBackups() < 0 {
+		c.add("http access logger max size, max age and max backups can not be negative")
+	}
+}
+
+// checkListeners checks the address and the TLS settings of every listener.
+func (c *configurationChecker) checkListeners() {
+	addresses := map[string]bool{}
+	all := append([]*listenerConfig{}, c.config.GetListeners()...)
+	if c.config.GetAdminListener() != nil {
+		all = append(all, c.config.GetAdminListener())
+	}
+	for _, l := range all {
+		if addresses[l.Network+" "+l.Address] {
+			c.add("listener %s is duplicated", l)
+		}
+		addresses[l.Network+" "+l.Address] = true
+		switch l.Network {
+		case listenerTCP:
+			if _, _, err := net.SplitHostPort(l.Address); err != nil {
+				c.add("listener %s: %s", l, err)
+			}
+		case listenerUnix:
+			c.checkFolder(fmt.Sprintf("listener %s socket folder", l), filepath.Dir(l.Address))
+			if _, err := strconv.ParseUint(l.SocketMode, 8, 32); l.SocketMode != "" && err != nil {
+				c.add("listener %s socket mode %q must be octal, e.g. 0660", l, l.SocketMode)
+			}
+		case listenerFD:
+			if l.Address == "" {
+				c.add("listener %s needs the name or the index of the socket passed by systemd", l)
+			}
+		default:
+			c.add("listener %s network %q does not exist, use one of %s", l, l.Network, strings.Join(listenerNetworks, ", "))
+		}
+		if len(c.config.Listeners) > 0 && l.MTLSEnabled && !l.TLSEnabled {
+			c.add("listener %s has mtls enabled but not tls", l)
+		}
+		listener := &configurationChecker{config: l.getConfiguration(c.config)}
+		listener.checkTLS()
+		for _, p := range listener.problems {
+			c.add("listener %s: %s", l, p)
+		}
+	}
+	// nodes are registered at the address of the first tcp listener
+	if c.config.GetRegistryDriver() == "etcd" {
+		if _, _, err := getRegisteredAddress(c.config); err != nil {
+			c.add("listeners: %s, the node can not be registered", err)
+		}
+	}
+}
+
+func (c *configurationChecker) checkTLS() {
+	if !c.config.IsTLSEnabled() {
+		return
+	}
+	switch c.config.GetTLSMode() {
+	case tlsModeFile:
+	case tlsModeACME:
+		if c.config.GetTLSACMEHosts() == "" {
+			c.add("tls mode is acme but tls acme hosts is empty")
+		}
+		if u, err := url.Parse(c.config.GetTLSACMEDirectoryURL()); err != nil || u.Scheme != "https" {
+			c.add("tls acme directory url %q must be an https url", c.config.GetTLSACMEDirectoryURL())
+		}
+		if c.config.GetTLSACMECACertificate() != "" {
+			if _, err := getACMEHTTPClient(c.config.GetTLSACMECACertificate()); err != nil {
+				c.add("tls acme ca certificate: %s", err)
+			}
+		}
+		return
+	default:
+		c.add("tls mode %q does not exist, use one of %s", c.config.GetTLSMode(), strings.Join(tlsModes, ", "))
+		return
+	}
+	if c.config.TLSCertificateReloadInterval < 0 {
+		c.add("tls certificate reload interval can not be negative")
+	}
+	certOK := c.checkFile("tls certificate", c.config.GetTLSCertificate())
+	keyOK := c.checkFile("tls private key", c.config.GetTLSPrivateKey())
+	if certOK && keyOK {
+		if _, err := tls.LoadX509KeyPair(c.config.GetTLSCertificate(), c.config.GetTLSPrivateKey()); err != nil {
+			c.add("tls certificate and private key do not match: %s", err)
+		}
+	}
+}
+
+func (c *configurationChecker) checkMutualTLS() {
+	if !c.config.IsMTLSEnabled() {
+		return
+	}
+	if !c.config.IsTLSEnabled() {
+		c.add("mtls is enabled but tls is not")
+	}
+	if c.checkFile("mtls ca certificate", c.config.GetMTLSCACertificate()) {
+		if _, err := loadCertPool(c.config.GetMTLSCACertificate(), false); err != nil {
+			c.add("mtls ca certificate: %s", err)
+		}
+	}
+	certOK := c.checkFile("mtls node certificate", c.config.GetMTLSNodeCertificate())
+	keyOK := c.checkFile("mtls node private key", c.config.GetMTLSNodePrivateKey())
+	if certOK && keyOK {
+		if _, err := tls.LoadX509KeyPair(c.config.GetMTLSNodeCertificate(), c.config.GetMTLSNodePrivateKey()); err != nil {
+			c.add("mtls node certificate and private key do not match: %s", err)
+		}
+	}
+	for ws := range getMTLSRequiredWebServices(c.config) {
+		if !find(ws, webServiceNames) {
+			c.add("mtls required web service %q does not exist", ws)
+		}
+	}
+	if len(getMTLSRequiredWebServices(c.config)) > 0 {
+		c.requireRegistry("mtls required web services are set")
+	}
+}
+
+func (c *configurationChecker) checkCORS() {
+	if c.config.IsCORSMiddlewareEnabled() && c.config.GetCORSMiddlewareAccessControlAllowOrigin() == "" {
+		c.add("cors middleware is enabled but access control allow origin is empty")
+	}
+}
+
+// checkFile reports a problem if the file does not exist or can not be read.
+func (c *configurationChecker) checkFile(name, path string) bool {
+	if path == "" {
+		c.add("%s is not set", name)
+		return false
+	}
+	fd, err := os.Open(path)
+	if err != nil {
+		c.add("%s %s can not be read: %s", name, path, err)
+		return false
+	}
+	fd.Close()
+	return true
+}
+
+// checkFolder reports a problem if the folder does not exist or is not writable.
+func (c *configurationChecker) checkFolder(name, path string) {
+	if path == "" {
+		c.add("%s is not set", name)
+		return
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		c.add("%s %s: %s", name, path, err)
+		return
+	}
+	if !info.IsDir() {
+		c.add("%s %s is not a folder", name, path)
+		return
+	}
+	fd, err := ioutil.TempFile(path, ".clawiod-check-")
+	if err != nil {
+		c.add("%s %s is not writable: %s", name, path, err)
+		return
+	}
+	fd.Close()
+	os.Remove(fd.Name())
+}
@@ -0,0 +1,779 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"golang.org/x/crypto/acme"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// configuration is the configuration loaded by the configuration sources
+// of this package. Every setting is identified by the key in its json tag,
+// the same key is used in configuration files and, upper-cased, in
+// environment variables.
+type configuration struct {
+	Port                                    int    `json:"port"`
+	CPU                                     string `json:"cpu"`
+	EnabledWebServices                      string `json:"enabled_web_services"`
+	AppLoggerOut                            string `json:"app_logger_out"`
+	AppLoggerMaxSize                        int    `json:"app_logger_max_size"`
+	AppLoggerMaxAge                         int    `json:"app_logger_max_age"`
+	AppLoggerMaxBackups                     int    `json:"app_logger_max_backups"`
+	HTTPAccessLoggerOut                     string `json:"http_access_logger_out"`
+	HTTPAccessLoggerMaxSize                 int    `json:"http_access_logger_max_size"`
+	HTTPAccessLoggerMaxAge                  int    `json:"http_access_logger_max_age"`
+	HTTPAccessLoggerMaxBackups              int    `json:"http_access_logger_max_backups"`
+	TLSEnabled                              bool   `json:"tls_enabled"`
+	TLSCertificate                          string `json:"tls_certificate"`
+	TLSPrivateKey                           string `json:"tls_private_key"`
+	TLSMode                                 string `json:"tls_mode"`
+	TLSCertificateReloadInterval            int    `json:"tls_certificate_reload_interval"`
+	TLSACMEDirectoryURL                     string `json:"tls_acme_directory_url"`
+	TLSACMEHosts                            string `json:"tls_acme_hosts"`
+	TLSACMEEmail                            string `json:"tls_acme_email"`
+	TLSACMECacheDir                         string `json:"tls_acme_cache_dir"`
+	TLSACMECACertificate                    string `json:"tls_acme_ca_certificate"`
+	MTLSEnabled                             bool   `json:"mtls_enabled"`
+	MTLSCACertificate                       string `json:"mtls_ca_certificate"`
+	MTLSNodeCertificate                     string `json:"mtls_node_certificate"`
+	MTLSNodePrivateKey                      string `json:"mtls_node_private_key"`
+	MTLSRequiredWebServices                 string `json:"mtls_required_web_services"`
+	UserDriver                              string `json:"user_driver"`
+	MemUserDriverUsers                      string `json:"mem_user_driver_users"`
+	LDAPUserDriverBindUsername              string `json:"ldap_user_driver_bind_username"`
+	LDAPUserDriverBindPassword              string `json:"ldap_user_driver_bind_password"`
+	LDAPUserDriverHostname                  string `json:"ldap_user_driver_hostname"`
+	LDAPUserDriverPort                      int    `json:"ldap_user_driver_port"`
+	LDAPUserDriverBaseDN                    string `json:"ldap_user_driver_base_dn"`
+	LDAPUserDriverFilter                    string `json:"ldap_user_driver_filter"`
+	TokenDriver                             string `json:"token_driver"`
+	JWTTokenDriverKey                       string `json:"jwt_token_driver_key"`
+	DataDriver                              string `json:"data_driver"`
+	FSDataDriverDataFolder                  string `json:"fs_data_driver_data_folder"`
+	FSDataDriverTemporaryFolder             string `json:"fs_data_driver_temporary_folder"`
+	FSDataDriverChecksum                    string `json:"fs_data_driver_checksum"`
+	FSDataDriverVerifyClientChecksum        bool   `json:"fs_data_driver_verify_client_checksum"`
+	OCFSDataDriverDataFolder                string `json:"ocfs_data_driver_data_folder"`
+	OCFSDataDriverTemporaryFolder           string `json:"ocfs_data_driver_temporary_folder"`
+	OCFSDataDriverChunksFolder              string `json:"ocfs_data_driver_chunks_folder"`
+	OCFSDataDriverChecksum                  string `json:"ocfs_data_driver_checksum"`
+	OCFSDataDriverVerifyClientChecksum      bool   `json:"ocfs_data_driver_verify_client_checksum"`
+	MetaDataDriver                          string `json:"meta_data_driver"`
+	FSMDataDriverDataFolder                 string `json:"fsm_data_driver_data_folder"`
+	FSMDataDriverTemporaryFolder            string `json:"fsm_data_driver_temporary_folder"`
+	OCFSMDataDriverMaxSQLIddle              int    `json:"ocfsm_data_driver_max_sql_iddle"`
+	OCFSMDataDriverMaxSQLConcurrent         int    `json:"ocfsm_data_driver_max_sql_concurrent"`
+	OCFSMDataDriverDataFolder               string `json:"ocfsm_data_driver_data_folder"`
+	OCFSMDataDriverTemporaryFolder          string `json:"ocfsm_data_driver_temporary_folder"`
+	OCFSMDataDriverDSN                      string `json:"ocfsm_data_driver_dsn"`
+	BasicAuthMiddleware                     string `json:"basic_auth_middleware"`
+	BasicAuthMiddlewareCookieName           string `json:"basic_auth_middleware_cookie_name"`
+	AuthenticationWebService                string `json:"authentication_web_service"`
+	AuthenticationWebServiceMethodAgnostic  bool   `json:"authentication_web_service_method_agnostic"`
+	DataWebService                          string `json:"data_web_service"`
+	DataWebServiceMaxUploadFileSize         int64  `json:"data_web_service_max_upload_file_size"`
+	MetaDataWebService                      string `json:"meta_data_web_service"`
+	OCWebService                            string `json:"oc_web_service"`
+	OCWebServiceMaxUploadFileSize           int64  `json:"oc_web_service_max_upload_file_size"`
+	RemoteOCWebServiceMaxUploadFileSize     int64  `json:"remote_oc_web_service_max_upload_file_size"`
+	RegistryDriver                          string `json:"registry_driver"`
+	ETCDRegistryDriverUrls                  string `json:"etcd_registry_driver_urls"`
+	ETCDRegistryDriverKey                   string `json:"etcd_registry_driver_key"`
+	ETCDRegistryDriverUsername              string `json:"etcd_registry_driver_username"`
+	ETCDRegistryDriverPassword              string `json:"etcd_registry_driver_password"`
+	FileRegistryDriverFile                  string `json:"file_registry_driver_file"`
+	FileRegistryDriverPollInterval          int    `json:"file_registry_driver_poll_interval"`
+	DNSRegistryDriverDomain                 string `json:"dns_registry_driver_domain"`
+	DNSRegistryDriverServers                string `json:"dns_registry_driver_servers"`
+	DNSRegistryDriverScheme                 string `json:"dns_registry_driver_scheme"`
+	AuthenticationWebServiceLoadBalancer    string `json:"authentication_web_service_load_balancer"`
+	DataWebServiceLoadBalancer              string `json:"data_web_service_load_balancer"`
+	MetaDataWebServiceLoadBalancer          string `json:"meta_data_web_service_load_balancer"`
+	OCWebServiceLoadBalancer                string `json:"oc_web_service_load_balancer"`
+	UpstreamHealthCheckInterval             int    `json:"upstream_health_check_interval"`
+	UpstreamHealthCheckTimeout              int    `json:"upstream_health_check_timeout"`
+	UpstreamOutlierConsecutiveFailures      int    `json:"upstream_outlier_consecutive_failures"`
+	UpstreamOutlierCooldown                 int    `json:"upstream_outlier_cooldown"`
+	RegistryHeartbeatInterval               int    `json:"registry_heartbeat_interval"`
+	RegistryHeartbeatTTL                    int    `json:"registry_heartbeat_ttl"`
+	RegistryHeartbeatJitter                 int    `json:"registry_heartbeat_jitter"`
+	RegistryHeartbeatMaxBackoff             int    `json:"registry_heartbeat_max_backoff"`
+	CORSMiddlewareEnabled                   bool   `json:"cors_middleware_enabled"`
+	CORSMiddlewareAccessControlAllowOrigin  string `json:"cors_middleware_access_control_allow_origin"`
+	CORSMiddlewareAccessControlAllowMethods string `json:"cors_middleware_access_control_allow_methods"`
+	CORSMiddlewareAccessControlAllowHeaders string `json:"cors_middleware_access_control_allow_headers"`
+	RetryBudgetPercent                      int    `json:"retry_budget_percent"`
+	RetryBudgetMinPerSecond                 int    `json:"retry_budget_min_per_second"`
+	HTTPReadHeaderTimeout                   int    `json:"http_read_header_timeout"`
+	HTTPIdleTimeout                         int    `json:"http_idle_timeout"`
+	HTTPMaxHeaderBytes                      int    `json:"http_max_header_bytes"`
+	HTTPMaxConnections                      int    `json:"http_max_connections"`
+	HTTP2Cleartext                          bool   `json:"http2_cleartext"`
+	HTTP2CleartextClient                    bool   `json:"http2_cleartext_client"`
+	HTTP2MaxConcurrentStreams               int    `json:"http2_max_concurrent_streams"`
+	HTTP2MaxReadFrameSize                   int    `json:"http2_max_read_frame_size"`
+	HTTP2ConnectionWindowSize               int    `json:"http2_connection_window_size"`
+	HTTP2StreamWindowSize                   int    `json:"http2_stream_window_size"`
+	AuthenticationWebServiceBodyReadTimeout int    `json:"authentication_web_service_body_read_timeout"`
+	DataWebServiceBodyReadTimeout           int    `json:"data_web_service_body_read_timeout"`
+	MetaDataWebServiceBodyReadTimeout       int    `json:"meta_data_web_service_body_read_timeout"`
+	OCWebServiceBodyReadTimeout             int    `json:"oc_web_service_body_read_timeout"`
+	AuthenticationWebServicePathPrefix      string `json:"authentication_web_service_path_prefix"`
+	DataWebServicePathPrefix                string `json:"data_web_service_path_prefix"`
+	MetaDataWebServicePathPrefix            string `json:"meta_data_web_service_path_prefix"`
+	OCWebServicePathPrefix                  string `json:"oc_web_service_path_prefix"`
+	AuthenticationWebServiceHosts           string `json:"authentication_web_service_hosts"`
+	DataWebServiceHosts                     string `json:"data_web_service_hosts"`
+	MetaDataWebServiceHosts                 string `json:"meta_data_web_service_hosts"`
+	OCWebServiceHosts                       string `json:"oc_web_service_hosts"`
+
+	// complex settings are expressed in json
+	AuthenticationWebServiceRetryPolicy *retryPolicy      `json:"authentication_web_service_retry_policy"`
+	DataWebServiceRetryPolicy           *retryPolicy      `json:"data_web_service_retry_policy"`
+	MetaDataWebServiceRetryPolicy       *retryPolicy      `json:"meta_data_web_service_retry_policy"`
+	OCWebServiceRetryPolicy             *retryPolicy      `json:"oc_web_service_retry_policy"`
+	Listeners                           []*listenerConfig `json:"listeners"`
+	AdminListener                       *listenerConfig   `json:"admin_listener"`
+}
+
+// newConfiguration creates a configuration from a set of settings.
+// Settings not present keep their zero value.
+func newConfiguration(settings map[string]interface{}) (*configuration, error) {
+	data, err := json.Marshal(settings)
+	if err != nil {
+		return nil, err
+	}
+	c := &configuration{}
+	if err := json.Unmarshal(data, c); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// parseSettings converts settings expressed as strings, like the ones coming
+// from environment variables, to the type of the configuration field with the same key.
+// Unknown keys are ignored.
+func parseSettings(raw map[string]string) (map[string]interface{}, error) {
+	settings := map[string]interface{}{}
+	t := reflect.TypeOf(configuration{})
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		key := strings.Split(field.Tag.Get("json"), ",")[0]
+		val, ok := raw[key]
+		if !ok {
+			continue
+		}
+		switch field.Type.Kind() {
+		case reflect.String:
+			settings[key] = val
+		case reflect.Bool:
+			b, err := strconv.ParseBool(val)
+			if err != nil {
+				return nil, fmt.Errorf("setting %q must be a boolean: %s", key, err)
+			}
+			settings[key] = b
+		case reflect.Int, reflect.Int64:
+			n, err := strconv.ParseInt(val, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("setting %q must be an integer: %s", key, err)
+			}
+			settings[key] = n
+		default:
+			// complex settings are expressed in json
+			var v interface{}
+			if err := json.Unmarshal([]byte(val), &v); err != nil {
+				return nil, fmt.Errorf("setting %q must be json: %s", key, err)
+			}
+			settings[key] = v
+		}
+	}
+	return settings, nil
+}
+
+// settingKeys returns the keys of all the settings.
+func settingKeys() []string {
+	keys := []string{}
+	t := reflect.TypeOf(configuration{})
+	for i := 0; i < t.NumField(); i++ {
+		keys = append(keys, strings.Split(t.Field(i).Tag.Get("json"), ",")[0])
+	}
+	return keys
+}
+
+func (c *configuration) GetPort() int {
+	return c.Port
+}
+func (c *configuration) GetCPU() string {
+	return c.CPU
+}
+func (c *configuration) GetEnabledWebServices() string {
+	return c.EnabledWebServices
+}
+func (c *configuration) GetAppLoggerOut() string {
+	return c.AppLoggerOut
+}
+func (c *configuration) GetAppLoggerMaxSize() int {
+	return c.AppLoggerMaxSize
+}
+func (c *configuration) GetAppLoggerMaxAge() int {
+	return c.AppLoggerMaxAge
+}
+func (c *configuration) GetAppLoggerMaxBackups() int {
+	return c.AppLoggerMaxBackups
+}
+func (c *configuration) GetHTTPAccessLoggerOut() string {
+	return c.HTTPAccessLoggerOut
+}
+func (c *configuration) GetHTTPAccessLoggerMaxSize() int {
+	return c.HTTPAccessLoggerMaxSize
+}
+func (c *configuration) GetHTTPAccessLoggerMaxAge() int {
+	return c.HTTPAccessLoggerMaxAge
+}
+func (c *configuration) GetHTTPAccessLoggerMaxBackups() int {
+	return c.HTTPAccessLoggerMaxBackups
+}
+func (c *configuration) IsTLSEnabled() bool {
+	return c.TLSEnabled
+}
+func (c *configuration) GetTLSCertificate() string {
+	return c.TLSCertificate
+}
+func (c *configuration) GetTLSPrivateKey() string {
+	return c.TLSPrivateKey
+}
+
+// GetTLSMode returns where the TLS certificate comes from: file or acme.
+func (c *configuration) GetTLSMode() string {
+	return defaultString(c.TLSMode, tlsModeFile)
+}
+
+// GetTLSCertificateReloadInterval returns how often the TLS certificate files are checked for changes.
+func (c *configuration) GetTLSCertificateReloadInterval() time.Duration {
+	return defaultSeconds(c.TLSCertificateReloadInterval, time.Minute)
+}
+
+// GetTLSACMEDirectoryURL returns the directory of the ACME server issuing the certificates.
+func (c *configuration) GetTLSACMEDirectoryURL() string {
+	return defaultString(c.TLSACMEDirectoryURL, acme.LetsEncryptURL)
+}
+
+// GetTLSACMEHosts returns the comma separated host names certificates are issued for.
+func (c *configuration) GetTLSACMEHosts() string {
+	return c.TLSACMEHosts
+}
+
+// GetTLSACMEEmail returns the contact email of the ACME account.
+func (c *configuration) GetTLSACMEEmail() string {
+	return c.TLSACMEEmail
+}
+
+// GetTLSACMECacheDir returns the folder where the ACME account and the certificates are kept.
+func (c *configuration) GetTLSACMECacheDir() string {
+	return defaultString(c.TLSACMECacheDir, "acme")
+}
+
+// GetTLSACMECACertificate returns the PEM certificate of the CA of a private ACME server.
+func (c *configuration) GetTLSACMECACertificate() string {
+	return c.TLSACMECACertificate
+}
+
+// IsMTLSEnabled returns true if nodes authenticate each other with certificates.
+func (c *configuration) IsMTLSEnabled() bool {
+	return c.MTLSEnabled
+}
+
+// GetMTLSCACertificate returns the PEM certificate of the CA of the node certificates.
+func (c *configuration) GetMTLSCACertificate() string {
+	return c.MTLSCACertificate
+}
+
+// GetMTLSNodeCertificate returns the certificate presented to other nodes,
+// the TLS certificate by default.
+func (c *configuration) GetMTLSNodeCertificate() string {
+	return defaultString(c.MTLSNodeCertificate, c.TLSCertificate)
+}
+
+// GetMTLSNodePrivateKey returns the private key of the node certificate,
+// the TLS private key by default.
+func (c *configuration) GetMTLSNodePrivateKey() string {
+	return defaultString(c.MTLSNodePrivateKey, c.TLSPrivateKey)
+}
+
+// GetMTLSRequiredWebServices returns the comma separated web services
+// only nodes in the registry can call.
+func (c *configuration) GetMTLSRequiredWebServices() string {
+	return c.MTLSRequiredWebServices
+}
+func (c *configuration) GetUserDriver() string {
+	return c.UserDriver
+}
+func (c *configuration) GetMemUserDriverUsers() string {
+	return c.MemUserDriverUsers
+}
+func (c *configuration) GetLDAPUserDriverBindUsername() string {
+	return c.LDAPUserDriverBindUsername
+}
+func (c *configuration) GetLDAPUserDriverBindPassword() string {
+	return c.LDAPUserDriverBindPassword
+}
+func (c *configuration) GetLDAPUserDriverHostname() string {
+	return c.LDAPUserDriverHostname
+}
+func (c *configuration) GetLDAPUserDriverPort() int {
+	return c.LDAPUserDriverPort
+}
+func (c *configuration) GetLDAPUserDriverBaseDN() string {
+	return c.LDAPUserDriverBaseDN
+}
+func (c *configuration) GetLDAPUserDriverFilter() string {
+	return c.LDAPUserDriverFilter
+}
+func (c *configuration) GetTokenDriver() string {
+	return c.TokenDriver
+}
+func (c *configuration) GetJWTTokenDriverKey() string {
+	return c.JWTTokenDriverKey
+}
+func (c *configuration) GetDataDriver() string {
+	return c.DataDriver
+}
+func (c *configuration) GetFSDataDriverDataFolder() string {
+	return c.FSDataDriverDataFolder
+}
+func (c *configuration) GetFSDataDriverTemporaryFolder() string {
+	return c.FSDataDriverTemporaryFolder
+}
+func (c *configuration) GetFSDataDriverChecksum() string {
+	return c.FSDataDriverChecksum
+}
+func (c *configuration) GetFSDataDriverVerifyClientChecksum() bool {
+	return c.FSDataDriverVerifyClientChecksum
+}
+func (c *configuration) GetOCFSDataDriverDataFolder() string {
+	return c.OCFSDataDriverDataFolder
+}
+func (c *configuration) GetOCFSDataDriverTemporaryFolder() string {
+	return c.OCFSDataDriverTemporaryFolder
+}
+func (c *configuration) GetOCFSDataDriverChunksFolder() string {
+	return c.OCFSDataDriverChunksFolder
+}
+func (c *configuration) GetOCFSDataDriverChecksum() string {
+	return c.OCFSDataDriverChecksum
+}
+func (c *configuration) GetOCFSDataDriverVerifyClientChecksum() bool {
+	return c.OCFSDataDriverVerifyClientChecksum
+}
+func (c *configuration) GetMetaDataDriver() string {
+	return c.MetaDataDriver
+}
+func (c *configuration) GetFSMDataDriverDataFolder() string {
+	return c.FSMDataDriverDataFolder
+}
+func (c *configuration) GetFSMDataDriverTemporaryFolder() string {
+	return c.FSMDataDriverTemporaryFolder
+}
+func (c *configuration) GetOCFSMDataDriverMaxSQLIddle() int {
+	return c.OCFSMDataDriverMaxSQLIddle
+}
+func (c *configuration) GetOCFSMDataDriverMaxSQLConcurrent() int {
+	return c.OCFSMDataDriverMaxSQLConcurrent
+}
+func (c *configuration) GetOCFSMDataDriverDataFolder() string {
+	return c.OCFSMDataDriverDataFolder
+}
+func (c *configuration) GetOCFSMDataDriverTemporaryFolder() string {
+	return c.OCFSMDataDriverTemporaryFolder
+}
+func (c *configuration) GetOCFSMDataDriverDSN() string {
+	return c.OCFSMDataDriverDSN
+}
+func (c *configuration) GetBasicAuthMiddleware() string {
+	return c.BasicAuthMiddleware
+}
+func (c *configuration) GetBasicAuthMiddlewareCookieName() string {
+	return c.BasicAuthMiddlewareCookieName
+}
+func (c *configuration) GetAuthenticationWebService() string {
+	return c.AuthenticationWebService
+}
+func (c *configuration) GetAuthenticationWebServiceMethodAgnostic() bool {
+	return c.AuthenticationWebServiceMethodAgnostic
+}
+func (c *configuration) GetDataWebService() string {
+	return c.DataWebService
+}
+func (c *configuration) GetDataWebServiceMaxUploadFileSize() int64 {
+	return c.DataWebServiceMaxUploadFileSize
+}
+func (c *configuration) GetMetaDataWebService() string {
+	return c.MetaDataWebService
+}
+func (c *configuration) GetOCWebService() string {
+	return c.OCWebService
+}
+func (c *configuration) GetOCWebServiceMaxUploadFileSize() int64 {
+	return c.OCWebServiceMaxUploadFileSize
+}
+func (c *configuration) GetRemoteOCWebServiceMaxUploadFileSize() int64 {
+	return c.RemoteOCWebServiceMaxUploadFileSize
+}
+func (c *configuration) GetRegistryDriver() string {
+	return c.RegistryDriver
+}
+func (c *configuration) GetETCDRegistryDriverUrls() string {
+	return c.ETCDRegistryDriverUrls
+}
+func (c *configuration) GetETCDRegistryDriverKey() string {
+	return c.ETCDRegistryDriverKey
+}
+func (c *configuration) GetETCDRegistryDriverUsername() string {
+	return c.ETCDRegistryDriverUsername
+}
+func (c *configuration) GetETCDRegistryDriverPassword() string {
+	return c.ETCDRegistryDriverPassword
+}
+func (c *configuration) IsCORSMiddlewareEnabled() bool {
+	return c.CORSMiddlewareEnabled
+}
+func (c *configuration) GetCORSMiddlewareAccessControlAllowOrigin() string {
+	return c.CORSMiddlewareAccessControlAllowOrigin
+}
+func (c *configuration) GetCORSMiddlewareAccessControlAllowMethods() string {
+	return c.CORSMiddlewareAccessControlAllowMethods
+}
+func (c *configuration) GetCORSMiddlewareAccessControlAllowHeaders() string {
+	return c.CORSMiddlewareAccessControlAllowHeaders
+}
+
+// The settings below are not part of lib.Configuration, they are only used
+// by the daemon. A zero value means the default.
+
+// GetRegistryHeartbeatInterval returns the time between two registrations of the node.
+// It defaults to a third of the TTL, so a node survives two lost heartbeats.
+func (c *configuration) GetRegistryHeartbeatInterval() time.Duration {
+	if c.RegistryHeartbeatInterval == 0 {
+		return c.GetRegistryHeartbeatTTL() / 3
+	}
+	return time.Duration(c.RegistryHeartbeatInterval) * time.Second
+}
+
+// GetRegistryHeartbeatTTL returns the time a node stays in the registry after its last heartbeat.
+// It is the TTL of the keys written by the etcd registry driver.
+func (c *configuration) GetRegistryHeartbeatTTL() time.Duration {
+	return defaultSeconds(c.RegistryHeartbeatTTL, 15*time.Second)
+}
+
+// GetRegistryHeartbeatJitter returns the percentage of the interval the heartbeats are spread by.
+func (c *configuration) GetRegistryHeartbeatJitter() int {
+	if c.RegistryHeartbeatJitter == 0 {
+		return 10
+	}
+	return c.RegistryHeartbeatJitter
+}
+
+// GetRegistryHeartbeatMaxBackoff returns the longest time between two heartbeats when they fail.
+// It defaults to the longest backoff, in whole seconds, that retries a failed heartbeat
+// before the node expires, 8s with the default TTL, interval and jitter.
+func (c *configuration) GetRegistryHeartbeatMaxBackoff() time.Duration {
+	if c.RegistryHeartbeatMaxBackoff != 0 {
+		return time.Duration(c.RegistryHeartbeatMaxBackoff) * time.Second
+	}
+	settings := heartbeatSettings{
+		interval: c.GetRegistryHeartbeatInterval(),
+		ttl:      c.GetRegistryHeartbeatTTL(),
+		jitter:   float64(c.GetRegistryHeartbeatJitter()) / 100,
+	}
+	left := settings.ttl - settings.longest(settings.interval)
+	// the backoff plus its jitter must stay strictly within what is left of the TTL
+	backoff := (time.Duration(float64(left)/(1+settings.jitter)) - 1) / time.Second * time.Second
+	if backoff < settings.interval {
+		return settings.interval
+	}
+	return backoff
+}
+
+// GetFileRegistryDriverFile returns the file with the nodes of the file registry driver.
+func (c *configuration) GetFileRegistryDriverFile() string {
+	return c.FileRegistryDriverFile
+}
+
+// GetFileRegistryDriverPollInterval returns how often the file registry driver checks its file for changes.
+func (c *configuration) GetFileRegistryDriverPollInterval() time.Duration {
+	return defaultSeconds(c.FileRegistryDriverPollInterval, 5*time.Second)
+}
+
+// GetDNSRegistryDriverDomain returns the domain the SRV records of the roles are published under.
+func (c *configuration) GetDNSRegistryDriverDomain() string {
+	return c.DNSRegistryDriverDomain
+}
+
+// GetDNSRegistryDriverServers returns the comma separated DNS servers to query.
+// Empty means the servers in /etc/resolv.conf.
+func (c *configuration) GetDNSRegistryDriverServers() string {
+	return c.DNSRegistryDriverServers
+}
+
+// GetDNSRegistryDriverScheme returns the scheme of the URLs of the nodes found by the DNS registry driver.
+func (c *configuration) GetDNSRegistryDriverScheme() string {
+	return defaultString(c.DNSRegistryDriverScheme, "http")
+}
+
+// GetAuthenticationWebServiceLoadBalancer returns the strategy to choose the authentication node of a request.
+func (c *configuration) GetAuthenticationWebServiceLoadBalancer() string {
+	return defaultString(c.AuthenticationWebServiceLoadBalancer, roundRobin)
+}
+
+// GetDataWebServiceLoadBalancer returns the strategy to choose the data node of a request.
+func (c *configuration) GetDataWebServiceLoadBalancer() string {
+	return defaultString(c.DataWebServiceLoadBalancer, roundRobin)
+}
+
+// GetMetaDataWebServiceLoadBalancer returns the strategy to choose the metadata node of a request.
+func (c *configuration) GetMetaDataWebServiceLoadBalancer() string {
+	return defaultString(c.MetaDataWebServiceLoadBalancer, roundRobin)
+}
+
+// GetOCWebServiceLoadBalancer returns the strategy to choose the owncloud node of a request.
+func (c *configuration) GetOCWebServiceLoadBalancer() string {
+	return defaultString(c.OCWebServiceLoadBalancer, roundRobin)
+}
+
+// GetUpstreamHealthCheckInterval returns how often the /healthz endpoint of the upstream nodes is checked.
+func (c *configuration) GetUpstreamHealthCheckInterval() time.Duration {
+	return defaultSeconds(c.UpstreamHealthCheckInterval, 10*time.Second)
+}
+
+// GetUpstreamHealthCheckTimeout returns the time an upstream node has to answer a health check.
+func (c *configuration) GetUpstreamHealthCheckTimeout() time.Duration {
+	return defaultSeconds(c.UpstreamHealthCheckTimeout, 2*time.Second)
+}
+
+// GetUpstreamOutlierConsecutiveFailures returns the number of consecutive failed
+// requests that eject an upstream node.
+func (c *configuration) GetUpstreamOutlierConsecutiveFailures() int {
+	if c.UpstreamOutlierConsecutiveFailures == 0 {
+		return 5
+	}
+	return c.UpstreamOutlierConsecutiveFailures
+}
+
+// GetUpstreamOutlierCooldown returns the time an ejected upstream node receives no requests.
+func (c *configuration) GetUpstreamOutlierCooldown() time.Duration {
+	return defaultSeconds(c.UpstreamOutlierCooldown, 30*time.Second)
+}
+
+// GetRetryBudgetPercent returns the retries allowed as a percentage of the requests.
+func (c *configuration) GetRetryBudgetPercent() int {
+	if c.RetryBudgetPercent == 0 {
+		return 20
+	}
+	return c.RetryBudgetPercent
+}
+
+// GetRetryBudgetMinPerSecond returns the retries per second allowed
+// regardless of the number of requests.
+func (c *configuration) GetRetryBudgetMinPerSecond() int {
+	if c.RetryBudgetMinPerSecond == 0 {
+		return 10
+	}
+	return c.RetryBudgetMinPerSecond
+}
+
+// GetAuthenticationWebServiceRetryPolicy returns how proxied authentication requests are retried,
+// nil if they are not.
+func (c *configuration) GetAuthenticationWebServiceRetryPolicy() *retryPolicy {
+	return c.AuthenticationWebServiceRetryPolicy.withDefaults()
+}
+
+// GetDataWebServiceRetryPolicy returns how proxied data requests are retried, nil if they are not.
+func (c *configuration) GetDataWebServiceRetryPolicy() *retryPolicy {
+	return c.DataWebServiceRetryPolicy.withDefaults()
+}
+
+// GetMetaDataWebServiceRetryPolicy returns how proxied metadata requests are retried, nil if they are not.
+func (c *configuration) GetMetaDataWebServiceRetryPolicy() *retryPolicy {
+	return c.MetaDataWebServiceRetryPolicy.withDefaults()
+}
+
+// GetOCWebServiceRetryPolicy returns how proxied or remote owncloud requests are retried,
+// nil if they are not.
+func (c *configuration) GetOCWebServiceRetryPolicy() *retryPolicy {
+	return c.OCWebServiceRetryPolicy.withDefaults()
+}
+
+// GetHTTPReadHeaderTimeout returns the time a client has to send the headers of a request.
+func (c *configuration) GetHTTPReadHeaderTimeout() time.Duration {
+	return defaultSeconds(c.HTTPReadHeaderTimeout, 10*time.Second)
+}
+
+// GetHTTPIdleTimeout returns the time a keep-alive connection waits for the next request.
+func (c *configuration) GetHTTPIdleTimeout() time.Duration {
+	return defaultSeconds(c.HTTPIdleTimeout, 2*time.Minute)
+}
+
+// GetHTTPMaxHeaderBytes returns the maximum size of the headers of a request.
+func (c *configuration) GetHTTPMaxHeaderBytes() int {
+	if c.HTTPMaxHeaderBytes == 0 {
+		return http.DefaultMaxHeaderBytes
+	}
+	return c.HTTPMaxHeaderBytes
+}
+
+// GetHTTPMaxConnections returns the maximum number of connections served
+// at the same time, zero means unlimited.
+func (c *configuration) GetHTTPMaxConnections() int {
+	return c.HTTPMaxConnections
+}
+
+// IsHTTP2CleartextEnabled returns true if the listeners without TLS
+// serve HTTP/2 (h2c) besides HTTP/1.
+func (c *configuration) IsHTTP2CleartextEnabled() bool {
+	return c.HTTP2Cleartext
+}
+
+// IsHTTP2CleartextClientEnabled returns true if the requests to other
+// nodes without TLS are sent with HTTP/2 (h2c).
+func (c *configuration) IsHTTP2CleartextClientEnabled() bool {
+	return c.HTTP2CleartextClient
+}
+
+// GetHTTP2MaxConcurrentStreams returns the number of requests a client
+// can send at the same time on an HTTP/2 connection.
+func (c *configuration) GetHTTP2MaxConcurrentStreams() int {
+	if c.HTTP2MaxConcurrentStreams == 0 {
+		return 250
+	}
+	return c.HTTP2MaxConcurrentStreams
+}
+
+// GetHTTP2MaxReadFrameSize returns the largest HTTP/2 frame a client can send.
+func (c *configuration) GetHTTP2MaxReadFrameSize() int {
+	if c.HTTP2MaxReadFrameSize == 0 {
+		return 1 << 20
+	}
+	return c.HTTP2MaxReadFrameSize
+}
+
+// GetHTTP2ConnectionWindowSize returns the bytes of the request bodies
+// a client can send on an HTTP/2 connection before they are read.
+func (c *configuration) GetHTTP2ConnectionWindowSize() int {
+	if c.HTTP2ConnectionWindowSize == 0 {
+		return 1 << 20
+	}
+	return c.HTTP2ConnectionWindowSize
+}
+
+// GetHTTP2StreamWindowSize returns the bytes of one request body a client
+// can send on an HTTP/2 connection before they are read.
+func (c *configuration) GetHTTP2StreamWindowSize() int {
+	if c.HTTP2StreamWindowSize == 0 {
+		return 1 << 20
+	}
+	return c.HTTP2StreamWindowSize
+}
+
+// GetAuthenticationWebServiceBodyReadTimeout returns the time a client has to send the body of an authentication request.
+func (c *configuration) GetAuthenticationWebServiceBodyReadTimeout() time.Duration {
+	return defaultSeconds(c.AuthenticationWebServiceBodyReadTimeout, 10*time.Second)
+}
+
+// GetDataWebServiceBodyReadTimeout returns the time a client has to send the body of a data request, e.g. an upload.
+func (c *configuration) GetDataWebServiceBodyReadTimeout() time.Duration {
+	return defaultSeconds(c.DataWebServiceBodyReadTimeout, time.Hour)
+}
+
+// GetMetaDataWebServiceBodyReadTimeout returns the time a client has to send the body of a metadata request.
+func (c *configuration) GetMetaDataWebServiceBodyReadTimeout() time.Duration {
+	return defaultSeconds(c.MetaDataWebServiceBodyReadTimeout, 30*time.Second)
+}
+
+// GetOCWebServiceBodyReadTimeout returns the time a client has to send the body of an owncloud request, e.g. an upload.
+func (c *configuration) GetOCWebServiceBodyReadTimeout() time.Duration {
+	return defaultSeconds(c.OCWebServiceBodyReadTimeout, time.Hour)
+}
+
+// GetAuthenticationWebServicePathPrefix returns the path the authentication endpoints are mounted on.
+func (c *configuration) GetAuthenticationWebServicePathPrefix() string {
+	return c.AuthenticationWebServicePathPrefix
+}
+
+// GetDataWebServicePathPrefix returns the path the data endpoints are mounted on.
+func (c *configuration) GetDataWebServicePathPrefix() string {
+	return c.DataWebServicePathPrefix
+}
+
+// GetMetaDataWebServicePathPrefix returns the path the metadata endpoints are mounted on.
+func (c *configuration) GetMetaDataWebServicePathPrefix() string {
+	return c.MetaDataWebServicePathPrefix
+}
+
+// GetOCWebServicePathPrefix returns the path the owncloud endpoints are mounted on.
+func (c *configuration) GetOCWebServicePathPrefix() string {
+	return c.OCWebServicePathPrefix
+}
+
+// GetAuthenticationWebServiceHosts returns the comma separated host names
+// the authentication endpoints are served for, any host if empty.
+func (c *configuration) GetAuthenticationWebServiceHosts() string {
+	return c.AuthenticationWebServiceHosts
+}
+
+// GetDataWebServiceHosts returns the comma separated host names
+// the data endpoints are served for, any host if empty.
+func (c *configuration) GetDataWebServiceHosts() string {
+	return c.DataWebServiceHosts
+}
+
+// GetMetaDataWebServiceHosts returns the comma separated host names
+// the metadata endpoints are served for, any host if empty.
+func (c *configuration) GetMetaDataWebServiceHosts() string {
+	return c.MetaDataWebServiceHosts
+}
+
+// GetOCWebServiceHosts returns the comma separated host names
+// the owncloud endpoints are served for, any host if empty.
+func (c *configuration) GetOCWebServiceHosts() string {
+	return c.OCWebServiceHosts
+}
+
+// GetListeners returns where client requests are served, a TCP listener on
+// the port with the global TLS settings by default. The port and TLS settings
+// are also the address registered for the other nodes.
+func (c *configuration) GetListeners() []*listenerConfig {
+	if len(c.Listeners) == 0 {
+		return []*listenerConfig{{
+			Network:     listenerTCP,
+			Address:     fmt.Sprintf(":%d", c.Port),
+			TLSEnabled:  c.TLSEnabled,
+			MTLSEnabled: c.MTLSEnabled,
+		}}
+	}
+	return c.Listeners
+}
+
+// GetAdminListener returns where the endpoints for operators are served,
+// nil if they are served with the web services.
+func (c *configuration) GetAdminListener() *listenerConfig {
+	return c.AdminListener
+}
+
+// defaultSeconds converts a setting in seconds, zero means def.
+func defaultSeconds(seconds int, def time.Duration) time.Duration {
+	if seconds == 0 {
+		return def
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+func defaultString(s, def string) string {
+	if s == "" {
+		return def
+	}
+	return s
+}
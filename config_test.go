@@ -0,0 +1,87 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseSettings(t *testing.T) {
+	tests := []struct {
+		name  string
+		raw   map[string]string
+		want  map[string]interface{}
+		isErr bool
+	}{
+		{"empty", map[string]string{}, map[string]interface{}{}, false},
+		{"string", map[string]string{"enabled_web_services": "data,metadata"}, map[string]interface{}{"enabled_web_services": "data,metadata"}, false},
+		{"int", map[string]string{"port": "1502"}, map[string]interface{}{"port": int64(1502)}, false},
+		{"int64", map[string]string{"data_web_service_max_upload_file_size": "10000000000"}, map[string]interface{}{"data_web_service_max_upload_file_size": int64(10000000000)}, false},
+		{"bool", map[string]string{"tls_enabled": "true"}, map[string]interface{}{"tls_enabled": true}, false},
+		{"json", map[string]string{"data_web_service_retry_policy": `{"max_attempts": 2}`}, map[string]interface{}{"data_web_service_retry_policy": map[string]interface{}{"max_attempts": float64(2)}}, false},
+		{"unknown key", map[string]string{"no_such_setting": "1"}, map[string]interface{}{}, false},
+		{"invalid int", map[string]string{"port": "http"}, nil, true},
+		{"invalid bool", map[string]string{"tls_enabled": "sometimes"}, nil, true},
+		{"invalid json", map[string]string{"listeners": "[{"}, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseSettings(tt.raw)
+			if tt.isErr {
+				if err == nil {
+					t.Fatalf("parseSettings() = %v, want an error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("parseSettings() = %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewConfigurationFromParsedSettings(t *testing.T) {
+	settings, err := parseSettings(map[string]string{
+		"port":                          "1502",
+		"tls_enabled":                   "true",
+		"enabled_web_services":          "data",
+		"data_web_service_retry_policy": `{"max_attempts": 2, "retry_on": [503]}`,
+		"listeners":                     `[{"network": "unix", "address": "/run/clawiod.sock"}]`,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	config, err := newConfiguration(settings)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.GetPort() != 1502 || !config.IsTLSEnabled() || config.GetEnabledWebServices() != "data" {
+		t.Fatalf("configuration = %+v, want port 1502, tls and the data web service", config)
+	}
+	if p := config.DataWebServiceRetryPolicy; p == nil || p.MaxAttempts != 2 || !reflect.DeepEqual(p.RetryOn, []int{503}) {
+		t.Fatalf("data retry policy = %+v, want 2 attempts on 503", p)
+	}
+	if len(config.Listeners) != 1 || config.Listeners[0].Address != "/run/clawiod.sock" {
+		t.Fatalf("listeners = %+v, want the unix socket", config.Listeners)
+	}
+}
+
+func TestSettingKeys(t *testing.T) {
+	keys := map[string]bool{}
+	for _, key := range settingKeys() {
+		if key == "" || key == "-" {
+			t.Errorf("a configuration field has no json key")
+		}
+		if keys[key] {
+			t.Errorf("setting %q is defined twice", key)
+		}
+		keys[key] = true
+	}
+	for _, key := range []string{"port", "enabled_web_services", "listeners"} {
+		if !keys[key] {
+			t.Errorf("setting %q is missing", key)
+		}
+	}
+}
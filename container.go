@@ -0,0 +1,101 @@
+package main
+
+import (
+	"github.com/clawio/clawiod/drivers"
+	"github.com/clawio/lib"
+	"github.com/go-kit/kit/log/levels"
+	"io"
+	"net/http"
+)
+
+// container builds the components for one configuration.
+// Every component is built once and the same instance is handed to all
+// its consumers, so web services share drivers, SQL pools and log files.
+// It is not safe for concurrent use, components are built while the
+// router is configured.
+type container struct {
+	config     *configuration
+	components map[string]interface{}
+	closers    []io.Closer
+}
+
+var _ drivers.Components = (*container)(nil)
+
+func newContainer(config *configuration) *container {
+	return &container{config: config, components: map[string]interface{}{}}
+}
+
+// get returns the component registered under name, building it the first time.
+// Components implementing io.Closer are closed when the container is closed.
+func (c *container) get(name string, build func(config lib.Configuration) (interface{}, error)) (interface{}, error) {
+	if v, ok := c.components[name]; ok {
+		return v, nil
+	}
+	v, err := build(c.config)
+	if err != nil {
+		return nil, err
+	}
+	c.components[name] = v
+	if closer, ok := v.(io.Closer); ok {
+		c.closers = append(c.closers, closer)
+	}
+	return v, nil
+}
+
+// close closes the components in the reverse order they were built,
+// so every component is closed before the ones it depends on.
+func (c *container) close() error {
+	var firstErr error
+	for i := len(c.closers) - 1; i >= 0; i-- {
+		if err := c.closers[i].Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	c.closers = nil
+	return firstErr
+}
+
+// Config returns the configuration the components are built for.
+func (c *container) Config() lib.Configuration {
+	return c.config
+}
+
+// Logger returns the shared logger.
+func (c *container) Logger() (levels.Levels, error) {
+	return getLogger(c)
+}
+
+// ContextManager returns the shared context manager.
+func (c *container) ContextManager() (lib.ContextManager, error) {
+	return getContextManager(c)
+}
+
+// UserDriver returns the shared user driver.
+func (c *container) UserDriver() (lib.UserDriver, error) {
+	return getUserDriver(c)
+}
+
+// TokenDriver returns the shared token driver.
+func (c *container) TokenDriver() (lib.TokenDriver, error) {
+	return getTokenDriver(c)
+}
+
+// DataDriver returns the shared data driver.
+func (c *container) DataDriver() (lib.DataDriver, error) {
+	return getDataDriver(c)
+}
+
+// MetaDataDriver returns the shared metadata driver.
+func (c *container) MetaDataDriver() (lib.MetaDataDriver, error) {
+	return getMetaDataDriver(c)
+}
+
+// RegistryDriver returns the shared registry driver.
+func (c *container) RegistryDriver() (lib.RegistryDriver, error) {
+	return getRegistryDriver(c)
+}
+
+// NodeTransport returns the shared transport for requests to other nodes.
+func (c *container) NodeTransport() (http.RoundTripper, error) {
+	return getNodeTransport(c)
+}
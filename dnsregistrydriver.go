@@ -0,0 +1,208 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/clawio/clawiod/drivers"
+	"github.com/clawio/lib"
+	"github.com/go-kit/kit/log/levels"
+	"github.com/miekg/dns"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// dnsNegativeTTL is how long a role without SRV records is cached.
+const dnsNegativeTTL = 5 * time.Second
+
+// dnsMinTTL is the shortest time answers are cached, platforms like Consul
+// publish records with a TTL of 0 that would be resolved on every request.
+const dnsMinTTL = 5 * time.Second
+
+// dnsRegistryDriver discovers nodes through the SRV records published by
+// platforms like Kubernetes or Consul. The nodes of role data-node are the
+// targets of _data-node._tcp.<domain> with the lowest priority, the others
+// are backups. The weight of a target is kept in the "weight" metadata of
+// its node, the round robin of the load balancer sends requests to the nodes
+// in proportion to it as in RFC 2782. Targets of weight 0 only get requests
+// when the others are not available. The other strategies ignore weights.
+// Answers are cached for their TTL, at least dnsMinTTL. Nodes do not
+// register themselves, the platform does it for them.
+type dnsRegistryDriver struct {
+	logger  levels.Levels
+	domain  string
+	scheme  string
+	servers []string
+	client  *dns.Client
+
+	mu    sync.Mutex
+	cache map[string]*dnsRegistryEntry
+}
+
+type dnsRegistryEntry struct {
+	nodes   []lib.RegistryNode
+	expires time.Time
+}
+
+func newDNSRegistryDriver(c drivers.Components) (lib.RegistryDriver, error) {
+	config, ok := c.Config().(*configuration)
+	if !ok {
+		return nil, errors.New("dns registry driver needs a configuration loaded by clawiod")
+	}
+	logger, err := c.Logger()
+	if err != nil {
+		return nil, err
+	}
+	if config.GetDNSRegistryDriverDomain() == "" {
+		return nil, errors.New("dns registry driver domain is empty")
+	}
+	servers, err := getDNSServers(config.GetDNSRegistryDriverServers())
+	if err != nil {
+		return nil, err
+	}
+	return &dnsRegistryDriver{
+		logger:  logger.With("pkg", "dnsregistrydriver"),
+		domain:  config.GetDNSRegistryDriverDomain(),
+		scheme:  config.GetDNSRegistryDriverScheme(),
+		servers: servers,
+		client:  &dns.Client{Timeout: 2 * time.Second},
+		cache:   map[string]*dnsRegistryEntry{},
+	}, nil
+}
+
+// getDNSServers returns the addresses of the comma separated servers,
+// or of the ones in /etc/resolv.conf if there are none.
+func getDNSServers(servers string) ([]string, error) {
+	addrs := []string{}
+	if servers == "" {
+		resolvConf, err := dns.ClientConfigFromFile("/etc/resolv.conf")
+		if err != nil {
+			return nil, err
+		}
+		for _, s := range resolvConf.Servers {
+			addrs = append(addrs, net.JoinHostPort(s, resolvConf.Port))
+		}
+	}
+	for _, s := range strings.Split(servers, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		if _, _, err := net.SplitHostPort(s); err != nil {
+			s = net.JoinHostPort(s, "53")
+		}
+		addrs = append(addrs, s)
+	}
+	if len(addrs) == 0 {
+		return nil, errors.New("there are no dns servers to query")
+	}
+	return addrs, nil
+}
+
+// Register does nothing, the platform publishes the nodes.
+func (d *dnsRegistryDriver) Register(ctx context.Context, node lib.RegistryNode) error {
+	return nil
+}
+
+// IsReadOnly reports that nodes can not be removed through the driver.
+func (d *dnsRegistryDriver) IsReadOnly() bool {
+	return true
+}
+
+func (d *dnsRegistryDriver) GetNodesForRol(ctx context.Context, rol string) ([]lib.RegistryNode, error) {
+	d.mu.Lock()
+	entry, ok := d.cache[rol]
+	d.mu.Unlock()
+	if ok && time.Now().Before(entry.expires) {
+		return entry.nodes, nil
+	}
+
+	nodes, ttl, err := d.lookup(ctx, rol)
+	if err != nil {
+		if ok {
+			// better a stale answer than none while the servers are unreachable
+			d.logger.Warn().Log("msg", "error resolving nodes, using expired ones", "rol", rol, "error", err)
+			return entry.nodes, nil
+		}
+		return nil, err
+	}
+	d.mu.Lock()
+	d.cache[rol] = &dnsRegistryEntry{nodes: nodes, expires: time.Now().Add(ttl)}
+	d.mu.Unlock()
+	return nodes, nil
+}
+
+// lookup queries the servers in order until one answers.
+func (d *dnsRegistryDriver) lookup(ctx context.Context, rol string) ([]lib.RegistryNode, time.Duration, error) {
+	name := dns.Fqdn(fmt.Sprintf("_%s._tcp.%s", rol, d.domain))
+	m := new(dns.Msg)
+	m.SetQuestion(name, dns.TypeSRV)
+
+	var err error
+	for _, server := range d.servers {
+		var r *dns.Msg
+		r, _, err = d.client.ExchangeContext(ctx, m, server)
+		if err == nil && r.Truncated {
+			tcp := &dns.Client{Net: "tcp", Timeout: d.client.Timeout}
+			r, _, err = tcp.ExchangeContext(ctx, m, server)
+		}
+		if err != nil {
+			continue
+		}
+		switch r.Rcode {
+		case dns.RcodeSuccess:
+			nodes, ttl := d.getNodes(rol, r.Answer)
+			return nodes, ttl, nil
+		case dns.RcodeNameError:
+			return []lib.RegistryNode{}, dnsNegativeTTL, nil
+		default:
+			err = fmt.Errorf("dns server %s answered %s for %s", server, dns.RcodeToString[r.Rcode], name)
+		}
+	}
+	return nil, 0, err
+}
+
+// getNodes returns the nodes of the SRV records with the lowest priority,
+// the others are backups, and the lowest TTL of the records.
+func (d *dnsRegistryDriver) getNodes(rol string, answer []dns.RR) ([]lib.RegistryNode, time.Duration) {
+	records := []*dns.SRV{}
+	for _, rr := range answer {
+		if srv, ok := rr.(*dns.SRV); ok {
+			records = append(records, srv)
+		}
+	}
+	if len(records) == 0 {
+		return []lib.RegistryNode{}, dnsNegativeTTL
+	}
+	sort.SliceStable(records, func(i, j int) bool {
+		return records[i].Priority < records[j].Priority
+	})
+
+	nodes := []lib.RegistryNode{}
+	ttl := time.Duration(records[0].Hdr.Ttl) * time.Second
+	for _, srv := range records {
+		if srv.Priority != records[0].Priority {
+			break
+		}
+		if t := time.Duration(srv.Hdr.Ttl) * time.Second; t < ttl {
+			ttl = t
+		}
+		host := net.JoinHostPort(strings.TrimSuffix(srv.Target, "."), fmt.Sprint(srv.Port))
+		nodes = append(nodes, &node{
+			xid:   host,
+			xrol:  rol,
+			xhost: host,
+			xurl:  fmt.Sprintf("%s://%s", d.scheme, host),
+			xmetadata: map[string]string{
+				"weight": fmt.Sprint(srv.Weight),
+			},
+		})
+	}
+	if ttl < dnsMinTTL {
+		ttl = dnsMinTTL
+	}
+	return nodes, ttl
+}
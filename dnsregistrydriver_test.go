@@ -0,0 +1,263 @@
+package main
+
+import (
+	"context"
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/levels"
+	"github.com/miekg/dns"
+	"net"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeDNS is an in-process DNS server answering the SRV records it is given.
+type fakeDNS struct {
+	server *dns.Server
+	addr   string
+
+	mu      sync.Mutex
+	records map[string][]dns.RR
+	rcode   int // answered when set instead of the records
+	queries int
+}
+
+func newFakeDNS(t *testing.T) *fakeDNS {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &fakeDNS{addr: conn.LocalAddr().String(), records: map[string][]dns.RR{}}
+	started := make(chan struct{})
+	f.server = &dns.Server{PacketConn: conn, Handler: dns.HandlerFunc(f.serveDNS), NotifyStartedFunc: func() { close(started) }}
+	go f.server.ActivateAndServe()
+	<-started
+	return f
+}
+
+func (f *fakeDNS) close() {
+	f.server.Shutdown()
+}
+
+func (f *fakeDNS) setSRV(name string, records ...string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.records[name] = nil
+	for _, record := range records {
+		rr, err := dns.NewRR(name + " " + record)
+		if err != nil {
+			panic(err)
+		}
+		f.records[name] = append(f.records[name], rr)
+	}
+}
+
+func (f *fakeDNS) setRcode(rcode int) {
+	f.mu.Lock()
+	f.rcode = rcode
+	f.mu.Unlock()
+}
+
+func (f *fakeDNS) getQueries() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.queries
+}
+
+func (f *fakeDNS) serveDNS(w dns.ResponseWriter, r *dns.Msg) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.queries++
+	m := new(dns.Msg)
+	m.SetReply(r)
+	records, ok := f.records[r.Question[0].Name]
+	switch {
+	case f.rcode != dns.RcodeSuccess:
+		m.Rcode = f.rcode
+	case !ok:
+		m.Rcode = dns.RcodeNameError
+	default:
+		m.Answer = records
+	}
+	w.WriteMsg(m)
+}
+
+func newTestDNSRegistryDriver(servers ...string) *dnsRegistryDriver {
+	return &dnsRegistryDriver{
+		logger:  levels.New(log.NewNopLogger()),
+		domain:  "clawio.test",
+		scheme:  "http",
+		servers: servers,
+		client:  &dns.Client{Timeout: 200 * time.Millisecond},
+		cache:   map[string]*dnsRegistryEntry{},
+	}
+}
+
+func TestGetDNSServers(t *testing.T) {
+	tests := []struct {
+		servers string
+		want    []string
+	}{
+		{"10.0.0.1", []string{"10.0.0.1:53"}},
+		{"10.0.0.1:5353", []string{"10.0.0.1:5353"}},
+		{"10.0.0.1, 10.0.0.2:5353,", []string{"10.0.0.1:53", "10.0.0.2:5353"}},
+		{"[fd00::1]:5353,fd00::2", []string{"[fd00::1]:5353", "[fd00::2]:53"}},
+	}
+	for _, tt := range tests {
+		got, err := getDNSServers(tt.servers)
+		if err != nil {
+			t.Errorf("getDNSServers(%q) = %s", tt.servers, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("getDNSServers(%q) = %v, want %v", tt.servers, got, tt.want)
+		}
+	}
+}
+
+func TestDNSRegistryDriverGetNodesForRol(t *testing.T) {
+	tests := []struct {
+		name    string
+		records []string
+		rcode   int
+		want    []string
+		ttl     time.Duration
+		isErr   bool
+	}{
+		{"no records", nil, dns.RcodeSuccess, []string{}, dnsNegativeTTL, false},
+		{"one node", []string{"30 IN SRV 10 5 1502 data1.clawio.test."}, dns.RcodeSuccess,
+			[]string{"http://data1.clawio.test:1502"}, 30 * time.Second, false},
+		{"lowest priority with lowest ttl", []string{
+			"60 IN SRV 10 5 1502 data1.clawio.test.",
+			"20 IN SRV 20 5 1502 backup.clawio.test.",
+			"30 IN SRV 10 5 1503 data2.clawio.test.",
+		}, dns.RcodeSuccess, []string{"http://data1.clawio.test:1502", "http://data2.clawio.test:1503"}, 30 * time.Second, false},
+		{"ttl of 0", []string{"0 IN SRV 10 5 1502 data1.clawio.test."}, dns.RcodeSuccess,
+			[]string{"http://data1.clawio.test:1502"}, dnsMinTTL, false},
+		{"server failure", nil, dns.RcodeServerFailure, nil, 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newFakeDNS(t)
+			defer f.close()
+			if tt.records != nil {
+				f.setSRV("_data-node._tcp.clawio.test.", tt.records...)
+			}
+			f.setRcode(tt.rcode)
+			d := newTestDNSRegistryDriver(f.addr)
+
+			nodes, err := d.GetNodesForRol(context.Background(), "data-node")
+			if tt.isErr {
+				if err == nil {
+					t.Fatal("GetNodesForRol() = nil error, want one")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			urls := []string{}
+			for _, n := range nodes {
+				if n.Rol() != "data-node" {
+					t.Errorf("node %s has role %s, want data-node", n.ID(), n.Rol())
+				}
+				urls = append(urls, n.URL())
+			}
+			sort.Strings(urls)
+			if !reflect.DeepEqual(urls, tt.want) {
+				t.Errorf("GetNodesForRol() = %v, want %v", urls, tt.want)
+			}
+			if ttl := d.cache["data-node"].expires.Sub(time.Now()); ttl > tt.ttl || ttl < tt.ttl-time.Second {
+				t.Errorf("nodes cached for %s, want %s", ttl, tt.ttl)
+			}
+		})
+	}
+}
+
+func TestDNSRegistryDriverAsksTheNextServer(t *testing.T) {
+	f := newFakeDNS(t)
+	defer f.close()
+	f.setSRV("_data-node._tcp.clawio.test.", "30 IN SRV 10 5 1502 data1.clawio.test.")
+
+	// nothing listens on the first server
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	down := conn.LocalAddr().String()
+	conn.Close()
+
+	d := newTestDNSRegistryDriver(down, f.addr)
+	nodes, err := d.GetNodesForRol(context.Background(), "data-node")
+	if err != nil || len(nodes) != 1 {
+		t.Fatalf("GetNodesForRol() = %d nodes, %v, want the node of the second server", len(nodes), err)
+	}
+}
+
+func TestDNSRegistryDriverCache(t *testing.T) {
+	f := newFakeDNS(t)
+	defer f.close()
+	f.setSRV("_data-node._tcp.clawio.test.", "30 IN SRV 10 5 1502 data1.clawio.test.")
+	d := newTestDNSRegistryDriver(f.addr)
+	ctx := context.Background()
+
+	for i := 0; i < 3; i++ {
+		if nodes, err := d.GetNodesForRol(ctx, "data-node"); err != nil || len(nodes) != 1 {
+			t.Fatalf("GetNodesForRol() = %d nodes, %v, want 1 node", len(nodes), err)
+		}
+	}
+	if queries := f.getQueries(); queries != 1 {
+		t.Fatalf("%d queries within the TTL, want 1", queries)
+	}
+
+	// expired answers are resolved again
+	d.cache["data-node"].expires = time.Now()
+	f.setSRV("_data-node._tcp.clawio.test.",
+		"30 IN SRV 10 5 1502 data1.clawio.test.",
+		"30 IN SRV 10 5 1502 data2.clawio.test.")
+	if nodes, err := d.GetNodesForRol(ctx, "data-node"); err != nil || len(nodes) != 2 {
+		t.Fatalf("GetNodesForRol() after the TTL = %d nodes, %v, want 2 nodes", len(nodes), err)
+	}
+	if queries := f.getQueries(); queries != 2 {
+		t.Fatalf("%d queries after the TTL, want 2", queries)
+	}
+
+	// expired answers are used while the servers fail
+	d.cache["data-node"].expires = time.Now()
+	f.setRcode(dns.RcodeServerFailure)
+	if nodes, err := d.GetNodesForRol(ctx, "data-node"); err != nil || len(nodes) != 2 {
+		t.Fatalf("GetNodesForRol() with failing servers = %d nodes, %v, want the 2 stale nodes", len(nodes), err)
+	}
+	if _, err := d.GetNodesForRol(ctx, "metadata-node"); err == nil {
+		t.Fatal("GetNodesForRol() of a role never resolved with failing servers = nil error, want one")
+	}
+}
+
+func TestDNSRegistryDriverWeights(t *testing.T) {
+	f := newFakeDNS(t)
+	defer f.close()
+	f.setSRV("_data-node._tcp.clawio.test.",
+		"30 IN SRV 10 60 1502 data1.clawio.test.",
+		"30 IN SRV 10 30 1502 data2.clawio.test.",
+		"30 IN SRV 10 10 1502 data3.clawio.test.",
+		"30 IN SRV 10 0 1502 spare.clawio.test.",
+		"30 IN SRV 20 50 1502 backup.clawio.test.")
+	d := newTestDNSRegistryDriver(f.addr)
+
+	// the round robin sends the requests in proportion to the weights
+	b := newLoadBalancer(d, map[string]string{"data": roundRobin}, newTestUpstreamHealth())
+	picked := map[string]int{}
+	for i := 0; i < 100; i++ {
+		picked[pick(t, b, context.Background())]++
+	}
+	want := map[string]int{
+		"http://data1.clawio.test:1502": 60,
+		"http://data2.clawio.test:1502": 30,
+		"http://data3.clawio.test:1502": 10,
+	}
+	if !reflect.DeepEqual(picked, want) {
+		t.Fatalf("picked %v, want %v", picked, want)
+	}
+}
@@ -0,0 +1,193 @@
+// Package drivers keeps the drivers available to clawiod by name.
+//
+// Drivers register a factory from an init function, so packages outside
+// this repository are compiled in with a blank import in clawiod:
+//
+//	import _ "example.org/s3datadriver"
+//
+// The name used in the registration is the one set in the configuration,
+// e.g. "data_driver": "s3datadriver".
+package drivers
+
+import (
+	"fmt"
+	"github.com/clawio/lib"
+	"github.com/go-kit/kit/log/levels"
+	"net/http"
+	"sort"
+	"sync"
+)
+
+// Components gives factories access to the configuration and to the components
+// built for it. Components are shared, asking twice returns the same instance.
+type Components interface {
+	Config() lib.Configuration
+	Logger() (levels.Levels, error)
+	ContextManager() (lib.ContextManager, error)
+	UserDriver() (lib.UserDriver, error)
+	TokenDriver() (lib.TokenDriver, error)
+	DataDriver() (lib.DataDriver, error)
+	MetaDataDriver() (lib.MetaDataDriver, error)
+	RegistryDriver() (lib.RegistryDriver, error)
+	// NodeTransport sends requests to other nodes with the settings of
+	// the cluster, e.g. presenting the node certificate with mutual TLS.
+	NodeTransport() (http.RoundTripper, error)
+}
+
+// UserDriverFactory creates a user driver.
+type UserDriverFactory func(c Components) (lib.UserDriver, error)
+
+// TokenDriverFactory creates a token driver.
+type TokenDriverFactory func(c Components) (lib.TokenDriver, error)
+
+// DataDriverFactory creates a data driver.
+type DataDriverFactory func(c Components) (lib.DataDriver, error)
+
+// MetaDataDriverFactory creates a metadata driver.
+type MetaDataDriverFactory func(c Components) (lib.MetaDataDriver, error)
+
+// RegistryDriverFactory creates a registry driver.
+type RegistryDriverFactory func(c Components) (lib.RegistryDriver, error)
+
+var (
+	mu        sync.RWMutex
+	factories = map[string]map[string]interface{}{}
+)
+
+// Kinds of drivers.
+const (
+	KindUser     = "user"
+	KindToken    = "token"
+	KindData     = "data"
+	KindMetaData = "metadata"
+	KindRegistry = "registry"
+)
+
+// Kinds returns the kinds of drivers that can be registered.
+func Kinds() []string {
+	return []string{KindUser, KindToken, KindData, KindMetaData, KindRegistry}
+}
+
+// Names returns the sorted names of the drivers registered for kind.
+func Names(kind string) []string {
+	mu.RLock()
+	defer mu.RUnlock()
+	names := []string{}
+	for name := range factories[kind] {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func register(kind, name string, factory interface{}) {
+	mu.Lock()
+	defer mu.Unlock()
+	if name == "" {
+		panic(fmt.Sprintf("drivers: register %s driver with empty name", kind))
+	}
+	if _, ok := factories[kind][name]; ok {
+		panic(fmt.Sprintf("drivers: register %s driver %q twice", kind, name))
+	}
+	if factories[kind] == nil {
+		factories[kind] = map[string]interface{}{}
+	}
+	factories[kind][name] = factory
+}
+
+func lookup(kind, name string) (interface{}, bool) {
+	mu.RLock()
+	defer mu.RUnlock()
+	factory, ok := factories[kind][name]
+	return factory, ok
+}
+
+// RegisterUserDriver makes a user driver available by name.
+// It panics if the name is empty, the factory is nil or the name is already registered.
+func RegisterUserDriver(name string, factory UserDriverFactory) {
+	if factory == nil {
+		panic("drivers: register nil user driver factory")
+	}
+	register(KindUser, name, factory)
+}
+
+// UserDriver returns the factory of the user driver registered as name.
+func UserDriver(name string) (UserDriverFactory, bool) {
+	factory, ok := lookup(KindUser, name)
+	if !ok {
+		return nil, false
+	}
+	return factory.(UserDriverFactory), true
+}
+
+// RegisterTokenDriver makes a token driver available by name.
+// It panics if the name is empty, the factory is nil or the name is already registered.
+func RegisterTokenDriver(name string, factory TokenDriverFactory) {
+	if factory == nil {
+		panic("drivers: register nil token driver factory")
+	}
+	register(KindToken, name, factory)
+}
+
+// TokenDriver returns the factory of the token driver registered as name.
+func TokenDriver(name string) (TokenDriverFactory, bool) {
+	factory, ok := lookup(KindToken, name)
+	if !ok {
+		return nil, false
+	}
+	return factory.(TokenDriverFactory), true
+}
+
+// RegisterDataDriver makes a data driver available by name.
+// It panics if the name is empty, the factory is nil or the name is already registered.
+func RegisterDataDriver(name string, factory DataDriverFactory) {
+	if factory == nil {
+		panic("drivers: register nil data driver factory")
+	}
+	register(KindData, name, factory)
+}
+
+// DataDriver returns the factory of the data driver registered as name.
+func DataDriver(name string) (DataDriverFactory, bool) {
+	factory, ok := lookup(KindData, name)
+	if !ok {
+		return nil, false
+	}
+	return factory.(DataDriverFactory), true
+}
+
+// RegisterMetaDataDriver makes a metadata driver available by name.
+// It panics if the name is empty, the factory is nil or the name is already registered.
+func RegisterMetaDataDriver(name string, factory MetaDataDriverFactory) {
+	if factory == nil {
+		panic("drivers: register nil metadata driver factory")
+	}
+	register(KindMetaData, name, factory)
+}
+
+// MetaDataDriver returns the factory of the metadata driver registered as name.
+func MetaDataDriver(name string) (MetaDataDriverFactory, bool) {
+	factory, ok := lookup(KindMetaData, name)
+	if !ok {
+		return nil, false
+	}
+	return factory.(MetaDataDriverFactory), true
+}
+
+// RegisterRegistryDriver makes a registry driver available by name.
+// It panics if the name is empty, the factory is nil or the name is already registered.
+func RegisterRegistryDriver(name string, factory RegistryDriverFactory) {
+	if factory == nil {
+		panic("drivers: register nil registry driver factory")
+	}
+	register(KindRegistry, name, factory)
+}
+
+// RegistryDriver returns the factory of the registry driver registered as name.
+func RegistryDriver(name string) (RegistryDriverFactory, bool) {
+	factory, ok := lookup(KindRegistry, name)
+	if !ok {
+		return nil, false
+	}
+	return factory.(RegistryDriverFactory), true
+}
@@ -0,0 +1,148 @@
+package drivers
+
+import (
+	"errors"
+	"github.com/clawio/lib"
+	"reflect"
+	"testing"
+)
+
+// errBuilt is returned by the factories of the tests, so calling the
+// factory looked up shows it is the one registered.
+var errBuilt = errors.New("built")
+
+func TestRegisterAndLookup(t *testing.T) {
+	tests := []struct {
+		kind     string
+		register func(name string)
+		lookup   func(name string) (func() error, bool)
+	}{
+		{KindUser, func(name string) {
+			RegisterUserDriver(name, func(c Components) (lib.UserDriver, error) { return nil, errBuilt })
+		}, func(name string) (func() error, bool) {
+			f, ok := UserDriver(name)
+			return func() error { _, err := f(nil); return err }, ok
+		}},
+		{KindToken, func(name string) {
+			RegisterTokenDriver(name, func(c Components) (lib.TokenDriver, error) { return nil, errBuilt })
+		}, func(name string) (func() error, bool) {
+			f, ok := TokenDriver(name)
+			return func() error { _, err := f(nil); return err }, ok
+		}},
+		{KindData, func(name string) {
+			RegisterDataDriver(name, func(c Components) (lib.DataDriver, error) { return nil, errBuilt })
+		}, func(name string) (func() error, bool) {
+			f, ok := DataDriver(name)
+			return func() error { _, err := f(nil); return err }, ok
+		}},
+		{KindMetaData, func(name string) {
+			RegisterMetaDataDriver(name, func(c Components) (lib.MetaDataDriver, error) { return nil, errBuilt })
+		}, func(name string) (func() error, bool) {
+			f, ok := MetaDataDriver(name)
+			return func() error { _, err := f(nil); return err }, ok
+		}},
+		{KindRegistry, func(name string) {
+			RegisterRegistryDriver(name, func(c Components) (lib.RegistryDriver, error) { return nil, errBuilt })
+		}, func(name string) (func() error, bool) {
+			f, ok := RegistryDriver(name)
+			return func() error { _, err := f(nil); return err }, ok
+		}},
+	}
+	if len(tests) != len(Kinds()) {
+		t.Fatalf("testing %d kinds, want the %d of Kinds()", len(tests), len(Kinds()))
+	}
+	for _, tt := range tests {
+		t.Run(tt.kind, func(t *testing.T) {
+			name := "test" + tt.kind + "driver"
+			if _, ok := tt.lookup(name); ok {
+				t.Fatalf("%s driver %q found before it is registered", tt.kind, name)
+			}
+			tt.register(name)
+			build, ok := tt.lookup(name)
+			if !ok {
+				t.Fatalf("%s driver %q not found", tt.kind, name)
+			}
+			if err := build(); err != errBuilt {
+				t.Fatalf("factory of %s driver %q = %v, want the registered one", tt.kind, name, err)
+			}
+			if _, ok := tt.lookup("nonexistent"); ok {
+				t.Fatalf("%s driver %q found, it was never registered", tt.kind, "nonexistent")
+			}
+
+			// the name of a kind does not register it for the others
+			for _, kind := range Kinds() {
+				found := false
+				for _, n := range Names(kind) {
+					found = found || n == name
+				}
+				if found != (kind == tt.kind) {
+					t.Errorf("%s driver %q listed for kind %s", tt.kind, name, kind)
+				}
+			}
+		})
+	}
+}
+
+func TestRegisterPanics(t *testing.T) {
+	factory := func(c Components) (lib.DataDriver, error) { return nil, errBuilt }
+	RegisterDataDriver("testduplicatedriver", factory)
+
+	tests := []struct {
+		name     string
+		register func()
+	}{
+		{"duplicate name", func() { RegisterDataDriver("testduplicatedriver", factory) }},
+		{"duplicate name with another factory", func() {
+			RegisterDataDriver("testduplicatedriver", func(c Components) (lib.DataDriver, error) { return nil, nil })
+		}},
+		{"empty name", func() { RegisterDataDriver("", factory) }},
+		{"nil factory", func() { RegisterDataDriver("testnildriver", nil) }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer func() {
+				if recover() == nil {
+					t.Fatal("register did not panic")
+				}
+			}()
+			tt.register()
+		})
+	}
+
+	// the first registration is kept
+	f, ok := DataDriver("testduplicatedriver")
+	if !ok {
+		t.Fatal("driver registered first not found")
+	}
+	if _, err := f(nil); err != errBuilt {
+		t.Fatalf("factory = %v, want the one registered first", err)
+	}
+	if _, ok := DataDriver("testnildriver"); ok {
+		t.Fatal("nil factory registered")
+	}
+}
+
+func TestNames(t *testing.T) {
+	for _, name := range []string{"testnamesc", "testnamesa", "testnamesb"} {
+		RegisterTokenDriver(name, func(c Components) (lib.TokenDriver, error) { return nil, errBuilt })
+	}
+	names := []string{}
+	for _, name := range Names(KindToken) {
+		if name == "testnamesa" || name == "testnamesb" || name == "testnamesc" {
+			names = append(names, name)
+		}
+	}
+	if want := []string{"testnamesa", "testnamesb", "testnamesc"}; !reflect.DeepEqual(names, want) {
+		t.Fatalf("Names() = %v, want %v", names, want)
+	}
+	all := Names(KindToken)
+	for i := 1; i < len(all); i++ {
+		if all[i-1] >= all[i] {
+			t.Fatalf("Names() = %v, want them sorted", all)
+		}
+	}
+
+	if names := Names("nonexistent"); names == nil || len(names) != 0 {
+		t.Fatalf("Names() of an unknown kind = %#v, want an empty list", names)
+	}
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"github.com/clawio/lib"
+	"os"
+	"strings"
+)
+
+const defaultEnvConfigurationPrefix = "CLAWIOD_"
+
+// envConfigurationSource loads the configuration from environment variables.
+// The variable for a setting is the prefix followed by the upper-cased key,
+// e.g. CLAWIOD_PORT or CLAWIOD_DATA_DRIVER.
+type envConfigurationSource struct {
+	prefix string
+}
+
+func newEnvConfigurationSource(prefix string) (*envConfigurationSource, error) {
+	if prefix == "" {
+		prefix = defaultEnvConfigurationPrefix
+	}
+	return &envConfigurationSource{prefix: prefix}, nil
+}
+
+func (s *envConfigurationSource) LoadConfiguration() (lib.Configuration, error) {
+	settings, err := s.loadSettings()
+	if err != nil {
+		return nil, err
+	}
+	return newConfiguration(settings)
+}
+
+func (s *envConfigurationSource) loadSettings() (map[string]interface{}, error) {
+	raw := map[string]string{}
+	for _, key := range settingKeys() {
+		if val, ok := os.LookupEnv(s.prefix + strings.ToUpper(key)); ok {
+			raw[key] = val
+		}
+	}
+	return parseSettings(raw)
+}
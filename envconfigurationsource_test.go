@@ -0,0 +1,48 @@
+package main
+
+import (
+	"os"
+	"testing"
+)
+
+func TestEnvConfigurationSource(t *testing.T) {
+	tests := []struct {
+		name   string
+		prefix string
+		env    map[string]string
+		port   int
+		tls    bool
+		isErr  bool
+	}{
+		{"default prefix", "", map[string]string{"CLAWIOD_PORT": "1600", "CLAWIOD_TLS_ENABLED": "true"}, 1600, true, false},
+		{"own prefix", "NODE1_", map[string]string{"NODE1_PORT": "1700", "CLAWIOD_PORT": "1600"}, 1700, false, false},
+		{"lower case is ignored", "", map[string]string{"CLAWIOD_port": "1600"}, 0, false, false},
+		{"invalid value", "", map[string]string{"CLAWIOD_PORT": "http"}, 0, false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for k, v := range tt.env {
+				os.Setenv(k, v)
+				defer os.Unsetenv(k)
+			}
+			s, err := newEnvConfigurationSource(tt.prefix)
+			if err != nil {
+				t.Fatal(err)
+			}
+			c, err := s.LoadConfiguration()
+			if tt.isErr {
+				if err == nil {
+					t.Fatal("LoadConfiguration() = nil error, want one")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			config := c.(*configuration)
+			if config.GetPort() != tt.port || config.IsTLSEnabled() != tt.tls {
+				t.Fatalf("port %d and tls %t, want %d and %t", config.GetPort(), config.IsTLSEnabled(), tt.port, tt.tls)
+			}
+		})
+	}
+}
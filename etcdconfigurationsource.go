@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/clawio/lib"
+	"github.com/coreos/etcd/client"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"time"
+)
+
+const defaultEtcdConfigurationEndpoint = "http://localhost:2379"
+
+// etcdConfigurationRetryInterval is how long a failed watch waits to start again.
+const etcdConfigurationRetryInterval = 5 * time.Second
+
+// etcdConfigurationSource loads the configuration from the keys under an etcd prefix,
+// one key per setting, e.g. /clawiod/config/port = 1560.
+// It connects to etcd using the same settings as the etcd registry driver,
+// taken from the CLAWIOD_ETCD_REGISTRY_DRIVER_URLS, CLAWIOD_ETCD_REGISTRY_DRIVER_USERNAME
+// and CLAWIOD_ETCD_REGISTRY_DRIVER_PASSWORD environment variables. When used on its own,
+// the loaded configuration uses that connection for the registry unless it sets its own,
+// so the whole cluster shares one etcd as source of truth and one client per process.
+type etcdConfigurationSource struct {
+	prefix   string
+	watched  bool
+	urls     string
+	username string
+	password string
+	keysAPI  client.KeysAPI
+	retry    time.Duration
+}
+
+// newEtcdConfigurationSource creates an etcd configuration source from
+// a specific like /clawiod/config or /clawiod/config?watch=true.
+func newEtcdConfigurationSource(specific string) (*etcdConfigurationSource, error) {
+	u, err := url.Parse(specific)
+	if err != nil {
+		return nil, err
+	}
+	if u.Path == "" {
+		return nil, errors.New("etcd configuration source needs a key prefix")
+	}
+	var watch bool
+	if v := u.Query().Get("watch"); v != "" {
+		watch, err = strconv.ParseBool(v)
+		if err != nil {
+			return nil, fmt.Errorf("etcd configuration source watch option must be a boolean: %s", err)
+		}
+	}
+
+	urls := os.Getenv(defaultEnvConfigurationPrefix + "ETCD_REGISTRY_DRIVER_URLS")
+	if urls == "" {
+		urls = defaultEtcdConfigurationEndpoint
+	}
+	username := os.Getenv(defaultEnvConfigurationPrefix + "ETCD_REGISTRY_DRIVER_USERNAME")
+	password := os.Getenv(defaultEnvConfigurationPrefix + "ETCD_REGISTRY_DRIVER_PASSWORD")
+
+	// the etcd registry driver reuses this client
+	keysAPI, err := getEtcdKeysAPI(urls, username, password)
+	if err != nil {
+		return nil, err
+	}
+	return &etcdConfigurationSource{
+		prefix:   path.Clean(u.Path),
+		watched:  watch,
+		urls:     urls,
+		username: username,
+		password: password,
+		keysAPI:  keysAPI,
+		retry:    etcdConfigurationRetryInterval,
+	}, nil
+}
+
+func (s *etcdConfigurationSource) LoadConfiguration() (lib.Configuration, error) {
+	settings, err := s.loadSettings()
+	if err != nil {
+		return nil, err
+	}
+	// the registry uses the same etcd unless configured otherwise
+	connection := map[string]string{
+		"etcd_registry_driver_urls":     s.urls,
+		"etcd_registry_driver_username": s.username,
+		"etcd_registry_driver_password": s.password,
+	}
+	for k, v := range connection {
+		if _, ok := settings[k]; !ok {
+			settings[k] = v
+		}
+	}
+	return newConfiguration(settings)
+}
+
+func (s *etcdConfigurationSource) loadSettings() (map[string]interface{}, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+	res, err := s.keysAPI.Get(ctx, s.prefix, &client.GetOptions{Recursive: true})
+	if err != nil {
+		if client.IsKeyNotFound(err) {
+			return nil, fmt.Errorf("no configuration found in etcd under %s", s.prefix)
+		}
+		return nil, err
+	}
+
+	raw := map[string]string{}
+	for _, n := range res.Node.Nodes {
+		if n.Dir {
+			continue
+		}
+		raw[path.Base(n.Key)] = n.Value
+	}
+	return parseSettings(raw)
+}
+
+// watch notifies when any key under the prefix changes.
+// Notifications are coalesced, a receiver only needs to reload once per value received.
+// It returns nil if the source was not configured to watch the prefix.
+func (s *etcdConfigurationSource) watch(stop <-chan struct{}) <-chan struct{} {
+	if !s.watched {
+		return nil
+	}
+	changes := make(chan struct{}, 1)
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-stop
+		cancel()
+	}()
+	go func() {
+		watcher := s.keysAPI.Watcher(s.prefix, &client.WatcherOptions{Recursive: true})
+		for {
+			_, err := watcher.Next(ctx)
+			if err != nil {
+				if ctx.Err() != nil {
+					return
+				}
+				// etcd is not reachable or the watched index was
+				// compacted, start watching again after a while.
+				select {
+				case <-time.After(s.retry):
+				case <-ctx.Done():
+					return
+				}
+				watcher = s.keysAPI.Watcher(s.prefix, &client.WatcherOptions{Recursive: true})
+				// changes may have been missed meanwhile
+				select {
+				case changes <- struct{}{}:
+				default:
+				}
+				continue
+			}
+			select {
+			case changes <- struct{}{}:
+			default:
+			}
+		}
+	}()
+	return changes
+}
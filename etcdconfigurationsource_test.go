@@ -0,0 +1,184 @@
+package main
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+func newTestEtcdConfigurationSource(t *testing.T, e *fakeEtcd, specific string) *etcdConfigurationSource {
+	os.Setenv("CLAWIOD_ETCD_REGISTRY_DRIVER_URLS", e.URL)
+	defer os.Unsetenv("CLAWIOD_ETCD_REGISTRY_DRIVER_URLS")
+	s, err := newEtcdConfigurationSource(specific)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.retry = 10 * time.Millisecond
+	return s
+}
+
+func TestNewEtcdConfigurationSource(t *testing.T) {
+	tests := []struct {
+		specific string
+		prefix   string
+		watched  bool
+		valid    bool
+	}{
+		{"/clawiod/config", "/clawiod/config", false, true},
+		{"/clawiod/config/", "/clawiod/config", false, true},
+		{"/clawiod/config?watch=true", "/clawiod/config", true, true},
+		{"/clawiod/config?watch=false", "/clawiod/config", false, true},
+		{"", "", false, false},
+		{"?watch=true", "", false, false},
+		{"/clawiod/config?watch=sometimes", "", false, false},
+	}
+	for _, tt := range tests {
+		s, err := newEtcdConfigurationSource(tt.specific)
+		if !tt.valid {
+			if err == nil {
+				t.Errorf("newEtcdConfigurationSource(%q) = nil error, want one", tt.specific)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("newEtcdConfigurationSource(%q) = %s", tt.specific, err)
+			continue
+		}
+		if s.prefix != tt.prefix || s.watched != tt.watched {
+			t.Errorf("newEtcdConfigurationSource(%q) has prefix %q and watch %t, want %q and %t",
+				tt.specific, s.prefix, s.watched, tt.prefix, tt.watched)
+		}
+	}
+}
+
+func TestEtcdConfigurationSourceSharesTheRegistryClient(t *testing.T) {
+	e := newFakeEtcd()
+	defer e.Close()
+	s := newTestEtcdConfigurationSource(t, e, "/clawiod/config")
+	keysAPI, err := getEtcdKeysAPI(e.URL, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.keysAPI != keysAPI {
+		t.Fatal("the configuration source and the registry driver use different etcd clients")
+	}
+}
+
+func TestEtcdConfigurationSourceLoadConfiguration(t *testing.T) {
+	tests := []struct {
+		name  string
+		keys  map[string]string
+		check func(t *testing.T, config *configuration, url string)
+		valid bool
+	}{
+		{"no configuration", map[string]string{"/other/port": "1560"}, nil, false},
+		{"settings", map[string]string{
+			"/clawiod/config/port":             "1560",
+			"/clawiod/config/tls_enabled":      "true",
+			"/clawiod/config/registry_driver":  "etcd",
+			"/clawiod/config/unknown":          "ignored",
+			"/clawiod/config/nested/log_level": "ignored",
+		}, func(t *testing.T, config *configuration, url string) {
+			if config.GetPort() != 1560 || !config.IsTLSEnabled() || config.GetRegistryDriver() != "etcd" {
+				t.Errorf("port %d, tls %t and registry driver %q, want 1560, true and etcd",
+					config.GetPort(), config.IsTLSEnabled(), config.GetRegistryDriver())
+			}
+			if config.GetETCDRegistryDriverUrls() != url {
+				t.Errorf("etcd registry driver urls %q, want the ones of the source %q", config.GetETCDRegistryDriverUrls(), url)
+			}
+		}, true},
+		{"own registry", map[string]string{
+			"/clawiod/config/etcd_registry_driver_urls": "http://registry:2379",
+		}, func(t *testing.T, config *configuration, url string) {
+			if config.GetETCDRegistryDriverUrls() != "http://registry:2379" {
+				t.Errorf("etcd registry driver urls %q, want http://registry:2379", config.GetETCDRegistryDriverUrls())
+			}
+		}, true},
+		{"invalid value", map[string]string{"/clawiod/config/port": "http"}, nil, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := newFakeEtcd()
+			defer e.Close()
+			for k, v := range tt.keys {
+				e.set(k, v)
+			}
+			s := newTestEtcdConfigurationSource(t, e, "/clawiod/config")
+			c, err := s.LoadConfiguration()
+			if !tt.valid {
+				if err == nil {
+					t.Fatal("LoadConfiguration() = nil error, want one")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			tt.check(t, c.(*configuration), e.URL)
+		})
+	}
+}
+
+func TestEtcdConfigurationSourceWatch(t *testing.T) {
+	e := newFakeEtcd()
+	defer e.Close()
+	e.set("/clawiod/config/port", "1560")
+
+	if s := newTestEtcdConfigurationSource(t, e, "/clawiod/config"); s.watch(nil) != nil {
+		t.Fatal("watch() of a source not watched returns a channel, want nil")
+	}
+
+	s := newTestEtcdConfigurationSource(t, e, "/clawiod/config?watch=true")
+	stop := make(chan struct{})
+	defer close(stop)
+	changes := s.watch(stop)
+	// give the watcher time to start waiting
+	time.Sleep(50 * time.Millisecond)
+
+	e.set("/other/port", "1561")
+	expectNoChange(t, changes)
+
+	e.set("/clawiod/config/port", "1561")
+	expectChange(t, changes, "changing a key")
+	expectNoChange(t, changes)
+
+	e.set("/clawiod/config/http_idle_timeout", "60")
+	expectChange(t, changes, "adding a key")
+
+	// changes made while etcd was unreachable are reported
+	// once the watch starts again
+	e.setDown(true)
+	time.Sleep(50 * time.Millisecond)
+	e.setDown(false)
+	expectChange(t, changes, "reconnecting")
+	time.Sleep(50 * time.Millisecond)
+	for len(changes) > 0 {
+		<-changes
+	}
+
+	e.set("/clawiod/config/port", "1562")
+	expectChange(t, changes, "changing a key after reconnecting")
+	config, err := s.LoadConfiguration()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.GetPort() != 1562 {
+		t.Errorf("port %d after reconnecting, want 1562", config.GetPort())
+	}
+}
+
+func expectChange(t *testing.T, changes <-chan struct{}, after string) {
+	select {
+	case <-changes:
+	case <-time.After(2 * time.Second):
+		t.Fatalf("no change notified after %s", after)
+	}
+}
+
+func expectNoChange(t *testing.T, changes <-chan struct{}) {
+	select {
+	case <-changes:
+		t.Fatal("change notified, want none")
+	case <-time.After(50 * time.Millisecond):
+	}
+}
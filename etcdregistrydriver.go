@@ -0,0 +1,317 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/clawio/clawiod/drivers"
+	"github.com/clawio/lib"
+	"github.com/clawio/lib/etcdregistrydriver"
+	"github.com/coreos/etcd/client"
+	"github.com/go-kit/kit/log/levels"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// etcdRegistryCacheTTL is how long the nodes of a role are cached,
+// so proxies do not query etcd on every request.
+const etcdRegistryCacheTTL = 2 * time.Second
+
+// etcdRegistryDriver registers the nodes with the etcd registry driver of
+// lib, so nodes running previous versions of clawiod and this one read each
+// other during a rolling upgrade, and adds what lib's driver lacks:
+//
+//   - Unregister, deleting the key lib's driver wrote for the node.
+//   - The TTL of the heartbeat on that key.
+//   - The metadata of the node, kept under <key>-metadata/<role>/<id>, as
+//     the value written by lib's driver has no room for it.
+//
+// The key lib's driver wrote is found by its value, the JSON object with the
+// id, role and url of the node, so nothing depends on the layout of its keys.
+// Values are never rewritten.
+type etcdRegistryDriver struct {
+	lib.RegistryDriver
+	logger  levels.Levels
+	key     string
+	ttl     time.Duration
+	keysAPI client.KeysAPI
+
+	mu    sync.Mutex
+	keys  map[string]string
+	cache map[string]*etcdRegistryEntry
+}
+
+type etcdRegistryEntry struct {
+	nodes   []lib.RegistryNode
+	expires time.Time
+}
+
+func newETCDRegistryDriver(c drivers.Components) (lib.RegistryDriver, error) {
+	config, ok := c.Config().(*configuration)
+	if !ok {
+		return nil, errors.New("etcd registry driver needs a configuration loaded by clawiod")
+	}
+	logger, err := c.Logger()
+	if err != nil {
+		return nil, err
+	}
+	if config.GetETCDRegistryDriverKey() == "" {
+		return nil, errors.New("etcd registry driver key is empty")
+	}
+	registryDriver, err := etcdregistrydriver.New(
+		logger.With("pkg", "etcdregistrydriver"),
+		config.GetETCDRegistryDriverUrls(),
+		config.GetETCDRegistryDriverKey(),
+		config.GetETCDRegistryDriverUsername(),
+		config.GetETCDRegistryDriverPassword())
+	if err != nil {
+		return nil, err
+	}
+	keysAPI, err := getEtcdKeysAPI(config.GetETCDRegistryDriverUrls(),
+		config.GetETCDRegistryDriverUsername(),
+		config.GetETCDRegistryDriverPassword())
+	if err != nil {
+		return nil, err
+	}
+	return newETCDRegistryDriverWith(registryDriver, logger.With("pkg", "etcdregistrydriver"),
+		config.GetETCDRegistryDriverKey(), config.GetRegistryHeartbeatTTL(), keysAPI), nil
+}
+
+// newETCDRegistryDriverWith wraps registryDriver, lib's driver writing the nodes under key.
+func newETCDRegistryDriverWith(registryDriver lib.RegistryDriver, logger levels.Levels, key string, ttl time.Duration, keysAPI client.KeysAPI) *etcdRegistryDriver {
+	return &etcdRegistryDriver{
+		RegistryDriver: registryDriver,
+		logger:         logger,
+		key:            path.Clean("/" + key),
+		ttl:            ttl,
+		keysAPI:        keysAPI,
+		keys:           map[string]string{},
+		cache:          map[string]*etcdRegistryEntry{},
+	}
+}
+
+// etcdClients are the etcd clients created so far by endpoints and credentials.
+var etcdClients = struct {
+	sync.Mutex
+	keysAPIs map[string]client.KeysAPI
+}{keysAPIs: map[string]client.KeysAPI{}}
+
+// getEtcdKeysAPI returns a client of the etcd at the comma separated urls.
+// Clients are shared, so the registry drivers and the configuration source
+// using the same etcd reuse their connections.
+func getEtcdKeysAPI(urls, username, password string) (client.KeysAPI, error) {
+	etcdClients.Lock()
+	defer etcdClients.Unlock()
+	id := strings.Join([]string{urls, username, password}, "\x00")
+	if keysAPI, ok := etcdClients.keysAPIs[id]; ok {
+		return keysAPI, nil
+	}
+	c, err := client.New(client.Config{
+		Endpoints:               strings.Split(urls, ","),
+		Username:                username,
+		Password:                password,
+		Transport:               client.DefaultTransport,
+		HeaderTimeoutPerRequest: time.Second * 5,
+	})
+	if err != nil {
+		return nil, err
+	}
+	keysAPI := client.NewKeysAPI(c)
+	etcdClients.keysAPIs[id] = keysAPI
+	return keysAPI, nil
+}
+
+// Register writes the node with lib's driver, then sets the TTL of the
+// heartbeat on the key it wrote and stores the metadata of the node.
+func (d *etcdRegistryDriver) Register(ctx context.Context, node lib.RegistryNode) error {
+	if err := d.RegistryDriver.Register(ctx, node); err != nil {
+		return err
+	}
+	written, err := d.getWrittenNode(ctx, node)
+	if err != nil {
+		return err
+	}
+	if written == nil {
+		d.logger.Warn().Log("msg", "key written for the node not found, it keeps the TTL of the etcd registry driver", "rol", node.Rol(), "id", node.ID())
+	} else {
+		opts := &client.SetOptions{TTL: d.ttl, PrevExist: client.PrevExist}
+		if _, err := d.keysAPI.Set(ctx, written.Key, written.Value, opts); err != nil && !client.IsKeyNotFound(err) {
+			return err
+		}
+	}
+	if m, ok := node.(registryNodeMetadata); ok && len(m.Metadata()) > 0 {
+		value, err := json.Marshal(m.Metadata())
+		if err != nil {
+			return err
+		}
+		if _, err := d.keysAPI.Set(ctx, d.getMetadataKey(node), string(value), &client.SetOptions{TTL: d.ttl}); err != nil {
+			return err
+		}
+	}
+	d.forget(node.Rol())
+	return nil
+}
+
+// Unregister deletes the key lib's driver wrote for the node and its
+// metadata. Nodes already expired are not an error.
+func (d *etcdRegistryDriver) Unregister(ctx context.Context, node lib.RegistryNode) error {
+	written, err := d.getWrittenNode(ctx, node)
+	if err != nil {
+		return err
+	}
+	if written != nil {
+		if _, err := d.keysAPI.Delete(ctx, written.Key, nil); err != nil && !client.IsKeyNotFound(err) {
+			return err
+		}
+	}
+	if _, err := d.keysAPI.Delete(ctx, d.getMetadataKey(node), nil); err != nil && !client.IsKeyNotFound(err) {
+		return err
+	}
+	d.mu.Lock()
+	delete(d.keys, getNodeName(node))
+	d.mu.Unlock()
+	d.forget(node.Rol())
+	return nil
+}
+
+// getWrittenNode returns the key lib's driver wrote for node, or nil if
+// there is none. The key found is remembered, so it is searched for once.
+func (d *etcdRegistryDriver) getWrittenNode(ctx context.Context, node lib.RegistryNode) (*client.Node, error) {
+	name := getNodeName(node)
+	d.mu.Lock()
+	key, ok := d.keys[name]
+	d.mu.Unlock()
+	if ok {
+		res, err := d.keysAPI.Get(ctx, key, nil)
+		if err != nil && !client.IsKeyNotFound(err) {
+			return nil, err
+		}
+		if err == nil && isNodeValue(res.Node.Value, node) {
+			return res.Node, nil
+		}
+	}
+
+	var written *client.Node
+	res, err := d.keysAPI.Get(ctx, d.key, &client.GetOptions{Recursive: true})
+	if err != nil && !client.IsKeyNotFound(err) {
+		return nil, err
+	}
+	if err == nil {
+		written = findNodeValue(res.Node, node)
+	}
+	d.mu.Lock()
+	if written != nil {
+		d.keys[name] = written.Key
+	} else {
+		delete(d.keys, name)
+	}
+	d.mu.Unlock()
+	return written, nil
+}
+
+// findNodeValue returns the key under n holding node.
+func findNodeValue(n *client.Node, node lib.RegistryNode) *client.Node {
+	if !n.Dir {
+		if isNodeValue(n.Value, node) {
+			return n
+		}
+		return nil
+	}
+	for _, child := range n.Nodes {
+		if found := findNodeValue(child, node); found != nil {
+			return found
+		}
+	}
+	return nil
+}
+
+// isNodeValue tells whether value is a JSON object holding the id, the role
+// and the url of node, whatever the names of its fields.
+func isNodeValue(value string, node lib.RegistryNode) bool {
+	fields := map[string]interface{}{}
+	if err := json.Unmarshal([]byte(value), &fields); err != nil {
+		return false
+	}
+	values := map[string]bool{}
+	for _, v := range fields {
+		if s, ok := v.(string); ok {
+			values[s] = true
+		}
+	}
+	return values[node.ID()] && values[node.Rol()] && values[node.URL()]
+}
+
+func getNodeName(node lib.RegistryNode) string {
+	return node.Rol() + "/" + node.ID()
+}
+
+func (d *etcdRegistryDriver) getMetadataKey(node lib.RegistryNode) string {
+	return path.Join(d.key+"-metadata", node.Rol(), node.ID())
+}
+
+func (d *etcdRegistryDriver) forget(rol string) {
+	d.mu.Lock()
+	delete(d.cache, rol)
+	d.mu.Unlock()
+}
+
+func (d *etcdRegistryDriver) GetNodesForRol(ctx context.Context, rol string) ([]lib.RegistryNode, error) {
+	d.mu.Lock()
+	entry, ok := d.cache[rol]
+	d.mu.Unlock()
+	if ok && time.Now().Before(entry.expires) {
+		return entry.nodes, nil
+	}
+
+	nodes, err := d.getNodes(ctx, rol)
+	if err != nil {
+		if ok {
+			// better the last known nodes than none while etcd is unreachable
+			d.logger.Warn().Log("msg", "error getting nodes, using expired ones", "rol", rol, "error", err)
+			return entry.nodes, nil
+		}
+		return nil, err
+	}
+	d.mu.Lock()
+	d.cache[rol] = &etcdRegistryEntry{nodes: nodes, expires: time.Now().Add(etcdRegistryCacheTTL)}
+	d.mu.Unlock()
+	return nodes, nil
+}
+
+// getNodes returns the nodes of rol read by lib's driver with their metadata.
+// Nodes registered by previous versions of clawiod have none.
+func (d *etcdRegistryDriver) getNodes(ctx context.Context, rol string) ([]lib.RegistryNode, error) {
+	found, err := d.RegistryDriver.GetNodesForRol(ctx, rol)
+	if err != nil {
+		return nil, err
+	}
+	metadata := map[string]map[string]string{}
+	res, err := d.keysAPI.Get(ctx, path.Join(d.key+"-metadata", rol), &client.GetOptions{Recursive: true})
+	if err != nil && !client.IsKeyNotFound(err) {
+		return nil, err
+	}
+	if err == nil {
+		for _, n := range res.Node.Nodes {
+			m := map[string]string{}
+			if n.Dir || json.Unmarshal([]byte(n.Value), &m) != nil {
+				d.logger.Warn().Log("msg", "ignoring key that is not node metadata", "key", n.Key)
+				continue
+			}
+			metadata[path.Base(n.Key)] = m
+		}
+	}
+	nodes := []lib.RegistryNode{}
+	for _, n := range found {
+		nodes = append(nodes, &node{
+			xid:       n.ID(),
+			xrol:      n.Rol(),
+			xhost:     n.Host(),
+			xurl:      n.URL(),
+			xversion:  n.Version(),
+			xmetadata: metadata[n.ID()],
+		})
+	}
+	return nodes, nil
+}
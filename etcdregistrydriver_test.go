@@ -0,0 +1,460 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/clawio/lib"
+	"github.com/clawio/lib/etcdregistrydriver"
+	"github.com/coreos/etcd/client"
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/levels"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeEtcd is an in-process stand-in for the keys API of etcd v2,
+// enough for the registry driver and the configuration source.
+type fakeEtcd struct {
+	*httptest.Server
+
+	mu      sync.Mutex
+	index   uint64
+	keys    map[string]*fakeEtcdKey
+	events  []*fakeEtcdEvent
+	changed chan struct{} // closed on every change
+	down    bool          // answer 503 to every request
+	gets    int
+}
+
+type fakeEtcdKey struct {
+	value string
+	ttl   int64
+	index uint64
+}
+
+type fakeEtcdEvent struct {
+	action string
+	key    string
+	index  uint64
+}
+
+// fakeEtcdNode is a node as serialized by etcd.
+type fakeEtcdNode struct {
+	Key           string          `json:"key"`
+	Value         string          `json:"value,omitempty"`
+	Dir           bool            `json:"dir,omitempty"`
+	Nodes         []*fakeEtcdNode `json:"nodes,omitempty"`
+	TTL           int64           `json:"ttl,omitempty"`
+	CreatedIndex  uint64          `json:"createdIndex"`
+	ModifiedIndex uint64          `json:"modifiedIndex"`
+}
+
+func newFakeEtcd() *fakeEtcd {
+	e := &fakeEtcd{keys: map[string]*fakeEtcdKey{}, changed: make(chan struct{})}
+	e.Server = httptest.NewServer(http.HandlerFunc(e.serveHTTP))
+	return e
+}
+
+func (e *fakeEtcd) set(key, value string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.write("set", key, &fakeEtcdKey{value: value})
+}
+
+func (e *fakeEtcd) get(key string) (*fakeEtcdKey, bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	k, ok := e.keys[key]
+	return k, ok
+}
+
+// setDown makes etcd unavailable, failing the watches in progress, or available again.
+func (e *fakeEtcd) setDown(down bool) {
+	e.mu.Lock()
+	e.down = down
+	close(e.changed)
+	e.changed = make(chan struct{})
+	e.mu.Unlock()
+}
+
+func (e *fakeEtcd) getCount() int {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.gets
+}
+
+// write must be called with e.mu held.
+func (e *fakeEtcd) write(action, key string, k *fakeEtcdKey) {
+	e.index++
+	if k == nil {
+		delete(e.keys, key)
+	} else {
+		k.index = e.index
+		e.keys[key] = k
+	}
+	e.events = append(e.events, &fakeEtcdEvent{action: action, key: key, index: e.index})
+	close(e.changed)
+	e.changed = make(chan struct{})
+}
+
+func (e *fakeEtcd) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	if !strings.HasPrefix(r.URL.Path, "/v2/keys") {
+		http.NotFound(w, r)
+		return
+	}
+	key := "/" + strings.Trim(strings.TrimPrefix(r.URL.Path, "/v2/keys"), "/")
+	r.ParseForm()
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.down {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	switch {
+	case r.Method == "GET" && r.Form.Get("wait") == "true":
+		e.watch(w, r, key)
+	case r.Method == "GET":
+		e.gets++
+		node := e.getNode(key)
+		if node == nil {
+			e.notFound(w, key)
+			return
+		}
+		e.reply(w, http.StatusOK, "get", node)
+	case r.Method == "PUT":
+		k := &fakeEtcdKey{value: r.Form.Get("value")}
+		if ttl := r.Form.Get("ttl"); ttl != "" {
+			k.ttl, _ = strconv.ParseInt(ttl, 10, 64)
+		}
+		e.write("set", key, k)
+		e.reply(w, http.StatusOK, "set", &fakeEtcdNode{Key: key, Value: k.value, TTL: k.ttl, ModifiedIndex: k.index})
+	case r.Method == "DELETE":
+		if _, ok := e.keys[key]; !ok {
+			e.notFound(w, key)
+			return
+		}
+		e.write("delete", key, nil)
+		e.reply(w, http.StatusOK, "delete", &fakeEtcdNode{Key: key, ModifiedIndex: e.index})
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// getNode returns key or the directory of the keys under it.
+// It must be called with e.mu held.
+func (e *fakeEtcd) getNode(key string) *fakeEtcdNode {
+	if k, ok := e.keys[key]; ok {
+		return &fakeEtcdNode{Key: key, Value: k.value, TTL: k.ttl, ModifiedIndex: k.index}
+	}
+	children := map[string]bool{}
+	prefix := strings.TrimSuffix(key, "/") + "/"
+	for k := range e.keys {
+		if strings.HasPrefix(k, prefix) {
+			children[prefix+strings.SplitN(strings.TrimPrefix(k, prefix), "/", 2)[0]] = true
+		}
+	}
+	if len(children) == 0 {
+		return nil
+	}
+	dir := &fakeEtcdNode{Key: key, Dir: true}
+	names := []string{}
+	for child := range children {
+		names = append(names, child)
+	}
+	sort.Strings(names)
+	for _, child := range names {
+		dir.Nodes = append(dir.Nodes, e.getNode(child))
+	}
+	return dir
+}
+
+// watch answers with the first change under key from waitIndex on,
+// waiting for it if needed. It must be called with e.mu held.
+func (e *fakeEtcd) watch(w http.ResponseWriter, r *http.Request, key string) {
+	waitIndex, _ := strconv.ParseUint(r.Form.Get("waitIndex"), 10, 64)
+	if waitIndex == 0 {
+		waitIndex = e.index + 1
+	}
+	for {
+		for _, ev := range e.events {
+			if ev.index >= waitIndex && (ev.key == key || strings.HasPrefix(ev.key, key+"/")) {
+				e.reply(w, http.StatusOK, ev.action, &fakeEtcdNode{Key: ev.key, ModifiedIndex: ev.index})
+				return
+			}
+		}
+		changed := e.changed
+		e.mu.Unlock()
+		select {
+		case <-changed:
+			e.mu.Lock()
+			if e.down {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+		case <-r.Context().Done():
+			e.mu.Lock()
+			return
+		}
+	}
+}
+
+func (e *fakeEtcd) notFound(w http.ResponseWriter, key string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Etcd-Index", fmt.Sprint(e.index))
+	w.WriteHeader(http.StatusNotFound)
+	fmt.Fprintf(w, `{"errorCode": 100, "message": "Key not found", "cause": %q, "index": %d}`, key, e.index)
+}
+
+func (e *fakeEtcd) reply(w http.ResponseWriter, code int, action string, node *fakeEtcdNode) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Etcd-Index", fmt.Sprint(e.index))
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(map[string]interface{}{"action": action, "node": node})
+}
+
+// newTestETCDRegistryDriver wraps lib's etcd registry driver writing to e.
+func newTestETCDRegistryDriver(t *testing.T, e *fakeEtcd) *etcdRegistryDriver {
+	return newETCDRegistryDriverWith(newTestLibETCDRegistryDriver(t, e), levels.New(log.NewNopLogger()),
+		"/clawio/nodes", 15*time.Second, newTestEtcdKeysAPI(t, e))
+}
+
+// newTestLibETCDRegistryDriver returns the driver of lib, as run by previous versions of clawiod.
+func newTestLibETCDRegistryDriver(t *testing.T, e *fakeEtcd) lib.RegistryDriver {
+	d, err := etcdregistrydriver.New(levels.New(log.NewNopLogger()), e.URL, "/clawio/nodes", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
+
+func newTestEtcdKeysAPI(t *testing.T, e *fakeEtcd) client.KeysAPI {
+	keysAPI, err := getEtcdKeysAPI(e.URL, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return keysAPI
+}
+
+// getValues returns the keys of e under prefix and their values.
+func (e *fakeEtcd) getValues(prefix string) map[string]string {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	values := map[string]string{}
+	for key, k := range e.keys {
+		if strings.HasPrefix(key, prefix+"/") {
+			values[key] = k.value
+		}
+	}
+	return values
+}
+
+var testETCDNodes = []*node{
+	{xid: "data1:1502", xrol: "data-node", xhost: "data1:1502", xurl: "http://data1:1502", xversion: "1.3.0",
+		xmetadata: map[string]string{"data_driver": "fsdatadriver", "registered": "2017-03-01T10:00:00Z"}},
+	{xid: "data2:1502", xrol: "data-node", xhost: "data2:1502", xurl: "https://data2:1502/api", xversion: "1.3.0"},
+	{xid: "data1:1502", xrol: "data-node-proxy", xhost: "data1:1502", xurl: "http://data1:1502", xversion: "1.3.0"},
+}
+
+func TestETCDRegistryDriverRegisterKeepsLibFormat(t *testing.T) {
+	ctx := context.Background()
+	// the same nodes registered by a previous version of clawiod
+	old := newFakeEtcd()
+	defer old.Close()
+	oldDriver := newTestLibETCDRegistryDriver(t, old)
+	e := newFakeEtcd()
+	defer e.Close()
+	d := newTestETCDRegistryDriver(t, e)
+	for _, n := range testETCDNodes {
+		if err := oldDriver.Register(ctx, n); err != nil {
+			t.Fatal(err)
+		}
+		if err := d.Register(ctx, n); err != nil {
+			t.Fatalf("Register(%s) = %s", n.ID(), err)
+		}
+	}
+
+	want := old.getValues("/clawio/nodes")
+	if got := e.getValues("/clawio/nodes"); !reflect.DeepEqual(got, want) {
+		t.Fatalf("keys written = %v, want the ones of lib's driver %v", got, want)
+	}
+	for key := range want {
+		if k, _ := e.get(key); k.ttl != 15 {
+			t.Errorf("key %s has TTL %d, want the heartbeat TTL 15", key, k.ttl)
+		}
+	}
+
+	// previous versions read the nodes
+	for _, n := range testETCDNodes {
+		nodes, err := newTestLibETCDRegistryDriver(t, e).GetNodesForRol(ctx, n.Rol())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !containsNode(nodes, n) {
+			t.Errorf("lib's driver does not read node %s of %s", n.ID(), n.Rol())
+		}
+	}
+}
+
+func containsNode(nodes []lib.RegistryNode, n lib.RegistryNode) bool {
+	for _, found := range nodes {
+		if found.ID() == n.ID() && found.Rol() == n.Rol() && found.URL() == n.URL() &&
+			found.Host() == n.Host() && found.Version() == n.Version() {
+			return true
+		}
+	}
+	return false
+}
+
+func TestETCDRegistryDriverGetNodesForRol(t *testing.T) {
+	ctx := context.Background()
+	e := newFakeEtcd()
+	defer e.Close()
+	d := newTestETCDRegistryDriver(t, e)
+	for _, n := range testETCDNodes {
+		if err := d.Register(ctx, n); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// a node registered by a previous version of clawiod
+	oldNode := &node{xid: "data3:1502", xrol: "data-node", xhost: "data3:1502", xurl: "http://data3:1502", xversion: "1.2.3"}
+	if err := newTestLibETCDRegistryDriver(t, e).Register(ctx, oldNode); err != nil {
+		t.Fatal(err)
+	}
+	// keys that are not metadata are ignored
+	e.set("/clawio/nodes-metadata/data-node/data4:1502", "not json")
+
+	for _, want := range append(testETCDNodes, oldNode) {
+		nodes, err := d.GetNodesForRol(ctx, want.Rol())
+		if err != nil {
+			t.Fatal(err)
+		}
+		var found lib.RegistryNode
+		for _, n := range nodes {
+			if n.ID() == want.ID() {
+				found = n
+			}
+		}
+		if found == nil || !containsNode(nodes, want) {
+			t.Fatalf("GetNodesForRol(%s) = %v, want node %s", want.Rol(), nodes, want.ID())
+		}
+		if got := found.(registryNodeMetadata).Metadata(); !reflect.DeepEqual(got, want.xmetadata) {
+			t.Errorf("node %s of %s has metadata %v, want %v", want.ID(), want.Rol(), got, want.xmetadata)
+		}
+	}
+}
+
+func TestETCDRegistryDriverUnregister(t *testing.T) {
+	e := newFakeEtcd()
+	defer e.Close()
+	d := newTestETCDRegistryDriver(t, e)
+	ctx := context.Background()
+
+	n := testETCDNodes[0]
+	if err := d.Register(ctx, n); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Register(ctx, testETCDNodes[1]); err != nil {
+		t.Fatal(err)
+	}
+	if nodes, _ := d.GetNodesForRol(ctx, "data-node"); len(nodes) != 2 {
+		t.Fatalf("GetNodesForRol() returns %d nodes, want 2", len(nodes))
+	}
+	// a new driver, as run by registry rm, finds the key of the node
+	for _, unregisterer := range []*etcdRegistryDriver{d, newTestETCDRegistryDriver(t, e)} {
+		if err := unregisterer.Unregister(ctx, n); err != nil {
+			t.Fatalf("Unregister() = %s", err)
+		}
+		nodes, err := newTestLibETCDRegistryDriver(t, e).GetNodesForRol(ctx, "data-node")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if containsNode(nodes, n) || !containsNode(nodes, testETCDNodes[1]) {
+			t.Fatalf("nodes after Unregister() = %v, want only %s", nodes, testETCDNodes[1].ID())
+		}
+		if _, ok := e.get("/clawio/nodes-metadata/data-node/data1:1502"); ok {
+			t.Fatal("Unregister() did not delete the metadata")
+		}
+		if err := d.Register(ctx, n); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := d.Unregister(ctx, n); err != nil {
+		t.Fatal(err)
+	}
+	// the cached nodes of the role are forgotten
+	if nodes, _ := d.GetNodesForRol(ctx, "data-node"); len(nodes) != 1 {
+		t.Fatalf("GetNodesForRol() returns %d nodes after Unregister, want 1", len(nodes))
+	}
+	if err := d.Unregister(ctx, n); err != nil {
+		t.Fatalf("Unregister() of an expired node = %s, want nil", err)
+	}
+}
+
+func TestIsNodeValue(t *testing.T) {
+	n := &node{xid: "data1:1502", xrol: "data-node", xurl: "http://data1:1502"}
+	tests := []struct {
+		value string
+		want  bool
+	}{
+		{`{"id": "data1:1502", "rol": "data-node", "url": "http://data1:1502"}`, true},
+		{`{"ID": "data1:1502", "Rol": "data-node", "Host": "data1:1502", "URL": "http://data1:1502"}`, true},
+		{`{"id": "data1:1502", "rol": "data-node-proxy", "url": "http://data1:1502"}`, false},
+		{`{"id": "data2:1502", "rol": "data-node", "url": "http://data2:1502"}`, false},
+		{`{"id": "data1:1502", "rol": "data-node"}`, false},
+		{`"data1:1502 data-node http://data1:1502"`, false},
+		{`not json`, false},
+	}
+	for _, tt := range tests {
+		if got := isNodeValue(tt.value, n); got != tt.want {
+			t.Errorf("isNodeValue(%s) = %t, want %t", tt.value, got, tt.want)
+		}
+	}
+}
+
+// countingRegistryDriver counts the lookups of the nodes.
+type countingRegistryDriver struct {
+	staticRegistryDriver
+	gets int
+}
+
+func (d *countingRegistryDriver) GetNodesForRol(ctx context.Context, rol string) ([]lib.RegistryNode, error) {
+	d.gets++
+	return d.staticRegistryDriver.GetNodesForRol(ctx, rol)
+}
+
+func TestETCDRegistryDriverCache(t *testing.T) {
+	e := newFakeEtcd()
+	defer e.Close()
+	inner := &countingRegistryDriver{staticRegistryDriver: staticRegistryDriver{newTestNodes("http://a:1502")}}
+	d := newETCDRegistryDriverWith(inner, levels.New(log.NewNopLogger()), "/clawio/nodes", 15*time.Second, newTestEtcdKeysAPI(t, e))
+	ctx := context.Background()
+
+	for i := 0; i < 3; i++ {
+		if nodes, err := d.GetNodesForRol(ctx, "data-node"); err != nil || len(nodes) != 1 {
+			t.Fatalf("GetNodesForRol() = %d nodes, %v, want 1 node", len(nodes), err)
+		}
+	}
+	if inner.gets != 1 || e.getCount() != 1 {
+		t.Errorf("nodes were read %d times and their metadata %d times, want 1", inner.gets, e.getCount())
+	}
+
+	// once expired the last known nodes are used while etcd is down
+	d.cache["data-node"].expires = time.Now()
+	e.setDown(true)
+	nodes, err := d.GetNodesForRol(ctx, "data-node")
+	if err != nil || len(nodes) != 1 {
+		t.Fatalf("GetNodesForRol() with etcd down = %d nodes, %v, want the stale node", len(nodes), err)
+	}
+	if _, err := d.GetNodesForRol(ctx, "metadata-node"); err == nil {
+		t.Fatal("GetNodesForRol() of a role never resolved with etcd down = nil, want an error")
+	}
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/clawio/lib"
+	"io/ioutil"
+)
+
+// fileConfigurationSource loads the configuration from a json file.
+type fileConfigurationSource struct {
+	path string
+}
+
+func newFileConfigurationSource(path string) (*fileConfigurationSource, error) {
+	return &fileConfigurationSource{path: path}, nil
+}
+
+func (s *fileConfigurationSource) LoadConfiguration() (lib.Configuration, error) {
+	settings, err := s.loadSettings()
+	if err != nil {
+		return nil, err
+	}
+	return newConfiguration(settings)
+}
+
+func (s *fileConfigurationSource) loadSettings() (map[string]interface{}, error) {
+	data, err := ioutil.ReadFile(s.path)
+	if err != nil {
+		return nil, err
+	}
+	settings := map[string]interface{}{}
+	if err := json.Unmarshal(data, &settings); err != nil {
+		return nil, err
+	}
+	return settings, nil
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFileConfigurationSource(t *testing.T) {
+	dir, err := ioutil.TempDir("", "clawiod")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		name    string
+		content string
+		port    int
+		isErr   bool
+	}{
+		{"valid", `{"port": 1502, "enabled_web_services": "data"}`, 1502, false},
+		{"unknown settings are ignored", `{"port": 1503, "no_such_setting": true}`, 1503, false},
+		{"invalid json", `{"port": `, 0, true},
+		{"wrong type", `{"port": "1502"}`, 0, true},
+		{"missing file", "", 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(dir, "missing.json")
+			if tt.content != "" {
+				path = filepath.Join(dir, filepath.Base(t.Name())+".json")
+				if err := ioutil.WriteFile(path, []byte(tt.content), 0600); err != nil {
+					t.Fatal(err)
+				}
+			}
+			s, err := newFileConfigurationSource(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			c, err := s.LoadConfiguration()
+			if tt.isErr {
+				if err == nil {
+					t.Fatal("LoadConfiguration() = nil error, want one")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if port := c.(*configuration).GetPort(); port != tt.port {
+				t.Fatalf("port = %d, want %d", port, tt.port)
+			}
+		})
+	}
+}
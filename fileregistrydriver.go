@@ -0,0 +1,223 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/clawio/clawiod/drivers"
+	"github.com/clawio/lib"
+	"github.com/go-kit/kit/log/levels"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// fileRegistryDriver is a registry driver for small clusters without etcd.
+// Nodes are defined in a json or yaml file, chosen by its extension, and the
+// file is polled so nodes can be added or removed without restarting:
+//
+//	# nodes.yaml
+//	- id: data1:1502
+//	  role: data-node
+//	  url: http://data1:1502
+//	  version: 1.3.0
+//	  metadata:
+//	    region: eu-west
+//
+// The same nodes in nodes.json:
+//
+//	[{"id": "data1:1502", "role": "data-node", "url": "http://data1:1502", "version": "1.3.0"}]
+//
+// Nodes do not register themselves, the file is the only source of truth.
+type fileRegistryDriver struct {
+	logger   levels.Levels
+	filename string
+
+	mu      sync.RWMutex
+	nodes   []*node
+	modTime time.Time
+	size    int64
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// fileRegistryNode is a node as it is written in the file.
+type fileRegistryNode struct {
+	ID       string            `json:"id" yaml:"id"`
+	Role     string            `json:"role" yaml:"role"`
+	URL      string            `json:"url" yaml:"url"`
+	Version  string            `json:"version" yaml:"version"`
+	Metadata map[string]string `json:"metadata" yaml:"metadata"`
+}
+
+func newFileRegistryDriver(c drivers.Components) (lib.RegistryDriver, error) {
+	config, ok := c.Config().(*configuration)
+	if !ok {
+		return nil, errors.New("file registry driver needs a configuration loaded by clawiod")
+	}
+	logger, err := c.Logger()
+	if err != nil {
+		return nil, err
+	}
+	if config.GetFileRegistryDriverFile() == "" {
+		return nil, errors.New("file registry driver file is empty")
+	}
+	d := &fileRegistryDriver{
+		logger:   logger.With("pkg", "fileregistrydriver"),
+		filename: config.GetFileRegistryDriverFile(),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	if _, err := d.load(); err != nil {
+		return nil, err
+	}
+	go d.poll(config.GetFileRegistryDriverPollInterval())
+	return d, nil
+}
+
+// errFileRegistryReadOnly is returned when nodes are added or removed
+// through the file registry driver.
+var errFileRegistryReadOnly = errors.New("file registry driver is read-only, nodes are defined in the file")
+
+// Register fails, nodes are defined in the file.
+func (d *fileRegistryDriver) Register(ctx context.Context, node lib.RegistryNode) error {
+	return errFileRegistryReadOnly
+}
+
+// Unregister fails, nodes are removed from the file.
+func (d *fileRegistryDriver) Unregister(ctx context.Context, node lib.RegistryNode) error {
+	return errFileRegistryReadOnly
+}
+
+// IsReadOnly reports that nodes can not be removed through the driver.
+func (d *fileRegistryDriver) IsReadOnly() bool {
+	return true
+}
+
+func (d *fileRegistryDriver) GetNodesForRol(ctx context.Context, rol string) ([]lib.RegistryNode, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	nodes := []lib.RegistryNode{}
+	for _, n := range d.nodes {
+		if n.Rol() == rol {
+			nodes = append(nodes, n)
+		}
+	}
+	return nodes, nil
+}
+
+// GetNodes returns the nodes of every role.
+func (d *fileRegistryDriver) GetNodes(ctx context.Context) ([]lib.RegistryNode, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	nodes := []lib.RegistryNode{}
+	for _, n := range d.nodes {
+		nodes = append(nodes, n)
+	}
+	return nodes, nil
+}
+
+// Close stops polling the file.
+func (d *fileRegistryDriver) Close() error {
+	close(d.stop)
+	<-d.done
+	return nil
+}
+
+func (d *fileRegistryDriver) poll(interval time.Duration) {
+	defer close(d.done)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			changed, err := d.load()
+			if err != nil {
+				// keep the nodes we know while the file is being edited
+				d.logger.Error().Log("msg", "error loading nodes, keeping the previous ones", "file", d.filename, "error", err)
+				continue
+			}
+			if changed {
+				d.mu.RLock()
+				d.logger.Info().Log("msg", "nodes reloaded", "file", d.filename, "nodes", len(d.nodes))
+				d.mu.RUnlock()
+			}
+		case <-d.stop:
+			return
+		}
+	}
+}
+
+// load reads the file if it changed since the last time it was read.
+// The nodes are replaced only if the whole file is valid.
+func (d *fileRegistryDriver) load() (bool, error) {
+	info, err := os.Stat(d.filename)
+	if err != nil {
+		return false, err
+	}
+	d.mu.RLock()
+	unchanged := info.ModTime().Equal(d.modTime) && info.Size() == d.size
+	d.mu.RUnlock()
+	if unchanged {
+		return false, nil
+	}
+
+	nodes, err := readFileRegistryNodes(d.filename)
+	if err != nil {
+		return false, err
+	}
+	d.mu.Lock()
+	d.nodes = nodes
+	d.modTime = info.ModTime()
+	d.size = info.Size()
+	d.mu.Unlock()
+	return true, nil
+}
+
+func readFileRegistryNodes(filename string) ([]*node, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	definitions := []*fileRegistryNode{}
+	switch filepath.Ext(filename) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, &definitions)
+	default:
+		err = json.Unmarshal(data, &definitions)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", filename, err)
+	}
+
+	nodes := []*node{}
+	ids := map[string]bool{}
+	for i, def := range definitions {
+		if def.ID == "" || def.Role == "" || def.URL == "" {
+			return nil, fmt.Errorf("%s: node %d must have an id, a role and a url", filename, i)
+		}
+		u, err := url.Parse(def.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("%s: node %q has an invalid url %q", filename, def.ID, def.URL)
+		}
+		if ids[def.Role+"/"+def.ID] {
+			return nil, fmt.Errorf("%s: node %q is defined twice for role %q", filename, def.ID, def.Role)
+		}
+		ids[def.Role+"/"+def.ID] = true
+		nodes = append(nodes, &node{
+			xid:       def.ID,
+			xrol:      def.Role,
+			xhost:     u.Host,
+			xurl:      def.URL,
+			xversion:  def.Version,
+			xmetadata: def.Metadata,
+		})
+	}
+	return nodes, nil
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/levels"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testFileRegistryNodesYAML = `- id: data1:1502
+  role: data-node
+  url: http://data1:1502
+  version: 1.3.0
+  metadata:
+    region: eu-west
+- id: auth1:1502
+  role: authentication-node
+  url: https://auth1:1502
+`
+
+const testFileRegistryNodesJSON = `[
+  {"id": "data1:1502", "role": "data-node", "url": "http://data1:1502", "version": "1.3.0", "metadata": {"region": "eu-west"}},
+  {"id": "auth1:1502", "role": "authentication-node", "url": "https://auth1:1502"}
+]`
+
+func TestReadFileRegistryNodes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "clawiod-fileregistrydriver")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		name     string
+		filename string
+		data     string
+		err      string
+	}{
+		{"yaml", "nodes.yaml", testFileRegistryNodesYAML, ""},
+		{"yml", "nodes.yml", testFileRegistryNodesYAML, ""},
+		{"json", "nodes.json", testFileRegistryNodesJSON, ""},
+		{"invalid json", "invalid.json", `[{"id": "data1:1502"`, "invalid.json"},
+		{"invalid yaml", "invalid.yaml", "- id: [data1", "invalid.yaml"},
+		{"missing role", "norole.json", `[{"id": "data1:1502", "url": "http://data1:1502"}]`, "must have an id, a role and a url"},
+		{"duplicate id", "duplicate.json", `[
+			{"id": "data1:1502", "role": "data-node", "url": "http://data1:1502"},
+			{"id": "data1:1502", "role": "data-node", "url": "http://data2:1502"}
+		]`, `node "data1:1502" is defined twice for role "data-node"`},
+		{"bad url", "badurl.json", `[{"id": "data1:1502", "role": "data-node", "url": "http://[::1"}]`, `invalid url "http://[::1"`},
+		{"url without scheme", "noscheme.json", `[{"id": "data1:1502", "role": "data-node", "url": "data1:1502"}]`, "invalid url"},
+		{"url without host", "nohost.json", `[{"id": "data1:1502", "role": "data-node", "url": "http:///data"}]`, "invalid url"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			filename := filepath.Join(dir, tt.filename)
+			if err := ioutil.WriteFile(filename, []byte(tt.data), 0600); err != nil {
+				t.Fatal(err)
+			}
+			nodes, err := readFileRegistryNodes(filename)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("readFileRegistryNodes() = %v, want an error with %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := []*node{
+				{xid: "data1:1502", xrol: "data-node", xhost: "data1:1502", xurl: "http://data1:1502", xversion: "1.3.0",
+					xmetadata: map[string]string{"region": "eu-west"}},
+				{xid: "auth1:1502", xrol: "authentication-node", xhost: "auth1:1502", xurl: "https://auth1:1502"},
+			}
+			if !reflect.DeepEqual(nodes, want) {
+				t.Fatalf("readFileRegistryNodes() = %+v, want %+v", nodes, want)
+			}
+		})
+	}
+}
+
+func TestNewFileRegistryDriver(t *testing.T) {
+	if _, err := newFileRegistryDriver(newContainer(&configuration{})); err == nil {
+		t.Fatal("newFileRegistryDriver() without file = nil error, want one")
+	}
+	if _, err := newFileRegistryDriver(newContainer(&configuration{FileRegistryDriverFile: "/nonexistent/nodes.json"})); err == nil {
+		t.Fatal("newFileRegistryDriver() with a missing file = nil error, want one")
+	}
+}
+
+func TestFileRegistryDriverReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "clawiod-fileregistrydriver")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "nodes.json")
+	modTime := time.Now().Add(-time.Hour)
+	writeTestFile(t, filename, []byte(testFileRegistryNodesJSON), modTime)
+
+	d := &fileRegistryDriver{
+		logger:   levels.New(log.NewNopLogger()),
+		filename: filename,
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	if _, err := d.load(); err != nil {
+		t.Fatal(err)
+	}
+	go d.poll(10 * time.Millisecond)
+	defer d.Close()
+
+	getURLs := func() []string {
+		nodes, err := d.GetNodesForRol(context.Background(), "data-node")
+		if err != nil {
+			t.Fatal(err)
+		}
+		urls := []string{}
+		for _, n := range nodes {
+			urls = append(urls, n.URL())
+		}
+		return urls
+	}
+	waitURLs := func(want []string) {
+		for i := 0; i < 200 && !reflect.DeepEqual(getURLs(), want); i++ {
+			time.Sleep(5 * time.Millisecond)
+		}
+		if urls := getURLs(); !reflect.DeepEqual(urls, want) {
+			t.Fatalf("GetNodesForRol() = %v, want %v", urls, want)
+		}
+	}
+	waitURLs([]string{"http://data1:1502"})
+	all, err := d.GetNodes(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all) != 2 {
+		t.Fatalf("GetNodes() = %d nodes, want 2", len(all))
+	}
+
+	// an added node is picked up
+	modTime = modTime.Add(time.Minute)
+	writeTestFile(t, filename, []byte(`[
+		{"id": "data1:1502", "role": "data-node", "url": "http://data1:1502"},
+		{"id": "data2:1502", "role": "data-node", "url": "http://data2:1502"}
+	]`), modTime)
+	waitURLs([]string{"http://data1:1502", "http://data2:1502"})
+
+	// an invalid file keeps the previous nodes
+	modTime = modTime.Add(time.Minute)
+	writeTestFile(t, filename, []byte(`[{"id": "data3:1502", "role": "data-node"`), modTime)
+	time.Sleep(50 * time.Millisecond)
+	if urls := getURLs(); !reflect.DeepEqual(urls, []string{"http://data1:1502", "http://data2:1502"}) {
+		t.Fatalf("GetNodesForRol() with an invalid file = %v, want the previous nodes", urls)
+	}
+
+	// a removed node is dropped once the file is valid again
+	modTime = modTime.Add(time.Minute)
+	writeTestFile(t, filename, []byte(`[{"id": "data2:1502", "role": "data-node", "url": "http://data2:1502"}]`), modTime)
+	waitURLs([]string{"http://data2:1502"})
+}
+
+func TestFileRegistryDriverIsReadOnly(t *testing.T) {
+	d := &fileRegistryDriver{}
+	if !d.IsReadOnly() {
+		t.Fatal("IsReadOnly() = false, want true")
+	}
+	if isRegistering(d) {
+		t.Fatal("isRegistering() = true, want false")
+	}
+	n := &node{xid: "data1:1502", xrol: "data-node", xurl: "http://data1:1502"}
+	if err := d.Register(context.Background(), n); err != errFileRegistryReadOnly {
+		t.Fatalf("Register() = %v, want %v", err, errFileRegistryReadOnly)
+	}
+	if err := d.Unregister(context.Background(), n); err != errFileRegistryReadOnly {
+		t.Fatalf("Unregister() = %v, want %v", err, errFileRegistryReadOnly)
+	}
+}
@@ -0,0 +1,424 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/clawio/lib"
+	_ "github.com/go-sql-driver/mysql" // ocfsmdatadriver dsn
+	"gopkg.in/ldap.v2"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// readinessTimeout is the time the readiness probe waits for all the checks.
+const readinessTimeout = time.Second * 5
+
+// readinessTTL is the time the result of the readiness checks is served
+// to the probes that follow, so frequent probes do not load the dependencies.
+const readinessTTL = time.Second * 2
+
+// healthChecker is implemented by drivers able to check their own
+// dependencies, e.g. the SQL database of a metadata driver, with the
+// connections they already have.
+type healthChecker interface {
+	HealthCheck(ctx context.Context) error
+}
+
+// healthCheck probes one dependency of the node.
+type healthCheck struct {
+	name  string
+	check func(ctx context.Context) error
+
+	mu      sync.Mutex
+	running bool
+}
+
+type componentHealth struct {
+	Name      string  `json:"name"`
+	Status    string  `json:"status"`
+	LatencyMS float64 `json:"latency_ms"`
+	Error     string  `json:"error,omitempty"`
+}
+
+type health struct {
+	Status     string            `json:"status"`
+	Components []componentHealth `json:"components,omitempty"`
+}
+
+// handleLiveness reports that the process is up and serving requests.
+func handleLiveness(w http.ResponseWriter, r *http.Request) {
+	writeHealth(w, http.StatusOK, &health{Status: "ok"})
+}
+
+// readinessHandler reports the status of each check. If any fails the
+// node is not ready. Concurrent probes share one run of the checks and
+// its result is served for readinessTTL.
+func readinessHandler(checks []*healthCheck) http.HandlerFunc {
+	rd := &readiness{checks: checks, ttl: readinessTTL}
+	return func(w http.ResponseWriter, r *http.Request) {
+		h, ok := rd.get(r.Context())
+		if !ok {
+			writeHealth(w, http.StatusServiceUnavailable, &health{Status: "fail"})
+			return
+		}
+		code := http.StatusOK
+		if h.Status != "ok" {
+			code = http.StatusServiceUnavailable
+		}
+		writeHealth(w, code, h)
+	}
+}
+
+// readiness runs the readiness checks once for all the probes arriving
+// while they run and caches the result.
+type readiness struct {
+	checks []*healthCheck
+	ttl    time.Duration
+
+	mu      sync.Mutex
+	last    *health
+	checked time.Time
+	running chan struct{}
+}
+
+// get returns the result of the checks, running them if the last result
+// expired. It returns false if ctx is done before they finish.
+func (rd *readiness) get(ctx context.Context) (*health, bool) {
+	rd.mu.Lock()
+	if rd.last != nil && time.Since(rd.checked) < rd.ttl {
+		h := rd.last
+		rd.mu.Unlock()
+		return h, true
+	}
+	if rd.running == nil {
+		rd.running = make(chan struct{})
+		go rd.run(rd.running)
+	}
+	running := rd.running
+	rd.mu.Unlock()
+
+	select {
+	case <-running:
+		rd.mu.Lock()
+		defer rd.mu.Unlock()
+		return rd.last, true
+	case <-ctx.Done():
+		return nil, false
+	}
+}
+
+// run runs all the checks concurrently, it does not depend on the probe
+// that started it.
+func (rd *readiness) run(done chan struct{}) {
+	ctx, cancel := context.WithTimeout(context.Background(), readinessTimeout)
+	defer cancel()
+
+	components := make([]componentHealth, len(rd.checks))
+	var wg sync.WaitGroup
+	for i, c := range rd.checks {
+		wg.Add(1)
+		go func(i int, c *healthCheck) {
+			defer wg.Done()
+			components[i] = runHealthCheck(ctx, c)
+		}(i, c)
+	}
+	wg.Wait()
+
+	h := &health{Status: "ok", Components: components}
+	for _, c := range components {
+		if c.Status != "ok" {
+			h.Status = "fail"
+		}
+	}
+	rd.mu.Lock()
+	rd.last = h
+	rd.checked = time.Now()
+	rd.running = nil
+	rd.mu.Unlock()
+	close(done)
+}
+
+// runHealthCheck runs c and gives up when ctx is done. A check ignoring
+// ctx keeps running, it is not run again until it finishes so checks
+// stuck on a dependency do not pile up.
+func runHealthCheck(ctx context.Context, c *healthCheck) componentHealth {
+	start := time.Now()
+	ch := componentHealth{Name: c.name, Status: "ok"}
+	c.mu.Lock()
+	if c.running {
+		c.mu.Unlock()
+		ch.Status = "fail"
+		ch.Error = "the previous check did not finish"
+		return ch
+	}
+	c.running = true
+	c.mu.Unlock()
+
+	errc := make(chan error, 1)
+	go func() {
+		err := c.check(ctx)
+		c.mu.Lock()
+		c.running = false
+		c.mu.Unlock()
+		errc <- err
+	}()
+	var err error
+	select {
+	case err = <-errc:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	ch.LatencyMS = float64(time.Since(start)) / float64(time.Millisecond)
+	if err != nil {
+		ch.Status = "fail"
+		ch.Error = err.Error()
+	}
+	return ch
+}
+
+func writeHealth(w http.ResponseWriter, code int, h *health) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(h)
+}
+
+// getReadinessChecks returns the checks for the dependencies of the enabled web services.
+func (s *server) getReadinessChecks(c *container, webServices map[string]lib.WebService) ([]*healthCheck, error) {
+	config := c.config
+	checks := map[string]*healthCheck{}
+	add := func(hc *healthCheck) {
+		checks[hc.name] = hc
+	}
+
+	add(&healthCheck{name: "registry", check: s.checkRegistration})
+
+	for key, ws := range webServices {
+		if ws.IsProxy() {
+			add(upstreamCheck(c, key))
+			continue
+		}
+		needs := []string{}
+		switch key {
+		case "authentication", "data", "metadata":
+			needs = append(needs, key)
+		case "owncloud":
+			if config.GetOCWebService() == "remote" {
+				add(upstreamCheck(c, "data"))
+				add(upstreamCheck(c, "metadata"))
+			} else {
+				needs = append(needs, "data", "metadata")
+			}
+			if config.GetBasicAuthMiddleware() == "remote" {
+				add(upstreamCheck(c, "authentication"))
+			} else {
+				needs = append(needs, "authentication")
+			}
+		}
+		for _, need := range needs {
+			var hc *healthCheck
+			var err error
+			switch need {
+			case "authentication":
+				hc, err = userDriverCheck(c)
+			case "data":
+				hc, err = dataDriverCheck(c)
+			case "metadata":
+				hc, err = metaDataDriverCheck(c)
+			}
+			if err != nil {
+				return nil, err
+			}
+			add(hc)
+		}
+	}
+
+	names := []string{}
+	for name := range checks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	sorted := []*healthCheck{}
+	for _, name := range names {
+		sorted = append(sorted, checks[name])
+	}
+	return sorted, nil
+}
+
+// checkRegistration fails if the node is not in the registry.
+func (s *server) checkRegistration(ctx context.Context) error {
+	return s.heartbeat.check(ctx)
+}
+
+// upstreamCheck fails if the registry does not know any node for the web service key.
+func upstreamCheck(c *container, key string) *healthCheck {
+	rol := key + "-node"
+	return &healthCheck{
+		name: "upstream:" + rol,
+		check: func(ctx context.Context) error {
+			registryDriver, err := getRegistryDriver(c)
+			if err != nil {
+				return err
+			}
+			nodes, err := registryDriver.GetNodesForRol(ctx, rol)
+			if err != nil {
+				return err
+			}
+			if len(nodes) == 0 {
+				return fmt.Errorf("no nodes registered for %s", rol)
+			}
+			return nil
+		},
+	}
+}
+
+func userDriverCheck(c *container) (*healthCheck, error) {
+	config := c.config
+	userDriver, err := getUserDriver(c)
+	if err != nil {
+		return nil, err
+	}
+	name := "userdriver:" + config.GetUserDriver()
+	if checker, ok := userDriver.(healthChecker); ok {
+		return &healthCheck{name: name, check: checker.HealthCheck}, nil
+	}
+	if config.GetUserDriver() != "ldapuserdriver" {
+		return &healthCheck{name: name, check: func(ctx context.Context) error { return nil }}, nil
+	}
+	addr := fmt.Sprintf("%s:%d", config.GetLDAPUserDriverHostname(), config.GetLDAPUserDriverPort())
+	return &healthCheck{
+		name: name,
+		check: func(ctx context.Context) error {
+			return checkLDAPBind(ctx, addr, config.GetLDAPUserDriverBindUsername(), config.GetLDAPUserDriverBindPassword())
+		},
+	}, nil
+}
+
+// checkLDAPBind binds to the LDAP server at addr, giving up when ctx is done.
+func checkLDAPBind(ctx context.Context, addr, username, password string) error {
+	dialer := &net.Dialer{}
+	nc, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return err
+	}
+	conn := ldap.NewConn(nc, false)
+	conn.Start()
+	defer conn.Close()
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			// the bind fails when the connection is closed
+			conn.Close()
+		case <-done:
+		}
+	}()
+	if err := conn.Bind(username, password); err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return err
+	}
+	return nil
+}
+
+func dataDriverCheck(c *container) (*healthCheck, error) {
+	config := c.config
+	var folders []string
+	switch config.GetDataDriver() {
+	case "fsdatadriver":
+		folders = []string{config.GetFSDataDriverDataFolder(), config.GetFSDataDriverTemporaryFolder()}
+	case "ocfsdatadriver":
+		folders = []string{
+			config.GetOCFSDataDriverDataFolder(),
+			config.GetOCFSDataDriverTemporaryFolder(),
+			config.GetOCFSDataDriverChunksFolder()}
+	}
+	dataDriver, err := getDataDriver(c)
+	if err != nil {
+		return nil, err
+	}
+	return driverCheck("datadriver:"+config.GetDataDriver(), dataDriver, folders), nil
+}
+
+func metaDataDriverCheck(c *container) (*healthCheck, error) {
+	config := c.config
+	var folders []string
+	var deps []func(ctx context.Context) error
+	switch config.GetMetaDataDriver() {
+	case "fsmdatadriver":
+		folders = []string{config.GetFSMDataDriverDataFolder(), config.GetFSMDataDriverTemporaryFolder()}
+	case "ocfsmdatadriver":
+		folders = []string{config.GetOCFSMDataDriverDataFolder(), config.GetOCFSMDataDriverTemporaryFolder()}
+		dsn := config.GetOCFSMDataDriverDSN()
+		deps = append(deps, func(ctx context.Context) error { return checkSQL(ctx, "mysql", dsn) })
+	}
+	metaDataDriver, err := getMetaDataDriver(c)
+	if err != nil {
+		return nil, err
+	}
+	return driverCheck("metadatadriver:"+config.GetMetaDataDriver(), metaDataDriver, folders, deps...), nil
+}
+
+// driverCheck checks that the folders of a driver can be written, that
+// its dependencies are reachable and, if the driver implements
+// healthChecker, the rest of its dependencies.
+func driverCheck(name string, driver interface{}, folders []string, deps ...func(ctx context.Context) error) *healthCheck {
+	return &healthCheck{
+		name: name,
+		check: func(ctx context.Context) error {
+			if err := checkWritableFolders(folders); err != nil {
+				return err
+			}
+			for _, dep := range deps {
+				if err := dep(ctx); err != nil {
+					return err
+				}
+			}
+			if checker, ok := driver.(healthChecker); ok {
+				return checker.HealthCheck(ctx)
+			}
+			return nil
+		},
+	}
+}
+
+// checkSQL pings the database at dsn with a connection opened for the
+// check, so the probe never takes one from the pool of the driver.
+func checkSQL(ctx context.Context, driverName, dsn string) error {
+	db, err := sql.Open(driverName, dsn)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+	return db.PingContext(ctx)
+}
+
+// checkWritableFolders fails if any of the folders can not be written.
+func checkWritableFolders(folders []string) error {
+	problems := []string{}
+	for _, folder := range folders {
+		fd, err := ioutil.TempFile(folder, ".clawiod-ready-")
+		if err != nil {
+			problems = append(problems, err.Error())
+			continue
+		}
+		fd.Close()
+		os.Remove(fd.Name())
+	}
+	if len(problems) > 0 {
+		return errors.New(strings.Join(problems, "; "))
+	}
+	return nil
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestReadinessHandler(t *testing.T) {
+	ok := func(ctx context.Context) error { return nil }
+	fail := func(ctx context.Context) error { return errors.New("down") }
+	tests := []struct {
+		name   string
+		checks []*healthCheck
+		code   int
+		status string
+	}{
+		{"no checks", nil, http.StatusOK, "ok"},
+		{"all ok", []*healthCheck{{name: "a", check: ok}, {name: "b", check: ok}}, http.StatusOK, "ok"},
+		{"one fails", []*healthCheck{{name: "a", check: ok}, {name: "b", check: fail}}, http.StatusServiceUnavailable, "fail"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			readinessHandler(tt.checks)(w, httptest.NewRequest("GET", "/readyz", nil))
+			if w.Code != tt.code {
+				t.Fatalf("status = %d, want %d", w.Code, tt.code)
+			}
+			h := &health{}
+			if err := json.NewDecoder(w.Body).Decode(h); err != nil {
+				t.Fatal(err)
+			}
+			if h.Status != tt.status || len(h.Components) != len(tt.checks) {
+				t.Fatalf("health = %+v, want status %s and %d components", h, tt.status, len(tt.checks))
+			}
+		})
+	}
+}
+
+func TestReadinessSharedAndCached(t *testing.T) {
+	var runs int32
+	release := make(chan struct{})
+	rd := &readiness{ttl: time.Hour, checks: []*healthCheck{{name: "slow", check: func(ctx context.Context) error {
+		atomic.AddInt32(&runs, 1)
+		<-release
+		return nil
+	}}}}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if h, ok := rd.get(context.Background()); !ok || h.Status != "ok" {
+				t.Errorf("get() = %+v, %t, want ok", h, ok)
+			}
+		}()
+	}
+	time.Sleep(20 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	rd.get(context.Background())
+	if n := atomic.LoadInt32(&runs); n != 1 {
+		t.Fatalf("checks run %d times, want 1", n)
+	}
+
+	// once expired they run again
+	rd.mu.Lock()
+	rd.checked = time.Now().Add(-2 * time.Hour)
+	rd.mu.Unlock()
+	rd.get(context.Background())
+	if n := atomic.LoadInt32(&runs); n != 2 {
+		t.Fatalf("checks run %d times after expiring, want 2", n)
+	}
+}
+
+func TestReadinessProbeGivesUp(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	rd := &readiness{ttl: time.Hour, checks: []*healthCheck{{name: "slow", check: func(ctx context.Context) error {
+		<-release
+		return nil
+	}}}}
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, ok := rd.get(ctx); ok {
+		t.Fatal("get() returned before the checks finished, want to give up")
+	}
+}
+
+func TestRunHealthCheckDoesNotPileUp(t *testing.T) {
+	var runs int32
+	release := make(chan struct{})
+	c := &healthCheck{name: "stuck", check: func(ctx context.Context) error {
+		atomic.AddInt32(&runs, 1)
+		// ignores ctx
+		<-release
+		return nil
+	}}
+	for i := 0; i < 3; i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		if ch := runHealthCheck(ctx, c); ch.Status != "fail" {
+			t.Fatalf("run %d status = %s, want fail", i, ch.Status)
+		}
+		cancel()
+	}
+	if n := atomic.LoadInt32(&runs); n != 1 {
+		t.Fatalf("check started %d times, want 1", n)
+	}
+
+	close(release)
+	for i := 0; i < 100; i++ {
+		c.mu.Lock()
+		running := c.running
+		c.mu.Unlock()
+		if !running {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if ch := runHealthCheck(context.Background(), c); ch.Status != "ok" {
+		t.Fatalf("status after the check finished = %s (%s), want ok", ch.Status, ch.Error)
+	}
+}
+
+func TestCheckLDAPBindHonoursContext(t *testing.T) {
+	// the server accepts connections and never answers
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	err = checkLDAPBind(ctx, ln.Addr().String(), "cn=admin", "secret")
+	if err != context.DeadlineExceeded {
+		t.Fatalf("checkLDAPBind() = %v, want %v", err, context.DeadlineExceeded)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("checkLDAPBind() took %s, want it to give up with the context", elapsed)
+	}
+}
+
+type testHealthCheckerDriver struct {
+	err error
+}
+
+func (d testHealthCheckerDriver) HealthCheck(ctx context.Context) error {
+	return d.err
+}
+
+func TestDriverCheck(t *testing.T) {
+	dir, err := ioutil.TempDir("", "clawiod")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		name    string
+		driver  interface{}
+		folders []string
+		isErr   bool
+	}{
+		{"no dependencies", struct{}{}, nil, false},
+		{"writable folder", struct{}{}, []string{dir}, false},
+		{"missing folder", struct{}{}, []string{filepath.Join(dir, "missing")}, true},
+		{"driver ok", testHealthCheckerDriver{}, []string{dir}, false},
+		{"driver fails", testHealthCheckerDriver{errors.New("database down")}, []string{dir}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := driverCheck("driver", tt.driver, tt.folders).check(context.Background())
+			if tt.isErr != (err != nil) {
+				t.Fatalf("check() = %v, want error %t", err, tt.isErr)
+			}
+		})
+	}
+}
+
+func TestReadinessUnreachableMetaDataDSN(t *testing.T) {
+	dir, err := ioutil.TempDir("", "clawiod")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	// nothing listens on the port once the listener is closed
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+
+	c := newContainer(&configuration{
+		MetaDataDriver:                 "ocfsmdatadriver",
+		OCFSMDataDriverDataFolder:      dir,
+		OCFSMDataDriverTemporaryFolder: dir,
+		OCFSMDataDriverDSN:             "clawio:secret@tcp(" + addr + ")/clawio",
+	})
+	// the driver itself does not check the database
+	c.components["metadatadriver"] = struct{}{}
+	check, err := metaDataDriverCheck(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	readinessHandler([]*healthCheck{check})(w, httptest.NewRequest("GET", "/readyz", nil))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("status = %d, want %d", w.Code, http.StatusServiceUnavailable)
+	}
+	h := &health{}
+	if err := json.NewDecoder(w.Body).Decode(h); err != nil {
+		t.Fatal(err)
+	}
+	if len(h.Components) != 1 || h.Components[0].Name != "metadatadriver:ocfsmdatadriver" || h.Components[0].Error == "" {
+		t.Fatalf("components = %+v, want the metadata driver failing", h.Components)
+	}
+}
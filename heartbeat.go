@@ -0,0 +1,219 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/go-kit/kit/log/levels"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+func init() {
+	// every node must draw a different jitter
+	rand.Seed(time.Now().UnixNano())
+}
+
+// heartbeatSettings controls how often a node is registered.
+type heartbeatSettings struct {
+	interval   time.Duration
+	ttl        time.Duration
+	jitter     float64 // fraction of the interval
+	maxBackoff time.Duration
+}
+
+func getHeartbeatSettings(config *configuration) heartbeatSettings {
+	return heartbeatSettings{
+		interval:   config.GetRegistryHeartbeatInterval(),
+		ttl:        config.GetRegistryHeartbeatTTL(),
+		jitter:     float64(config.GetRegistryHeartbeatJitter()) / 100,
+		maxBackoff: config.GetRegistryHeartbeatMaxBackoff(),
+	}
+}
+
+// validate checks that a node beating with these settings
+// does not expire from the registry while it is healthy.
+func (s heartbeatSettings) validate() error {
+	if s.interval <= 0 {
+		return fmt.Errorf("registry heartbeat interval %s must be positive", s.interval)
+	}
+	if s.jitter < 0 || s.jitter >= 1 {
+		return fmt.Errorf("registry heartbeat jitter %.0f%% is out of range 0-99", s.jitter*100)
+	}
+	if s.longest(s.interval) >= s.ttl {
+		return fmt.Errorf("registry heartbeat interval %s plus jitter must be lower than TTL %s", s.interval, s.ttl)
+	}
+	if s.maxBackoff < s.interval {
+		return fmt.Errorf("registry heartbeat max backoff %s can not be lower than interval %s", s.maxBackoff, s.interval)
+	}
+	// a beat that fails is retried after backing off, the retry must
+	// reach the registry before the previous beat expires
+	if s.maxBackoff > s.interval && s.longest(s.interval)+s.longest(s.maxBackoff) >= s.ttl {
+		return fmt.Errorf("registry heartbeat max backoff %s plus jitter must be lower than TTL %s minus interval %s plus jitter",
+			s.maxBackoff, s.ttl, s.interval)
+	}
+	return nil
+}
+
+// longest returns the longest time waited for a beat due after d.
+func (s heartbeatSettings) longest(d time.Duration) time.Duration {
+	return d + time.Duration(float64(d)*s.jitter)
+}
+
+// next returns the time to wait for the next beat after failures consecutive failures.
+// Failed beats back off exponentially so a registry that is down is not hammered.
+func (s heartbeatSettings) next(failures int) time.Duration {
+	d := s.interval
+	for i := 0; i < failures && d < s.maxBackoff; i++ {
+		d *= 2
+	}
+	if d > s.maxBackoff {
+		d = s.maxBackoff
+	}
+	// spread the beats so the nodes of a cluster started
+	// together do not hit the registry in lockstep.
+	spread := int64(float64(d) * s.jitter)
+	if spread > 0 {
+		d += time.Duration(rand.Int63n(2*spread+1) - spread)
+	}
+	return d
+}
+
+// heartbeatState is the outcome of the beats so far.
+type heartbeatState struct {
+	running     bool
+	lastBeat    time.Time
+	lastSuccess time.Time
+	lastErr     error
+	failures    int
+}
+
+// heartbeat calls beat periodically until it is stopped.
+type heartbeat struct {
+	beat   func(ctx context.Context) error
+	logger func() levels.Levels
+
+	mu       sync.Mutex
+	settings heartbeatSettings
+	state    heartbeatState
+	cancel   context.CancelFunc
+	done     chan struct{}
+}
+
+func newHeartbeat(beat func(ctx context.Context) error, logger func() levels.Levels, settings heartbeatSettings) *heartbeat {
+	return &heartbeat{beat: beat, logger: logger, settings: settings}
+}
+
+// start beats right away and then periodically in the background.
+// Starting a running heartbeat has no effect.
+func (h *heartbeat) start() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.cancel != nil {
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	h.cancel = cancel
+	h.done = done
+	h.state.running = true
+	go h.run(ctx, h.settings, done)
+}
+
+// stop stops beating, cancelling the beat in progress, and waits
+// until it returns or ctx is done. Stopping a stopped heartbeat has no effect.
+func (h *heartbeat) stop(ctx context.Context) error {
+	h.mu.Lock()
+	cancel, done := h.cancel, h.done
+	h.cancel = nil
+	h.done = nil
+	h.state.running = false
+	h.mu.Unlock()
+	if cancel == nil {
+		return nil
+	}
+	cancel()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// restart stops the heartbeat and starts it again with new settings.
+func (h *heartbeat) restart(settings heartbeatSettings) {
+	h.stop(context.Background())
+	h.mu.Lock()
+	h.settings = settings
+	h.mu.Unlock()
+	h.start()
+}
+
+func (h *heartbeat) getState() heartbeatState {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.state
+}
+
+// check fails if the node is not in the registry anymore: the heartbeat
+// is stopped or the last successful beat is older than the TTL.
+// Failed beats within the TTL do not make the check fail.
+func (h *heartbeat) check(ctx context.Context) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	state := h.state
+	if !state.running {
+		return errors.New("registry heartbeat is stopped")
+	}
+	if state.lastSuccess.IsZero() {
+		if state.lastErr != nil {
+			return state.lastErr
+		}
+		return errors.New("node not registered yet")
+	}
+	if age := time.Since(state.lastSuccess); age > h.settings.ttl {
+		return fmt.Errorf("node registration expired %s ago after %d failed heartbeats: %s",
+			age-h.settings.ttl, state.failures, state.lastErr)
+	}
+	return nil
+}
+
+func (h *heartbeat) run(ctx context.Context, settings heartbeatSettings, done chan<- struct{}) {
+	defer close(done)
+	for {
+		beatCtx, cancel := context.WithTimeout(ctx, settings.ttl)
+		err := h.beat(beatCtx)
+		cancel()
+		if ctx.Err() != nil {
+			// stopped while beating
+			return
+		}
+
+		h.mu.Lock()
+		h.state.lastBeat = time.Now()
+		h.state.lastErr = err
+		if err == nil {
+			h.state.lastSuccess = h.state.lastBeat
+			h.state.failures = 0
+		} else {
+			h.state.failures++
+		}
+		failures := h.state.failures
+		h.mu.Unlock()
+
+		wait := settings.next(failures)
+		if err != nil {
+			h.logger().Warn().Log("msg", "registry heartbeat failed", "failures", failures, "retry", wait, "error", err)
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		}
+	}
+}
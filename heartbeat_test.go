@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/levels"
+	"testing"
+	"time"
+)
+
+func TestHeartbeatSettingsValidate(t *testing.T) {
+	tests := []struct {
+		name     string
+		settings heartbeatSettings
+		valid    bool
+	}{
+		{"default", heartbeatSettings{interval: 5 * time.Second, ttl: 15 * time.Second, jitter: 0.1, maxBackoff: 8 * time.Second}, true},
+		{"zero interval", heartbeatSettings{ttl: 15 * time.Second, maxBackoff: 15 * time.Second}, false},
+		{"negative jitter", heartbeatSettings{interval: 5 * time.Second, ttl: 15 * time.Second, jitter: -0.1, maxBackoff: 15 * time.Second}, false},
+		{"jitter of the whole interval", heartbeatSettings{interval: 5 * time.Second, ttl: 15 * time.Second, jitter: 1, maxBackoff: 15 * time.Second}, false},
+		{"interval equal to ttl", heartbeatSettings{interval: 15 * time.Second, ttl: 15 * time.Second, maxBackoff: 15 * time.Second}, false},
+		{"jitter reaching ttl", heartbeatSettings{interval: 10 * time.Second, ttl: 15 * time.Second, jitter: 0.5, maxBackoff: 15 * time.Second}, false},
+		{"max backoff lower than interval", heartbeatSettings{interval: 5 * time.Second, ttl: 15 * time.Second, maxBackoff: time.Second}, false},
+		{"max backoff reaching ttl", heartbeatSettings{interval: 5 * time.Second, ttl: 15 * time.Second, maxBackoff: 10 * time.Second}, false},
+		{"max backoff jitter reaching ttl", heartbeatSettings{interval: 5 * time.Second, ttl: 15 * time.Second, jitter: 0.1, maxBackoff: 9 * time.Second}, false},
+		{"max backoff above ttl", heartbeatSettings{interval: 5 * time.Second, ttl: 15 * time.Second, jitter: 0.1, maxBackoff: time.Minute}, false},
+		{"no backoff with a long interval", heartbeatSettings{interval: 10 * time.Second, ttl: 15 * time.Second, maxBackoff: 10 * time.Second}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.settings.validate()
+			if tt.valid && err != nil {
+				t.Fatalf("validate() = %s, want nil", err)
+			}
+			if !tt.valid && err == nil {
+				t.Fatal("validate() = nil, want an error")
+			}
+		})
+	}
+}
+
+func TestGetHeartbeatSettingsMaxBackoff(t *testing.T) {
+	tests := []struct {
+		name   string
+		config *configuration
+		want   time.Duration
+	}{
+		{"default", &configuration{}, 8 * time.Second},
+		{"configured", &configuration{RegistryHeartbeatMaxBackoff: 7}, 7 * time.Second},
+		{"longer ttl", &configuration{RegistryHeartbeatTTL: 60}, 34 * time.Second},
+		{"little jitter", &configuration{RegistryHeartbeatTTL: 15, RegistryHeartbeatInterval: 5, RegistryHeartbeatJitter: 1}, 9 * time.Second},
+		{"interval close to ttl", &configuration{RegistryHeartbeatTTL: 15, RegistryHeartbeatInterval: 10}, 10 * time.Second},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			settings := getHeartbeatSettings(tt.config)
+			if settings.maxBackoff != tt.want {
+				t.Fatalf("max backoff = %s, want %s", settings.maxBackoff, tt.want)
+			}
+			if err := settings.validate(); err != nil {
+				t.Fatalf("validate() = %s, want nil", err)
+			}
+		})
+	}
+}
+
+func TestHeartbeatSettingsNextBacksOff(t *testing.T) {
+	settings := heartbeatSettings{interval: time.Second, ttl: 3 * time.Second, maxBackoff: 10 * time.Second}
+	tests := []struct {
+		failures int
+		want     time.Duration
+	}{
+		{0, time.Second},
+		{1, 2 * time.Second},
+		{2, 4 * time.Second},
+		{3, 8 * time.Second},
+		{4, 10 * time.Second},
+		{100, 10 * time.Second},
+	}
+	for _, tt := range tests {
+		if got := settings.next(tt.failures); got != tt.want {
+			t.Errorf("next(%d) = %s, want %s", tt.failures, got, tt.want)
+		}
+	}
+}
+
+func TestHeartbeatSettingsNextJitter(t *testing.T) {
+	settings := heartbeatSettings{interval: time.Second, ttl: 3 * time.Second, jitter: 0.2, maxBackoff: 4 * time.Second}
+	tests := []struct {
+		failures int
+		min, max time.Duration
+	}{
+		{0, 800 * time.Millisecond, 1200 * time.Millisecond},
+		{1, 1600 * time.Millisecond, 2400 * time.Millisecond},
+		{5, 3200 * time.Millisecond, 4800 * time.Millisecond},
+	}
+	for _, tt := range tests {
+		spread := map[time.Duration]bool{}
+		for i := 0; i < 100; i++ {
+			got := settings.next(tt.failures)
+			if got < tt.min || got > tt.max {
+				t.Fatalf("next(%d) = %s, want between %s and %s", tt.failures, got, tt.min, tt.max)
+			}
+			spread[got] = true
+		}
+		if len(spread) < 2 {
+			t.Errorf("next(%d) always returns the same wait, want it spread by jitter", tt.failures)
+		}
+	}
+}
+
+func TestHeartbeatCheck(t *testing.T) {
+	settings := heartbeatSettings{interval: time.Second, ttl: 3 * time.Second, maxBackoff: 4 * time.Second}
+	tests := []struct {
+		name  string
+		state heartbeatState
+		valid bool
+	}{
+		{"stopped", heartbeatState{lastSuccess: time.Now()}, false},
+		{"not registered yet", heartbeatState{running: true}, false},
+		{"first beat failed", heartbeatState{running: true, lastErr: errors.New("unreachable"), failures: 1}, false},
+		{"registered", heartbeatState{running: true, lastSuccess: time.Now()}, true},
+		{"failing within ttl", heartbeatState{running: true, lastSuccess: time.Now().Add(-2 * time.Second), lastErr: errors.New("unreachable"), failures: 2}, true},
+		{"expired", heartbeatState{running: true, lastSuccess: time.Now().Add(-5 * time.Second), lastErr: errors.New("unreachable"), failures: 4}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := newHeartbeat(nil, nil, settings)
+			h.state = tt.state
+			err := h.check(context.Background())
+			if tt.valid && err != nil {
+				t.Fatalf("check() = %s, want nil", err)
+			}
+			if !tt.valid && err == nil {
+				t.Fatal("check() = nil, want an error")
+			}
+		})
+	}
+}
+
+func TestHeartbeatRetriesAfterFailures(t *testing.T) {
+	settings := heartbeatSettings{interval: 10 * time.Millisecond, ttl: time.Second, maxBackoff: 20 * time.Millisecond}
+	beats := make(chan int, 10)
+	count := 0
+	beat := func(ctx context.Context) error {
+		count++
+		beats <- count
+		if count < 3 {
+			return errors.New("registry unreachable")
+		}
+		return nil
+	}
+	logger := levels.New(log.NewNopLogger())
+	h := newHeartbeat(beat, func() levels.Levels { return logger }, settings)
+	h.start()
+	defer h.stop(context.Background())
+
+	for want := 1; want <= 3; want++ {
+		select {
+		case got := <-beats:
+			if got != want {
+				t.Fatalf("beat %d, want %d", got, want)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("beat %d did not happen", want)
+		}
+	}
+	deadline := time.Now().Add(time.Second)
+	for h.check(context.Background()) != nil {
+		if time.Now().After(deadline) {
+			t.Fatalf("check() = %s after a successful beat, want nil", h.check(context.Background()))
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if state := h.getState(); state.failures != 0 {
+		t.Errorf("failures = %d after a successful beat, want 0", state.failures)
+	}
+}
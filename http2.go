@@ -0,0 +1,97 @@
+package main
+
+import (
+	"crypto/tls"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+	"net"
+	"net/http"
+	"time"
+)
+
+// HTTP/2 frame and flow control window limits of RFC 7540
+const (
+	http2MinFrameSize  = 1 << 14
+	http2MaxFrameSize  = 1<<24 - 1
+	http2MinWindowSize = 1<<16 - 1
+	http2MaxWindowSize = 1<<31 - 1
+)
+
+// newHTTP2Server creates the HTTP/2 settings of the TLS and h2c connections.
+func newHTTP2Server(config *configuration) *http2.Server {
+	return &http2.Server{
+		MaxConcurrentStreams:         uint32(config.GetHTTP2MaxConcurrentStreams()),
+		MaxReadFrameSize:             uint32(config.GetHTTP2MaxReadFrameSize()),
+		MaxUploadBufferPerConnection: int32(config.GetHTTP2ConnectionWindowSize()),
+		MaxUploadBufferPerStream:     int32(config.GetHTTP2StreamWindowSize()),
+		IdleTimeout:                  config.GetHTTPIdleTimeout(),
+	}
+}
+
+// configureHTTP2Server applies the HTTP/2 settings to srv and, if h2c is
+// enabled, serves HTTP/2 without TLS too, with prior knowledge or upgrading
+// an HTTP/1 connection. h2c connections are hijacked from srv, on shutdown
+// they are told to go away but srv does not wait for them.
+func configureHTTP2Server(config *configuration, srv *http.Server) error {
+	h2s := newHTTP2Server(config)
+	if err := http2.ConfigureServer(srv, h2s); err != nil {
+		return err
+	}
+	if !config.IsHTTP2CleartextEnabled() {
+		return nil
+	}
+	handler := srv.Handler
+	cleartext := h2c.NewHandler(handler, h2s)
+	srv.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// HTTP/2 over TLS is negotiated with ALPN, never upgraded
+		if r.TLS != nil {
+			handler.ServeHTTP(w, r)
+			return
+		}
+		cleartext.ServeHTTP(w, r)
+	})
+	return nil
+}
+
+// configureHTTP2Transport enables HTTP/2 in the node transport, which does
+// not negotiate it by itself once it has its own TLS settings, e.g. for
+// mutual TLS. If h2c is enabled for clients, the returned round tripper
+// sends the requests without TLS with HTTP/2 with prior knowledge, so every
+// node reached without TLS must serve h2c.
+func configureHTTP2Transport(config *configuration, transport *http.Transport) (http.RoundTripper, error) {
+	if err := http2.ConfigureTransport(transport); err != nil {
+		return nil, err
+	}
+	if !config.IsHTTP2CleartextClientEnabled() {
+		return transport, nil
+	}
+	dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+	return &cleartextTransport{
+		Transport: transport,
+		cleartext: &http2.Transport{
+			AllowHTTP: true,
+			DialTLS: func(network, addr string, _ *tls.Config) (net.Conn, error) {
+				return dialer.Dial(network, addr)
+			},
+		},
+	}, nil
+}
+
+// cleartextTransport sends the requests without TLS with h2c
+// and the rest with the wrapped transport.
+type cleartextTransport struct {
+	*http.Transport
+	cleartext *http2.Transport
+}
+
+func (t *cleartextTransport) CloseIdleConnections() {
+	t.Transport.CloseIdleConnections()
+	t.cleartext.CloseIdleConnections()
+}
+
+func (t *cleartextTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	if r.URL.Scheme == "http" {
+		return t.cleartext.RoundTrip(r)
+	}
+	return t.Transport.RoundTrip(r)
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"github.com/clawio/lib"
+)
+
+// settingsSource is implemented by the configuration sources that can be
+// used as a layer of the layered configuration source.
+type settingsSource interface {
+	loadSettings() (map[string]interface{}, error)
+}
+
+// layeredConfigurationSource merges the settings of several sources.
+// Settings from later layers override the ones from earlier layers.
+type layeredConfigurationSource struct {
+	layers []settingsSource
+}
+
+func newLayeredConfigurationSource(layers ...settingsSource) (*layeredConfigurationSource, error) {
+	return &layeredConfigurationSource{layers: layers}, nil
+}
+
+func (s *layeredConfigurationSource) LoadConfiguration() (lib.Configuration, error) {
+	settings, err := s.loadSettings()
+	if err != nil {
+		return nil, err
+	}
+	return newConfiguration(settings)
+}
+
+func (s *layeredConfigurationSource) loadSettings() (map[string]interface{}, error) {
+	settings := map[string]interface{}{}
+	for _, layer := range s.layers {
+		layerSettings, err := layer.loadSettings()
+		if err != nil {
+			return nil, err
+		}
+		for k, v := range layerSettings {
+			settings[k] = v
+		}
+	}
+	return settings, nil
+}
+
+// watch notifies when any of the layers able to watch its settings changes.
+// It returns nil if no layer can be watched.
+func (s *layeredConfigurationSource) watch(stop <-chan struct{}) <-chan struct{} {
+	layerChanges := []<-chan struct{}{}
+	for _, layer := range s.layers {
+		if watcher, ok := layer.(configurationWatcher); ok {
+			if c := watcher.watch(stop); c != nil {
+				layerChanges = append(layerChanges, c)
+			}
+		}
+	}
+	if len(layerChanges) == 0 {
+		return nil
+	}
+	changes := make(chan struct{}, 1)
+	for _, c := range layerChanges {
+		go func(c <-chan struct{}) {
+			for {
+				select {
+				case <-c:
+					select {
+					case changes <- struct{}{}:
+					default:
+					}
+				case <-stop:
+					return
+				}
+			}
+		}(c)
+	}
+	return changes
+}
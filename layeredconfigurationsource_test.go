@@ -0,0 +1,140 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// staticSettingsSource is a layer with fixed settings.
+type staticSettingsSource struct {
+	settings map[string]interface{}
+	err      error
+	changes  chan struct{}
+}
+
+func (s *staticSettingsSource) loadSettings() (map[string]interface{}, error) {
+	return s.settings, s.err
+}
+
+// watchedSettingsSource is a layer that can be watched.
+type watchedSettingsSource struct {
+	staticSettingsSource
+}
+
+func (s *watchedSettingsSource) watch(stop <-chan struct{}) <-chan struct{} {
+	return s.changes
+}
+
+func TestLayeredConfigurationSource(t *testing.T) {
+	tests := []struct {
+		name   string
+		layers []settingsSource
+		port   int
+		cpu    string
+		isErr  bool
+	}{
+		{"no layers", nil, 0, "", false},
+		{"later layers override", []settingsSource{
+			&staticSettingsSource{settings: map[string]interface{}{"port": 1502, "cpu": "50%"}},
+			&staticSettingsSource{settings: map[string]interface{}{"port": 1600}},
+		}, 1600, "50%", false},
+		{"empty layer", []settingsSource{
+			&staticSettingsSource{settings: map[string]interface{}{"port": 1502}},
+			&staticSettingsSource{settings: map[string]interface{}{}},
+		}, 1502, "", false},
+		{"failing layer", []settingsSource{
+			&staticSettingsSource{settings: map[string]interface{}{"port": 1502}},
+			&staticSettingsSource{err: errors.New("unavailable")},
+		}, 0, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := newLayeredConfigurationSource(tt.layers...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			c, err := s.LoadConfiguration()
+			if tt.isErr {
+				if err == nil {
+					t.Fatal("LoadConfiguration() = nil error, want one")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			config := c.(*configuration)
+			if config.GetPort() != tt.port || config.GetCPU() != tt.cpu {
+				t.Fatalf("port %d and cpu %q, want %d and %q", config.GetPort(), config.GetCPU(), tt.port, tt.cpu)
+			}
+		})
+	}
+}
+
+func TestLayeredConfigurationSourceFileAndEnv(t *testing.T) {
+	dir, err := ioutil.TempDir("", "clawiod")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "clawiod.conf")
+	if err := ioutil.WriteFile(path, []byte(`{"port": 1502, "cpu": "100%"}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	os.Setenv("CLAWIOD_PORT", "1600")
+	defer os.Unsetenv("CLAWIOD_PORT")
+
+	source, err := getConfigurationSource("layered:file:" + path + ",env:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := source.LoadConfiguration()
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := c.(*configuration)
+	if config.GetPort() != 1600 || config.GetCPU() != "100%" {
+		t.Fatalf("port %d and cpu %q, want 1600 from the environment and 100%% from the file", config.GetPort(), config.GetCPU())
+	}
+}
+
+func TestGetLayeredConfigurationSourceErrors(t *testing.T) {
+	tests := []string{
+		"layered:file:a.json,layered:env:",
+		"layered:file:a.json,nosuchprotocol:x",
+		"layered:",
+	}
+	for _, source := range tests {
+		if _, err := getConfigurationSource(source); err == nil {
+			t.Errorf("getConfigurationSource(%q) = nil error, want one", source)
+		}
+	}
+}
+
+func TestLayeredConfigurationSourceWatch(t *testing.T) {
+	stop := make(chan struct{})
+	defer close(stop)
+
+	static := &staticSettingsSource{}
+	s, _ := newLayeredConfigurationSource(static)
+	if s.watch(stop) != nil {
+		t.Fatal("watch() of layers that can not be watched is not nil")
+	}
+
+	watched := &watchedSettingsSource{staticSettingsSource{changes: make(chan struct{})}}
+	s, _ = newLayeredConfigurationSource(static, watched)
+	changes := s.watch(stop)
+	if changes == nil {
+		t.Fatal("watch() = nil, want the changes of the watched layer")
+	}
+	watched.changes <- struct{}{}
+	select {
+	case <-changes:
+	case <-time.After(time.Second):
+		t.Fatal("the change of a layer was not notified")
+	}
+}
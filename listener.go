@@ -0,0 +1,552 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"github.com/go-kit/kit/log/levels"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// newHTTPServer creates the http server for config.
+// Read and write timeouts are not set, the bodies are limited
+// per web service by bodyReadTimeoutMiddleware.
+func newHTTPServer(config *configuration, handler http.Handler) (*http.Server, error) {
+	srv := &http.Server{
+		Handler:           handler,
+		ReadHeaderTimeout: config.GetHTTPReadHeaderTimeout(),
+		IdleTimeout:       config.GetHTTPIdleTimeout(),
+		MaxHeaderBytes:    config.GetHTTPMaxHeaderBytes(),
+	}
+	if err := configureHTTP2Server(config, srv); err != nil {
+		return nil, err
+	}
+	return srv, nil
+}
+
+// getBodyReadTimeouts returns the body read timeout of every web service.
+func getBodyReadTimeouts(config *configuration) map[string]time.Duration {
+	return map[string]time.Duration{
+		"authentication": config.GetAuthenticationWebServiceBodyReadTimeout(),
+		"data":           config.GetDataWebServiceBodyReadTimeout(),
+		"metadata":       config.GetMetaDataWebServiceBodyReadTimeout(),
+		"owncloud":       config.GetOCWebServiceBodyReadTimeout(),
+	}
+}
+
+// listener networks
+const (
+	listenerTCP  = "tcp"
+	listenerUnix = "unix"
+	listenerFD   = "fd"
+)
+
+var listenerNetworks = []string{listenerTCP, listenerUnix, listenerFD}
+
+// listenerConfig is a listener as it is written in the listeners setting:
+//
+//	[{"network": "unix", "address": "/run/clawiod.sock", "socket_mode": "0660"}]
+//
+// The address of an fd listener is the name systemd gives to the socket
+// (FileDescriptorName) or its index. The TLS settings not set are the global ones.
+type listenerConfig struct {
+	Network        string `json:"network"`
+	Address        string `json:"address"`
+	SocketMode     string `json:"socket_mode"`
+	TLSEnabled     bool   `json:"tls_enabled"`
+	TLSMode        string `json:"tls_mode"`
+	TLSCertificate string `json:"tls_certificate"`
+	TLSPrivateKey  string `json:"tls_private_key"`
+	TLSACMEHosts   string `json:"tls_acme_hosts"`
+	MTLSEnabled    bool   `json:"mtls_enabled"`
+}
+
+// getConfiguration returns config with the TLS settings of the listener.
+func (l *listenerConfig) getConfiguration(config *configuration) *configuration {
+	c := *config
+	c.TLSEnabled = l.TLSEnabled
+	c.TLSMode = defaultString(l.TLSMode, config.TLSMode)
+	c.TLSCertificate = defaultString(l.TLSCertificate, config.TLSCertificate)
+	c.TLSPrivateKey = defaultString(l.TLSPrivateKey, config.TLSPrivateKey)
+	c.TLSACMEHosts = defaultString(l.TLSACMEHosts, config.TLSACMEHosts)
+	c.MTLSEnabled = l.MTLSEnabled
+	return &c
+}
+
+func (l *listenerConfig) String() string {
+	scheme := "http"
+	if l.TLSEnabled {
+		scheme = "https"
+	}
+	return fmt.Sprintf("%s+%s://%s", scheme, l.Network, l.Address)
+}
+
+// listeners are the listeners opened for a configuration.
+type listeners struct {
+	public []net.Listener
+	// admin is nil if there is no admin listener
+	admin        net.Listener
+	certificates []io.Closer
+}
+
+// Close stops the certificate reloads of the listeners.
+// The listeners are closed by the http servers.
+func (ls *listeners) Close() error {
+	for _, c := range ls.certificates {
+		c.Close()
+	}
+	return nil
+}
+
+// listen opens the listeners of config with their TLS settings. The public
+// ones accept at most http_max_connections connections at the same time
+// between all of them if it is set, and their connections are tracked
+// by conns. The admin listener has no limit, operators must always get in.
+func listen(config *configuration, conns *connTracker, logger levels.Levels) (*listeners, error) {
+	activated, err := getActivatedListeners()
+	if err != nil {
+		return nil, err
+	}
+	var sem chan struct{}
+	if max := config.GetHTTPMaxConnections(); max > 0 {
+		sem = make(chan struct{}, max)
+	}
+
+	ls := &listeners{}
+	fail := func(l *listenerConfig, err error) (*listeners, error) {
+		for _, ln := range ls.public {
+			ln.Close()
+		}
+		ls.Close()
+		return nil, fmt.Errorf("listener %s: %s", l, err)
+	}
+	for _, l := range config.GetListeners() {
+		ln, err := l.listen(activated)
+		if err != nil {
+			return fail(l, err)
+		}
+		if sem != nil {
+			ln = &limitListener{Listener: ln, sem: sem}
+		}
+		ln = conns.track(ln)
+		if ln, err = ls.secure(l, config, ln, "client", logger); err != nil {
+			return fail(l, err)
+		}
+		ls.public = append(ls.public, ln)
+	}
+	if l := config.GetAdminListener(); l != nil {
+		ln, err := l.listen(activated)
+		if err != nil {
+			return fail(l, err)
+		}
+		if ls.admin, err = ls.secure(l, config, ln, "admin", logger); err != nil {
+			return fail(l, err)
+		}
+	}
+	unused := map[net.Listener]string{}
+	for name, ln := range activated {
+		if _, err := strconv.Atoi(name); err != nil || unused[ln] == "" {
+			unused[ln] = name
+		}
+	}
+	for ln, name := range unused {
+		logger.Warn().Log("msg", "socket passed by systemd is not configured as a listener, closing it", "name", name)
+		ln.Close()
+	}
+	return ls, nil
+}
+
+// secure serves TLS on ln if it is enabled for listener l.
+// The listener is closed on error.
+func (ls *listeners) secure(l *listenerConfig, config *configuration, ln net.Listener, kind string, logger levels.Levels) (net.Listener, error) {
+	settings := l.getConfiguration(config)
+	if !settings.IsTLSEnabled() {
+		logger.Warn().Log("msg", "serving insecure "+kind+" requests", "listener", l)
+		return ln, nil
+	}
+	tlsConfig, certificates, err := getTLSConfig(settings, logger)
+	if err == nil && settings.IsMTLSEnabled() {
+		err = configureMutualTLSServer(settings, tlsConfig)
+	}
+	if err != nil {
+		ln.Close()
+		return nil, err
+	}
+	if certificates != nil {
+		ls.certificates = append(ls.certificates, certificates)
+	}
+	logger.Info().Log("msg", "serving secure "+kind+" requests", "listener", l)
+	return tls.NewListener(ln, tlsConfig), nil
+}
+
+// getRegisteredAddress returns the scheme and the address other nodes reach
+// this node at, the ones of the first TCP listener. The address of unix
+// sockets and of sockets passed by systemd is not known by other nodes.
+func getRegisteredAddress(config *configuration) (string, string, error) {
+	for _, l := range config.GetListeners() {
+		if l.Network != listenerTCP {
+			continue
+		}
+		host, port, err := net.SplitHostPort(l.Address)
+		if err != nil {
+			return "", "", fmt.Errorf("listener %s: %s", l, err)
+		}
+		if ip := net.ParseIP(host); host == "" || (ip != nil && ip.IsUnspecified()) {
+			if host, err = os.Hostname(); err != nil {
+				return "", "", err
+			}
+		}
+		scheme := "http"
+		if l.TLSEnabled {
+			scheme = "https"
+		}
+		return scheme, net.JoinHostPort(host, port), nil
+	}
+	return "", "", errors.New("there is no tcp listener other nodes can reach this node at")
+}
+
+// listen opens the listener. The fd listeners used are removed from activated.
+func (l *listenerConfig) listen(activated map[string]net.Listener) (net.Listener, error) {
+	switch l.Network {
+	case listenerTCP:
+		ln, err := net.Listen("tcp", l.Address)
+		if err != nil {
+			return nil, err
+		}
+		return tcpKeepAliveListener{ln.(*net.TCPListener)}, nil
+	case listenerUnix:
+		if err := removeStaleSocket(l.Address); err != nil {
+			return nil, err
+		}
+		ln, err := net.Listen("unix", l.Address)
+		if err != nil {
+			return nil, err
+		}
+		if l.SocketMode != "" {
+			mode, err := strconv.ParseUint(l.SocketMode, 8, 32)
+			if err == nil {
+				err = os.Chmod(l.Address, os.FileMode(mode))
+			}
+			if err != nil {
+				ln.Close()
+				return nil, err
+			}
+		}
+		return ln, nil
+	case listenerFD:
+		ln, ok := activated[l.Address]
+		if !ok {
+			return nil, errors.New("systemd did not pass a socket with this name")
+		}
+		// a socket can be named by its name and by its index
+		for name, other := range activated {
+			if other == ln {
+				delete(activated, name)
+			}
+		}
+		return ln, nil
+	default:
+		return nil, fmt.Errorf("network %q does not exist", l.Network)
+	}
+}
+
+// removeStaleSocket removes the socket at address left by a process that did
+// not exit cleanly. A socket still accepting connections is in use and kept.
+func removeStaleSocket(address string) error {
+	info, err := os.Stat(address)
+	if err != nil || info.Mode()&os.ModeSocket == 0 {
+		// net.Listen reports what is wrong
+		return nil
+	}
+	conn, err := net.DialTimeout("unix", address, time.Second)
+	if err == nil {
+		conn.Close()
+		return errors.New("socket is in use by another process")
+	}
+	if !isConnectionRefused(err) {
+		return fmt.Errorf("socket may be in use by another process: %s", err)
+	}
+	return os.Remove(address)
+}
+
+// isConnectionRefused reports whether err is the error of dialing
+// a socket nobody listens on.
+func isConnectionRefused(err error) bool {
+	if opErr, ok := err.(*net.OpError); ok {
+		err = opErr.Err
+	}
+	if sysErr, ok := err.(*os.SyscallError); ok {
+		err = sysErr.Err
+	}
+	return err == syscall.ECONNREFUSED
+}
+
+// getActivatedListeners returns the sockets passed by systemd socket
+// activation by name and by index. The process keeps serving on them
+// while a new binary is started, so upgrades do not refuse connections.
+func getActivatedListeners() (map[string]net.Listener, error) {
+	activated := map[string]net.Listener{}
+	if os.Getenv("LISTEN_PID") != strconv.Itoa(os.Getpid()) {
+		return activated, nil
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil {
+		return nil, fmt.Errorf("LISTEN_FDS: %s", err)
+	}
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+	// the children of the process must not inherit them
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+	for i := 0; i < n; i++ {
+		fd := listenFDsStart + i
+		syscall.CloseOnExec(fd)
+		f := os.NewFile(uintptr(fd), fmt.Sprintf("LISTEN_FD_%d", fd))
+		ln, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("socket %d passed by systemd: %s", i, err)
+		}
+		activated[strconv.Itoa(i)] = ln
+		if i < len(names) && names[i] != "" {
+			activated[names[i]] = ln
+		}
+	}
+	return activated, nil
+}
+
+// listenFDsStart is the first file descriptor passed by systemd.
+const listenFDsStart = 3
+
+// limitListener accepts connections while there is room for them in sem,
+// which may be shared by several listeners.
+type limitListener struct {
+	net.Listener
+	sem chan struct{}
+}
+
+func (ln *limitListener) Accept() (net.Conn, error) {
+	ln.sem <- struct{}{}
+	conn, err := ln.Listener.Accept()
+	if err != nil {
+		<-ln.sem
+		return nil, err
+	}
+	return &limitConn{Conn: conn, sem: ln.sem}, nil
+}
+
+type limitConn struct {
+	net.Conn
+	sem  chan struct{}
+	once sync.Once
+}
+
+func (c *limitConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(func() { <-c.sem })
+	return err
+}
+
+// tcpKeepAliveListener enables TCP keep-alives on the accepted
+// connections like http.ListenAndServe does, so dead peers go away.
+type tcpKeepAliveListener struct {
+	*net.TCPListener
+}
+
+func (ln tcpKeepAliveListener) Accept() (net.Conn, error) {
+	conn, err := ln.AcceptTCP()
+	if err != nil {
+		return nil, err
+	}
+	conn.SetKeepAlive(true)
+	conn.SetKeepAlivePeriod(3 * time.Minute)
+	return conn, nil
+}
+
+// connTracker finds the connection of a request by its remote address,
+// net/http does not give it to handlers. The peers of unix sockets have no
+// address, their connections get a unique one like @1 so they can be found.
+type connTracker struct {
+	mu    sync.Mutex
+	conns map[string]net.Conn
+	last  uint64
+}
+
+func newConnTracker() *connTracker {
+	return &connTracker{conns: map[string]net.Conn{}}
+}
+
+func (t *connTracker) track(ln net.Listener) net.Listener {
+	return &trackedListener{Listener: ln, tracker: t}
+}
+
+func (t *connTracker) get(remoteAddr string) net.Conn {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.conns[remoteAddr]
+}
+
+type trackedListener struct {
+	net.Listener
+	tracker *connTracker
+}
+
+func (ln *trackedListener) Accept() (net.Conn, error) {
+	conn, err := ln.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	c := &trackedConn{Conn: conn, tracker: ln.tracker}
+	ln.tracker.mu.Lock()
+	if _, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+		c.addr = conn.RemoteAddr().String()
+	} else {
+		ln.tracker.last++
+		c.remoteAddr = &net.UnixAddr{Net: "unix", Name: fmt.Sprintf("@%d", ln.tracker.last)}
+		c.addr = c.remoteAddr.String()
+	}
+	ln.tracker.conns[c.addr] = c
+	ln.tracker.mu.Unlock()
+	return c, nil
+}
+
+type trackedConn struct {
+	net.Conn
+	tracker *connTracker
+	addr    string
+	// remoteAddr is the address given to a connection without one
+	remoteAddr net.Addr
+	once       sync.Once
+}
+
+func (c *trackedConn) RemoteAddr() net.Addr {
+	if c.remoteAddr != nil {
+		return c.remoteAddr
+	}
+	return c.Conn.RemoteAddr()
+}
+
+func (c *trackedConn) Close() error {
+	c.once.Do(func() {
+		c.tracker.mu.Lock()
+		if c.tracker.conns[c.addr] == c {
+			delete(c.tracker.conns, c.addr)
+		}
+		c.tracker.mu.Unlock()
+	})
+	return c.Conn.Close()
+}
+
+// bodyReadTimeoutMiddleware fails the reads of a request body not finished
+// within timeout, so slow clients can not hold a connection forever.
+// The deadline is removed once the body is read, it does not limit the
+// time to write the response. HTTP/1 requests own their connection, its
+// read deadline is set. An HTTP/2 connection is shared by several requests,
+// the body of the stream is closed by a timer instead.
+func bodyReadTimeoutMiddleware(conns *connTracker, timeout time.Duration, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Body == nil || r.ContentLength == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+		var conn net.Conn
+		if r.ProtoMajor == 1 {
+			conn = conns.get(r.RemoteAddr)
+		}
+		if conn == nil {
+			body := newTimeoutBody(r.Body, timeout)
+			defer body.stop()
+			r.Body = body
+			next.ServeHTTP(w, r)
+			return
+		}
+		conn.SetReadDeadline(time.Now().Add(timeout))
+		r.Body = &deadlineBody{ReadCloser: r.Body, conn: conn}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// errBodyReadTimeout is returned by the reads of a body not finished in time.
+var errBodyReadTimeout = errors.New("request body read timeout")
+
+// timeoutBody closes the body when its timer fires before the body is
+// read, which unblocks a pending read of an HTTP/2 stream.
+type timeoutBody struct {
+	io.ReadCloser
+	timer *time.Timer
+
+	mu       sync.Mutex
+	done     bool
+	timedOut bool
+}
+
+func newTimeoutBody(body io.ReadCloser, timeout time.Duration) *timeoutBody {
+	b := &timeoutBody{ReadCloser: body}
+	b.timer = time.AfterFunc(timeout, b.expire)
+	return b
+}
+
+func (b *timeoutBody) expire() {
+	b.mu.Lock()
+	if b.done {
+		b.mu.Unlock()
+		return
+	}
+	b.timedOut = true
+	b.mu.Unlock()
+	b.ReadCloser.Close()
+}
+
+// stop stops the timer, the body is read or the request finished.
+func (b *timeoutBody) stop() {
+	b.mu.Lock()
+	b.done = true
+	b.mu.Unlock()
+	b.timer.Stop()
+}
+
+func (b *timeoutBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.mu.Lock()
+	timedOut := b.timedOut
+	b.mu.Unlock()
+	if timedOut {
+		return n, errBodyReadTimeout
+	}
+	if err == io.EOF {
+		b.stop()
+	}
+	return n, err
+}
+
+func (b *timeoutBody) Close() error {
+	b.stop()
+	return b.ReadCloser.Close()
+}
+
+// deadlineBody removes the read deadline of the connection when the body
+// is read. Otherwise the deadline would cancel the request while the
+// response is written, net/http keeps reading to detect closed connections.
+type deadlineBody struct {
+	io.ReadCloser
+	conn net.Conn
+	once sync.Once
+}
+
+func (b *deadlineBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if err == io.EOF {
+		b.once.Do(func() {
+			b.conn.SetReadDeadline(time.Time{})
+		})
+	}
+	return n, err
+}
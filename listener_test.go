@@ -0,0 +1,242 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"golang.org/x/net/http2"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRemoveStaleSocket(t *testing.T) {
+	dir, err := ioutil.TempDir("", "clawiod")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		name    string
+		create  func(address string) func()
+		removed bool
+		isErr   bool
+	}{
+		{"nothing", func(address string) func() { return func() {} }, false, false},
+		{"regular file", func(address string) func() {
+			ioutil.WriteFile(address, []byte("data"), 0600)
+			return func() {}
+		}, false, false},
+		{"stale socket", func(address string) func() {
+			ln, err := net.Listen("unix", address)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// the socket is left like a process killed would do
+			ln.(*net.UnixListener).SetUnlinkOnClose(false)
+			ln.Close()
+			return func() {}
+		}, true, false},
+		{"socket in use", func(address string) func() {
+			ln, err := net.Listen("unix", address)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return func() { ln.Close() }
+		}, false, true},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			address := filepath.Join(dir, fmt.Sprintf("socket%d", i))
+			cleanup := tt.create(address)
+			defer cleanup()
+			_, statErr := os.Stat(address)
+			existed := statErr == nil
+
+			err := removeStaleSocket(address)
+			if tt.isErr != (err != nil) {
+				t.Fatalf("removeStaleSocket() = %v, want error %t", err, tt.isErr)
+			}
+			_, statErr = os.Stat(address)
+			if removed := existed && os.IsNotExist(statErr); removed != tt.removed {
+				t.Fatalf("socket removed %t, want %t", removed, tt.removed)
+			}
+		})
+	}
+}
+
+func TestGetRegisteredAddress(t *testing.T) {
+	hostname, err := os.Hostname()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name    string
+		config  *configuration
+		scheme  string
+		address string
+		isErr   bool
+	}{
+		{"port", &configuration{Port: 1502}, "http", net.JoinHostPort(hostname, "1502"), false},
+		{"port with tls", &configuration{Port: 1502, TLSEnabled: true}, "https", net.JoinHostPort(hostname, "1502"), false},
+		{"first tcp listener", &configuration{Port: 1502, Listeners: []*listenerConfig{
+			{Network: listenerUnix, Address: "/run/clawiod.sock"},
+			{Network: listenerTCP, Address: "0.0.0.0:1600", TLSEnabled: true},
+			{Network: listenerTCP, Address: ":1601"},
+		}}, "https", net.JoinHostPort(hostname, "1600"), false},
+		{"listener host", &configuration{Listeners: []*listenerConfig{
+			{Network: listenerTCP, Address: "10.0.0.5:1600"},
+		}}, "http", "10.0.0.5:1600", false},
+		{"ipv6 wildcard", &configuration{Listeners: []*listenerConfig{
+			{Network: listenerTCP, Address: "[::]:1600"},
+		}}, "http", net.JoinHostPort(hostname, "1600"), false},
+		{"no tcp listener", &configuration{Port: 1502, Listeners: []*listenerConfig{
+			{Network: listenerUnix, Address: "/run/clawiod.sock"},
+			{Network: listenerFD, Address: "https"},
+		}}, "", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			scheme, address, err := getRegisteredAddress(tt.config)
+			if tt.isErr {
+				if err == nil {
+					t.Fatalf("getRegisteredAddress() = %s://%s, want an error", scheme, address)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if scheme != tt.scheme || address != tt.address {
+				t.Fatalf("getRegisteredAddress() = %s://%s, want %s://%s", scheme, address, tt.scheme, tt.address)
+			}
+		})
+	}
+}
+
+func TestBodyReadTimeoutMiddleware(t *testing.T) {
+	dir, err := ioutil.TempDir("", "clawiod")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		network string
+		address string
+	}{
+		{"tcp", "127.0.0.1:0"},
+		{"unix", filepath.Join(dir, "clawiod.sock")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.network, func(t *testing.T) {
+			conns := newConnTracker()
+			ln, err := net.Listen(tt.network, tt.address)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ln = conns.track(ln)
+			results := make(chan error, 2)
+			handler := bodyReadTimeoutMiddleware(conns, 100*time.Millisecond, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				_, err := ioutil.ReadAll(r.Body)
+				results <- err
+			}))
+			go http.Serve(ln, handler)
+			defer ln.Close()
+
+			for _, slow := range []bool{false, true} {
+				conn, err := net.Dial(tt.network, ln.Addr().String())
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer conn.Close()
+				body := "0123456789"
+				if slow {
+					// the client stops sending the body
+					body = "01"
+				}
+				fmt.Fprintf(conn, "PUT /upload HTTP/1.1\r\nHost: localhost\r\nContent-Length: 10\r\n\r\n%s", body)
+				select {
+				case err := <-results:
+					if slow && err == nil {
+						t.Fatal("slow body read without error, want a timeout")
+					}
+					if !slow && err != nil {
+						t.Fatalf("body read = %s, want nil", err)
+					}
+				case <-time.After(2 * time.Second):
+					t.Fatalf("body read not finished, slow %t", slow)
+				}
+			}
+		})
+	}
+}
+
+func TestBodyReadTimeoutMiddlewareHTTP2(t *testing.T) {
+	results := make(chan error, 2)
+	handler := bodyReadTimeoutMiddleware(newConnTracker(), 100*time.Millisecond, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, err := ioutil.ReadAll(r.Body)
+		results <- err
+	}))
+	srv := httptest.NewUnstartedServer(handler)
+	if err := http2.ConfigureServer(srv.Config, nil); err != nil {
+		t.Fatal(err)
+	}
+	srv.TLS = srv.Config.TLSConfig
+	srv.StartTLS()
+	defer srv.Close()
+	client := &http.Client{Transport: &http2.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}}
+
+	// both requests share the connection, the slow one does not stop the other
+	for _, slow := range []bool{true, false} {
+		pr, pw := io.Pipe()
+		defer pw.Close()
+		req, err := http.NewRequest("PUT", srv.URL+"/upload", pr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		go func() {
+			res, err := client.Do(req)
+			if err == nil {
+				res.Body.Close()
+			}
+		}()
+		if slow {
+			// the client stops sending the body
+			pw.Write([]byte("01"))
+		} else {
+			pw.Write([]byte("0123456789"))
+			pw.Close()
+		}
+		select {
+		case err := <-results:
+			if slow && err != errBodyReadTimeout {
+				t.Fatalf("slow body read = %v, want %v", err, errBodyReadTimeout)
+			}
+			if !slow && err != nil {
+				t.Fatalf("body read = %s, want nil", err)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("body read not finished, slow %t", slow)
+		}
+	}
+}
+
+func TestTimeoutBody(t *testing.T) {
+	// a body read in time keeps working after the timeout
+	b := newTimeoutBody(ioutil.NopCloser(strings.NewReader("0123456789")), 20*time.Millisecond)
+	if data, err := ioutil.ReadAll(b); err != nil || string(data) != "0123456789" {
+		t.Fatalf("ReadAll() = %q, %v, want the body", data, err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if n, err := b.Read(make([]byte, 1)); n != 0 || err != io.EOF {
+		t.Fatalf("Read() after EOF = %d, %v, want %v", n, err, io.EOF)
+	}
+}
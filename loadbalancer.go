@@ -0,0 +1,321 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"github.com/clawio/lib"
+	"hash/fnv"
+	"math/rand"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// load balancing strategies
+const (
+	roundRobin       = "round-robin"
+	leastOutstanding = "least-outstanding"
+	randomOfTwo      = "random-of-two"
+	consistentHash   = "consistent-hash"
+)
+
+var loadBalancingStrategies = []string{roundRobin, leastOutstanding, randomOfTwo, consistentHash}
+
+// getLoadBalancingStrategies returns the strategy of every web service.
+func getLoadBalancingStrategies(config *configuration) map[string]string {
+	return map[string]string{
+		"authentication": config.GetAuthenticationWebServiceLoadBalancer(),
+		"data":           config.GetDataWebServiceLoadBalancer(),
+		"metadata":       config.GetMetaDataWebServiceLoadBalancer(),
+		"owncloud":       config.GetOCWebServiceLoadBalancer(),
+	}
+}
+
+// loadBalancer is the registry driver given to the proxied web services and to
+// the web service clients. It returns a single node, chosen with the strategy
+// of the web service of the role, so they send the request where we want.
+// Requests served through routingMiddleware tell it which user they belong to
+// and how they finish, the rest are balanced without that information.
+// Nodes ejected by the upstream health are skipped.
+type loadBalancer struct {
+	lib.RegistryDriver
+	strategies map[string]string
+	health     *upstreamHealth
+
+	mu          sync.Mutex
+	next        map[string]int
+	current     map[string]map[string]int
+	outstanding map[string]int
+}
+
+func newLoadBalancer(registryDriver lib.RegistryDriver, strategies map[string]string, health *upstreamHealth) *loadBalancer {
+	return &loadBalancer{
+		RegistryDriver: registryDriver,
+		strategies:     strategies,
+		health:         health,
+		next:           map[string]int{},
+		current:        map[string]map[string]int{},
+		outstanding:    map[string]int{},
+	}
+}
+
+func (b *loadBalancer) GetNodesForRol(ctx context.Context, rol string) ([]lib.RegistryNode, error) {
+	nodes, err := b.RegistryDriver.GetNodesForRol(ctx, rol)
+	if err != nil || len(nodes) == 0 {
+		return nodes, err
+	}
+	nodes = b.health.available(rol, nodes)
+	tried := getTriedNodes(ctx)
+	if tried != nil {
+		nodes = getUntriedNodes(nodes, tried)
+	}
+	// the registry does not guarantee any order
+	sorted := make([]lib.RegistryNode, len(nodes))
+	copy(sorted, nodes)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].URL() < sorted[j].URL() })
+
+	routing := getRouting(ctx)
+	b.mu.Lock()
+	n := b.choose(rol, sorted, routing)
+	if routing != nil {
+		b.outstanding[n.URL()]++
+	}
+	b.mu.Unlock()
+	if routing != nil {
+		routing.picked(b, rol, n)
+	}
+	if tried != nil {
+		tried.add(n.URL())
+	}
+	return []lib.RegistryNode{n}, nil
+}
+
+// choose returns the node for the next request. It must be called with b.mu held.
+func (b *loadBalancer) choose(rol string, nodes []lib.RegistryNode, routing *routing) lib.RegistryNode {
+	if len(nodes) == 1 {
+		return nodes[0]
+	}
+	switch b.strategies[getWebServiceName(rol)] {
+	case leastOutstanding:
+		best := nodes[0]
+		for _, n := range nodes[1:] {
+			if b.outstanding[n.URL()] < b.outstanding[best.URL()] {
+				best = n
+			}
+		}
+		return best
+	case randomOfTwo:
+		i := rand.Intn(len(nodes))
+		j := rand.Intn(len(nodes) - 1)
+		if j >= i {
+			j++
+		}
+		if b.outstanding[nodes[j].URL()] < b.outstanding[nodes[i].URL()] {
+			return nodes[j]
+		}
+		return nodes[i]
+	case consistentHash:
+		if routing != nil && routing.key != "" {
+			// rendezvous hashing: only the users of a node that
+			// leaves or joins the registry move to another one
+			var best lib.RegistryNode
+			var bestScore uint64
+			for _, n := range nodes {
+				h := fnv.New64a()
+				h.Write([]byte(routing.key))
+				h.Write([]byte(n.URL()))
+				if score := h.Sum64(); best == nil || score > bestScore {
+					best, bestScore = n, score
+				}
+			}
+			return best
+		}
+	}
+	if weights := getNodeWeights(nodes); weights != nil {
+		return b.chooseWeighted(rol, nodes, weights)
+	}
+	i := b.next[rol] % len(nodes)
+	b.next[rol] = i + 1
+	return nodes[i]
+}
+
+// chooseWeighted is the round robin of nodes with different weights. Each
+// node is picked in proportion to its weight, spread over the turn instead
+// of in a row (smooth weighted round robin). It must be called with b.mu held.
+func (b *loadBalancer) chooseWeighted(rol string, nodes []lib.RegistryNode, weights []int) lib.RegistryNode {
+	// nodes that left the registry are forgotten
+	current := map[string]int{}
+	total := 0
+	best := 0
+	for i, n := range nodes {
+		current[n.URL()] = b.current[rol][n.URL()] + weights[i]
+		total += weights[i]
+		if current[n.URL()] > current[nodes[best].URL()] {
+			best = i
+		}
+	}
+	current[nodes[best].URL()] -= total
+	b.current[rol] = current
+	return nodes[best]
+}
+
+// getNodeWeights returns the weights of nodes, set by registry drivers
+// like the dns one, or nil if they all weigh the same.
+func getNodeWeights(nodes []lib.RegistryNode) []int {
+	weights := make([]int, len(nodes))
+	same := true
+	for i, n := range nodes {
+		m, ok := n.(registryNodeMetadata)
+		if !ok {
+			return nil
+		}
+		weight, err := strconv.Atoi(m.Metadata()["weight"])
+		if err != nil || weight < 0 {
+			return nil
+		}
+		weights[i] = weight
+		same = same && weight == weights[0]
+	}
+	if same {
+		return nil
+	}
+	return weights
+}
+
+// getUntriedNodes returns the nodes not tried by a previous attempt of the
+// request, or all of them if all were tried.
+func getUntriedNodes(nodes []lib.RegistryNode, tried *triedNodes) []lib.RegistryNode {
+	untried := []lib.RegistryNode{}
+	for _, n := range nodes {
+		if !tried.has(n.URL()) {
+			untried = append(untried, n)
+		}
+	}
+	if len(untried) == 0 {
+		return nodes
+	}
+	return untried
+}
+
+// release records that the request sent to node n of rol finished.
+func (b *loadBalancer) release(rol string, n lib.RegistryNode, failed bool) {
+	b.mu.Lock()
+	b.outstanding[n.URL()]--
+	if b.outstanding[n.URL()] <= 0 {
+		delete(b.outstanding, n.URL())
+	}
+	b.mu.Unlock()
+	b.health.report(rol, n, failed)
+}
+
+// getWebServiceName returns the web service of a registry role,
+// e.g. data for data-node or data-node-proxy.
+func getWebServiceName(rol string) string {
+	return strings.TrimSuffix(strings.TrimSuffix(rol, "-proxy"), "-node")
+}
+
+type routingContextKey struct{}
+
+// routing follows a request through the load balancers.
+type routing struct {
+	// key identifies the user, so the consistent hash strategy
+	// sends all the requests of a user to the same node.
+	key string
+
+	mu    sync.Mutex
+	nodes []pickedNode
+}
+
+type pickedNode struct {
+	balancer *loadBalancer
+	rol      string
+	node     lib.RegistryNode
+}
+
+func (r *routing) picked(b *loadBalancer, rol string, n lib.RegistryNode) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.nodes = append(r.nodes, pickedNode{balancer: b, rol: rol, node: n})
+}
+
+// done releases the nodes picked for the request, telling
+// whether the request failed because of them.
+func (r *routing) done(failed bool) {
+	r.mu.Lock()
+	nodes := r.nodes
+	r.nodes = nil
+	r.mu.Unlock()
+	for _, p := range nodes {
+		p.balancer.release(p.rol, p.node, failed)
+	}
+}
+
+func getRouting(ctx context.Context) *routing {
+	if ctx == nil {
+		return nil
+	}
+	r, _ := ctx.Value(routingContextKey{}).(*routing)
+	return r
+}
+
+// routingMiddleware attaches a routing to the request. Server errors and
+// timeouts count as failures of the upstream nodes that served the request,
+// canceled requests, by the client or because another attempt won, do not.
+func routingMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		routing := &routing{key: getRoutingKey(r)}
+		rw, wrapped := newResponseWriter(w)
+		ctx := context.WithValue(r.Context(), routingContextKey{}, routing)
+		next.ServeHTTP(wrapped, r.WithContext(ctx))
+		canceled := ctx.Err() == context.Canceled
+		routing.done(!canceled && (rw.status >= 500 || ctx.Err() == context.DeadlineExceeded))
+	})
+}
+
+// getRoutingKey returns the user of the request, from basic auth or from
+// the claims of its token, or the client address for anonymous requests.
+func getRoutingKey(r *http.Request) string {
+	if username, _, ok := r.BasicAuth(); ok && username != "" {
+		return username
+	}
+	token := r.Header.Get("token")
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		token = strings.TrimPrefix(auth, "Bearer ")
+	}
+	if username := getTokenUsername(token); username != "" {
+		return username
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// getTokenUsername returns the username in the claims of a JWT token.
+// The token is not verified, the username is only used to pick a node,
+// the node authenticates the request.
+func getTokenUsername(token string) string {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return ""
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "="))
+	if err != nil {
+		return ""
+	}
+	claims := map[string]interface{}{}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return ""
+	}
+	for _, claim := range []string{"username", "sub"} {
+		if username, ok := claims[claim].(string); ok && username != "" {
+			return username
+		}
+	}
+	return ""
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"github.com/clawio/lib"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// staticRegistryDriver returns the same nodes for every role.
+type staticRegistryDriver struct {
+	nodes []lib.RegistryNode
+}
+
+func (d *staticRegistryDriver) Register(ctx context.Context, n lib.RegistryNode) error {
+	return nil
+}
+
+func (d *staticRegistryDriver) GetNodesForRol(ctx context.Context, rol string) ([]lib.RegistryNode, error) {
+	return d.nodes, nil
+}
+
+func newTestNodes(urls ...string) []lib.RegistryNode {
+	nodes := []lib.RegistryNode{}
+	for _, url := range urls {
+		nodes = append(nodes, &node{xrol: "data-node", xurl: url})
+	}
+	return nodes
+}
+
+func newTestLoadBalancer(strategy string, nodes []lib.RegistryNode) *loadBalancer {
+	return newLoadBalancer(&staticRegistryDriver{nodes}, map[string]string{"data": strategy}, newTestUpstreamHealth())
+}
+
+// pick returns the URL of the node chosen for a request.
+func pick(t *testing.T, b *loadBalancer, ctx context.Context) string {
+	nodes, err := b.GetNodesForRol(ctx, "data-node")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(nodes) != 1 {
+		t.Fatalf("%d nodes returned, want 1", len(nodes))
+	}
+	return nodes[0].URL()
+}
+
+func TestLoadBalancerStrategies(t *testing.T) {
+	nodes := newTestNodes("http://c", "http://a", "http://b")
+	tests := []struct {
+		name        string
+		strategy    string
+		nodes       []lib.RegistryNode
+		outstanding map[string]int
+		key         string
+		want        []string
+	}{
+		{"round robin", roundRobin, nodes, nil, "", []string{"http://a", "http://b", "http://c", "http://a"}},
+		{"default is round robin", "", nodes, nil, "", []string{"http://a", "http://b", "http://c", "http://a"}},
+		// picks count as outstanding requests until they are released
+		{"least outstanding", leastOutstanding, nodes, map[string]int{"http://a": 3, "http://b": 1, "http://c": 2}, "", []string{"http://b", "http://b", "http://c", "http://a"}},
+		{"random of two picks the least loaded", randomOfTwo, newTestNodes("http://a", "http://b"), map[string]int{"http://a": 10}, "", []string{"http://b", "http://b", "http://b", "http://b"}},
+		{"consistent hash", consistentHash, nodes, nil, "alice", []string{"http://b", "http://b", "http://b", "http://b"}},
+		{"consistent hash without key", consistentHash, nodes, nil, "", []string{"http://a", "http://b", "http://c", "http://a"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := newTestLoadBalancer(tt.strategy, tt.nodes)
+			for url, n := range tt.outstanding {
+				b.outstanding[url] = n
+			}
+			got := []string{}
+			for range tt.want {
+				ctx := context.WithValue(context.Background(), routingContextKey{}, &routing{key: tt.key})
+				got = append(got, pick(t, b, ctx))
+			}
+			if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+				t.Fatalf("picked %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadBalancerWeightedRoundRobin(t *testing.T) {
+	weighted := func(weights ...string) []lib.RegistryNode {
+		nodes := []lib.RegistryNode{}
+		for i, weight := range weights {
+			nodes = append(nodes, &node{xrol: "data-node", xurl: fmt.Sprintf("http://%c", 'a'+i), xmetadata: map[string]string{"weight": weight}})
+		}
+		return nodes
+	}
+	tests := []struct {
+		name  string
+		nodes []lib.RegistryNode
+		want  []string
+	}{
+		{"spread over the turn", weighted("5", "1", "1"), []string{"a", "a", "b", "a", "c", "a", "a", "a", "a", "b"}},
+		{"same weights", weighted("3", "3"), []string{"a", "b", "a", "b"}},
+		{"all weights 0", weighted("0", "0"), []string{"a", "b", "a", "b"}},
+		{"weight 0 not picked while others are available", weighted("0", "1", "2"), []string{"c", "b", "c", "c", "b", "c"}},
+		{"invalid weight", weighted("2", "heavy"), []string{"a", "b", "a", "b"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := newTestLoadBalancer(roundRobin, tt.nodes)
+			got := []string{}
+			for range tt.want {
+				got = append(got, strings.TrimPrefix(pick(t, b, context.Background()), "http://"))
+			}
+			if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+				t.Fatalf("picked %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadBalancerConsistentHashStability(t *testing.T) {
+	urls := []string{}
+	for i := 0; i < 5; i++ {
+		urls = append(urls, fmt.Sprintf("http://node%d", i))
+	}
+	users := []string{}
+	for i := 0; i < 50; i++ {
+		users = append(users, fmt.Sprintf("user%d", i))
+	}
+	pickFor := func(b *loadBalancer, user string) string {
+		return pick(t, b, context.WithValue(context.Background(), routingContextKey{}, &routing{key: user}))
+	}
+
+	before := map[string]string{}
+	all := newTestLoadBalancer(consistentHash, newTestNodes(urls...))
+	for _, user := range users {
+		before[user] = pickFor(all, user)
+	}
+	// node0 leaves, only its users move
+	fewer := newTestLoadBalancer(consistentHash, newTestNodes(urls[1:]...))
+	for _, user := range users {
+		after := pickFor(fewer, user)
+		if before[user] != "http://node0" && after != before[user] {
+			t.Errorf("%s moved from %s to %s when node0 left", user, before[user], after)
+		}
+	}
+}
+
+func TestLoadBalancerSkipsTriedAndEjectedNodes(t *testing.T) {
+	nodes := newTestNodes("http://a", "http://b", "http://c")
+	tests := []struct {
+		name    string
+		tried   []string
+		ejected []string
+		want    string
+	}{
+		{"tried", []string{"http://a", "http://b"}, nil, "http://c"},
+		{"all tried", []string{"http://a", "http://b", "http://c"}, nil, "http://a"},
+		{"ejected", nil, []string{"http://a", "http://c"}, "http://b"},
+		{"all ejected", nil, []string{"http://a", "http://b", "http://c"}, "http://a"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := newTestLoadBalancer(roundRobin, nodes)
+			for _, url := range tt.ejected {
+				b.health.getState("data-node", url).healthy = false
+			}
+			tried := &triedNodes{urls: map[string]bool{}}
+			for _, url := range tt.tried {
+				tried.add(url)
+			}
+			ctx := context.WithValue(context.Background(), triedNodesContextKey{}, tried)
+			if got := pick(t, b, ctx); got != tt.want {
+				t.Fatalf("picked %s, want %s", got, tt.want)
+			}
+			if !tried.has(tt.want) {
+				t.Fatalf("picked node %s is not recorded as tried", tt.want)
+			}
+		})
+	}
+}
+
+func TestRoutingMiddlewareReleasesNodes(t *testing.T) {
+	tests := []struct {
+		name   string
+		status int
+		failed bool
+	}{
+		{"success", http.StatusOK, false},
+		{"client error", http.StatusNotFound, false},
+		{"server error", http.StatusBadGateway, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := newTestLoadBalancer(leastOutstanding, newTestNodes("http://a"))
+			handler := routingMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				pick(t, b, r.Context())
+				if b.outstanding["http://a"] != 1 {
+					t.Errorf("outstanding requests while serving = %d, want 1", b.outstanding["http://a"])
+				}
+				w.WriteHeader(tt.status)
+			}))
+			handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/download/file", nil))
+
+			if n := b.outstanding["http://a"]; n != 0 {
+				t.Errorf("outstanding requests after serving = %d, want 0", n)
+			}
+			failures := b.health.getState("data-node", "http://a").failures
+			if (failures > 0) != tt.failed {
+				t.Errorf("failures reported = %d, want failed %t", failures, tt.failed)
+			}
+		})
+	}
+}
+
+func TestGetWebServiceName(t *testing.T) {
+	tests := map[string]string{
+		"data-node":             "data",
+		"data-node-proxy":       "data",
+		"authentication-node":   "authentication",
+		"owncloud-node-proxy":   "owncloud",
+		"metadata":              "metadata",
+		"metadata-node-proxy-x": "metadata-node-proxy-x",
+	}
+	for rol, want := range tests {
+		if got := getWebServiceName(rol); got != want {
+			t.Errorf("getWebServiceName(%q) = %q, want %q", rol, got, want)
+		}
+	}
+}
+
+func newTestToken(claims string) string {
+	return "e30." + base64.RawURLEncoding.EncodeToString([]byte(claims)) + ".signature"
+}
+
+func TestGetRoutingKey(t *testing.T) {
+	tests := []struct {
+		name   string
+		header map[string]string
+		basic  string
+		want   string
+	}{
+		{"basic auth", nil, "alice", "alice"},
+		{"token header", map[string]string{"token": newTestToken(`{"username":"bob"}`)}, "", "bob"},
+		{"bearer token", map[string]string{"Authorization": "Bearer " + newTestToken(`{"sub":"carol"}`)}, "", "carol"},
+		{"token without username", map[string]string{"token": newTestToken(`{"exp":1}`)}, "", "192.0.2.1"},
+		{"invalid token", map[string]string{"token": "not-a-token"}, "", "192.0.2.1"},
+		{"anonymous", nil, "", "192.0.2.1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/", nil)
+			for k, v := range tt.header {
+				r.Header.Set(k, v)
+			}
+			if tt.basic != "" {
+				r.SetBasicAuth(tt.basic, "secret")
+			}
+			if got := getRoutingKey(r); got != tt.want {
+				t.Fatalf("getRoutingKey() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
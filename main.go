@@ -1,9 +1,11 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"flag"
 	"fmt"
+	"github.com/clawio/clawiod/drivers"
 	"github.com/clawio/lib"
 	"github.com/clawio/lib/authenticationmiddleware"
 	"github.com/clawio/lib/authenticationwebservice"
@@ -13,20 +15,10 @@ import (
 	"github.com/clawio/lib/corsmiddleware"
 	"github.com/clawio/lib/datawebservice"
 	"github.com/clawio/lib/datawebserviceclient"
-	"github.com/clawio/lib/dummyregistrydriver"
-	"github.com/clawio/lib/etcdregistrydriver"
-	"github.com/clawio/lib/fileconfigurationsource"
-	"github.com/clawio/lib/fsdatadriver"
-	"github.com/clawio/lib/fsmdatadriver"
-	"github.com/clawio/lib/jwttokendriver"
-	"github.com/clawio/lib/ldapuserdriver"
 	"github.com/clawio/lib/loggermiddleware"
-	"github.com/clawio/lib/memuserdriver"
 	"github.com/clawio/lib/metadatawebservice"
 	"github.com/clawio/lib/metadatawebserviceclient"
 	"github.com/clawio/lib/mimeguesser"
-	"github.com/clawio/lib/ocfsdatadriver"
-	"github.com/clawio/lib/ocfsmdatadriver"
 	"github.com/clawio/lib/ocwebservice"
 	"github.com/clawio/lib/proxiedauthenticationwebservice"
 	"github.com/clawio/lib/proxieddatawebservice"
@@ -40,16 +32,21 @@ import (
 	"gopkg.in/natefinch/lumberjack.v2"
 	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
 	"runtime"
 	"strconv"
 	"strings"
+	"syscall"
+	"time"
 )
 
 var (
 	flagConfigurationSource string
 	flagVersion             bool
+	flagShutdownTimeout     time.Duration
 )
 
 // Build information obtained with the help of -ldflags
@@ -64,35 +61,60 @@ var (
 func init() {
 	flag.StringVar(&flagConfigurationSource, "conf", "file:clawiod.conf", "Configuration source where to obtain the configuration")
 	flag.BoolVar(&flagVersion, "version", false, "Show version")
-	flag.Parse()
+	flag.DurationVar(&flagShutdownTimeout, "shutdowntimeout", 30*time.Second, "Time to wait for in-flight requests to finish when shutting down")
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s [flags] [command]\n\nCommands:\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  check-config\tvalidate the configuration and exit\n")
+		fmt.Fprintf(os.Stderr, "  drivers\tlist the drivers compiled in and exit\n")
+		fmt.Fprintf(os.Stderr, "  registry ls|get <id>|rm <id>\tinspect and manage the nodes in the registry and exit\n")
+		fmt.Fprintf(os.Stderr, "  routes [-output table|json|openapi]\tlist the routes of the configuration and exit\n\nFlags:\n")
+		flag.PrintDefaults()
+	}
 }
 
 func main() {
+	// parsed here and not in init so the flags of go test are not rejected
+	flag.Parse()
 	if flagVersion {
 		handleVersion()
 	}
 
+	switch flag.Arg(0) {
+	case "":
+	case "check-config":
+		handleCheckConfig()
+	case "drivers":
+		handleDrivers()
+	case "registry":
+		handleRegistry(flag.Args()[1:])
+	case "routes":
+		handleRoutes(flag.Args()[1:])
+	default:
+		fmt.Printf("command %q does not exist\n", flag.Arg(0))
+		os.Exit(1)
+	}
+
 	configurationSource, err := getConfigurationSource(flagConfigurationSource)
 	if err != nil {
 		fmt.Println(err)
 		fmt.Println("can not instantiate configuration source")
 		os.Exit(1)
 	}
-	config, err := configurationSource.LoadConfiguration()
+	config, err := loadConfiguration(configurationSource)
 	if err != nil {
 		fmt.Println(err)
 		fmt.Println("can not load configuration")
 		os.Exit(1)
 	}
 
-	logger, err := getLogger(config)
+	server, err := newServer(config)
 	if err != nil {
 		fmt.Println(err)
-		fmt.Println("can not instantiate logger")
+		fmt.Println("can not instantiate server")
 		os.Exit(1)
 	}
 
-	mainLogger := logger.With("pkg", "main")
+	mainLogger := server.getLogger().With("pkg", "main")
 
 	// Set CPU capacity
 	err = setCPU(config.GetCPU())
@@ -101,32 +123,121 @@ func main() {
 		os.Exit(1)
 	}
 
-	server, err := newServer(config)
+	listeners, err := listen(config, server.conns, server.getLogger().With("pkg", "listener"))
 	if err != nil {
-		mainLogger.Error().Log("error", err)
+		mainLogger.Crit().Log("msg", "error listening", "error", err)
 		os.Exit(1)
 	}
-
-	hostname, err := os.Hostname()
+	defer listeners.Close()
+	httpServer, err := newHTTPServer(config, server)
+	if err != nil {
+		mainLogger.Crit().Log("msg", "error configuring http server", "error", err)
+		os.Exit(1)
+	}
+	serveErrors := make(chan error, len(listeners.public)+1)
+	for _, ln := range listeners.public {
+		go func(ln net.Listener) {
+			serveErrors <- httpServer.Serve(ln)
+		}(ln)
+	}
+	// the admin endpoints are served even while the public
+	// listeners are drained, e.g. to watch the shutdown
+	adminServer, err := newHTTPServer(config, http.HandlerFunc(server.serveAdmin))
 	if err != nil {
-		mainLogger.Error().Log("error", err)
+		mainLogger.Crit().Log("msg", "error configuring admin http server", "error", err)
 		os.Exit(1)
 	}
+	if listeners.admin != nil {
+		go func() {
+			serveErrors <- adminServer.Serve(listeners.admin)
+		}()
+	}
 
-	addr := fmt.Sprintf(":%d", config.GetPort())
-	if config.IsTLSEnabled() {
-		mainLogger.Info().Log("msg", "serving secure client requests", "addr", fmt.Sprintf("https://%s:%d", hostname, config.GetPort()))
-		mainLogger.Error().Log("error", http.ListenAndServeTLS(
-			addr,
-			config.GetTLSCertificate(),
-			config.GetTLSPrivateKey(),
-			server))
-	} else {
-		mainLogger.Warn().Log("msg", "serving insecure client requests", "addr", fmt.Sprintf("http://%s:%d", hostname, config.GetPort()))
-		mainLogger.Error().Log("error", http.ListenAndServe(
-			addr,
-			server))
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+
+	stopWatching := make(chan struct{})
+	defer close(stopWatching)
+	configurationChanges := watchConfiguration(configurationSource, stopWatching)
+
+	reload := func(reason string) {
+		mainLogger.Info().Log("msg", "reloading configuration", "reason", reason)
+		err := reloadConfiguration(configurationSource, server)
+		if err != nil {
+			mainLogger.Error().Log("msg", "configuration rejected, keep serving with the current one", "error", err)
+			return
+		}
+		// the previous logger is closed once its in-flight requests finish
+		mainLogger = server.getLogger().With("pkg", "main")
+		mainLogger.Info().Log("msg", "configuration reloaded")
+	}
+
+wait:
+	for {
+		select {
+		case err := <-serveErrors:
+			mainLogger.Error().Log("error", err)
+			os.Exit(1)
+		case <-configurationChanges:
+			reload("configuration source changed")
+		case sig := <-signals:
+			if sig == syscall.SIGHUP {
+				reload(sig.String())
+				continue
+			}
+			mainLogger.Info().Log("msg", "shutting down", "signal", sig, "timeout", flagShutdownTimeout)
+			break wait
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), flagShutdownTimeout)
+	defer cancel()
+
+	// leave the registry first so proxies stop sending us new requests
+	// while the in-flight ones are drained.
+	if err := server.stop(ctx); err != nil {
+		mainLogger.Error().Log("msg", "error unregistering node", "error", err)
+	}
+	if err := httpServer.Shutdown(ctx); err != nil {
+		mainLogger.Error().Log("msg", "error draining in-flight requests", "error", err)
+		os.Exit(1)
+	}
+	adminServer.Close()
+	mainLogger.Info().Log("msg", "server stopped")
+	server.close()
+}
+
+// loadConfiguration loads the configuration from configurationSource.
+// The sources of this package also load the settings only used by the daemon.
+func loadConfiguration(configurationSource lib.ConfigurationSource) (*configuration, error) {
+	c, err := configurationSource.LoadConfiguration()
+	if err != nil {
+		return nil, err
+	}
+	config, ok := c.(*configuration)
+	if !ok {
+		return nil, fmt.Errorf("configuration source returned an unsupported configuration %T", c)
+	}
+	return config, nil
+}
+
+// reloadConfiguration loads the configuration again from the configuration source
+// and applies it to the running server. On error the server is left untouched.
+func reloadConfiguration(configurationSource lib.ConfigurationSource, s *server) error {
+	config, err := loadConfiguration(configurationSource)
+	if err != nil {
+		return err
+	}
+	numCPU, err := getCPU(config.GetCPU())
+	if err != nil {
+		return err
+	}
+	err = s.reload(config)
+	if err != nil {
+		return err
 	}
+	runtime.GOMAXPROCS(numCPU)
+	return nil
 }
 
 func handleVersion() {
@@ -138,525 +249,643 @@ func handleVersion() {
 	fmt.Printf("%s %s commit:%s dev-build\n", appName, gitNearestTag, gitCommit)
 	os.Exit(0)
 }
-func getUserDriver(config lib.Configuration) (lib.UserDriver, error) {
-	switch config.GetUserDriver() {
-	case "memuserdriver":
-		return memuserdriver.New(config.GetMemUserDriverUsers()), nil
-	case "ldapuserdriver":
-		logger, err := getLogger(config)
-		if err != nil {
-			return nil, err
-		}
-		return ldapuserdriver.New(logger,
-			config.GetLDAPUserDriverBindUsername(),
-			config.GetLDAPUserDriverBindPassword(),
-			config.GetLDAPUserDriverHostname(),
-			config.GetLDAPUserDriverPort(),
-			config.GetLDAPUserDriverBaseDN(),
-			config.GetLDAPUserDriverFilter())
-	default:
-		return nil, errors.New("configured user driver does not exist")
+
+// getVersion returns the version of the build: the tag for
+// release builds and the nearest tag plus the commit for dev builds.
+func getVersion() string {
+	if gitTag != "" {
+		return gitNearestTag
 	}
+	if gitNearestTag == "" && gitCommit == "" {
+		return "unknown"
+	}
+	return fmt.Sprintf("%s+%s", gitNearestTag, gitCommit)
 }
 
-func getTokenDriver(config lib.Configuration) (lib.TokenDriver, error) {
-	switch config.GetTokenDriver() {
-	case "jwttokendriver":
-		cm, err := getContextManager(config)
-		if err != nil {
-			return nil, err
-		}
-		logger, err := getLogger(config)
-		if err != nil {
-			return nil, err
-		}
-		return jwttokendriver.New(config.GetJWTTokenDriverKey(), cm, logger), nil
-	default:
-		return nil, errors.New("configured token driver does not exist")
+// handleDrivers prints the drivers compiled in, by kind.
+func handleDrivers() {
+	for _, kind := range drivers.Kinds() {
+		fmt.Printf("%s drivers: %s\n", kind, strings.Join(drivers.Names(kind), ", "))
 	}
-
+	os.Exit(0)
 }
 
-func getDataDriver(config lib.Configuration) (lib.DataDriver, error) {
-	switch config.GetDataDriver() {
-	case "fsdatadriver":
-		logger, err := getLogger(config)
-		if err != nil {
-			return nil, err
+func getUserDriver(c *container) (lib.UserDriver, error) {
+	v, err := c.get("userdriver", func(config lib.Configuration) (interface{}, error) {
+		factory, ok := drivers.UserDriver(config.GetUserDriver())
+		if !ok {
+			return nil, errors.New("configured user driver does not exist")
 		}
-		return fsdatadriver.New(
-			logger,
-			config.GetFSDataDriverDataFolder(),
-			config.GetFSDataDriverTemporaryFolder(),
-			config.GetFSDataDriverChecksum(),
-			config.GetFSDataDriverVerifyClientChecksum())
-	case "ocfsdatadriver":
-		logger, err := getLogger(config)
-		if err != nil {
-			return nil, err
-		}
-		metaDataDriver, err := getMetaDataDriver(config)
-		if err != nil {
-			return nil, err
-		}
-		return ocfsdatadriver.New(logger,
-			config.GetOCFSDataDriverDataFolder(),
-			config.GetOCFSDataDriverTemporaryFolder(),
-			config.GetOCFSDataDriverChunksFolder(),
-			config.GetOCFSDataDriverChecksum(),
-			config.GetOCFSDataDriverVerifyClientChecksum(),
-			metaDataDriver)
-	default:
-		return nil, errors.New("configured datadriver does not exist")
-
+		return factory(c)
+	})
+	if err != nil {
+		return nil, err
 	}
-
+	return v.(lib.UserDriver), nil
 }
 
-func getMetaDataDriver(config lib.Configuration) (lib.MetaDataDriver, error) {
-	switch config.GetMetaDataDriver() {
-	case "fsmdatadriver":
-		logger, err := getLogger(config)
-		if err != nil {
-			return nil, err
+func getTokenDriver(c *container) (lib.TokenDriver, error) {
+	v, err := c.get("tokendriver", func(config lib.Configuration) (interface{}, error) {
+		factory, ok := drivers.TokenDriver(config.GetTokenDriver())
+		if !ok {
+			return nil, errors.New("configured token driver does not exist")
 		}
-		return fsmdatadriver.New(
-			logger,
-			config.GetFSMDataDriverDataFolder(),
-			config.GetFSMDataDriverTemporaryFolder())
-	case "ocfsmdatadriver":
-		logger, err := getLogger(config)
-		if err != nil {
-			return nil, err
-		}
-		return ocfsmdatadriver.New(logger,
-			nil,
-			config.GetOCFSMDataDriverMaxSQLIddle(),
-			config.GetOCFSMDataDriverMaxSQLConcurrent(),
-			config.GetOCFSMDataDriverDataFolder(),
-			config.GetOCFSMDataDriverTemporaryFolder(),
-			config.GetOCFSMDataDriverDSN())
-	default:
-		return nil, errors.New("configured metadata driver does not exist")
+		return factory(c)
+	})
+	if err != nil {
+		return nil, err
 	}
+	return v.(lib.TokenDriver), nil
 }
 
-func getContextManager(config lib.Configuration) (lib.ContextManager, error) {
-	// only one
-	return contextmanager.New(), nil
+func getDataDriver(c *container) (lib.DataDriver, error) {
+	v, err := c.get("datadriver", func(config lib.Configuration) (interface{}, error) {
+		factory, ok := drivers.DataDriver(config.GetDataDriver())
+		if !ok {
+			return nil, errors.New("configured datadriver does not exist")
+		}
+		return factory(c)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return v.(lib.DataDriver), nil
 }
 
-func getMimeGuesser(config lib.Configuration) (lib.MimeGuesser, error) {
-	return mimeguesser.New(), nil
+func getMetaDataDriver(c *container) (lib.MetaDataDriver, error) {
+	v, err := c.get("metadatadriver", func(config lib.Configuration) (interface{}, error) {
+		factory, ok := drivers.MetaDataDriver(config.GetMetaDataDriver())
+		if !ok {
+			return nil, errors.New("configured metadata driver does not exist")
+		}
+		return factory(c)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return v.(lib.MetaDataDriver), nil
 }
 
-func getAuthenticationMiddleware(config lib.Configuration) (lib.AuthenticationMiddleware, error) {
-	cm, err := getContextManager(config)
+func getContextManager(c *container) (lib.ContextManager, error) {
+	v, err := c.get("contextmanager", func(config lib.Configuration) (interface{}, error) {
+		// only one
+		return contextmanager.New(), nil
+	})
 	if err != nil {
 		return nil, err
 	}
-	tokenDriver, err := getTokenDriver(config)
+	return v.(lib.ContextManager), nil
+}
+
+func getMimeGuesser(c *container) (lib.MimeGuesser, error) {
+	v, err := c.get("mimeguesser", func(config lib.Configuration) (interface{}, error) {
+		return mimeguesser.New(), nil
+	})
 	if err != nil {
 		return nil, err
 	}
-	return authenticationmiddleware.New(cm, tokenDriver), nil
+	return v.(lib.MimeGuesser), nil
 }
 
-func getBasicAuthMiddleware(config lib.Configuration) (lib.BasicAuthMiddleware, error) {
-	switch config.GetBasicAuthMiddleware() {
-	case "local":
-		cm, err := getContextManager(config)
+func getAuthenticationMiddleware(c *container) (lib.AuthenticationMiddleware, error) {
+	v, err := c.get("authenticationmiddleware", func(config lib.Configuration) (interface{}, error) {
+		cm, err := getContextManager(c)
 		if err != nil {
 			return nil, err
 		}
-		tokenDriver, err := getTokenDriver(config)
+		tokenDriver, err := getTokenDriver(c)
 		if err != nil {
 			return nil, err
 		}
-		userDriver, err := getUserDriver(config)
-		if err != nil {
-			return nil, err
+		return authenticationmiddleware.New(cm, tokenDriver), nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return v.(lib.AuthenticationMiddleware), nil
+}
+
+func getBasicAuthMiddleware(c *container) (lib.BasicAuthMiddleware, error) {
+	v, err := c.get("basicauthmiddleware", func(config lib.Configuration) (interface{}, error) {
+		switch config.GetBasicAuthMiddleware() {
+		case "local":
+			cm, err := getContextManager(c)
+			if err != nil {
+				return nil, err
+			}
+			tokenDriver, err := getTokenDriver(c)
+			if err != nil {
+				return nil, err
+			}
+			userDriver, err := getUserDriver(c)
+			if err != nil {
+				return nil, err
+			}
+			return basicauthmiddleware.New(cm, userDriver, tokenDriver, config.GetBasicAuthMiddlewareCookieName()), nil
+		case "remote":
+			cm, err := getContextManager(c)
+			if err != nil {
+				return nil, err
+			}
+			tokenDriver, err := getTokenDriver(c)
+			if err != nil {
+				return nil, err
+			}
+			authenticationWebServiceClient, err := getAuthenticationWebServiceClient(c)
+			if err != nil {
+				return nil, err
+			}
+			return remotebasicauthmiddleware.New(cm, authenticationWebServiceClient, tokenDriver, config.GetBasicAuthMiddleware()), nil
+		default:
+			return nil, fmt.Errorf("configured basic auth middleware does not exit")
 		}
-		return basicauthmiddleware.New(cm, userDriver, tokenDriver, config.GetBasicAuthMiddlewareCookieName()), nil
-	case "remote":
-		cm, err := getContextManager(config)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return v.(lib.BasicAuthMiddleware), nil
+}
+
+func getLogger(c *container) (levels.Levels, error) {
+	v, err := c.get("logger", func(config lib.Configuration) (interface{}, error) {
+		hostname, err := os.Hostname()
 		if err != nil {
-			return nil, err
+			return levels.Levels{}, err
 		}
-		tokenDriver, err := getTokenDriver(config)
+		out, err := getLogWriter(c,
+			config.GetAppLoggerOut(),
+			config.GetAppLoggerMaxSize(),
+			config.GetAppLoggerMaxAge(),
+			config.GetAppLoggerMaxBackups())
 		if err != nil {
-			return nil, err
+			return levels.Levels{}, err
 		}
-		authenticationWebServiceClient, err := getAuthenticationWebServiceClient(config)
-		if err != nil {
-			return nil, err
-		}
-		return remotebasicauthmiddleware.New(cm, authenticationWebServiceClient, tokenDriver, config.GetBasicAuthMiddleware()), nil
-	default:
-		return nil, fmt.Errorf("configured basic auth middleware does not exit")
-	}
-}
-
-func getLogger(config lib.Configuration) (levels.Levels, error) {
-	hostname, err := os.Hostname()
+		hostname = fmt.Sprintf("%s:%d", hostname, config.GetPort())
+		l := log.NewLogfmtLogger(log.NewSyncWriter(out))
+		l = log.NewContext(l).With("ts", log.DefaultTimestampUTC, "caller", log.DefaultCaller, "host", hostname)
+		return levels.New(l), nil
+	})
 	if err != nil {
 		return levels.Levels{}, err
 	}
-	var out io.Writer
-	switch config.GetAppLoggerOut() {
-	case "1":
-		out = os.Stdout
-	case "2":
-		out = os.Stderr
-	case "":
-		out = ioutil.Discard
-	default:
-		out = &lumberjack.Logger{
-			Filename:   config.GetAppLoggerOut() + "@" + hostname,
-			MaxSize:    config.GetAppLoggerMaxSize(),
-			MaxAge:     config.GetAppLoggerMaxAge(),
-			MaxBackups: config.GetAppLoggerMaxBackups()}
-	}
-	hostname = fmt.Sprintf("%s:%d", hostname, config.GetPort())
-	l := log.NewLogfmtLogger(log.NewSyncWriter(out))
-	l = log.NewContext(l).With("ts", log.DefaultTimestampUTC, "caller", log.DefaultCaller, "host", hostname)
-	return levels.New(l), nil
+	return v.(levels.Levels), nil
 }
 
-func getHTTPLogger(config lib.Configuration) (io.Writer, error) {
-	hostname, err := os.Hostname()
-	if err != nil {
-		return nil, err
-	}
-	var out io.Writer
-	switch config.GetHTTPAccessLoggerOut() {
+func getHTTPLogger(c *container) (io.Writer, error) {
+	config := c.config
+	return getLogWriter(c,
+		config.GetHTTPAccessLoggerOut(),
+		config.GetHTTPAccessLoggerMaxSize(),
+		config.GetHTTPAccessLoggerMaxAge(),
+		config.GetHTTPAccessLoggerMaxBackups())
+}
+
+// getLogWriter returns the writer for a log output: "1" for stdout, "2" for stderr,
+// empty to discard and a file path otherwise. Files are suffixed with "@<hostname>"
+// and rotated. Loggers writing to the same file share the writer so rotation
+// happens only once.
+func getLogWriter(c *container, out string, maxSize, maxAge, maxBackups int) (io.Writer, error) {
+	switch out {
 	case "1":
-		out = os.Stdout
+		return os.Stdout, nil
 	case "2":
-		out = os.Stderr
+		return os.Stderr, nil
 	case "":
-		out = ioutil.Discard
-	default:
-		out = &lumberjack.Logger{
-			Filename:   config.GetHTTPAccessLoggerOut() + "@" + hostname,
-			MaxAge:     config.GetHTTPAccessLoggerMaxAge(),
-			MaxBackups: config.GetHTTPAccessLoggerMaxBackups(),
-			MaxSize:    config.GetHTTPAccessLoggerMaxSize(),
-		}
+		return ioutil.Discard, nil
 	}
-	return out, nil
-}
-
-func getLoggerMiddleware(config lib.Configuration) (lib.LoggerMiddleware, error) {
-	logger, err := getLogger(config)
+	hostname, err := os.Hostname()
 	if err != nil {
 		return nil, err
 	}
-	cm, err := getContextManager(config)
+	filename := out + "@" + hostname
+	v, err := c.get("logwriter:"+filename, func(config lib.Configuration) (interface{}, error) {
+		return &lumberjack.Logger{
+			Filename:   filename,
+			MaxSize:    maxSize,
+			MaxAge:     maxAge,
+			MaxBackups: maxBackups,
+		}, nil
+	})
 	if err != nil {
 		return nil, err
 	}
-	return loggermiddleware.New(cm, logger), nil
+	return v.(io.Writer), nil
 }
 
-func getAuthenticationWebService(config lib.Configuration) (lib.WebService, error) {
-	switch config.GetAuthenticationWebService() {
-	case "local":
-		logger, err := getLogger(config)
-		if err != nil {
-			return nil, err
-		}
-		cm, err := getContextManager(config)
-		if err != nil {
-			return nil, err
-		}
-		userDriver, err := getUserDriver(config)
-		if err != nil {
-			return nil, err
-		}
-		tokenDriver, err := getTokenDriver(config)
+func getLoggerMiddleware(c *container) (lib.LoggerMiddleware, error) {
+	v, err := c.get("loggermiddleware", func(config lib.Configuration) (interface{}, error) {
+		logger, err := getLogger(c)
 		if err != nil {
 			return nil, err
 		}
-		authenticationMiddleware, err := getAuthenticationMiddleware(config)
+		cm, err := getContextManager(c)
 		if err != nil {
 			return nil, err
 		}
-		webErrorConverter, err := getWebErrorConverter(config)
-		if err != nil {
-			return nil, err
-		}
-		return authenticationwebservice.New(cm,
-			logger,
-			userDriver,
-			tokenDriver,
-			authenticationMiddleware,
-			webErrorConverter,
-			config.GetAuthenticationWebServiceMethodAgnostic()), nil
-	case "proxied":
-		logger, err := getLogger(config)
-		if err != nil {
-			return nil, err
-		}
-		logger.With("pkg", "proxiedauthenticationwebservice")
+		return loggermiddleware.New(cm, logger), nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return v.(lib.LoggerMiddleware), nil
+}
 
-		registryDriver, err := getRegistryDriver(config)
-		if err != nil {
-			return nil, err
-		}
-		return proxiedauthenticationwebservice.New(logger, registryDriver)
-	default:
-		return nil, errors.New("configured authentication web service does not exist")
+func getAuthenticationWebService(c *container) (lib.WebService, error) {
+	v, err := c.get("authenticationwebservice", func(config lib.Configuration) (interface{}, error) {
+		switch config.GetAuthenticationWebService() {
+		case "local":
+			logger, err := getLogger(c)
+			if err != nil {
+				return nil, err
+			}
+			cm, err := getContextManager(c)
+			if err != nil {
+				return nil, err
+			}
+			userDriver, err := getUserDriver(c)
+			if err != nil {
+				return nil, err
+			}
+			tokenDriver, err := getTokenDriver(c)
+			if err != nil {
+				return nil, err
+			}
+			authenticationMiddleware, err := getAuthenticationMiddleware(c)
+			if err != nil {
+				return nil, err
+			}
+			webErrorConverter, err := getWebErrorConverter(c)
+			if err != nil {
+				return nil, err
+			}
+			return authenticationwebservice.New(cm,
+				logger,
+				userDriver,
+				tokenDriver,
+				authenticationMiddleware,
+				webErrorConverter,
+				config.GetAuthenticationWebServiceMethodAgnostic()), nil
+		case "proxied":
+			logger, err := getLogger(c)
+			if err != nil {
+				return nil, err
+			}
+			logger.With("pkg", "proxiedauthenticationwebservice")
+
+			loadBalancer, err := getLoadBalancer(c)
+			if err != nil {
+				return nil, err
+			}
+			proxied, err := proxiedauthenticationwebservice.New(logger, loadBalancer)
+			if err != nil {
+				return nil, err
+			}
+			return getProxiedWebService(c, proxied, "authentication-node", logger)
+		default:
+			return nil, errors.New("configured authentication web service does not exist")
 
+		}
+	})
+	if err != nil {
+		return nil, err
 	}
+	return v.(lib.WebService), nil
 }
 
-func getDataWebService(config lib.Configuration) (lib.WebService, error) {
-	switch config.GetDataWebService() {
-	case "local":
-		logger, err := getLogger(config)
-		if err != nil {
-			return nil, err
-		}
-		cm, err := getContextManager(config)
-		if err != nil {
-			return nil, err
-		}
-		dataDriver, err := getDataDriver(config)
-		if err != nil {
-			return nil, err
-		}
-		authenticationMiddleware, err := getAuthenticationMiddleware(config)
-		if err != nil {
-			return nil, err
-		}
-		webErrorConverter, err := getWebErrorConverter(config)
-		if err != nil {
-			return nil, err
-		}
-		return datawebservice.New(cm,
-			logger,
-			dataDriver,
-			authenticationMiddleware,
-			webErrorConverter,
-			config.GetDataWebServiceMaxUploadFileSize()), nil
-	case "proxied":
-		logger, err := getLogger(config)
-		if err != nil {
-			return nil, err
-		}
-		logger = logger.With("pkg", "proxieddatawebservice")
+func getDataWebService(c *container) (lib.WebService, error) {
+	v, err := c.get("datawebservice", func(config lib.Configuration) (interface{}, error) {
+		switch config.GetDataWebService() {
+		case "local":
+			logger, err := getLogger(c)
+			if err != nil {
+				return nil, err
+			}
+			cm, err := getContextManager(c)
+			if err != nil {
+				return nil, err
+			}
+			dataDriver, err := getDataDriver(c)
+			if err != nil {
+				return nil, err
+			}
+			authenticationMiddleware, err := getAuthenticationMiddleware(c)
+			if err != nil {
+				return nil, err
+			}
+			webErrorConverter, err := getWebErrorConverter(c)
+			if err != nil {
+				return nil, err
+			}
+			return datawebservice.New(cm,
+				logger,
+				dataDriver,
+				authenticationMiddleware,
+				webErrorConverter,
+				config.GetDataWebServiceMaxUploadFileSize()), nil
+		case "proxied":
+			logger, err := getLogger(c)
+			if err != nil {
+				return nil, err
+			}
+			logger = logger.With("pkg", "proxieddatawebservice")
 
-		registryDriver, err := getRegistryDriver(config)
-		if err != nil {
-			return nil, err
-		}
+			loadBalancer, err := getLoadBalancer(c)
+			if err != nil {
+				return nil, err
+			}
 
-		return proxieddatawebservice.New(logger, registryDriver)
+			proxied, err := proxieddatawebservice.New(logger, loadBalancer)
+			if err != nil {
+				return nil, err
+			}
+			return getProxiedWebService(c, proxied, "data-node", logger)
 
-	default:
-		return nil, errors.New("configured data webservice does not exist")
+		default:
+			return nil, errors.New("configured data webservice does not exist")
 
+		}
+	})
+	if err != nil {
+		return nil, err
 	}
+	return v.(lib.WebService), nil
 }
 
-func getMetaDataWebService(config lib.Configuration) (lib.WebService, error) {
-	switch config.GetMetaDataWebService() {
-	case "local":
-		logger, err := getLogger(config)
-		if err != nil {
-			return nil, err
-		}
-		cm, err := getContextManager(config)
-		if err != nil {
-			return nil, err
-		}
-		metaDataDriver, err := getMetaDataDriver(config)
-		if err != nil {
-			return nil, err
-		}
-		authenticationMiddleware, err := getAuthenticationMiddleware(config)
-		if err != nil {
-			return nil, err
-		}
-		webErrorConverter, err := getWebErrorConverter(config)
-		if err != nil {
-			return nil, err
-		}
-		return metadatawebservice.New(
-			cm,
-			logger,
-			metaDataDriver,
-			authenticationMiddleware,
-			webErrorConverter,
-		), nil
-	case "proxied":
-		logger, err := getLogger(config)
-		if err != nil {
-			return nil, err
-		}
-		logger = logger.With("pkg", "proxiedmetadatawebservice")
+func getMetaDataWebService(c *container) (lib.WebService, error) {
+	v, err := c.get("metadatawebservice", func(config lib.Configuration) (interface{}, error) {
+		switch config.GetMetaDataWebService() {
+		case "local":
+			logger, err := getLogger(c)
+			if err != nil {
+				return nil, err
+			}
+			cm, err := getContextManager(c)
+			if err != nil {
+				return nil, err
+			}
+			metaDataDriver, err := getMetaDataDriver(c)
+			if err != nil {
+				return nil, err
+			}
+			authenticationMiddleware, err := getAuthenticationMiddleware(c)
+			if err != nil {
+				return nil, err
+			}
+			webErrorConverter, err := getWebErrorConverter(c)
+			if err != nil {
+				return nil, err
+			}
+			return metadatawebservice.New(
+				cm,
+				logger,
+				metaDataDriver,
+				authenticationMiddleware,
+				webErrorConverter,
+			), nil
+		case "proxied":
+			logger, err := getLogger(c)
+			if err != nil {
+				return nil, err
+			}
+			logger = logger.With("pkg", "proxiedmetadatawebservice")
 
-		registryDriver, err := getRegistryDriver(config)
-		if err != nil {
-			return nil, err
+			loadBalancer, err := getLoadBalancer(c)
+			if err != nil {
+				return nil, err
+			}
+			proxied, err := proxiedmetadatawebservice.New(logger, loadBalancer)
+			if err != nil {
+				return nil, err
+			}
+			return getProxiedWebService(c, proxied, "metadata-node", logger)
+		default:
+			return nil, errors.New("configured metadata webservice does not exist")
 		}
-		return proxiedmetadatawebservice.New(logger, registryDriver)
-	default:
-		return nil, errors.New("configured metadata webservice does not exist")
+	})
+	if err != nil {
+		return nil, err
 	}
+	return v.(lib.WebService), nil
 }
 
-func getOCWebService(config lib.Configuration) (lib.WebService, error) {
-	switch config.GetOCWebService() {
-	case "local":
-		logger, err := getLogger(config)
-		if err != nil {
-			return nil, err
-		}
-		cm, err := getContextManager(config)
-		if err != nil {
-			return nil, err
-		}
-		dataDriver, err := getDataDriver(config)
-		if err != nil {
-			return nil, err
-		}
-		metaDataDriver, err := getMetaDataDriver(config)
-		if err != nil {
-			return nil, err
+func getOCWebService(c *container) (lib.WebService, error) {
+	v, err := c.get("ocwebservice", func(config lib.Configuration) (interface{}, error) {
+		switch config.GetOCWebService() {
+		case "local":
+			logger, err := getLogger(c)
+			if err != nil {
+				return nil, err
+			}
+			cm, err := getContextManager(c)
+			if err != nil {
+				return nil, err
+			}
+			dataDriver, err := getDataDriver(c)
+			if err != nil {
+				return nil, err
+			}
+			metaDataDriver, err := getMetaDataDriver(c)
+			if err != nil {
+				return nil, err
+			}
+			webErrorConverter, err := getWebErrorConverter(c)
+			if err != nil {
+				return nil, err
+			}
+			mimeGuesser, err := getMimeGuesser(c)
+			if err != nil {
+				return nil, err
+			}
+			basicAuthMiddleware, err := getBasicAuthMiddleware(c)
+			if err != nil {
+				return nil, err
+			}
+			return ocwebservice.New(cm,
+				logger,
+				dataDriver,
+				metaDataDriver,
+				basicAuthMiddleware,
+				webErrorConverter,
+				mimeGuesser,
+				config.GetOCWebServiceMaxUploadFileSize()), nil
+		case "proxied":
+			logger, err := getLogger(c)
+			if err != nil {
+				return nil, err
+			}
+			logger = logger.With("pkg", "proxiedocwebservice")
+
+			loadBalancer, err := getLoadBalancer(c)
+			if err != nil {
+				return nil, err
+			}
+			proxied, err := proxiedocwebservice.New(logger, loadBalancer)
+			if err != nil {
+				return nil, err
+			}
+			return getProxiedWebService(c, proxied, "owncloud-node", logger)
+		case "remote":
+			logger, err := getLogger(c)
+			if err != nil {
+				return nil, err
+			}
+			cm, err := getContextManager(c)
+			if err != nil {
+				return nil, err
+			}
+			webErrorConverter, err := getWebErrorConverter(c)
+			if err != nil {
+				return nil, err
+			}
+			mimeGuesser, err := getMimeGuesser(c)
+			if err != nil {
+				return nil, err
+			}
+			basicAuthMiddleware, err := getBasicAuthMiddleware(c)
+			if err != nil {
+				return nil, err
+			}
+			dataWebServiceClient, err := getDataWebServiceClient(c)
+			if err != nil {
+				return nil, err
+			}
+			metaDataWebServiceClient, err := getMetaDataWebServiceClient(c)
+			if err != nil {
+				return nil, err
+			}
+			return remoteocwebservice.New(cm,
+				logger,
+				dataWebServiceClient,
+				metaDataWebServiceClient,
+				basicAuthMiddleware,
+				webErrorConverter,
+				mimeGuesser,
+				config.GetRemoteOCWebServiceMaxUploadFileSize()), nil
+		default:
+			return nil, errors.New("configured oc webservice does not exist")
+
 		}
-		webErrorConverter, err := getWebErrorConverter(config)
-		if err != nil {
+	})
+	if err != nil {
+		return nil, err
+	}
+	return v.(lib.WebService), nil
+}
+
+// getProxiedWebService returns the web service serving the endpoints of
+// proxied, a proxied web service of lib, with the node transport.
+func getProxiedWebService(c *container, proxied lib.WebService, rol string, logger levels.Levels) (lib.WebService, error) {
+	loadBalancer, err := getLoadBalancer(c)
+	if err != nil {
+		return nil, err
+	}
+	transport, err := getNodeTransport(c)
+	if err != nil {
+		return nil, err
+	}
+	return newProxiedWebService(proxied, rol, loadBalancer, transport, logger), nil
+}
+
+// checkWebServiceClient fails if the web service clients of lib can not reach
+// the nodes: they send their requests with http.DefaultTransport, without the
+// settings of the node transport.
+func checkWebServiceClient(config *configuration) error {
+	if config.IsMTLSEnabled() {
+		return errors.New("the remote owncloud web service and basic auth middleware can not be used with mutual TLS, the web service clients of lib can not present the node certificate")
+	}
+	return nil
+}
+
+func getDataWebServiceClient(c *container) (lib.DataWebServiceClient, error) {
+	v, err := c.get("datawebserviceclient", func(config lib.Configuration) (interface{}, error) {
+		if err := checkWebServiceClient(c.config); err != nil {
 			return nil, err
 		}
-		mimeGuesser, err := getMimeGuesser(config)
+		logger, err := getLogger(c)
 		if err != nil {
 			return nil, err
 		}
-		basicAuthMiddleware, err := getBasicAuthMiddleware(config)
+		cm, err := getContextManager(c)
 		if err != nil {
 			return nil, err
 		}
-		return ocwebservice.New(cm,
-			logger,
-			dataDriver,
-			metaDataDriver,
-			basicAuthMiddleware,
-			webErrorConverter,
-			mimeGuesser,
-			config.GetOCWebServiceMaxUploadFileSize()), nil
-	case "proxied":
-		logger, err := getLogger(config)
+		loadBalancer, err := getLoadBalancer(c)
 		if err != nil {
 			return nil, err
 		}
-		logger = logger.With("pkg", "proxiedocwebservice")
+		return datawebserviceclient.New(logger, cm, loadBalancer), nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return v.(lib.DataWebServiceClient), nil
+}
 
-		registryDriver, err := getRegistryDriver(config)
-		if err != nil {
+func getMetaDataWebServiceClient(c *container) (lib.MetaDataWebServiceClient, error) {
+	v, err := c.get("metadatawebserviceclient", func(config lib.Configuration) (interface{}, error) {
+		if err := checkWebServiceClient(c.config); err != nil {
 			return nil, err
 		}
-		return proxiedocwebservice.New(logger, registryDriver)
-	case "remote":
-		logger, err := getLogger(config)
+		logger, err := getLogger(c)
 		if err != nil {
 			return nil, err
 		}
-		cm, err := getContextManager(config)
+		cm, err := getContextManager(c)
 		if err != nil {
 			return nil, err
 		}
-		webErrorConverter, err := getWebErrorConverter(config)
+		loadBalancer, err := getLoadBalancer(c)
 		if err != nil {
 			return nil, err
 		}
-		mimeGuesser, err := getMimeGuesser(config)
-		if err != nil {
+		return metadatawebserviceclient.New(logger, cm, loadBalancer), nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return v.(lib.MetaDataWebServiceClient), nil
+}
+
+func getAuthenticationWebServiceClient(c *container) (lib.AuthenticationWebServiceClient, error) {
+	v, err := c.get("authenticationwebserviceclient", func(config lib.Configuration) (interface{}, error) {
+		if err := checkWebServiceClient(c.config); err != nil {
 			return nil, err
 		}
-		basicAuthMiddleware, err := getBasicAuthMiddleware(config)
+		logger, err := getLogger(c)
 		if err != nil {
 			return nil, err
 		}
-		dataWebServiceClient, err := getDataWebServiceClient(config)
+		cm, err := getContextManager(c)
 		if err != nil {
 			return nil, err
 		}
-		metaDataWebServiceClient, err := getMetaDataWebServiceClient(config)
+		loadBalancer, err := getLoadBalancer(c)
 		if err != nil {
 			return nil, err
 		}
-		return remoteocwebservice.New(cm,
-			logger,
-			dataWebServiceClient,
-			metaDataWebServiceClient,
-			basicAuthMiddleware,
-			webErrorConverter,
-			mimeGuesser,
-			config.GetRemoteOCWebServiceMaxUploadFileSize()), nil
-	default:
-		return nil, errors.New("configured oc webservice does not exist")
-
-	}
-}
-
-func getDataWebServiceClient(config lib.Configuration) (lib.DataWebServiceClient, error) {
-	logger, err := getLogger(config)
-	if err != nil {
-		return nil, err
-	}
-	cm, err := getContextManager(config)
+		return authenticationwebserviceclient.New(logger, cm, loadBalancer), nil
+	})
 	if err != nil {
 		return nil, err
 	}
-	registryDriver, err := getRegistryDriver(config)
-	if err != nil {
-		return nil, err
-	}
-	return datawebserviceclient.New(logger, cm, registryDriver), nil
-}
-
-func getMetaDataWebServiceClient(config lib.Configuration) (lib.MetaDataWebServiceClient, error) {
-	logger, err := getLogger(config)
-	if err != nil {
-		return nil, err
-	}
-	cm, err := getContextManager(config)
-	if err != nil {
-		return nil, err
-	}
-	registryDriver, err := getRegistryDriver(config)
-	if err != nil {
-		return nil, err
-	}
-	return metadatawebserviceclient.New(logger, cm, registryDriver), nil
-
+	return v.(lib.AuthenticationWebServiceClient), nil
 }
 
-func getAuthenticationWebServiceClient(config lib.Configuration) (lib.AuthenticationWebServiceClient, error) {
-	logger, err := getLogger(config)
-	if err != nil {
-		return nil, err
-	}
-	cm, err := getContextManager(config)
-	if err != nil {
-		return nil, err
-	}
-	registryDriver, err := getRegistryDriver(config)
-	if err != nil {
-		return nil, err
-	}
-	return authenticationwebserviceclient.New(logger, cm, registryDriver), nil
-}
+// getConfigurationSource returns the configuration source described by source.
+// The format is <protocol>:<specific> and defaults to the file protocol. Available protocols:
+//
+//	file:clawiod.conf           settings from a json file
+//	env:CLAWIOD_                settings from environment variables with the given prefix
+//	etcd:/clawiod/config?watch=true  settings from the keys under an etcd prefix, optionally watched
+//	layered:file:clawiod.conf,env:  merge of several sources, later ones override earlier ones
 func getConfigurationSource(source string) (lib.ConfigurationSource, error) {
-	var protocol string
-	var specific string
-	parts := strings.Split(source, ":")
-	if len(parts) == 0 {
+	if source == "" {
 		return nil, errors.New("configuration source is empty")
 	}
-	if len(parts) >= 2 {
+	var protocol string
+	var specific string
+	parts := strings.SplitN(source, ":", 2)
+	if len(parts) == 2 {
 		protocol = parts[0]
 		specific = parts[1]
 	} else {
@@ -667,7 +896,28 @@ func getConfigurationSource(source string) (lib.ConfigurationSource, error) {
 	}
 	switch protocol {
 	case "file":
-		return fileconfigurationsource.New(specific)
+		return newFileConfigurationSource(specific)
+	case "env":
+		return newEnvConfigurationSource(specific)
+	case "etcd":
+		return newEtcdConfigurationSource(specific)
+	case "layered":
+		layers := []settingsSource{}
+		for _, layerSource := range strings.Split(specific, ",") {
+			if strings.HasPrefix(layerSource, "layered:") {
+				return nil, errors.New("layered configuration sources can not be nested")
+			}
+			layer, err := getConfigurationSource(layerSource)
+			if err != nil {
+				return nil, err
+			}
+			settingsSource, ok := layer.(settingsSource)
+			if !ok {
+				return nil, fmt.Errorf("configuration source %q can not be used as a layer", layerSource)
+			}
+			layers = append(layers, settingsSource)
+		}
+		return newLayeredConfigurationSource(layers...)
 	default:
 		return nil, errors.New("configuration protocol does not exist")
 
@@ -675,42 +925,130 @@ func getConfigurationSource(source string) (lib.ConfigurationSource, error) {
 
 }
 
-func getRegistryDriver(config lib.Configuration) (lib.RegistryDriver, error) {
-	logger, err := getLogger(config)
+// configurationWatcher is implemented by configuration sources
+// able to notify when the configuration changes.
+type configurationWatcher interface {
+	watch(stop <-chan struct{}) <-chan struct{}
+}
+
+// watchConfiguration returns a channel that receives a value every time the configuration
+// of source changes. It returns nil if the source can not be watched.
+func watchConfiguration(source lib.ConfigurationSource, stop <-chan struct{}) <-chan struct{} {
+	watcher, ok := source.(configurationWatcher)
+	if !ok {
+		return nil
+	}
+	return watcher.watch(stop)
+}
+
+func getRegistryDriver(c *container) (lib.RegistryDriver, error) {
+	v, err := c.get("registrydriver", func(config lib.Configuration) (interface{}, error) {
+		name := config.GetRegistryDriver()
+		factory, ok := drivers.RegistryDriver(name)
+		if !ok {
+			if name != "" {
+				logger, err := getLogger(c)
+				if err != nil {
+					return nil, err
+				}
+				logger.Warn().Log("msg", "configured registry driver does not exist, using dummy registry driver", "registrydriver", name)
+			}
+			// use dummy implementation
+			factory, _ = drivers.RegistryDriver("dummy")
+		}
+		return factory(c)
+	})
 	if err != nil {
 		return nil, err
 	}
-	logger = logger.With("pkg", "etcdregistrydriver")
+	return v.(lib.RegistryDriver), nil
+}
 
-	switch config.GetRegistryDriver() {
-	case "etcd":
-		return etcdregistrydriver.New(
-			logger,
-			config.GetETCDRegistryDriverUrls(),
-			config.GetETCDRegistryDriverKey(),
-			config.GetETCDRegistryDriverUsername(),
-			config.GetETCDRegistryDriverPassword())
-	default:
-		// use dummy implementation
-		return dummyregistrydriver.New(), nil
+// getLoadBalancer returns the registry driver used to reach other nodes.
+// It chooses one node per request with the strategy of each web service.
+func getLoadBalancer(c *container) (*loadBalancer, error) {
+	v, err := c.get("loadbalancer", func(config lib.Configuration) (interface{}, error) {
+		registryDriver, err := getRegistryDriver(c)
+		if err != nil {
+			return nil, err
+		}
+		health, err := getUpstreamHealth(c)
+		if err != nil {
+			return nil, err
+		}
+		return newLoadBalancer(registryDriver, getLoadBalancingStrategies(c.config), health), nil
+	})
+	if err != nil {
+		return nil, err
 	}
+	return v.(*loadBalancer), nil
 }
 
-func getWebErrorConverter(config lib.Configuration) (lib.WebErrorConverter, error) {
-	return weberrorconverter.New(), nil
+// getUpstreamHealth returns the health of the nodes reached through the load balancer.
+func getUpstreamHealth(c *container) (*upstreamHealth, error) {
+	v, err := c.get("upstreamhealth", func(config lib.Configuration) (interface{}, error) {
+		logger, err := getLogger(c)
+		if err != nil {
+			return nil, err
+		}
+		registryDriver, err := getRegistryDriver(c)
+		if err != nil {
+			return nil, err
+		}
+		transport, err := getNodeTransport(c)
+		if err != nil {
+			return nil, err
+		}
+		return newUpstreamHealth(registryDriver, logger.With("pkg", "upstream"), getUpstreamHealthSettings(c.config), transport), nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return v.(*upstreamHealth), nil
+}
+
+// getNodeTransport returns the transport of the requests to other nodes.
+func getNodeTransport(c *container) (*nodeTransport, error) {
+	v, err := c.get("nodetransport", func(config lib.Configuration) (interface{}, error) {
+		logger, err := getLogger(c)
+		if err != nil {
+			return nil, err
+		}
+		return newNodeTransport(c.config, logger.With("pkg", "mtls"))
+	})
+	if err != nil {
+		return nil, err
+	}
+	return v.(*nodeTransport), nil
 }
 
-func getCORSMiddleware(config lib.Configuration) (lib.CorsMiddleware, error) {
-	logger, err := getLogger(config)
+func getWebErrorConverter(c *container) (lib.WebErrorConverter, error) {
+	v, err := c.get("weberrorconverter", func(config lib.Configuration) (interface{}, error) {
+		return weberrorconverter.New(), nil
+	})
 	if err != nil {
 		return nil, err
 	}
+	return v.(lib.WebErrorConverter), nil
+}
 
-	return corsmiddleware.New(
-		logger.With("pkg", "corsmiddleware"),
-		config.GetCORSMiddlewareAccessControlAllowOrigin(),
-		config.GetCORSMiddlewareAccessControlAllowMethods(),
-		config.GetCORSMiddlewareAccessControlAllowHeaders()), nil
+func getCORSMiddleware(c *container) (lib.CorsMiddleware, error) {
+	v, err := c.get("corsmiddleware", func(config lib.Configuration) (interface{}, error) {
+		logger, err := getLogger(c)
+		if err != nil {
+			return nil, err
+		}
+
+		return corsmiddleware.New(
+			logger.With("pkg", "corsmiddleware"),
+			config.GetCORSMiddlewareAccessControlAllowOrigin(),
+			config.GetCORSMiddlewareAccessControlAllowMethods(),
+			config.GetCORSMiddlewareAccessControlAllowHeaders()), nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return v.(lib.CorsMiddleware), nil
 }
 
 func find(needle string, haystack []string) bool {
@@ -722,11 +1060,12 @@ func find(needle string, haystack []string) bool {
 	return false
 }
 
-func getWebServices(config lib.Configuration) (map[string]lib.WebService, error) {
+func getWebServices(c *container) (map[string]lib.WebService, error) {
+	config := c.config
 	enabledWebServices := strings.Split(config.GetEnabledWebServices(), ",")
 	webServices := map[string]lib.WebService{}
 	if find("authentication", enabledWebServices) {
-		authenticationWebService, err := getAuthenticationWebService(config)
+		authenticationWebService, err := getAuthenticationWebService(c)
 		if err != nil {
 			return nil, err
 		}
@@ -734,7 +1073,7 @@ func getWebServices(config lib.Configuration) (map[string]lib.WebService, error)
 	}
 
 	if find("data", enabledWebServices) {
-		dataWebService, err := getDataWebService(config)
+		dataWebService, err := getDataWebService(c)
 		if err != nil {
 			return nil, err
 		}
@@ -742,7 +1081,7 @@ func getWebServices(config lib.Configuration) (map[string]lib.WebService, error)
 	}
 
 	if find("metadata", enabledWebServices) {
-		metaDataWebService, err := getMetaDataWebService(config)
+		metaDataWebService, err := getMetaDataWebService(c)
 		if err != nil {
 			return nil, err
 		}
@@ -750,7 +1089,7 @@ func getWebServices(config lib.Configuration) (map[string]lib.WebService, error)
 	}
 
 	if find("owncloud", enabledWebServices) {
-		ownCloudWebService, err := getOCWebService(config)
+		ownCloudWebService, err := getOCWebService(c)
 		if err != nil {
 			return nil, err
 		}
@@ -763,6 +1102,17 @@ func getWebServices(config lib.Configuration) (map[string]lib.WebService, error)
 // according to its value. It accepts either
 // a number (e.g. 3) or a percent (e.g. 50%).
 func setCPU(cpu string) error {
+	numCPU, err := getCPU(cpu)
+	if err != nil {
+		return err
+	}
+	runtime.GOMAXPROCS(numCPU)
+	return nil
+}
+
+// getCPU parses string cpu and returns the number
+// of CPUs to use, capped to the available ones.
+func getCPU(cpu string) (int, error) {
 	var numCPU int
 
 	availCPU := runtime.NumCPU()
@@ -773,7 +1123,7 @@ func setCPU(cpu string) error {
 		pctStr := cpu[:len(cpu)-1]
 		pctInt, err := strconv.Atoi(pctStr)
 		if err != nil || pctInt < 1 || pctInt > 100 {
-			return errors.New("invalid CPU value: percentage must be between 1-100")
+			return 0, errors.New("invalid CPU value: percentage must be between 1-100")
 		}
 		percent = float32(pctInt) / 100
 		numCPU = int(float32(availCPU) * percent)
@@ -781,7 +1131,7 @@ func setCPU(cpu string) error {
 		// Number
 		num, err := strconv.Atoi(cpu)
 		if err != nil || num < 1 {
-			return errors.New("invalid CPU value: provide a number or percent greater than 0")
+			return 0, errors.New("invalid CPU value: provide a number or percent greater than 0")
 		}
 		numCPU = num
 	}
@@ -789,7 +1139,5 @@ func setCPU(cpu string) error {
 	if numCPU > availCPU {
 		numCPU = availCPU
 	}
-
-	runtime.GOMAXPROCS(numCPU)
-	return nil
+	return numCPU, nil
 }
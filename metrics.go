@@ -0,0 +1,233 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+var (
+	httpRequestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "clawiod",
+		Subsystem: "http",
+		Name:      "requests_total",
+		Help:      "Number of HTTP requests served by web service, route, method and status code.",
+	}, []string{"webservice", "route", "method", "code"})
+
+	httpRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "clawiod",
+		Subsystem: "http",
+		Name:      "request_duration_seconds",
+		Help:      "Latency of HTTP requests by web service, route and method.",
+		Buckets:   []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60, 300},
+	}, []string{"webservice", "route", "method"})
+
+	httpRequestSize = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "clawiod",
+		Subsystem: "http",
+		Name:      "request_size_bytes",
+		Help:      "Size of HTTP request bodies by web service, route and method.",
+		Buckets:   prometheus.ExponentialBuckets(256, 4, 12),
+	}, []string{"webservice", "route", "method"})
+
+	httpResponseSize = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "clawiod",
+		Subsystem: "http",
+		Name:      "response_size_bytes",
+		Help:      "Size of HTTP response bodies by web service, route and method.",
+		Buckets:   prometheus.ExponentialBuckets(256, 4, 12),
+	}, []string{"webservice", "route", "method"})
+
+	httpRequestsInFlight = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "clawiod",
+		Subsystem: "http",
+		Name:      "requests_in_flight",
+		Help:      "Number of HTTP requests being served by web service and route.",
+	}, []string{"webservice", "route"})
+
+	registryRegistrationsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "clawiod",
+		Subsystem: "registry",
+		Name:      "registrations_total",
+		Help:      "Number of attempts to register the node by result.",
+	}, []string{"result"})
+
+	registryLastRegistration = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "clawiod",
+		Subsystem: "registry",
+		Name:      "last_registration_timestamp_seconds",
+		Help:      "Unix time of the last successful registration of the node.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(
+		httpRequestsTotal,
+		httpRequestDuration,
+		httpRequestSize,
+		httpResponseSize,
+		httpRequestsInFlight,
+		registryRegistrationsTotal,
+		registryLastRegistration,
+	)
+}
+
+// newRegistrationAgeMetric returns a metric with the seconds elapsed since the last
+// successful registration of s, or -1 if it was never registered.
+func newRegistrationAgeMetric(s *server) prometheus.GaugeFunc {
+	return prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: "clawiod",
+		Subsystem: "registry",
+		Name:      "last_registration_age_seconds",
+		Help:      "Seconds since the last successful registration of the node, -1 if never registered.",
+	}, func() float64 {
+		state := s.heartbeat.getState()
+		if state.lastSuccess.IsZero() {
+			return -1
+		}
+		return time.Since(state.lastSuccess).Seconds()
+	})
+}
+
+// observeRegistration records the result of an attempt to register the node.
+func observeRegistration(err error) {
+	if err != nil {
+		registryRegistrationsTotal.WithLabelValues("failure").Inc()
+		return
+	}
+	registryRegistrationsTotal.WithLabelValues("success").Inc()
+	registryLastRegistration.Set(float64(time.Now().Unix()))
+}
+
+// instrumentHandler records the metrics of the requests served by
+// the route of a web service.
+func instrumentHandler(webService, route string, next http.Handler) http.Handler {
+	inFlight := httpRequestsInFlight.WithLabelValues(webService, route)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		inFlight.Inc()
+		defer inFlight.Dec()
+
+		start := time.Now()
+		body := &countingReader{ReadCloser: r.Body}
+		if r.Body != nil {
+			r.Body = body
+		}
+		rw, wrapped := newResponseWriter(w)
+		next.ServeHTTP(wrapped, r)
+
+		method := getMethodLabel(r.Method)
+		httpRequestsTotal.WithLabelValues(webService, route, method, strconv.Itoa(rw.status)).Inc()
+		httpRequestDuration.WithLabelValues(webService, route, method).Observe(time.Since(start).Seconds())
+		httpRequestSize.WithLabelValues(webService, route, method).Observe(float64(body.n))
+		httpResponseSize.WithLabelValues(webService, route, method).Observe(float64(rw.written))
+	})
+}
+
+// methodLabels are the methods with their own label value, the ones of
+// HTTP and WebDAV. Any other method is labeled "other", so clients can
+// not create series at will.
+var methodLabels = map[string]bool{
+	"GET": true, "HEAD": true, "POST": true, "PUT": true, "DELETE": true,
+	"OPTIONS": true, "PATCH": true, "PROPFIND": true, "PROPPATCH": true,
+	"MKCOL": true, "COPY": true, "MOVE": true, "LOCK": true, "UNLOCK": true,
+}
+
+func getMethodLabel(method string) string {
+	if methodLabels[method] {
+		return method
+	}
+	return "other"
+}
+
+// countingReader counts the bytes read from a request body.
+type countingReader struct {
+	io.ReadCloser
+	n int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.n += int64(n)
+	return n, err
+}
+
+// responseWriter records the status code and the number of bytes written
+// to a response.
+type responseWriter struct {
+	http.ResponseWriter
+	status      int
+	written     int64
+	wroteHeader bool
+}
+
+// newResponseWriter returns the recorder of the response written to w and
+// the writer to pass to handlers. The writer implements http.Flusher,
+// http.CloseNotifier and http.Hijacker only when w does, web services and
+// proxies check them to stream, cancel and upgrade requests.
+func newResponseWriter(w http.ResponseWriter) (*responseWriter, http.ResponseWriter) {
+	rw := &responseWriter{ResponseWriter: w, status: http.StatusOK}
+	f, flusher := w.(http.Flusher)
+	cn, closeNotifier := w.(http.CloseNotifier)
+	h, hijacker := w.(http.Hijacker)
+	switch {
+	case flusher && closeNotifier && hijacker:
+		return rw, struct {
+			*responseWriter
+			http.Flusher
+			http.CloseNotifier
+			http.Hijacker
+		}{rw, f, cn, h}
+	case flusher && closeNotifier:
+		return rw, struct {
+			*responseWriter
+			http.Flusher
+			http.CloseNotifier
+		}{rw, f, cn}
+	case flusher && hijacker:
+		return rw, struct {
+			*responseWriter
+			http.Flusher
+			http.Hijacker
+		}{rw, f, h}
+	case closeNotifier && hijacker:
+		return rw, struct {
+			*responseWriter
+			http.CloseNotifier
+			http.Hijacker
+		}{rw, cn, h}
+	case flusher:
+		return rw, struct {
+			*responseWriter
+			http.Flusher
+		}{rw, f}
+	case closeNotifier:
+		return rw, struct {
+			*responseWriter
+			http.CloseNotifier
+		}{rw, cn}
+	case hijacker:
+		return rw, struct {
+			*responseWriter
+			http.Hijacker
+		}{rw, h}
+	default:
+		return rw, rw
+	}
+}
+
+func (w *responseWriter) WriteHeader(code int) {
+	if !w.wroteHeader {
+		w.status = code
+		w.wroteHeader = true
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *responseWriter) Write(p []byte) (int, error) {
+	w.wroteHeader = true
+	n, err := w.ResponseWriter.Write(p)
+	w.written += int64(n)
+	return n, err
+}
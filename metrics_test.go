@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestGetMethodLabel(t *testing.T) {
+	tests := []struct {
+		method string
+		want   string
+	}{
+		{"GET", "GET"},
+		{"PUT", "PUT"},
+		{"PROPFIND", "PROPFIND"},
+		{"MOVE", "MOVE"},
+		{"get", "other"},
+		{"BREW", "other"},
+		{"", "other"},
+	}
+	for _, tt := range tests {
+		if got := getMethodLabel(tt.method); got != tt.want {
+			t.Errorf("getMethodLabel(%q) = %q, want %q", tt.method, got, tt.want)
+		}
+	}
+}
+
+type testFlusher struct{}
+
+func (testFlusher) Flush() {}
+
+type testCloseNotifier struct{ c chan bool }
+
+func (n testCloseNotifier) CloseNotify() <-chan bool { return n.c }
+
+type testHijacker struct{}
+
+func (testHijacker) Hijack() (net.Conn, *bufio.ReadWriter, error) { return nil, nil, nil }
+
+func TestNewResponseWriterInterfaces(t *testing.T) {
+	tests := []struct {
+		name                             string
+		w                                http.ResponseWriter
+		flusher, closeNotifier, hijacker bool
+	}{
+		{"plain", struct{ http.ResponseWriter }{httptest.NewRecorder()}, false, false, false},
+		{"flusher", struct {
+			http.ResponseWriter
+			testFlusher
+		}{httptest.NewRecorder(), testFlusher{}}, true, false, false},
+		{"close notifier", struct {
+			http.ResponseWriter
+			testCloseNotifier
+		}{httptest.NewRecorder(), testCloseNotifier{}}, false, true, false},
+		{"hijacker", struct {
+			http.ResponseWriter
+			testHijacker
+		}{httptest.NewRecorder(), testHijacker{}}, false, false, true},
+		{"flusher and close notifier", struct {
+			http.ResponseWriter
+			testFlusher
+			testCloseNotifier
+		}{httptest.NewRecorder(), testFlusher{}, testCloseNotifier{}}, true, true, false},
+		{"flusher and hijacker", struct {
+			http.ResponseWriter
+			testFlusher
+			testHijacker
+		}{httptest.NewRecorder(), testFlusher{}, testHijacker{}}, true, false, true},
+		{"close notifier and hijacker", struct {
+			http.ResponseWriter
+			testCloseNotifier
+			testHijacker
+		}{httptest.NewRecorder(), testCloseNotifier{}, testHijacker{}}, false, true, true},
+		{"all", struct {
+			http.ResponseWriter
+			testFlusher
+			testCloseNotifier
+			testHijacker
+		}{httptest.NewRecorder(), testFlusher{}, testCloseNotifier{}, testHijacker{}}, true, true, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rw, w := newResponseWriter(tt.w)
+			if _, ok := w.(http.Flusher); ok != tt.flusher {
+				t.Errorf("http.Flusher %t, want %t", ok, tt.flusher)
+			}
+			if _, ok := w.(http.CloseNotifier); ok != tt.closeNotifier {
+				t.Errorf("http.CloseNotifier %t, want %t", ok, tt.closeNotifier)
+			}
+			if _, ok := w.(http.Hijacker); ok != tt.hijacker {
+				t.Errorf("http.Hijacker %t, want %t", ok, tt.hijacker)
+			}
+
+			w.WriteHeader(http.StatusCreated)
+			w.Write([]byte("hello"))
+			if rw.status != http.StatusCreated || rw.written != 5 {
+				t.Errorf("recorded status %d and %d bytes, want 201 and 5", rw.status, rw.written)
+			}
+		})
+	}
+}
+
+func TestNewResponseWriterCloseNotify(t *testing.T) {
+	closed := make(chan bool, 1)
+	_, w := newResponseWriter(struct {
+		http.ResponseWriter
+		testCloseNotifier
+	}{httptest.NewRecorder(), testCloseNotifier{closed}})
+	closed <- true
+	select {
+	case <-w.(http.CloseNotifier).CloseNotify():
+	default:
+		t.Fatal("CloseNotify() does not notify when the wrapped writer does")
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/gorilla/mux"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// webServiceMount is where the endpoints of a web service are served:
+// under a path prefix and only for some host names, e.g. /api/v1/data
+// for api.example.com.
+type webServiceMount struct {
+	pathPrefix string
+	hosts      []string
+}
+
+// getWebServiceMounts returns the mount of every web service.
+func getWebServiceMounts(config *configuration) map[string]*webServiceMount {
+	return map[string]*webServiceMount{
+		"authentication": newWebServiceMount(config.GetAuthenticationWebServicePathPrefix(), config.GetAuthenticationWebServiceHosts()),
+		"data":           newWebServiceMount(config.GetDataWebServicePathPrefix(), config.GetDataWebServiceHosts()),
+		"metadata":       newWebServiceMount(config.GetMetaDataWebServicePathPrefix(), config.GetMetaDataWebServiceHosts()),
+		"owncloud":       newWebServiceMount(config.GetOCWebServicePathPrefix(), config.GetOCWebServiceHosts()),
+	}
+}
+
+func newWebServiceMount(pathPrefix, hosts string) *webServiceMount {
+	m := &webServiceMount{pathPrefix: pathPrefix}
+	for _, host := range strings.Split(hosts, ",") {
+		if host = strings.ToLower(strings.TrimSpace(host)); host != "" {
+			m.hosts = append(m.hosts, host)
+		}
+	}
+	return m
+}
+
+func (m *webServiceMount) validate() error {
+	if m.pathPrefix != "" && (!strings.HasPrefix(m.pathPrefix, "/") || strings.HasSuffix(m.pathPrefix, "/")) {
+		return errors.New("path prefix must start with / and must not end with /")
+	}
+	for _, host := range m.hosts {
+		if strings.ContainsAny(host, "/:") {
+			return fmt.Errorf("host %q must be a host name without scheme, port or path", host)
+		}
+	}
+	return nil
+}
+
+// conflicts reports whether m and o serve the same requests: they are
+// mounted on the same path prefix for a host name in common. A mount
+// without hosts is served for any host. Web services mounted at the root
+// for any host do not conflict, their endpoints have different paths.
+func (m *webServiceMount) conflicts(o *webServiceMount) bool {
+	if m.pathPrefix != o.pathPrefix {
+		return false
+	}
+	if len(m.hosts) == 0 || len(o.hosts) == 0 {
+		return m.pathPrefix != "" || len(m.hosts) > 0 || len(o.hosts) > 0
+	}
+	for _, host := range m.hosts {
+		if find(host, o.hosts) {
+			return true
+		}
+	}
+	return false
+}
+
+// router returns the router the endpoints of the web service are added to.
+// Other nodes reach the node by nodeHost, the host of its registered URL,
+// so the requests for it are served whatever the hosts of the mount are.
+func (m *webServiceMount) router(router *mux.Router, nodeHost string) *mux.Router {
+	if m.pathPrefix == "" && len(m.hosts) == 0 {
+		return router
+	}
+	route := router.NewRoute()
+	if len(m.hosts) > 0 {
+		route = route.MatcherFunc(matchHosts(append([]string{strings.ToLower(nodeHost)}, m.hosts...)))
+	}
+	if m.pathPrefix != "" {
+		route = route.PathPrefix(m.pathPrefix)
+	}
+	return route.Subrouter()
+}
+
+// handler serves next with the paths the web service defines,
+// without the path prefix.
+func (m *webServiceMount) handler(next http.Handler) http.Handler {
+	if m.pathPrefix == "" {
+		return next
+	}
+	return http.StripPrefix(m.pathPrefix, next)
+}
+
+// matchHosts matches the requests for any of hosts, whatever the port.
+func matchHosts(hosts []string) mux.MatcherFunc {
+	return func(r *http.Request, _ *mux.RouteMatch) bool {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		host = strings.ToLower(host)
+		for _, h := range hosts {
+			if host == h {
+				return true
+			}
+		}
+		return false
+	}
+}
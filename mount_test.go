@@ -0,0 +1,135 @@
+package main
+
+import (
+	"github.com/gorilla/mux"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestNewWebServiceMount(t *testing.T) {
+	tests := []struct {
+		hosts string
+		want  []string
+	}{
+		{"", nil},
+		{"files.example.com", []string{"files.example.com"}},
+		{" Files.Example.com , api.example.com,", []string{"files.example.com", "api.example.com"}},
+	}
+	for _, tt := range tests {
+		m := newWebServiceMount("", tt.hosts)
+		if strings.Join(m.hosts, ",") != strings.Join(tt.want, ",") {
+			t.Errorf("newWebServiceMount(%q) hosts = %q, want %q", tt.hosts, m.hosts, tt.want)
+		}
+	}
+}
+
+func TestWebServiceMountValidate(t *testing.T) {
+	tests := []struct {
+		pathPrefix string
+		hosts      string
+		isErr      bool
+	}{
+		{"", "", false},
+		{"/api/v1/data", "files.example.com", false},
+		{"api", "", true},
+		{"/api/", "", true},
+		{"", "http://files.example.com", true},
+		{"", "files.example.com:443", true},
+	}
+	for _, tt := range tests {
+		err := newWebServiceMount(tt.pathPrefix, tt.hosts).validate()
+		if tt.isErr != (err != nil) {
+			t.Errorf("validate(%q, %q) = %v, want error %t", tt.pathPrefix, tt.hosts, err, tt.isErr)
+		}
+	}
+}
+
+func TestWebServiceMountConflicts(t *testing.T) {
+	tests := []struct {
+		name      string
+		a, b      *webServiceMount
+		conflicts bool
+	}{
+		{"both at the root", newWebServiceMount("", ""), newWebServiceMount("", ""), false},
+		{"different prefixes", newWebServiceMount("/data", ""), newWebServiceMount("/meta", ""), false},
+		{"same prefix", newWebServiceMount("/api", ""), newWebServiceMount("/api", ""), true},
+		{"same prefix and host", newWebServiceMount("/api", "a.example.com"), newWebServiceMount("/api", "a.example.com,b.example.com"), true},
+		{"same prefix other hosts", newWebServiceMount("/api", "a.example.com"), newWebServiceMount("/api", "b.example.com"), false},
+		{"same prefix any host", newWebServiceMount("/api", "a.example.com"), newWebServiceMount("/api", ""), true},
+		{"root for a host and for any host", newWebServiceMount("", "a.example.com"), newWebServiceMount("", ""), true},
+		{"root for other hosts", newWebServiceMount("", "a.example.com"), newWebServiceMount("", "b.example.com"), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.a.conflicts(tt.b); got != tt.conflicts {
+				t.Errorf("a.conflicts(b) = %t, want %t", got, tt.conflicts)
+			}
+			if got := tt.b.conflicts(tt.a); got != tt.conflicts {
+				t.Errorf("b.conflicts(a) = %t, want %t", got, tt.conflicts)
+			}
+		})
+	}
+}
+
+func TestCheckMounts(t *testing.T) {
+	tests := []struct {
+		name     string
+		config   *configuration
+		enabled  []string
+		problems int
+	}{
+		{"defaults", &configuration{}, webServiceNames, 0},
+		{"different prefixes", &configuration{
+			DataWebServicePathPrefix:     "/data",
+			MetaDataWebServicePathPrefix: "/meta",
+		}, webServiceNames, 0},
+		{"same prefix", &configuration{
+			DataWebServicePathPrefix:     "/api",
+			MetaDataWebServicePathPrefix: "/api",
+		}, webServiceNames, 1},
+		{"same prefix one disabled", &configuration{
+			DataWebServicePathPrefix:     "/api",
+			MetaDataWebServicePathPrefix: "/api",
+		}, []string{"data"}, 0},
+		{"invalid prefix", &configuration{DataWebServicePathPrefix: "api"}, webServiceNames, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &configurationChecker{config: tt.config}
+			c.checkMounts(tt.enabled)
+			if len(c.problems) != tt.problems {
+				t.Fatalf("problems = %v, want %d", c.problems, tt.problems)
+			}
+		})
+	}
+}
+
+func TestWebServiceMountRouter(t *testing.T) {
+	m := newWebServiceMount("/api/data", "files.example.com")
+	router := mux.NewRouter()
+	var served string
+	m.router(router, "node1").Handle("/download/{path:.*}", m.handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		served = r.URL.Path
+	})))
+	tests := []struct {
+		host   string
+		path   string
+		served string
+	}{
+		{"files.example.com", "/api/data/download/a", "/download/a"},
+		{"FILES.example.com:8443", "/api/data/download/a", "/download/a"},
+		{"node1:1502", "/api/data/download/a", "/download/a"},
+		{"other.example.com", "/api/data/download/a", ""},
+		{"files.example.com", "/download/a", ""},
+	}
+	for _, tt := range tests {
+		served = ""
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("GET", "http://"+tt.host+tt.path, nil))
+		if served != tt.served {
+			t.Errorf("request for %s%s served path %q, want %q", tt.host, tt.path, served, tt.served)
+		}
+	}
+}
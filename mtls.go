@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"github.com/clawio/lib"
+	"github.com/go-kit/kit/log/levels"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// nodeIdentitiesTTL is how long the names of the nodes in the registry are cached.
+const nodeIdentitiesTTL = 10 * time.Second
+
+// nodeIdentitiesTimeout is the time a refresh of the names of the nodes has.
+const nodeIdentitiesTimeout = 10 * time.Second
+
+// configureMutualTLSServer makes a listener ask for client certificates
+// signed by the CA of the nodes. Clients without a certificate are still
+// accepted, the web services that require one are protected by
+// nodeIdentityMiddleware.
+func configureMutualTLSServer(config *configuration, tlsConfig *tls.Config) error {
+	clientCAs, err := loadCertPool(config.GetMTLSCACertificate(), false)
+	if err != nil {
+		return err
+	}
+	tlsConfig.ClientCAs = clientCAs
+	tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	return nil
+}
+
+// newMutualTLSClientConfig returns the TLS settings of the node transport,
+// presenting the node certificate to other nodes. The returned closer stops
+// the reloads of the node certificate.
+func newMutualTLSClientConfig(config *configuration, logger levels.Levels) (*tls.Config, io.Closer, error) {
+	// other nodes may serve certificates of a public CA, e.g. issued by ACME
+	rootCAs, err := loadCertPool(config.GetMTLSCACertificate(), true)
+	if err != nil {
+		return nil, nil, err
+	}
+	reloader, err := newCertificateReloader(config.GetMTLSNodeCertificate(), config.GetMTLSNodePrivateKey(), config.GetTLSCertificateReloadInterval(), logger)
+	if err != nil {
+		return nil, nil, err
+	}
+	tlsConfig := &tls.Config{
+		RootCAs:              rootCAs,
+		GetClientCertificate: reloader.GetClientCertificate,
+	}
+	return tlsConfig, reloader, nil
+}
+
+// getMTLSRequiredWebServices returns whether every web service requires a node certificate.
+func getMTLSRequiredWebServices(config *configuration) map[string]bool {
+	required := map[string]bool{}
+	if !config.IsMTLSEnabled() {
+		return required
+	}
+	for _, ws := range strings.Split(config.GetMTLSRequiredWebServices(), ",") {
+		if ws = strings.TrimSpace(ws); ws != "" {
+			required[ws] = true
+		}
+	}
+	return required
+}
+
+// nodeIdentities are the host names of the nodes in the registry. They are
+// refreshed in the background once expired, the previous names are used
+// meanwhile, so handshakes and requests never wait for the registry but the
+// first time.
+type nodeIdentities struct {
+	registryDriver lib.RegistryDriver
+
+	mu         sync.Mutex
+	names      map[string]bool
+	err        error
+	expires    time.Time
+	refreshing chan struct{}
+}
+
+func newNodeIdentities(registryDriver lib.RegistryDriver) *nodeIdentities {
+	return &nodeIdentities{registryDriver: registryDriver}
+}
+
+// has reports whether any of names is the host of a node in the registry.
+func (n *nodeIdentities) has(ctx context.Context, names []string) (bool, error) {
+	n.mu.Lock()
+	if time.Now().After(n.expires) && n.refreshing == nil {
+		n.refreshing = make(chan struct{})
+		go n.refresh(n.refreshing)
+	}
+	known, refreshing := n.names, n.refreshing
+	n.mu.Unlock()
+
+	if known == nil {
+		// nothing to serve until the first refresh finishes
+		if refreshing != nil {
+			select {
+			case <-refreshing:
+			case <-ctx.Done():
+				return false, ctx.Err()
+			}
+		}
+		n.mu.Lock()
+		known = n.names
+		err := n.err
+		n.mu.Unlock()
+		if known == nil {
+			return false, err
+		}
+	}
+	return hasName(known, names), nil
+}
+
+func hasName(known map[string]bool, names []string) bool {
+	for _, name := range names {
+		if known[strings.ToLower(name)] {
+			return true
+		}
+	}
+	return false
+}
+
+// refresh gets the names of the nodes and closes done. On error the
+// previous names are kept and the refresh is tried again after a second.
+func (n *nodeIdentities) refresh(done chan struct{}) {
+	defer close(done)
+	ctx, cancel := context.WithTimeout(context.Background(), nodeIdentitiesTimeout)
+	defer cancel()
+	nodes, err := listRegistryNodes(ctx, n.registryDriver)
+	names := map[string]bool{}
+	for _, node := range nodes {
+		if host, _, err := net.SplitHostPort(node.Host()); err == nil {
+			names[strings.ToLower(host)] = true
+		}
+		if u, err := url.Parse(node.URL()); err == nil && u.Hostname() != "" {
+			names[strings.ToLower(u.Hostname())] = true
+		}
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.refreshing = nil
+	n.err = err
+	if err != nil {
+		n.expires = time.Now().Add(time.Second)
+		return
+	}
+	n.names = names
+	n.expires = time.Now().Add(nodeIdentitiesTTL)
+}
+
+// getCertificateNames returns the names a certificate is valid for,
+// the common name only if it has no subject alternative names.
+func getCertificateNames(cert *x509.Certificate) []string {
+	names := append([]string{}, cert.DNSNames...)
+	for _, ip := range cert.IPAddresses {
+		names = append(names, ip.String())
+	}
+	if len(names) == 0 && cert.Subject.CommonName != "" {
+		names = append(names, cert.Subject.CommonName)
+	}
+	return names
+}
+
+// nodeIdentityMiddleware only lets in requests from nodes in the registry.
+// They are identified by a client certificate signed by the CA of the nodes
+// and valid for the host of a registered node.
+func nodeIdentityMiddleware(identities *nodeIdentities, logger levels.Levels, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+			http.Error(w, "a node certificate is required", http.StatusForbidden)
+			return
+		}
+		names := getCertificateNames(r.TLS.VerifiedChains[0][0])
+		ok, err := identities.has(r.Context(), names)
+		if err != nil {
+			logger.Error().Log("msg", "error getting the nodes to check a node certificate", "error", err)
+			http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+			return
+		}
+		if !ok {
+			logger.Warn().Log("msg", "node certificate is not of a node in the registry", "names", strings.Join(names, ","), "remote", r.RemoteAddr)
+			http.Error(w, "the node certificate is not of a node in the registry", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"github.com/clawio/lib"
+	"sync"
+	"testing"
+	"time"
+)
+
+// slowRegistryDriver answers when released, counting the lookups of the nodes.
+type slowRegistryDriver struct {
+	staticRegistryDriver
+	release chan struct{}
+
+	mu      sync.Mutex
+	err     error
+	lookups int
+}
+
+func (d *slowRegistryDriver) GetNodesForRol(ctx context.Context, rol string) ([]lib.RegistryNode, error) {
+	if rol == "authentication-node" {
+		d.mu.Lock()
+		d.lookups++
+		d.mu.Unlock()
+		<-d.release
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.err != nil {
+		return nil, d.err
+	}
+	return d.staticRegistryDriver.GetNodesForRol(ctx, rol)
+}
+
+func (d *slowRegistryDriver) set(nodes []lib.RegistryNode, err error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.nodes, d.err = nodes, err
+}
+
+func (d *slowRegistryDriver) getLookups() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.lookups
+}
+
+func TestNodeIdentitiesHas(t *testing.T) {
+	d := &slowRegistryDriver{staticRegistryDriver: staticRegistryDriver{newTestNodes("https://Node1:1502")}, release: make(chan struct{})}
+	close(d.release)
+	n := newNodeIdentities(d)
+	tests := []struct {
+		names []string
+		want  bool
+	}{
+		{[]string{"node1"}, true},
+		{[]string{"NODE1"}, true},
+		{[]string{"other", "node1"}, true},
+		{[]string{"node2"}, false},
+		{nil, false},
+	}
+	for _, tt := range tests {
+		ok, err := n.has(context.Background(), tt.names)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok != tt.want {
+			t.Errorf("has(%q) = %t, want %t", tt.names, ok, tt.want)
+		}
+	}
+	if lookups := d.getLookups(); lookups != 1 {
+		t.Fatalf("registry asked %d times, want 1", lookups)
+	}
+}
+
+func TestNodeIdentitiesRefreshInBackground(t *testing.T) {
+	d := &slowRegistryDriver{staticRegistryDriver: staticRegistryDriver{newTestNodes("https://node1:1502")}, release: make(chan struct{})}
+	n := newNodeIdentities(d)
+
+	// the first callers wait for one refresh
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if ok, err := n.has(context.Background(), []string{"node1"}); !ok || err != nil {
+				t.Errorf("has() = %t, %v, want true", ok, err)
+			}
+		}()
+	}
+	time.Sleep(20 * time.Millisecond)
+	d.release <- struct{}{}
+	wg.Wait()
+
+	// once expired the previous names are used while the registry answers
+	d.set(newTestNodes("https://node2:1502"), nil)
+	n.mu.Lock()
+	n.expires = time.Now().Add(-time.Second)
+	n.mu.Unlock()
+	for i := 0; i < 3; i++ {
+		ok, err := n.has(context.Background(), []string{"node1"})
+		if !ok || err != nil {
+			t.Fatalf("has() during the refresh = %t, %v, want the previous names", ok, err)
+		}
+	}
+	d.release <- struct{}{}
+	for i := 0; i < 100; i++ {
+		if ok, _ := n.has(context.Background(), []string{"node2"}); ok {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if ok, _ := n.has(context.Background(), []string{"node2"}); !ok {
+		t.Fatal("has() after the refresh does not know the new node")
+	}
+	if lookups := d.getLookups(); lookups != 2 {
+		t.Fatalf("registry asked %d times, want 2", lookups)
+	}
+}
+
+func TestNodeIdentitiesErrors(t *testing.T) {
+	d := &slowRegistryDriver{release: make(chan struct{})}
+	close(d.release)
+	d.set(nil, errors.New("registry unavailable"))
+	n := newNodeIdentities(d)
+	if _, err := n.has(context.Background(), []string{"node1"}); err == nil {
+		t.Fatal("has() without names and the registry down = nil error, want one")
+	}
+
+	// the names are kept when a refresh fails
+	d.set(newTestNodes("https://node1:1502"), nil)
+	n.mu.Lock()
+	n.expires = time.Time{}
+	n.mu.Unlock()
+	if ok, err := n.has(context.Background(), []string{"node1"}); !ok || err != nil {
+		t.Fatalf("has() = %t, %v, want true", ok, err)
+	}
+	d.set(nil, errors.New("registry unavailable"))
+	n.mu.Lock()
+	n.expires = time.Time{}
+	n.mu.Unlock()
+	for i := 0; i < 3; i++ {
+		if ok, err := n.has(context.Background(), []string{"node1"}); !ok || err != nil {
+			t.Fatalf("has() with the registry down = %t, %v, want the previous names", ok, err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestNodeIdentitiesFirstRefreshHonoursContext(t *testing.T) {
+	d := &slowRegistryDriver{release: make(chan struct{})}
+	defer close(d.release)
+	n := newNodeIdentities(d)
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := n.has(ctx, []string{"node1"}); err != context.DeadlineExceeded {
+		t.Fatalf("has() = %v, want %v", err, context.DeadlineExceeded)
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"github.com/go-kit/kit/log/levels"
+	"io"
+	"net"
+	"net/http"
+	"time"
+)
+
+// nodeTransport sends the requests to other nodes, presenting the node
+// certificate when mutual TLS is enabled and with HTTP/2. It is given
+// explicitly to the proxies and to the upstream health checks, the rest
+// of the requests of the process are not affected by its settings.
+type nodeTransport struct {
+	http.RoundTripper
+	transport   *http.Transport
+	certificate io.Closer
+}
+
+func newNodeTransport(config *configuration, logger levels.Levels) (*nodeTransport, error) {
+	dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+	transport := &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           dialer.DialContext,
+		MaxIdleConns:          100,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+	}
+	t := &nodeTransport{transport: transport}
+	if config.IsMTLSEnabled() {
+		tlsConfig, certificate, err := newMutualTLSClientConfig(config, logger)
+		if err != nil {
+			return nil, err
+		}
+		transport.TLSClientConfig = tlsConfig
+		t.certificate = certificate
+	}
+	roundTripper, err := configureHTTP2Transport(config, transport)
+	if err != nil {
+		t.Close()
+		return nil, err
+	}
+	t.RoundTripper = roundTripper
+	return t, nil
+}
+
+// Close stops the reloads of the node certificate and closes the idle connections.
+func (t *nodeTransport) Close() error {
+	if c, ok := t.RoundTripper.(interface {
+		CloseIdleConnections()
+	}); ok {
+		c.CloseIdleConnections()
+	}
+	if t.certificate != nil {
+		return t.certificate.Close()
+	}
+	return nil
+}
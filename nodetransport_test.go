@@ -0,0 +1,129 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/levels"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestNodeTransportMutualTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "clawiod")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cert := newTestCertificate(t, "node1")
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	writeTestFile(t, certFile, cert.cert, time.Now())
+	writeTestFile(t, keyFile, cert.key, time.Now())
+
+	serverCert, err := tls.X509KeyPair(cert.cert, cert.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{serverCert},
+		ClientAuth:   tls.RequestClientCert,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go http.Serve(ln, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "%d", len(r.TLS.PeerCertificates))
+	}))
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+	url := "https://localhost:" + port + "/"
+
+	transport, err := newNodeTransport(&configuration{
+		MTLSEnabled:         true,
+		MTLSCACertificate:   certFile,
+		MTLSNodeCertificate: certFile,
+		MTLSNodePrivateKey:  keyFile,
+	}, levels.New(log.NewNopLogger()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer transport.Close()
+
+	// the proxies send the requests with the node certificate
+	proxied := newProxiedWebService(newTestWebService("GET", "/"), "data-node",
+		&staticRegistryDriver{newTestNodes(url)}, transport, levels.New(log.NewNopLogger()))
+	w := httptest.NewRecorder()
+	proxied.Endpoints()["/"]["GET"](w, httptest.NewRequest("GET", "/", nil))
+	if w.Body.String() != "1" {
+		t.Fatalf("proxied request presented %s certificates, want 1", w.Body.String())
+	}
+
+	// the rest of the requests are not affected: the CA of the nodes is not trusted
+	if res, err := http.Get(url); err == nil {
+		res.Body.Close()
+		t.Fatal("request with the default transport trusted the CA of the nodes")
+	}
+	if c := http.DefaultTransport.(*http.Transport).TLSClientConfig; c != nil && c.GetClientCertificate != nil {
+		t.Fatal("http.DefaultTransport presents the node certificate")
+	}
+}
+
+func TestNodeTransportHTTP2Cleartext(t *testing.T) {
+	tests := []struct {
+		name   string
+		client bool
+		proto  int
+	}{
+		{"http/1", false, 1},
+		{"h2c", true, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := &configuration{HTTP2Cleartext: true, HTTP2CleartextClient: tt.client}
+			srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				fmt.Fprintf(w, "%d", r.ProtoMajor)
+			})}
+			if err := configureHTTP2Server(config, srv); err != nil {
+				t.Fatal(err)
+			}
+			ln, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer ln.Close()
+			go srv.Serve(ln)
+
+			transport, err := newNodeTransport(config, levels.New(log.NewNopLogger()))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer transport.Close()
+			// the proxies send the requests with the node transport
+			proxied := newProxiedWebService(newTestWebService("GET", "/"), "data-node",
+				&staticRegistryDriver{newTestNodes("http://" + ln.Addr().String())}, transport, levels.New(log.NewNopLogger()))
+			w := httptest.NewRecorder()
+			proxied.Endpoints()["/"]["GET"](w, httptest.NewRequest("GET", "/", nil))
+			if w.Body.String() != fmt.Sprint(tt.proto) {
+				t.Fatalf("request served with HTTP/%s, want HTTP/%d", w.Body.String(), tt.proto)
+			}
+
+			// the clients of lib send HTTP/1, still served
+			res, err := http.Get("http://" + ln.Addr().String() + "/")
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, _ := ioutil.ReadAll(res.Body)
+			res.Body.Close()
+			if string(body) != "1" {
+				t.Fatalf("request with the default transport served with HTTP/%s, want HTTP/1", body)
+			}
+		})
+	}
+}
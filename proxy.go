@@ -0,0 +1,86 @@
+package main
+
+import (
+	"github.com/clawio/lib"
+	kitlog "github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/levels"
+	"log"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+)
+
+// proxiedWebService serves the endpoints of a web service run by other
+// nodes. The endpoints are the ones of the proxied web service of lib, the
+// requests are forwarded by a nodeProxy, so they are sent with the node
+// transport instead of the transport lib uses.
+type proxiedWebService struct {
+	endpoints map[string]map[string]http.HandlerFunc
+}
+
+func newProxiedWebService(proxied lib.WebService, rol string, registryDriver lib.RegistryDriver, transport http.RoundTripper, logger levels.Levels) *proxiedWebService {
+	p := &nodeProxy{
+		rol:            rol,
+		registryDriver: registryDriver,
+		transport:      transport,
+		logger:         logger,
+	}
+	endpoints := map[string]map[string]http.HandlerFunc{}
+	for path, methods := range proxied.Endpoints() {
+		endpoints[path] = map[string]http.HandlerFunc{}
+		for method := range methods {
+			endpoints[path][method] = p.ServeHTTP
+		}
+	}
+	return &proxiedWebService{endpoints: endpoints}
+}
+
+func (ws *proxiedWebService) IsProxy() bool {
+	return true
+}
+
+func (ws *proxiedWebService) Endpoints() map[string]map[string]http.HandlerFunc {
+	return ws.endpoints
+}
+
+// nodeProxy forwards the requests to a node of rol, under the path of its URL.
+type nodeProxy struct {
+	rol            string
+	registryDriver lib.RegistryDriver
+	transport      http.RoundTripper
+	logger         levels.Levels
+}
+
+func (p *nodeProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	nodes, err := p.registryDriver.GetNodesForRol(r.Context(), p.rol)
+	if err != nil {
+		p.logger.Error().Log("msg", "error getting nodes", "rol", p.rol, "error", err)
+		http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+		return
+	}
+	if len(nodes) == 0 {
+		p.logger.Error().Log("msg", "no nodes registered", "rol", p.rol)
+		http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+		return
+	}
+	target, err := url.Parse(nodes[0].URL())
+	if err != nil {
+		p.logger.Error().Log("msg", "invalid node url", "rol", p.rol, "url", nodes[0].URL(), "error", err)
+		http.Error(w, http.StatusText(http.StatusBadGateway), http.StatusBadGateway)
+		return
+	}
+	proxy := &httputil.ReverseProxy{
+		Director: func(req *http.Request) {
+			req.URL.Scheme = target.Scheme
+			req.URL.Host = target.Host
+			req.URL.Path = strings.TrimSuffix(target.Path, "/") + "/" + strings.TrimPrefix(req.URL.Path, "/")
+			// the node serves the requests for the host of its URL,
+			// whatever the hosts of its mount are
+			req.Host = target.Host
+		},
+		Transport: p.transport,
+		ErrorLog:  log.New(kitlog.NewStdlibAdapter(p.logger.With("rol", p.rol).Error()), "", 0),
+	}
+	proxy.ServeHTTP(w, r)
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/clawio/lib"
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/levels"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// testWebService is a web service answering 204 on its endpoints.
+type testWebService struct {
+	proxy     bool
+	endpoints map[string]map[string]http.HandlerFunc
+}
+
+func (ws *testWebService) IsProxy() bool {
+	return ws.proxy
+}
+
+func (ws *testWebService) Endpoints() map[string]map[string]http.HandlerFunc {
+	return ws.endpoints
+}
+
+// newTestWebService returns a proxied web service with the endpoints given
+// as method and path pairs.
+func newTestWebService(endpoints ...string) *testWebService {
+	ws := &testWebService{proxy: true, endpoints: map[string]map[string]http.HandlerFunc{}}
+	for i := 0; i+1 < len(endpoints); i += 2 {
+		method, path := endpoints[i], endpoints[i+1]
+		if ws.endpoints[path] == nil {
+			ws.endpoints[path] = map[string]http.HandlerFunc{}
+		}
+		ws.endpoints[path][method] = func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}
+	return ws
+}
+
+// failingRegistryDriver fails to return the nodes of any role.
+type failingRegistryDriver struct {
+	staticRegistryDriver
+}
+
+func (d *failingRegistryDriver) GetNodesForRol(ctx context.Context, rol string) ([]lib.RegistryNode, error) {
+	return nil, errors.New("registry unavailable")
+}
+
+func TestNewProxiedWebService(t *testing.T) {
+	proxied := newProxiedWebService(newTestWebService("GET", "/download/{path:.*}", "PUT", "/upload/{path:.*}", "OPTIONS", "/upload/{path:.*}"),
+		"data-node", &staticRegistryDriver{}, http.DefaultTransport, levels.New(log.NewNopLogger()))
+	if !proxied.IsProxy() {
+		t.Fatal("IsProxy() = false, want true")
+	}
+	got := []string{}
+	for path, methods := range proxied.Endpoints() {
+		for method := range methods {
+			got = append(got, method+" "+path)
+		}
+	}
+	if len(got) != 3 {
+		t.Fatalf("endpoints = %q, want the 3 of the proxied web service", got)
+	}
+}
+
+func TestNodeProxy(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		fmt.Fprintf(w, "%s %s %s %s %s", r.Method, r.Host, r.URL.Path, r.URL.RawQuery, body)
+	}))
+	defer upstream.Close()
+	host := strings.TrimPrefix(upstream.URL, "http://")
+
+	tests := []struct {
+		name   string
+		driver lib.RegistryDriver
+		method string
+		target string
+		body   string
+		code   int
+		want   string
+	}{
+		{"root", &staticRegistryDriver{newTestNodes(upstream.URL)}, "GET", "/download/a.txt?x=1", "", http.StatusOK,
+			"GET " + host + " /download/a.txt x=1 "},
+		{"path prefix of the node", &staticRegistryDriver{newTestNodes(upstream.URL + "/api/data")}, "PUT", "/upload/a.txt", "hello", http.StatusOK,
+			"PUT " + host + " /api/data/upload/a.txt  hello"},
+		{"path prefix with trailing slash", &staticRegistryDriver{newTestNodes(upstream.URL + "/api/data/")}, "GET", "/download/a.txt", "", http.StatusOK,
+			"GET " + host + " /api/data/download/a.txt  "},
+		{"no nodes", &staticRegistryDriver{}, "GET", "/download/a.txt", "", http.StatusServiceUnavailable, ""},
+		{"registry error", &failingRegistryDriver{}, "GET", "/download/a.txt", "", http.StatusServiceUnavailable, ""},
+		{"invalid node url", &staticRegistryDriver{newTestNodes("http://[::1")}, "GET", "/download/a.txt", "", http.StatusBadGateway, ""},
+		{"node down", &staticRegistryDriver{newTestNodes("http://127.0.0.1:1")}, "GET", "/download/a.txt", "", http.StatusBadGateway, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := &nodeProxy{rol: "data-node", registryDriver: tt.driver, transport: http.DefaultTransport, logger: levels.New(log.NewNopLogger())}
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(tt.method, "http://files.example.com"+tt.target, strings.NewReader(tt.body))
+			p.ServeHTTP(w, r)
+			if w.Code != tt.code {
+				t.Fatalf("status = %d, want %d", w.Code, tt.code)
+			}
+			if tt.want != "" && w.Body.String() != tt.want {
+				t.Fatalf("upstream got %q, want %q", w.Body.String(), tt.want)
+			}
+		})
+	}
+}
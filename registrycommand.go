@@ -0,0 +1,244 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/clawio/lib"
+	"os"
+	"sort"
+	"text/tabwriter"
+	"time"
+)
+
+// webServiceNames are the web services clawiod can enable.
+var webServiceNames = []string{"authentication", "data", "metadata", "owncloud"}
+
+// registryNodeView is a registry node as printed by the registry command.
+type registryNodeView struct {
+	ID            string            `json:"id"`
+	Role          string            `json:"role"`
+	Host          string            `json:"host"`
+	URL           string            `json:"url"`
+	Version       string            `json:"version"`
+	Metadata      map[string]string `json:"metadata,omitempty"`
+	Registered    *time.Time        `json:"registered,omitempty"`
+	LastHeartbeat *time.Time        `json:"last_heartbeat,omitempty"`
+}
+
+func newRegistryNodeView(n lib.RegistryNode) *registryNodeView {
+	v := &registryNodeView{ID: n.ID(), Role: n.Rol(), Host: n.Host(), URL: n.URL(), Version: n.Version()}
+	if m, ok := n.(registryNodeMetadata); ok {
+		v.Metadata = m.Metadata()
+		v.Registered = parseRegistryTime(v.Metadata["registered"])
+		v.LastHeartbeat = parseRegistryTime(v.Metadata["last_heartbeat"])
+	}
+	return v
+}
+
+func parseRegistryTime(s string) *time.Time {
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return nil
+	}
+	return &t
+}
+
+// ago returns how long ago t was, rounded to seconds,
+// or "-" for nodes registered by previous versions.
+func ago(t *time.Time) string {
+	if t == nil {
+		return "-"
+	}
+	return (time.Since(*t) / time.Second * time.Second).String()
+}
+
+// handleRegistry inspects and manages the nodes of the registry configured
+// for the server. It exits with a non-zero code on error.
+//
+//	clawiod registry ls [-output table|json]
+//	clawiod registry get [-output table|json] <id>
+//	clawiod registry rm <id>
+func handleRegistry(args []string) {
+	if err := runRegistryCommand(args); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	os.Exit(0)
+}
+
+func runRegistryCommand(args []string) error {
+	fs := flag.NewFlagSet("registry", flag.ExitOnError)
+	output := fs.String("output", "table", "Output format: table or json")
+	usage := fmt.Errorf("usage: %s [flags] registry ls|get <id>|rm <id> [-output table|json]", os.Args[0])
+	if len(args) == 0 {
+		return usage
+	}
+	command := args[0]
+	fs.Parse(args[1:])
+	if *output != "table" && *output != "json" {
+		return fmt.Errorf("output %q does not exist, use table or json", *output)
+	}
+	id := fs.Arg(0)
+	switch command {
+	case "ls":
+	case "get", "rm":
+		if id == "" {
+			return usage
+		}
+	default:
+		return fmt.Errorf("registry command %q does not exist, use ls, get or rm", command)
+	}
+
+	configurationSource, err := getConfigurationSource(flagConfigurationSource)
+	if err != nil {
+		return err
+	}
+	config, err := loadConfiguration(configurationSource)
+	if err != nil {
+		return err
+	}
+	// logs go to stderr so they do not mix with the output of the command
+	commandConfig := *config
+	commandConfig.AppLoggerOut = "2"
+	c := newContainer(&commandConfig)
+	defer c.close()
+	registryDriver, err := getRegistryDriver(c)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	nodes, err := listRegistryNodes(ctx, registryDriver)
+	if err != nil {
+		return err
+	}
+
+	switch command {
+	case "get":
+		nodes = filterRegistryNodes(nodes, id)
+		if len(nodes) == 0 {
+			return fmt.Errorf("node %q is not in the registry", id)
+		}
+		return printRegistryNode(nodes, *output)
+	case "rm":
+		return removeRegistryNode(ctx, registryDriver, filterRegistryNodes(nodes, id), id)
+	default:
+		return printRegistryNodes(nodes, *output)
+	}
+}
+
+// listRegistryNodes returns all the nodes in the registry sorted by role and id.
+// Registry drivers not able to list their nodes are asked for the roles of the
+// clawiod web services.
+func listRegistryNodes(ctx context.Context, registryDriver lib.RegistryDriver) ([]lib.RegistryNode, error) {
+	var nodes []lib.RegistryNode
+	if lister, ok := registryDriver.(registryLister); ok {
+		all, err := lister.GetNodes(ctx)
+		if err != nil {
+			return nil, err
+		}
+		nodes = all
+	} else {
+		for _, key := range webServiceNames {
+			for _, rol := range []string{key + "-node", key + "-node-proxy"} {
+				found, err := registryDriver.GetNodesForRol(ctx, rol)
+				if err != nil {
+					return nil, err
+				}
+				nodes = append(nodes, found...)
+			}
+		}
+	}
+	sort.Slice(nodes, func(i, j int) bool {
+		if nodes[i].Rol() != nodes[j].Rol() {
+			return nodes[i].Rol() < nodes[j].Rol()
+		}
+		return nodes[i].ID() < nodes[j].ID()
+	})
+	return nodes, nil
+}
+
+// filterRegistryNodes returns the nodes with id, one per role.
+func filterRegistryNodes(nodes []lib.RegistryNode, id string) []lib.RegistryNode {
+	found := []lib.RegistryNode{}
+	for _, n := range nodes {
+		if n.ID() == id {
+			found = append(found, n)
+		}
+	}
+	return found
+}
+
+func printRegistryNodes(nodes []lib.RegistryNode, output string) error {
+	views := []*registryNodeView{}
+	for _, n := range nodes {
+		views = append(views, newRegistryNodeView(n))
+	}
+	if output == "json" {
+		return printJSON(views)
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "ROLE\tID\tURL\tVERSION\tREGISTERED\tLAST HEARTBEAT")
+	for _, v := range views {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", v.Role, v.ID, v.URL, v.Version, ago(v.Registered), ago(v.LastHeartbeat))
+	}
+	return w.Flush()
+}
+
+func printRegistryNode(nodes []lib.RegistryNode, output string) error {
+	views := []*registryNodeView{}
+	for _, n := range nodes {
+		views = append(views, newRegistryNodeView(n))
+	}
+	if output == "json" {
+		return printJSON(views)
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	for i, v := range views {
+		if i > 0 {
+			fmt.Fprintln(w)
+		}
+		fmt.Fprintf(w, "id:\t%s\nrole:\t%s\nhost:\t%s\nurl:\t%s\nversion:\t%s\nregistered:\t%s\nlast heartbeat:\t%s\n",
+			v.ID, v.Role, v.Host, v.URL, v.Version, ago(v.Registered), ago(v.LastHeartbeat))
+		keys := []string{}
+		for k := range v.Metadata {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			fmt.Fprintf(w, "%s:\t%s\n", k, v.Metadata[k])
+		}
+	}
+	return w.Flush()
+}
+
+func removeRegistryNode(ctx context.Context, registryDriver lib.RegistryDriver, nodes []lib.RegistryNode, id string) error {
+	if len(nodes) == 0 {
+		return fmt.Errorf("node %q is not in the registry", id)
+	}
+	if r, ok := registryDriver.(registryReadOnly); ok && r.IsReadOnly() {
+		return fmt.Errorf("the nodes of the configured registry driver are published by others, remove node %q where it is defined", id)
+	}
+	unregisterer, ok := registryDriver.(registryUnregisterer)
+	if !ok {
+		return errors.New("the configured registry driver can not remove nodes")
+	}
+	for _, n := range nodes {
+		if err := unregisterer.Unregister(ctx, n); err != nil {
+			return err
+		}
+		// a running node is back with its next heartbeat
+		fmt.Printf("node %s removed from role %s\n", n.ID(), n.Rol())
+	}
+	return nil
+}
+
+func printJSON(v interface{}) error {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"github.com/clawio/lib"
+	"testing"
+	"time"
+)
+
+func TestNewRegistryNodeView(t *testing.T) {
+	registered := time.Date(2017, 3, 1, 10, 0, 0, 0, time.UTC)
+	lastHeartbeat := time.Date(2017, 3, 2, 8, 30, 0, 0, time.UTC)
+	tests := []struct {
+		name          string
+		metadata      map[string]string
+		registered    *time.Time
+		lastHeartbeat *time.Time
+	}{
+		{"without metadata", nil, nil, nil},
+		{"registered by a previous version", map[string]string{"registered": "2017-03-01T10:00:00Z"}, &registered, nil},
+		{"heartbeat", map[string]string{"registered": "2017-03-01T10:00:00Z", "last_heartbeat": "2017-03-02T08:30:00Z"},
+			&registered, &lastHeartbeat},
+		{"invalid times", map[string]string{"registered": "yesterday", "last_heartbeat": "now"}, nil, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v := newRegistryNodeView(&node{xid: "data1:1502", xrol: "data-node", xmetadata: tt.metadata})
+			for _, field := range []struct {
+				name      string
+				got, want *time.Time
+			}{
+				{"registered", v.Registered, tt.registered},
+				{"last heartbeat", v.LastHeartbeat, tt.lastHeartbeat},
+			} {
+				if field.want == nil {
+					if field.got != nil || ago(field.got) != "-" {
+						t.Fatalf("%s %v, ago %s, want none", field.name, field.got, ago(field.got))
+					}
+					continue
+				}
+				if field.got == nil || !field.got.Equal(*field.want) {
+					t.Fatalf("%s %v, want %s", field.name, field.got, field.want)
+				}
+			}
+		})
+	}
+}
+
+func TestAgo(t *testing.T) {
+	stale := time.Now().Add(-90*time.Second - 300*time.Millisecond)
+	if got := ago(&stale); got != "1m30s" {
+		t.Fatalf("ago() = %s, want 1m30s", got)
+	}
+	if got := ago(nil); got != "-" {
+		t.Fatalf("ago(nil) = %s, want -", got)
+	}
+}
+
+func TestRemoveRegistryNode(t *testing.T) {
+	e := newFakeEtcd()
+	defer e.Close()
+	etcd := newTestETCDRegistryDriver(t, e)
+	ctx := context.Background()
+	registered := &node{xid: "data1:1502", xrol: "data-node", xurl: "http://data1:1502"}
+	if err := etcd.Register(ctx, registered); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		driver   lib.RegistryDriver
+		nodes    []lib.RegistryNode
+		removed  bool
+		hasError bool
+	}{
+		{"not in the registry", etcd, nil, false, true},
+		{"read only driver", &fileRegistryDriver{}, []lib.RegistryNode{registered}, false, true},
+		{"etcd", etcd, []lib.RegistryNode{registered}, true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := removeRegistryNode(ctx, tt.driver, filterRegistryNodes(tt.nodes, "data1:1502"), "data1:1502")
+			if tt.hasError != (err != nil) {
+				t.Fatalf("removeRegistryNode() = %v, want error %t", err, tt.hasError)
+			}
+			nodes, err := newTestLibETCDRegistryDriver(t, e).GetNodesForRol(ctx, "data-node")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if stored := containsNode(nodes, registered); tt.removed == stored {
+				t.Fatalf("node stored %t, want removed %t", stored, tt.removed)
+			}
+		})
+	}
+}
@@ -0,0 +1,516 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// retryBudgetMaxTokens limits the retries a quiet period saves for a burst.
+const retryBudgetMaxTokens = 100
+
+// retryMaxWithheldBody is the largest body of a failed attempt kept in case
+// it is not retried. Attempts writing more are sent to the client.
+const retryMaxWithheldBody = 64 * 1024
+
+var (
+	retryAttemptsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "clawiod",
+		Subsystem: "retry",
+		Name:      "attempts_total",
+		Help:      "Number of extra attempts of requests to other nodes by web service and reason: status, timeout or hedge.",
+	}, []string{"webservice", "reason"})
+
+	retryBudgetExhaustedTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "clawiod",
+		Subsystem: "retry",
+		Name:      "budget_exhausted_total",
+		Help:      "Number of attempts not made because the retry budget of the web service was exhausted.",
+	}, []string{"webservice"})
+)
+
+func init() {
+	prometheus.MustRegister(retryAttemptsTotal, retryBudgetExhaustedTotal)
+}
+
+// retryPolicy controls how the requests of a web service served
+// by other nodes are retried.
+type retryPolicy struct {
+	// MaxAttempts counts the first attempt, retries and hedged requests.
+	MaxAttempts int `json:"max_attempts"`
+	// PerTryTimeout is the time in seconds an attempt has to send the
+	// response headers, zero for no limit.
+	PerTryTimeout int `json:"per_try_timeout"`
+	// RetryOn are the status codes retried.
+	RetryOn []int `json:"retry_on"`
+	// HedgeAfter is the time in milliseconds after which a GET or HEAD request
+	// is sent to another node if the first one did not answer, zero to disable it.
+	HedgeAfter int `json:"hedge_after"`
+	// MaxReplayBodySize is the largest request body in bytes kept in memory to be
+	// sent again. Requests with larger or unknown size bodies are not retried.
+	MaxReplayBodySize int64 `json:"max_replay_body_size"`
+}
+
+// withDefaults returns a copy of p with the unset settings filled in.
+func (p *retryPolicy) withDefaults() *retryPolicy {
+	if p == nil {
+		return nil
+	}
+	policy := *p
+	if policy.MaxAttempts == 0 {
+		policy.MaxAttempts = 3
+	}
+	if len(policy.RetryOn) == 0 {
+		policy.RetryOn = []int{http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout}
+	}
+	return &policy
+}
+
+func (p *retryPolicy) validate() error {
+	if p.MaxAttempts < 1 {
+		return fmt.Errorf("max attempts %d must be at least 1", p.MaxAttempts)
+	}
+	if p.PerTryTimeout < 0 || p.HedgeAfter < 0 || p.MaxReplayBodySize < 0 {
+		return fmt.Errorf("per try timeout, hedge after and max replay body size can not be negative")
+	}
+	for _, code := range p.RetryOn {
+		if code < 400 || code > 599 {
+			return fmt.Errorf("retry on status %d is not an error status", code)
+		}
+	}
+	return nil
+}
+
+func (p *retryPolicy) retryOn(code int) bool {
+	for _, c := range p.RetryOn {
+		if c == code {
+			return true
+		}
+	}
+	return false
+}
+
+// getRetryPolicies returns the retry policy of every web service, nil for
+// the ones that are not retried.
+func getRetryPolicies(config *configuration) map[string]*retryPolicy {
+	return map[string]*retryPolicy{
+		"authentication": config.GetAuthenticationWebServiceRetryPolicy(),
+		"data":           config.GetDataWebServiceRetryPolicy(),
+		"metadata":       config.GetMetaDataWebServiceRetryPolicy(),
+		"owncloud":       config.GetOCWebServiceRetryPolicy(),
+	}
+}
+
+// retryBudget limits retries to a percentage of the requests, plus a
+// minimum per second, so retries do not overload nodes that are already failing.
+type retryBudget struct {
+	webService   string
+	ratio        float64
+	minPerSecond float64
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+func newRetryBudget(webService string, percent, minPerSecond int) *retryBudget {
+	return &retryBudget{
+		webService:   webService,
+		ratio:        float64(percent) / 100,
+		minPerSecond: float64(minPerSecond),
+		tokens:       float64(minPerSecond),
+		last:         time.Now(),
+	}
+}
+
+// deposit is called for every request.
+func (b *retryBudget) deposit() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.add(b.ratio)
+}
+
+// withdraw reports whether there is budget for one more attempt and takes it.
+func (b *retryBudget) withdraw() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	b.add(now.Sub(b.last).Seconds() * b.minPerSecond)
+	b.last = now
+	if b.tokens < 1 {
+		retryBudgetExhaustedTotal.WithLabelValues(b.webService).Inc()
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+func (b *retryBudget) add(tokens float64) {
+	b.tokens += tokens
+	if b.tokens > retryBudgetMaxTokens {
+		b.tokens = retryBudgetMaxTokens
+	}
+}
+
+type triedNodesContextKey struct{}
+
+// triedNodes are the nodes already tried by the attempts of a request.
+// Load balancers choose other nodes for the next attempts if they can.
+type triedNodes struct {
+	mu   sync.Mutex
+	urls map[string]bool
+}
+
+func (t *triedNodes) add(url string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.urls[url] = true
+}
+
+func (t *triedNodes) has(url string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.urls[url]
+}
+
+func getTriedNodes(ctx context.Context) *triedNodes {
+	if ctx == nil {
+		return nil
+	}
+	t, _ := ctx.Value(triedNodesContextKey{}).(*triedNodes)
+	return t
+}
+
+// retryMiddleware serves the requests of a web service handled by other nodes.
+// A request is sent again, to another node if there is one, when an attempt
+// fails with a retryable status or does not answer within the per try timeout.
+// GET and HEAD requests are also hedged: sent to another node when the first
+// one did not answer after a threshold, the first answer wins.
+// Only reads and uploads whose body can be replayed are retried, the other
+// requests are served once.
+func retryMiddleware(webService string, policy *retryPolicy, budget *retryBudget, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !isIdempotent(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		budget.deposit()
+		body, ok := readReplayableBody(r, policy.MaxReplayBodySize)
+		if !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+		rt := &retry{
+			webService: webService,
+			policy:     policy,
+			budget:     budget,
+			w:          w,
+			r:          r,
+			body:       body,
+			tried:      &triedNodes{urls: map[string]bool{}},
+			hedge:      policy.HedgeAfter > 0 && (r.Method == "GET" || r.Method == "HEAD"),
+		}
+		rt.serve(next)
+	})
+}
+
+// isIdempotent reports whether r can be sent again after an attempt failed:
+// reads and uploads, which write the same file again. Requests like DELETE,
+// MOVE or POST may have changed the files on a node that failed to answer.
+func isIdempotent(r *http.Request) bool {
+	switch r.Method {
+	case "GET", "HEAD", "OPTIONS", "PUT":
+		return true
+	default:
+		return false
+	}
+}
+
+// readReplayableBody reads the body of r if it can be sent more than once.
+// Bodies of unknown size or larger than max are not.
+func readReplayableBody(r *http.Request, max int64) ([]byte, bool) {
+	if r.Body == nil || r.ContentLength == 0 {
+		return nil, true
+	}
+	if r.ContentLength < 0 || r.ContentLength > max {
+		return nil, false
+	}
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		// the attempt will find the same error
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+		return nil, false
+	}
+	return body, true
+}
+
+// retry is a request served by one or more attempts.
+type retry struct {
+	webService string
+	policy     *retryPolicy
+	budget     *retryBudget
+	w          http.ResponseWriter
+	r          *http.Request
+	body       []byte
+	tried      *triedNodes
+	hedge      bool
+
+	mu       sync.Mutex
+	attempts []*attempt
+	winner   *attempt
+}
+
+func (rt *retry) serve(next http.Handler) {
+	results := make(chan *attempt, rt.policy.MaxAttempts)
+	var hedge <-chan time.Time
+	start := func() {
+		a := rt.newAttempt()
+		go a.run(next, results)
+		hedge = nil
+		if rt.hedge && a.n < rt.policy.MaxAttempts {
+			hedge = time.After(time.Duration(rt.policy.HedgeAfter) * time.Millisecond)
+		}
+	}
+
+	start()
+	inFlight := 1
+	var last *attempt
+	for inFlight > 0 {
+		select {
+		case a := <-results:
+			inFlight--
+			if a.claimed {
+				// the others were canceled when a claimed the response
+				for ; inFlight > 0; inFlight-- {
+					<-results
+				}
+				if a.panicked != nil {
+					panic(a.panicked)
+				}
+				return
+			}
+			last = a
+			if rt.getWinner() != nil || len(rt.attempts) >= rt.policy.MaxAttempts {
+				continue
+			}
+			if rt.budget.withdraw() {
+				retryAttemptsTotal.WithLabelValues(rt.webService, a.failure()).Inc()
+				start()
+				inFlight++
+			}
+		case <-hedge:
+			hedge = nil
+			if rt.getWinner() == nil && len(rt.attempts) < rt.policy.MaxAttempts && rt.budget.withdraw() {
+				retryAttemptsTotal.WithLabelValues(rt.webService, "hedge").Inc()
+				start()
+				inFlight++
+			}
+		}
+	}
+
+	// every attempt failed, the client gets the last failure
+	if last.panicked != nil {
+		panic(last.panicked)
+	}
+	if last.status == 0 {
+		last.status = http.StatusGatewayTimeout
+	}
+	last.withheld = false
+	rt.mu.Lock()
+	rt.setWinner(last)
+	rt.mu.Unlock()
+	if last.claimed {
+		rt.w.Write(last.buf.Bytes())
+	}
+}
+
+func (rt *retry) newAttempt() *attempt {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	n := len(rt.attempts) + 1
+	ctx, cancel := context.WithCancel(context.WithValue(rt.r.Context(), triedNodesContextKey{}, rt.tried))
+	a := &attempt{
+		retry:  rt,
+		n:      n,
+		header: http.Header{},
+		// the last attempt does not withhold anything
+		withhold: n < rt.policy.MaxAttempts,
+	}
+	a.ctx = &tryContext{Context: ctx, timedOut: &a.timedOut}
+	a.cancel = cancel
+	if rt.policy.PerTryTimeout > 0 {
+		a.timer = time.AfterFunc(time.Duration(rt.policy.PerTryTimeout)*time.Second, a.timeout)
+	}
+	rt.attempts = append(rt.attempts, a)
+	return a
+}
+
+// setWinner sends the response headers of a to the client unless another
+// attempt did it before. The other attempts are canceled.
+// It must be called with rt.mu held.
+func (rt *retry) setWinner(a *attempt) {
+	if rt.winner != nil {
+		return
+	}
+	rt.winner = a
+	a.claimed = true
+	for _, other := range rt.attempts {
+		if other != a {
+			other.cancel()
+		}
+	}
+	header := rt.w.Header()
+	for k, v := range a.header {
+		header[k] = v
+	}
+	rt.w.WriteHeader(a.status)
+}
+
+func (rt *retry) getWinner() *attempt {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	return rt.winner
+}
+
+// attempt is the http.ResponseWriter of one attempt of a retry. It withholds
+// retryable responses and sends the others to the client if no other attempt
+// did it before.
+type attempt struct {
+	retry  *retry
+	n      int
+	ctx    context.Context
+	cancel context.CancelFunc
+	timer  *time.Timer
+
+	header   http.Header
+	status   int
+	withhold bool
+	withheld bool
+	buf      bytes.Buffer
+	claimed  bool
+	timedOut int32
+	panicked interface{}
+}
+
+func (a *attempt) run(next http.Handler, results chan<- *attempt) {
+	defer func() {
+		if p := recover(); p != nil {
+			a.panicked = p
+		}
+		if a.timer != nil {
+			a.timer.Stop()
+		}
+		a.cancel()
+		results <- a
+	}()
+	r := a.retry.r.WithContext(a.ctx)
+	r.Header = http.Header{}
+	for k, v := range a.retry.r.Header {
+		r.Header[k] = append([]string(nil), v...)
+	}
+	if a.retry.body != nil {
+		r.Body = ioutil.NopCloser(bytes.NewReader(a.retry.body))
+	}
+	next.ServeHTTP(a, r)
+	if a.status == 0 && a.ctx.Err() == nil {
+		a.WriteHeader(http.StatusOK)
+	}
+}
+
+// timeout cancels the attempt if it did not send the response headers yet.
+func (a *attempt) timeout() {
+	a.retry.mu.Lock()
+	defer a.retry.mu.Unlock()
+	if a.retry.winner == a {
+		return
+	}
+	atomic.StoreInt32(&a.timedOut, 1)
+	a.cancel()
+}
+
+// failure returns why a failed attempt failed.
+func (a *attempt) failure() string {
+	if atomic.LoadInt32(&a.timedOut) == 1 || a.status == 0 {
+		return "timeout"
+	}
+	return "status"
+}
+
+func (a *attempt) Header() http.Header {
+	return a.header
+}
+
+func (a *attempt) WriteHeader(code int) {
+	if a.status != 0 {
+		return
+	}
+	a.status = code
+	if a.withhold && a.retry.policy.retryOn(code) {
+		a.withheld = true
+		return
+	}
+	a.claim()
+}
+
+func (a *attempt) Write(p []byte) (int, error) {
+	if a.status == 0 {
+		a.WriteHeader(http.StatusOK)
+	}
+	if a.withheld {
+		if a.buf.Len()+len(p) <= retryMaxWithheldBody {
+			return a.buf.Write(p)
+		}
+		// too large to keep, this failure is the response
+		a.withheld = false
+		a.claim()
+		if a.claimed {
+			if _, err := a.retry.w.Write(a.buf.Bytes()); err != nil {
+				return 0, err
+			}
+		}
+	}
+	if !a.claimed {
+		// another attempt sent the response
+		return len(p), nil
+	}
+	return a.retry.w.Write(p)
+}
+
+func (a *attempt) Flush() {
+	if !a.claimed {
+		return
+	}
+	if f, ok := a.retry.w.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// claim makes a the response of the request unless it timed out.
+func (a *attempt) claim() {
+	a.retry.mu.Lock()
+	defer a.retry.mu.Unlock()
+	if atomic.LoadInt32(&a.timedOut) == 1 {
+		return
+	}
+	a.retry.setWinner(a)
+}
+
+// tryContext is the context of an attempt. When the attempt times out it is
+// canceled with context.DeadlineExceeded, so the node is blamed for it.
+type tryContext struct {
+	context.Context
+	timedOut *int32
+}
+
+func (c *tryContext) Err() error {
+	if atomic.LoadInt32(c.timedOut) == 1 {
+		return context.DeadlineExceeded
+	}
+	return c.Context.Err()
+}
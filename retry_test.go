@@ -0,0 +1,205 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// failingHandler answers the first failures attempts with 503 and the
+// others with 200, recording the bodies received.
+type failingHandler struct {
+	failures int
+
+	mu     sync.Mutex
+	bodies []string
+}
+
+func (h *failingHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := ioutil.ReadAll(r.Body)
+	h.mu.Lock()
+	h.bodies = append(h.bodies, string(body))
+	n := len(h.bodies)
+	h.mu.Unlock()
+	if n <= h.failures {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte("failure"))
+		return
+	}
+	w.Write([]byte("ok"))
+}
+
+func (h *failingHandler) attempts() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return len(h.bodies)
+}
+
+func TestRetryMiddleware(t *testing.T) {
+	tests := []struct {
+		name          string
+		method        string
+		body          string
+		contentLength int64
+		failures      int
+		budget        int
+		attempts      int
+		code          int
+	}{
+		{"get retried", "GET", "", 0, 2, 10, 3, http.StatusOK},
+		{"get all attempts fail", "GET", "", 0, 5, 10, 3, http.StatusServiceUnavailable},
+		{"head retried", "HEAD", "", 0, 1, 10, 2, http.StatusOK},
+		{"options retried", "OPTIONS", "", 0, 1, 10, 2, http.StatusOK},
+		{"put retried", "PUT", "data", 4, 1, 10, 2, http.StatusOK},
+		{"put too large", "PUT", "too large data", 14, 1, 10, 1, http.StatusServiceUnavailable},
+		{"put unknown size", "PUT", "data", -1, 1, 10, 1, http.StatusServiceUnavailable},
+		{"post not retried", "POST", "data", 4, 1, 10, 1, http.StatusServiceUnavailable},
+		{"delete not retried", "DELETE", "", 0, 1, 10, 1, http.StatusServiceUnavailable},
+		{"move not retried", "MOVE", "", 0, 1, 10, 1, http.StatusServiceUnavailable},
+		{"budget exhausted", "GET", "", 0, 1, 0, 1, http.StatusServiceUnavailable},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			policy := (&retryPolicy{MaxReplayBodySize: 8}).withDefaults()
+			next := &failingHandler{failures: tt.failures}
+			handler := retryMiddleware("test", policy, newRetryBudget("test", 0, tt.budget), next)
+
+			r := httptest.NewRequest(tt.method, "/data/file", strings.NewReader(tt.body))
+			r.ContentLength = tt.contentLength
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+
+			if got := next.attempts(); got != tt.attempts {
+				t.Errorf("attempts = %d, want %d", got, tt.attempts)
+			}
+			if w.Code != tt.code {
+				t.Errorf("status = %d, want %d", w.Code, tt.code)
+			}
+			want := "ok"
+			if tt.code != http.StatusOK {
+				want = "failure"
+			}
+			if got := w.Body.String(); got != want {
+				t.Errorf("body = %q, want %q", got, want)
+			}
+			for i, body := range next.bodies {
+				if body != tt.body {
+					t.Errorf("attempt %d got body %q, want %q", i+1, body, tt.body)
+				}
+			}
+		})
+	}
+}
+
+func TestRetryMiddlewareHedge(t *testing.T) {
+	tests := []struct {
+		method   string
+		attempts int
+	}{
+		{"GET", 2},
+		{"HEAD", 2},
+		{"OPTIONS", 1},
+		{"PUT", 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.method, func(t *testing.T) {
+			policy := (&retryPolicy{MaxAttempts: 2, HedgeAfter: 20}).withDefaults()
+			var mu sync.Mutex
+			attempts := 0
+			canceled := make(chan struct{}, 1)
+			next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				mu.Lock()
+				attempts++
+				n := attempts
+				mu.Unlock()
+				if n == 1 {
+					// the first node is slow
+					select {
+					case <-r.Context().Done():
+						canceled <- struct{}{}
+						return
+					case <-time.After(100 * time.Millisecond):
+					}
+				}
+				w.WriteHeader(http.StatusOK)
+			})
+			handler := retryMiddleware("test", policy, newRetryBudget("test", 0, 10), next)
+
+			r := httptest.NewRequest(tt.method, "/data/file", nil)
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+
+			if attempts != tt.attempts {
+				t.Errorf("attempts = %d, want %d", attempts, tt.attempts)
+			}
+			if w.Code != http.StatusOK {
+				t.Errorf("status = %d, want 200", w.Code)
+			}
+			if hedged := len(canceled) == 1; hedged != (tt.attempts > 1) {
+				t.Errorf("slow attempt canceled %t, want %t", hedged, tt.attempts > 1)
+			}
+		})
+	}
+}
+
+func TestRetryBudget(t *testing.T) {
+	tests := []struct {
+		name         string
+		percent      int
+		minPerSecond int
+		requests     int
+		retries      int
+	}{
+		{"no budget", 0, 0, 100, 0},
+		{"minimum per second", 0, 3, 100, 3},
+		{"percent of requests", 25, 0, 40, 10},
+		{"percent and minimum", 50, 2, 10, 7},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := newRetryBudget("test", tt.percent, tt.minPerSecond)
+			for i := 0; i < tt.requests; i++ {
+				b.deposit()
+			}
+			retries := 0
+			for b.withdraw() {
+				retries++
+			}
+			if retries != tt.retries {
+				t.Fatalf("retries = %d, want %d", retries, tt.retries)
+			}
+		})
+	}
+}
+
+func TestReadReplayableBody(t *testing.T) {
+	tests := []struct {
+		name          string
+		body          string
+		contentLength int64
+		ok            bool
+	}{
+		{"empty", "", 0, true},
+		{"small", "data", 4, true},
+		{"max size", "12345678", 8, true},
+		{"too large", "123456789", 9, false},
+		{"unknown size", "data", -1, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("PUT", "/data/file", strings.NewReader(tt.body))
+			r.ContentLength = tt.contentLength
+			body, ok := readReplayableBody(r, 8)
+			if ok != tt.ok {
+				t.Fatalf("readReplayableBody() ok = %t, want %t", ok, tt.ok)
+			}
+			if ok && string(body) != tt.body {
+				t.Fatalf("readReplayableBody() = %q, want %q", body, tt.body)
+			}
+		})
+	}
+}
@@ -0,0 +1,363 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// routeView is a route of the public router as served by the routes endpoint.
+type routeView struct {
+	Method       string   `json:"method"`
+	Path         string   `json:"path"`
+	WebService   string   `json:"web_service,omitempty"`
+	Hosts        []string `json:"hosts,omitempty"`
+	CORS         bool     `json:"cors"`
+	AuthRequired bool     `json:"auth_required"`
+}
+
+// authentication schemes of the web services
+const (
+	authToken = "token"
+	authBasic = "basic"
+)
+
+// getWebServiceAuth returns how the requests to web service key are
+// authenticated, empty if they are not. The authentication web service
+// issues the tokens, the owncloud web service takes basic auth and the
+// other web services take a token. Proxied web services are authenticated
+// by the nodes they proxy to.
+func getWebServiceAuth(key string) string {
+	switch key {
+	case "data", "metadata":
+		return authToken
+	case "owncloud":
+		return authBasic
+	default:
+		return ""
+	}
+}
+
+// nativeEndpoint is an endpoint of a web service: its method, its path
+// without the path prefix and whether its requests are authenticated.
+type nativeEndpoint struct {
+	method string
+	path   string
+	auth   bool
+}
+
+// nativeEndpoints are the endpoints of the web services of clawio/lib, for
+// the routes command to list the routes without building the web services.
+// They are kept by hand and may fall behind the web services, the /routes
+// endpoint of a running node lists the routes it really serves.
+var nativeEndpoints = map[string][]nativeEndpoint{
+	"authentication": {
+		{"POST", "/token", false},
+	},
+	"data": {
+		{"PUT", "/upload/{path:.*}", true},
+		{"GET", "/download/{path:.*}", true},
+	},
+	"metadata": {
+		{"POST", "/init", true},
+		{"GET", "/examine/{path:.*}", true},
+		{"GET", "/list/{path:.*}", true},
+		{"DELETE", "/delete/{path:.*}", true},
+		{"POST", "/move/{path:.*}", true},
+		{"POST", "/mkdir/{path:.*}", true},
+	},
+	"owncloud": {
+		{"GET", "/status.php", false},
+		{"GET", "/ocs/v1.php/cloud/capabilities", false},
+		{"GET", "/ocs/v1.php/cloud/user", true},
+		{"*", "/remote.php/webdav{path:.*}", true},
+	},
+}
+
+// isAuthRequired reports whether the requests of a route of web service
+// key must be authenticated. The endpoints not in nativeEndpoints are
+// authenticated like the rest of the web service. CORS preflight requests
+// never are, the cors middleware answers them.
+func isAuthRequired(key, method, path string) bool {
+	if method == "OPTIONS" {
+		return false
+	}
+	for _, e := range nativeEndpoints[key] {
+		if e.method == method && e.path == path {
+			return e.auth
+		}
+	}
+	return getWebServiceAuth(key) != ""
+}
+
+// routeCatalog collects the routes of a configuration.
+type routeCatalog struct {
+	config *configuration
+	mounts map[string]*webServiceMount
+	routes []*routeView
+	routed map[string]bool
+}
+
+func newRouteCatalog(config *configuration) *routeCatalog {
+	return &routeCatalog{
+		config: config,
+		mounts: getWebServiceMounts(config),
+		routes: []*routeView{},
+		routed: map[string]bool{},
+	}
+}
+
+// add adds the route of method and path of web service key, empty for the
+// endpoints of the node. The path of a web service is the one it defines,
+// without the path prefix. A route is added once for every method and path,
+// e.g. the preflight route shared by every method of a path.
+func (c *routeCatalog) add(key, method, path string) {
+	r := &routeView{Method: method, Path: path, WebService: key}
+	if mount := c.mounts[key]; mount != nil {
+		r.Path = mount.pathPrefix + path
+		r.Hosts = mount.hosts
+		r.CORS = c.config.IsCORSMiddlewareEnabled()
+		r.AuthRequired = isAuthRequired(key, method, path)
+	}
+	if c.routed[r.Method+" "+r.Path] {
+		return
+	}
+	c.routed[r.Method+" "+r.Path] = true
+	c.routes = append(c.routes, r)
+}
+
+// addNodeEndpoints adds the endpoints served by every node. The endpoints
+// for operators are served by the admin listener if there is one.
+func (c *routeCatalog) addNodeEndpoints() {
+	c.add("", "GET", "/healthz")
+	c.add("", "GET", "/readyz")
+	if c.config.GetAdminListener() == nil {
+		for _, path := range []string{"/metrics", "/upstreams", "/routes", "/openapi.json"} {
+			c.add("", "GET", path)
+		}
+	}
+}
+
+// addEndpoint adds the routes of an endpoint of web service key,
+// with its preflight route if CORS is enabled.
+func (c *routeCatalog) addEndpoint(key, method, path string) {
+	c.add(key, method, path)
+	if c.config.IsCORSMiddlewareEnabled() {
+		c.add(key, "OPTIONS", path)
+	}
+}
+
+// getConfiguredRoutes returns the routes of the enabled web services from
+// the configuration and nativeEndpoints, without building the web services
+// or their drivers.
+func getConfiguredRoutes(config *configuration) []*routeView {
+	catalog := newRouteCatalog(config)
+	catalog.addNodeEndpoints()
+	enabled := strings.Split(config.GetEnabledWebServices(), ",")
+	for _, key := range webServiceNames {
+		if !find(key, enabled) {
+			continue
+		}
+		for _, e := range nativeEndpoints[key] {
+			catalog.addEndpoint(key, e.method, e.path)
+		}
+	}
+	return sortRoutes(catalog.routes)
+}
+
+// sortRoutes returns the routes sorted by path and method.
+func sortRoutes(routes []*routeView) []*routeView {
+	sorted := make([]*routeView, len(routes))
+	copy(sorted, routes)
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].Path != sorted[j].Path {
+			return sorted[i].Path < sorted[j].Path
+		}
+		return sorted[i].Method < sorted[j].Method
+	})
+	return sorted
+}
+
+// routesHandler serves the routes sorted by path and method.
+func routesHandler(routes []*routeView) http.HandlerFunc {
+	sorted := sortRoutes(routes)
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(sorted)
+	}
+}
+
+// openAPIHandler serves the OpenAPI document of the routes.
+func openAPIHandler(routes []*routeView) http.HandlerFunc {
+	doc := newOpenAPIDocument(routes)
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(doc)
+	}
+}
+
+// openAPIWebServices are the web services described by the OpenAPI
+// document, the native API of clawiod. The owncloud web service
+// speaks WebDAV, for which there are clients already.
+var openAPIWebServices = map[string]bool{"authentication": true, "data": true, "metadata": true}
+
+// openAPIDocument is an OpenAPI 3 document.
+type openAPIDocument struct {
+	OpenAPI    string                                  `json:"openapi"`
+	Info       *openAPIInfo                            `json:"info"`
+	Paths      map[string]map[string]*openAPIOperation `json:"paths"`
+	Components *openAPIComponents                      `json:"components"`
+}
+
+type openAPIInfo struct {
+	Title   string `json:"title"`
+	Version string `json:"version"`
+}
+
+type openAPIOperation struct {
+	OperationID string                      `json:"operationId"`
+	Tags        []string                    `json:"tags"`
+	Parameters  []*openAPIParameter         `json:"parameters,omitempty"`
+	Security    []map[string][]string       `json:"security,omitempty"`
+	Responses   map[string]*openAPIResponse `json:"responses"`
+}
+
+type openAPIParameter struct {
+	Name     string         `json:"name"`
+	In       string         `json:"in"`
+	Required bool           `json:"required"`
+	Schema   *openAPISchema `json:"schema"`
+}
+
+type openAPISchema struct {
+	Type    string `json:"type"`
+	Pattern string `json:"pattern,omitempty"`
+}
+
+type openAPIResponse struct {
+	Description string `json:"description"`
+}
+
+type openAPIComponents struct {
+	SecuritySchemes map[string]*openAPISecurityScheme `json:"securitySchemes"`
+}
+
+type openAPISecurityScheme struct {
+	Type   string `json:"type"`
+	In     string `json:"in,omitempty"`
+	Name   string `json:"name,omitempty"`
+	Scheme string `json:"scheme,omitempty"`
+}
+
+// newOpenAPIDocument describes the routes of the native web services.
+// The routes of any method and the CORS preflight requests are left out,
+// they are not operations of the API. A token is sent in the token header
+// or as a bearer token.
+func newOpenAPIDocument(routes []*routeView) *openAPIDocument {
+	doc := &openAPIDocument{
+		OpenAPI: "3.0.0",
+		Info:    &openAPIInfo{Title: "ClawIO", Version: getVersion()},
+		Paths:   map[string]map[string]*openAPIOperation{},
+		Components: &openAPIComponents{SecuritySchemes: map[string]*openAPISecurityScheme{
+			"token":  {Type: "apiKey", In: "header", Name: "token"},
+			"bearer": {Type: "http", Scheme: "bearer"},
+		}},
+	}
+	operationIDs := map[string]int{}
+	for _, r := range sortRoutes(routes) {
+		if !openAPIWebServices[r.WebService] || r.Method == "*" || r.Method == "OPTIONS" {
+			continue
+		}
+		path, parameters := parsePathTemplate(r.Path)
+		op := &openAPIOperation{
+			OperationID: getOperationID(r, operationIDs),
+			Tags:        []string{r.WebService},
+			Parameters:  parameters,
+			Responses:   map[string]*openAPIResponse{"default": {Description: "response of the " + r.WebService + " web service"}},
+		}
+		if r.AuthRequired {
+			op.Security = []map[string][]string{{"token": {}}, {"bearer": {}}}
+		}
+		if doc.Paths[path] == nil {
+			doc.Paths[path] = map[string]*openAPIOperation{}
+		}
+		doc.Paths[path][strings.ToLower(r.Method)] = op
+	}
+	return doc
+}
+
+// parsePathTemplate converts a mux path template, e.g. /download/{path:.*},
+// to an OpenAPI path and its parameters, e.g. /download/{path}.
+func parsePathTemplate(template string) (string, []*openAPIParameter) {
+	var path bytes.Buffer
+	parameters := []*openAPIParameter{}
+	for {
+		start := strings.Index(template, "{")
+		if start < 0 {
+			path.WriteString(template)
+			return path.String(), parameters
+		}
+		// the pattern of a variable can have braces, e.g. {id:[0-9]{4}}
+		end, depth := -1, 0
+		for i := start; i < len(template) && end < 0; i++ {
+			switch template[i] {
+			case '{':
+				depth++
+			case '}':
+				if depth--; depth == 0 {
+					end = i
+				}
+			}
+		}
+		if end < 0 {
+			path.WriteString(template)
+			return path.String(), parameters
+		}
+		name, pattern := template[start+1:end], ""
+		if i := strings.Index(name, ":"); i >= 0 {
+			name, pattern = name[:i], name[i+1:]
+		}
+		path.WriteString(template[:start] + "{" + name + "}")
+		parameters = append(parameters, &openAPIParameter{
+			Name:     name,
+			In:       "path",
+			Required: true,
+			Schema:   &openAPISchema{Type: "string", Pattern: pattern},
+		})
+		template = template[end+1:]
+	}
+}
+
+// getOperationID names an operation after its web service, method and
+// the literal segments of its path, e.g. dataGetDownload.
+// ids counts the names given to keep them unique.
+func getOperationID(r *routeView, ids map[string]int) string {
+	id := r.WebService + title(strings.ToLower(r.Method))
+	for _, segment := range strings.Split(r.Path, "/") {
+		if strings.HasPrefix(segment, "{") {
+			continue
+		}
+		id += title(strings.Map(func(c rune) rune {
+			if unicode.IsLetter(c) || unicode.IsDigit(c) {
+				return c
+			}
+			return -1
+		}, segment))
+	}
+	ids[id]++
+	if n := ids[id]; n > 1 {
+		return fmt.Sprintf("%s%d", id, n)
+	}
+	return id
+}
+
+func title(s string) string {
+	if s == "" {
+		return s
+	}
+	return strings.ToUpper(s[:1]) + s[1:]
+}
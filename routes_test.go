@@ -0,0 +1,180 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParsePathTemplate(t *testing.T) {
+	tests := []struct {
+		template string
+		path     string
+		names    []string
+		patterns []string
+	}{
+		{"/init", "/init", []string{}, []string{}},
+		{"/download/{path:.*}", "/download/{path}", []string{"path"}, []string{".*"}},
+		{"/users/{id}", "/users/{id}", []string{"id"}, []string{""}},
+		{"/year/{year:[0-9]{4}}/{path:.*}", "/year/{year}/{path}", []string{"year", "path"}, []string{"[0-9]{4}", ".*"}},
+		{"/remote.php/webdav{path:.*}", "/remote.php/webdav{path}", []string{"path"}, []string{".*"}},
+		{"/broken/{path", "/broken/{path", []string{}, []string{}},
+	}
+	for _, tt := range tests {
+		path, parameters := parsePathTemplate(tt.template)
+		if path != tt.path {
+			t.Errorf("parsePathTemplate(%q) path = %q, want %q", tt.template, path, tt.path)
+		}
+		names, patterns := []string{}, []string{}
+		for _, p := range parameters {
+			if p.In != "path" || !p.Required {
+				t.Errorf("parsePathTemplate(%q) parameter %q is not a required path parameter", tt.template, p.Name)
+			}
+			names = append(names, p.Name)
+			patterns = append(patterns, p.Schema.Pattern)
+		}
+		if !reflect.DeepEqual(names, tt.names) || !reflect.DeepEqual(patterns, tt.patterns) {
+			t.Errorf("parsePathTemplate(%q) parameters = %q %q, want %q %q", tt.template, names, patterns, tt.names, tt.patterns)
+		}
+	}
+}
+
+func TestGetOperationID(t *testing.T) {
+	ids := map[string]int{}
+	tests := []struct {
+		route *routeView
+		want  string
+	}{
+		{&routeView{WebService: "data", Method: "GET", Path: "/download/{path:.*}"}, "dataGetDownload"},
+		{&routeView{WebService: "metadata", Method: "POST", Path: "/api/v1/metadata/mkdir/{path:.*}"}, "metadataPostApiV1MetadataMkdir"},
+		{&routeView{WebService: "authentication", Method: "POST", Path: "/token"}, "authenticationPostToken"},
+		// the same name again is numbered
+		{&routeView{WebService: "data", Method: "GET", Path: "/download/{id}"}, "dataGetDownload2"},
+	}
+	for _, tt := range tests {
+		if got := getOperationID(tt.route, ids); got != tt.want {
+			t.Errorf("getOperationID(%s %s) = %q, want %q", tt.route.Method, tt.route.Path, got, tt.want)
+		}
+	}
+}
+
+func TestIsAuthRequired(t *testing.T) {
+	tests := []struct {
+		webService, method, path string
+		want                     bool
+	}{
+		{"authentication", "POST", "/token", false},
+		{"data", "GET", "/download/{path:.*}", true},
+		{"data", "OPTIONS", "/download/{path:.*}", false},
+		{"metadata", "POST", "/init", true},
+		{"owncloud", "GET", "/status.php", false},
+		{"owncloud", "*", "/remote.php/webdav{path:.*}", true},
+		// endpoints not known are authenticated like their web service
+		{"owncloud", "GET", "/unknown", true},
+		{"authentication", "GET", "/unknown", false},
+		{"", "GET", "/healthz", false},
+	}
+	for _, tt := range tests {
+		if got := isAuthRequired(tt.webService, tt.method, tt.path); got != tt.want {
+			t.Errorf("isAuthRequired(%q, %q, %q) = %t, want %t", tt.webService, tt.method, tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestGetConfiguredRoutes(t *testing.T) {
+	tests := []struct {
+		name   string
+		config *configuration
+		want   []string
+	}{
+		{"node endpoints", &configuration{AdminListener: &listenerConfig{Network: listenerTCP, Address: "127.0.0.1:1503"}}, []string{
+			"GET /healthz",
+			"GET /readyz",
+		}},
+		{"authentication", &configuration{EnabledWebServices: "authentication"}, []string{
+			"GET /healthz",
+			"GET /metrics",
+			"GET /openapi.json",
+			"GET /readyz",
+			"GET /routes",
+			"POST /token",
+			"GET /upstreams",
+		}},
+		{"path prefix and cors", &configuration{
+			EnabledWebServices:       "data",
+			DataWebServicePathPrefix: "/api/data",
+			CORSMiddlewareEnabled:    true,
+			AdminListener:            &listenerConfig{Network: listenerTCP, Address: "127.0.0.1:1503"},
+		}, []string{
+			"GET /api/data/download/{path:.*}",
+			"OPTIONS /api/data/download/{path:.*}",
+			"OPTIONS /api/data/upload/{path:.*}",
+			"PUT /api/data/upload/{path:.*}",
+			"GET /healthz",
+			"GET /readyz",
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := []string{}
+			for _, r := range getConfiguredRoutes(tt.config) {
+				got = append(got, r.Method+" "+r.Path)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("routes = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRouteCatalogAdd(t *testing.T) {
+	catalog := newRouteCatalog(&configuration{
+		OCWebServicePathPrefix: "/oc",
+		OCWebServiceHosts:      "files.example.com",
+		CORSMiddlewareEnabled:  true,
+	})
+	catalog.add("owncloud", "GET", "/status.php")
+	catalog.add("owncloud", "OPTIONS", "/status.php")
+	catalog.add("owncloud", "GET", "/ocs/v1.php/cloud/user")
+	// the preflight route of a path is added once
+	catalog.add("owncloud", "OPTIONS", "/status.php")
+
+	want := []*routeView{
+		{Method: "GET", Path: "/oc/status.php", WebService: "owncloud", Hosts: []string{"files.example.com"}, CORS: true},
+		{Method: "OPTIONS", Path: "/oc/status.php", WebService: "owncloud", Hosts: []string{"files.example.com"}, CORS: true},
+		{Method: "GET", Path: "/oc/ocs/v1.php/cloud/user", WebService: "owncloud", Hosts: []string{"files.example.com"}, CORS: true, AuthRequired: true},
+	}
+	if !reflect.DeepEqual(catalog.routes, want) {
+		t.Fatalf("routes = %+v, want %+v", catalog.routes, want)
+	}
+}
+
+func TestNewOpenAPIDocument(t *testing.T) {
+	doc := newOpenAPIDocument(getConfiguredRoutes(&configuration{
+		EnabledWebServices:    "authentication,data,owncloud",
+		CORSMiddlewareEnabled: true,
+	}))
+	tests := []struct {
+		path, method string
+		exists       bool
+		secured      bool
+	}{
+		{"/token", "post", true, false},
+		{"/download/{path}", "get", true, true},
+		{"/upload/{path}", "put", true, true},
+		// preflight requests are not operations
+		{"/download/{path}", "options", false, false},
+		// the owncloud web service and the node endpoints are not described
+		{"/status.php", "get", false, false},
+		{"/healthz", "get", false, false},
+	}
+	for _, tt := range tests {
+		op, ok := doc.Paths[tt.path][tt.method]
+		if ok != tt.exists {
+			t.Errorf("%s %s described %t, want %t", tt.method, tt.path, ok, tt.exists)
+			continue
+		}
+		if ok && (len(op.Security) > 0) != tt.secured {
+			t.Errorf("%s %s secured %t, want %t", tt.method, tt.path, len(op.Security) > 0, tt.secured)
+		}
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+)
+
+// handleRoutes prints the routes served for the configuration of the server,
+// or their OpenAPI document, from the configuration and the endpoints known
+// of every web service. It exits with a non-zero code on error.
+//
+//	clawiod routes [-output table|json|openapi]
+func handleRoutes(args []string) {
+	if err := runRoutesCommand(args); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	os.Exit(0)
+}
+
+func runRoutesCommand(args []string) error {
+	fs := flag.NewFlagSet("routes", flag.ExitOnError)
+	output := fs.String("output", "table", "Output format: table, json or openapi")
+	fs.Parse(args)
+	if *output != "table" && *output != "json" && *output != "openapi" {
+		return fmt.Errorf("output %q does not exist, use table, json or openapi", *output)
+	}
+
+	configurationSource, err := getConfigurationSource(flagConfigurationSource)
+	if err != nil {
+		return err
+	}
+	config, err := loadConfiguration(configurationSource)
+	if err != nil {
+		return err
+	}
+	// the web services are not built, the command does not reach
+	// the drivers, the registry or other nodes
+	routes := getConfiguredRoutes(config)
+
+	switch *output {
+	case "json":
+		return printJSON(routes)
+	case "openapi":
+		return printJSON(newOpenAPIDocument(routes))
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "METHOD\tPATH\tWEB SERVICE\tHOSTS\tCORS\tAUTH")
+	for _, r := range routes {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%t\t%t\n", r.Method, r.Path, dash(r.WebService), dash(strings.Join(r.Hosts, ",")), r.CORS, r.AuthRequired)
+	}
+	return w.Flush()
+}
+
+func dash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"github.com/clawio/lib"
 	"github.com/go-kit/kit/log/levels"
@@ -9,166 +10,589 @@ import (
 	"github.com/gorilla/mux"
 	"github.com/prometheus/client_golang/prometheus"
 	"io"
+	"net"
 	"net/http"
 	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 )
 
 type server struct {
+	// mu guards the fields below that are replaced
+	// when the configuration is reloaded.
+	mu             sync.RWMutex
+	current        *generation
 	logger         levels.Levels
 	router         http.Handler
-	config         lib.Configuration
+	config         *configuration
 	httpLogger     io.Writer
 	registryDriver lib.RegistryDriver
 	webServices    map[string]lib.WebService
+
+	started time.Time
+	// registered is when the node was first registered
+	registered time.Time
+	// lastHeartbeat is when the node was last registered
+	lastHeartbeat time.Time
+	heartbeat     *heartbeat
+	// conns are the connections accepted by the listener
+	conns *connTracker
 }
 
-func newServer(config lib.Configuration) (*server, error) {
-	logger, err := getLogger(config)
-	if err != nil {
+// generation is the handler built for one configuration together
+// with its components and the requests it is serving.
+type generation struct {
+	handler   http.Handler
+	admin     http.Handler
+	routes    []*routeView
+	container *container
+	inFlight  sync.WaitGroup
+}
+
+func newServer(config *configuration) (*server, error) {
+	heartbeatSettings := getHeartbeatSettings(config)
+	if err := heartbeatSettings.validate(); err != nil {
 		return nil, err
 	}
-	registryDriver, err := getRegistryDriver(config)
+	s := &server{started: time.Now(), conns: newConnTracker()}
+	s.heartbeat = newHeartbeat(s.registerNode, s.getLogger, heartbeatSettings)
+	err := s.configureRouter(config)
 	if err != nil {
 		return nil, err
 	}
-	s := &server{logger: logger, config: config, registryDriver: registryDriver}
-	err = s.configureRouter()
+	prometheus.MustRegister(newRegistrationAgeMetric(s))
+	// register the node repeatedly to avoid it
+	// being removed by the TTL constraint
+	s.heartbeat.start()
+	return s, nil
+}
+
+// stop stops registering the node and removes it from the registry
+// so proxies stop routing requests to it.
+func (s *server) stop(ctx context.Context) error {
+	if err := s.heartbeat.stop(ctx); err != nil {
+		return err
+	}
+	return s.unregisterNode(ctx)
+}
+
+// close closes the components of the current configuration.
+// It must be called once the server does not serve requests anymore.
+func (s *server) close() error {
+	s.mu.RLock()
+	current := s.current
+	s.mu.RUnlock()
+	current.inFlight.Wait()
+	return current.container.close()
+}
+
+// ServeHTTP serves the request with the handler that was active when the
+// request arrived, so in-flight requests are not affected by reloads.
+func (s *server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.RLock()
+	current := s.current
+	current.inFlight.Add(1)
+	s.mu.RUnlock()
+	defer current.inFlight.Done()
+	current.handler.ServeHTTP(w, r)
+}
+
+// serveAdmin serves the requests of the admin listener
+// with the admin router of the current configuration.
+func (s *server) serveAdmin(w http.ResponseWriter, r *http.Request) {
+	s.mu.RLock()
+	current := s.current
+	current.inFlight.Add(1)
+	s.mu.RUnlock()
+	defer current.inFlight.Done()
+	current.admin.ServeHTTP(w, r)
+}
+
+func (s *server) getLogger() levels.Levels {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.logger
+}
+
+// reload applies a new configuration to the running server.
+// If the configuration is not valid the server keeps the current one.
+func (s *server) reload(config *configuration) error {
+	s.mu.RLock()
+	current := s.config
+	s.mu.RUnlock()
+
+	if config.GetPort() != current.GetPort() ||
+		config.IsTLSEnabled() != current.IsTLSEnabled() ||
+		config.GetTLSCertificate() != current.GetTLSCertificate() ||
+		config.GetTLSPrivateKey() != current.GetTLSPrivateKey() ||
+		config.GetTLSMode() != current.GetTLSMode() ||
+		config.GetTLSACMEHosts() != current.GetTLSACMEHosts() ||
+		config.GetTLSACMEDirectoryURL() != current.GetTLSACMEDirectoryURL() ||
+		config.IsMTLSEnabled() != current.IsMTLSEnabled() ||
+		config.GetMTLSCACertificate() != current.GetMTLSCACertificate() ||
+		config.GetHTTPReadHeaderTimeout() != current.GetHTTPReadHeaderTimeout() ||
+		config.GetHTTPIdleTimeout() != current.GetHTTPIdleTimeout() ||
+		config.GetHTTPMaxHeaderBytes() != current.GetHTTPMaxHeaderBytes() ||
+		config.GetHTTPMaxConnections() != current.GetHTTPMaxConnections() ||
+		config.IsHTTP2CleartextEnabled() != current.IsHTTP2CleartextEnabled() ||
+		config.IsHTTP2CleartextClientEnabled() != current.IsHTTP2CleartextClientEnabled() ||
+		config.GetHTTP2MaxConcurrentStreams() != current.GetHTTP2MaxConcurrentStreams() ||
+		config.GetHTTP2MaxReadFrameSize() != current.GetHTTP2MaxReadFrameSize() ||
+		config.GetHTTP2ConnectionWindowSize() != current.GetHTTP2ConnectionWindowSize() ||
+		config.GetHTTP2StreamWindowSize() != current.GetHTTP2StreamWindowSize() ||
+		!reflect.DeepEqual(config.GetListeners(), current.GetListeners()) ||
+		!reflect.DeepEqual(config.GetAdminListener(), current.GetAdminListener()) {
+		return errors.New("port, listeners, TLS, HTTP and HTTP/2 settings can not be changed without a restart")
+	}
+	heartbeatSettings := getHeartbeatSettings(config)
+	if err := heartbeatSettings.validate(); err != nil {
+		return err
+	}
+
+	var err error
+	oldNodes := []*node{}
+	s.mu.RLock()
+	oldRegistryDriver := s.registryDriver
+	if isRegistering(oldRegistryDriver) {
+		oldNodes, err = s.getNodes()
+	}
+	s.mu.RUnlock()
 	if err != nil {
-		return nil, err
+		return err
 	}
-	// do the register in other routine repeatedly to avoid the node
-	// being removed by the TTL constraint
-	go func() {
-		err = s.registerNode()
-		if err != nil {
-			s.logger.Error().Log("error", "error registering node")
+
+	if err := s.configureRouter(config); err != nil {
+		return err
+	}
+
+	// nodes of web services that are not enabled anymore
+	// must leave the registry. The configuration is applied already,
+	// so on error the nodes left behind stay until they expire.
+	if len(oldNodes) > 0 {
+		s.mu.RLock()
+		newNodes, err := s.getNodes()
+		s.mu.RUnlock()
+		if err == nil {
+			err = s.unregister(context.Background(), oldRegistryDriver, getDisabledNodes(oldNodes, newNodes))
 		}
-		for range time.Tick(time.Second * 5) {
-			err = s.registerNode()
-			if err != nil {
-				s.logger.Error().Log("error", "error registering node")
-			}
+		if err != nil {
+			s.getLogger().Warn().Log("msg", "nodes of disabled web services are still registered", "error", err)
 		}
-	}()
+	}
 
-	return s, nil
+	if heartbeatSettings != getHeartbeatSettings(current) {
+		s.heartbeat.restart(heartbeatSettings)
+	}
+	return nil
 }
 
-func (s *server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	handlers.CombinedLoggingHandler(s.httpLogger, s.router).ServeHTTP(w, r)
+// registerNode registers the nodes of every enabled web service.
+// It is called by the heartbeat.
+func (s *server) registerNode(ctx context.Context) (err error) {
+	defer func() {
+		observeRegistration(err)
+	}()
+
+	s.mu.Lock()
+	s.lastHeartbeat = time.Now()
+	if s.registered.IsZero() {
+		s.registered = s.lastHeartbeat
+	}
+	logger := s.logger
+	registryDriver := s.registryDriver
+	if !isRegistering(registryDriver) {
+		s.mu.Unlock()
+		return nil
+	}
+	nodes, err := s.getNodes()
+	s.mu.Unlock()
+	if err != nil {
+		logger.Error().Log("error", err)
+		return err
+	}
+	for _, node := range nodes {
+		err := registryDriver.Register(ctx, node)
+		if err != nil {
+			logger.Error().Log("error", err)
+			return err
+		}
+	}
+	return nil
 }
 
-func (s *server) registerNode() error {
-	hostname, err := os.Hostname()
+// unregisterNode removes the nodes of every enabled web service from the registry.
+func (s *server) unregisterNode(ctx context.Context) error {
+	s.mu.RLock()
+	registryDriver := s.registryDriver
+	if !isRegistering(registryDriver) {
+		s.mu.RUnlock()
+		return nil
+	}
+	nodes, err := s.getNodes()
+	s.mu.RUnlock()
 	if err != nil {
-		s.logger.Error().Log("error", err)
+		s.getLogger().Error().Log("error", err)
+		return err
+	}
+	return s.unregister(ctx, registryDriver, nodes)
+}
+
+// unregister removes nodes from the registry. It fails if the registry
+// driver is not able to remove them, they stay until they expire.
+func (s *server) unregister(ctx context.Context, registryDriver lib.RegistryDriver, nodes []*node) error {
+	logger := s.getLogger()
+	if len(nodes) == 0 {
+		return nil
+	}
+	if !isRegistering(registryDriver) {
+		// the nodes were never registered by us
+		return nil
+	}
+	unregisterer, ok := registryDriver.(registryUnregisterer)
+	if !ok {
+		err := errors.New("registry driver can not remove nodes, they stay in the registry until they expire")
+		logger.Error().Log("error", err)
 		return err
 	}
+	for _, node := range nodes {
+		err := unregisterer.Unregister(ctx, node)
+		if err != nil {
+			logger.Error().Log("error", err)
+			return err
+		}
+		logger.Info().Log("msg", "node unregistered", "rol", node.Rol(), "id", node.ID())
+	}
+	return nil
+}
+
+// getDisabledNodes returns the nodes of oldNodes missing from newNodes.
+func getDisabledNodes(oldNodes, newNodes []*node) []*node {
+	disabled := []*node{}
+	for _, old := range oldNodes {
+		found := false
+		for _, n := range newNodes {
+			if n.Rol() == old.Rol() && n.ID() == old.ID() {
+				found = true
+				break
+			}
+		}
+		if !found {
+			disabled = append(disabled, old)
+		}
+	}
+	return disabled
+}
+
+// getNodes returns the registry nodes for the enabled web services,
+// reached at the address of the first TCP listener.
+// It must be called with s.mu held.
+func (s *server) getNodes() ([]*node, error) {
+	scheme, address, err := getRegisteredAddress(s.config)
+	if err != nil {
+		return nil, err
+	}
+	mounts := getWebServiceMounts(s.config)
+	nodes := []*node{}
 	for key, ws := range s.webServices {
 		rol := key + "-node"
 		if ws.IsProxy() {
 			rol = rol + "-proxy"
 		}
 
-		url := fmt.Sprintf("%s:%d", hostname, s.config.GetPort())
-		if s.config.IsTLSEnabled() {
-			url = fmt.Sprintf("https://%s", url)
+		// other nodes reach the endpoints under the path prefix
+		url := fmt.Sprintf("%s://%s%s", scheme, address, mounts[key].pathPrefix)
+
+		nodes = append(nodes, &node{
+			xhost:     address,
+			xid:       address,
+			xrol:      rol,
+			xurl:      url,
+			xversion:  getVersion(),
+			xmetadata: s.getNodeMetadata(key, ws)})
+	}
+	return nodes, nil
+}
+
+// getNodeMetadata returns the information a proxy can use to route requests
+// to the node of web service key. It must be called with s.mu held.
+func (s *server) getNodeMetadata(key string, ws lib.WebService) map[string]string {
+	config := s.config
+	metadata := map[string]string{
+		"commit":         gitCommit,
+		"build_date":     buildDate,
+		"started":        s.started.UTC().Format(time.RFC3339),
+		"registered":     s.registered.UTC().Format(time.RFC3339),
+		"last_heartbeat": s.lastHeartbeat.UTC().Format(time.RFC3339),
+		"tls":            strconv.FormatBool(config.IsTLSEnabled()),
+	}
+	if ws.IsProxy() {
+		return metadata
+	}
+	switch key {
+	case "authentication":
+		metadata["user_driver"] = config.GetUserDriver()
+		metadata["token_driver"] = config.GetTokenDriver()
+	case "data":
+		metadata["data_driver"] = config.GetDataDriver()
+		metadata["max_upload_file_size"] = strconv.FormatInt(config.GetDataWebServiceMaxUploadFileSize(), 10)
+	case "metadata":
+		metadata["meta_data_driver"] = config.GetMetaDataDriver()
+	case "owncloud":
+		metadata["basic_auth_middleware"] = config.GetBasicAuthMiddleware()
+		if config.GetOCWebService() == "remote" {
+			metadata["max_upload_file_size"] = strconv.FormatInt(config.GetRemoteOCWebServiceMaxUploadFileSize(), 10)
 		} else {
-			url = fmt.Sprintf("http://%s", url)
+			metadata["data_driver"] = config.GetDataDriver()
+			metadata["meta_data_driver"] = config.GetMetaDataDriver()
+			metadata["max_upload_file_size"] = strconv.FormatInt(config.GetOCWebServiceMaxUploadFileSize(), 10)
 		}
+	}
+	return metadata
+}
 
-		node := &node{
-			xhost:    fmt.Sprintf("%s:%d", hostname, s.config.GetPort()),
-			xid:      fmt.Sprintf("%s:%d", hostname, s.config.GetPort()),
-			xrol:     rol,
-			xurl:     url,
-			xversion: "TODO"}
-		err := s.registryDriver.Register(context.Background(), node)
+// configureRouter builds the router for config and swaps it with the running one.
+// Nothing is swapped if any of the components can not be created. The components
+// of the previous configuration are closed once its in-flight requests finish.
+func (s *server) configureRouter(config *configuration) (err error) {
+	c := newContainer(config)
+	defer func() {
 		if err != nil {
-			s.logger.Error().Log("error", err)
-			return err
+			c.close()
 		}
+	}()
+
+	logger, err := getLogger(c)
+	if err != nil {
+		return err
 	}
-	return nil
-}
 
-func (s *server) configureRouter() error {
-	config := s.config
+	registryDriver, err := getRegistryDriver(c)
+	if err != nil {
+		logger.Error().Log("error", err)
+		return err
+	}
 
-	httpLogger, err := getHTTPLogger(config)
+	httpLogger, err := getHTTPLogger(c)
 	if err != nil {
-		s.logger.Error().Log("error", err)
+		logger.Error().Log("error", err)
 		return err
 	}
-	s.httpLogger = httpLogger
 
-	loggerMiddleware, err := getLoggerMiddleware(config)
+	loggerMiddleware, err := getLoggerMiddleware(c)
 	if err != nil {
-		s.logger.Error().Log("error", err)
+		logger.Error().Log("error", err)
 		return err
 	}
 
-	corsMiddleware, err := getCORSMiddleware(config)
+	corsMiddleware, err := getCORSMiddleware(c)
 	if err != nil {
-		s.logger.Error().Log("error", err)
+		logger.Error().Log("error", err)
 		return err
 	}
 
-	webServices, err := getWebServices(config)
+	webServices, err := getWebServices(c)
 	if err != nil {
-		s.logger.Error().Log("error", err)
+		logger.Error().Log("error", err)
 		return err
 	}
-	s.logger.Info().Log("msg", "web services enabled", "webservices", config.GetEnabledWebServices())
-	s.webServices = webServices
+	logger.Info().Log("msg", "web services enabled", "webservices", config.GetEnabledWebServices())
+
+	readinessChecks, err := s.getReadinessChecks(c, webServices)
+	if err != nil {
+		logger.Error().Log("error", err)
+		return err
+	}
+	// the admin and the public endpoints share the cached result
+	handleReadiness := readinessHandler(readinessChecks)
+
+	upstreamHealth, err := getUpstreamHealth(c)
+	if err != nil {
+		logger.Error().Log("error", err)
+		return err
+	}
+	retryPolicies := getRetryPolicies(config)
+	retryBudgets := map[string]*retryBudget{}
+	bodyReadTimeouts := getBodyReadTimeouts(config)
+	mtlsRequired := getMTLSRequiredWebServices(config)
+	mounts := getWebServiceMounts(config)
+	hostname, err := os.Hostname()
+	if err != nil {
+		logger.Error().Log("error", err)
+		return err
+	}
+	if _, address, err := getRegisteredAddress(config); err == nil {
+		hostname, _, _ = net.SplitHostPort(address)
+	} else if isRegistering(registryDriver) && len(webServices) > 0 {
+		// the nodes could not be registered
+		logger.Error().Log("error", err)
+		return err
+	}
+	identities := newNodeIdentities(registryDriver)
+	// wrap adds to the handlers of web service key the routing, the retries
+	// of the requests served by other nodes, the body read timeout, the node
+	// identity check and the metrics.
+	wrap := func(key string, service lib.WebService, path string, handler http.Handler) http.Handler {
+		handler = routingMiddleware(handler)
+		remote := service.IsProxy() || (key == "owncloud" && config.GetOCWebService() == "remote")
+		if policy := retryPolicies[key]; policy != nil && remote {
+			if retryBudgets[key] == nil {
+				retryBudgets[key] = newRetryBudget(key, config.GetRetryBudgetPercent(), config.GetRetryBudgetMinPerSecond())
+			}
+			handler = retryMiddleware(key, policy, retryBudgets[key], handler)
+		}
+		handler = bodyReadTimeoutMiddleware(s.conns, bodyReadTimeouts[key], handler)
+		if mtlsRequired[key] {
+			handler = nodeIdentityMiddleware(identities, logger, handler)
+		}
+		return instrumentHandler(key, path, handler)
+	}
+
+	catalog := newRouteCatalog(config)
+	catalog.addNodeEndpoints()
 
 	router := mux.NewRouter()
-	router.Handle("/metrics", prometheus.Handler()).Methods("GET")
-	s.logger.Info().Log("method", "GET", "endpoint", "/metrics", "msg", "endpoint available - created by prometheus")
-	for key, service := range webServices {
-		s.logger.Info().Log("msg", key+" web service enabled")
+	// with an admin listener the endpoints for operators are only served
+	// by it, the health endpoints are also public for load balancers and
+	// for the upstream health checks of other nodes
+	adminRouter := router
+	if config.GetAdminListener() != nil {
+		adminRouter = mux.NewRouter()
+		adminRouter.HandleFunc("/healthz", handleLiveness).Methods("GET")
+		adminRouter.Handle("/readyz", handleReadiness).Methods("GET")
+	}
+	adminRouter.Handle("/metrics", prometheus.Handler()).Methods("GET")
+	logger.Info().Log("method", "GET", "endpoint", "/metrics", "msg", "endpoint available - created by prometheus")
+	router.HandleFunc("/healthz", handleLiveness).Methods("GET")
+	logger.Info().Log("method", "GET", "endpoint", "/healthz", "msg", "endpoint available - liveness probe")
+	router.Handle("/readyz", handleReadiness).Methods("GET")
+	logger.Info().Log("method", "GET", "endpoint", "/readyz", "msg", "endpoint available - readiness probe")
+	adminRouter.Handle("/upstreams", upstreamsHandler(upstreamHealth)).Methods("GET")
+	logger.Info().Log("method", "GET", "endpoint", "/upstreams", "msg", "endpoint available - upstream nodes health")
+	// web services are added in the same order every time, the first
+	// route matching a request serves it
+	for _, key := range webServiceNames {
+		service, ok := webServices[key]
+		if !ok {
+			continue
+		}
+		mount := mounts[key]
+		serviceRouter := mount.router(router, hostname)
+		logger.Info().Log("msg", key+" web service enabled", "prefix", mount.pathPrefix, "hosts", strings.Join(mount.hosts, ","))
 		for path, methods := range service.Endpoints() {
+			endpoint := mount.pathPrefix + path
 			for method, handlerFunc := range methods {
 				handlerFunc = loggerMiddleware.HandlerFunc(handlerFunc)
 				handlerFunc := http.HandlerFunc(handlerFunc)
 				var handler http.Handler
 				if config.IsCORSMiddlewareEnabled() {
-					handler = handlerFunc
+					handler = mount.handler(handlerFunc)
 					handler = corsMiddleware.Handler(handler)
+					handler = wrap(key, service, endpoint, handler)
 					if method == "*" {
-						router.Handle(path, handler)
+						serviceRouter.Handle(path, handler)
 					} else {
-						router.Handle(path, handler).Methods(method)
+						serviceRouter.Handle(path, handler).Methods(method)
 					}
 
-					prometheus.InstrumentHandler(path, handler)
-					s.logger.Info().Log("method", method, "endpoint", path, "msg", "endpoint available")
-					router.Handle(path, handler).Methods("OPTIONS")
-					s.logger.Info().Log("method", "OPTIONS", "endpoint", path, "msg", "endpoint available - created by corsmiddleware")
+					catalog.add(key, method, path)
+					logger.Info().Log("method", method, "endpoint", endpoint, "msg", "endpoint available")
+					serviceRouter.Handle(path, handler).Methods("OPTIONS")
+					catalog.add(key, "OPTIONS", path)
+					logger.Info().Log("method", "OPTIONS", "endpoint", endpoint, "msg", "endpoint available - created by corsmiddleware")
 				} else {
-					handler = handlerFunc
+					handler = mount.handler(handlerFunc)
+					handler = wrap(key, service, endpoint, handler)
 					if method == "*" {
-						router.Handle(path, handler)
+						serviceRouter.Handle(path, handler)
 					} else {
-						router.Handle(path, handler).Methods(method)
+						serviceRouter.Handle(path, handler).Methods(method)
 					}
-					prometheus.InstrumentHandler(path, handler)
-					s.logger.Info().Log("method", method, "endpoint", path, "msg", "endpoint available")
+					catalog.add(key, method, path)
+					logger.Info().Log("method", method, "endpoint", endpoint, "msg", "endpoint available")
 				}
 			}
 		}
 	}
+
+	routes := catalog.routes
+	adminRouter.Handle("/routes", routesHandler(routes)).Methods("GET")
+	logger.Info().Log("method", "GET", "endpoint", "/routes", "msg", "endpoint available - route catalog")
+	adminRouter.Handle("/openapi.json", openAPIHandler(routes)).Methods("GET")
+	logger.Info().Log("method", "GET", "endpoint", "/openapi.json", "msg", "endpoint available - openapi document")
+	if adminRouter != router {
+		handleDebugEndpoints(adminRouter, registryDriver)
+		logger.Info().Log("msg", "admin endpoints available", "endpoints", "/metrics,/healthz,/readyz,/upstreams,/routes,/openapi.json,/registry,/debug/pprof/")
+	}
+
+	s.mu.Lock()
+	previous := s.current
+	s.current = &generation{
+		handler:   handlers.CombinedLoggingHandler(httpLogger, router),
+		admin:     adminRouter,
+		routes:    routes,
+		container: c,
+	}
+	s.logger = logger
+	s.config = config
+	s.registryDriver = registryDriver
+	s.httpLogger = httpLogger
+	s.webServices = webServices
 	s.router = router
+	s.mu.Unlock()
+
+	if previous != nil {
+		go func() {
+			previous.inFlight.Wait()
+			if err := previous.container.close(); err != nil {
+				logger.Error().Log("msg", "error closing components of previous configuration", "error", err)
+			}
+		}()
+	}
 	return nil
 }
 
+// registryUnregisterer is implemented by registry drivers able to remove
+// a node before its TTL expires.
+type registryUnregisterer interface {
+	Unregister(ctx context.Context, node lib.RegistryNode) error
+}
+
+// isRegistering reports whether registryDriver keeps the nodes clawiod registers.
+func isRegistering(registryDriver lib.RegistryDriver) bool {
+	r, ok := registryDriver.(registryReadOnly)
+	return !ok || !r.IsReadOnly()
+}
+
+// registryReadOnly is implemented by registry drivers whose nodes are
+// published by others, like a file or the platform, so clawiod neither
+// registers nor removes them.
+type registryReadOnly interface {
+	IsReadOnly() bool
+}
+
+// registryLister is implemented by registry drivers able to list
+// the nodes of every role.
+type registryLister interface {
+	GetNodes(ctx context.Context) ([]lib.RegistryNode, error)
+}
+
+// registryNodeMetadata is implemented by registry nodes carrying extra
+// information for routing, like the enabled drivers or the max upload size.
+// Registry drivers able to store it should keep it along the node.
+type registryNodeMetadata interface {
+	Metadata() map[string]string
+}
+
 type node struct {
-	xid      string
-	xrol     string
-	xhost    string
-	xversion string
-	xurl     string
+	xid       string
+	xrol      string
+	xhost     string
+	xversion  string
+	xurl      string
+	xmetadata map[string]string
 }
 
 func (n *node) ID() string {
@@ -186,3 +610,6 @@ func (n *node) Version() string {
 func (n *node) URL() string {
 	return n.xurl
 }
+func (n *node) Metadata() map[string]string {
+	return n.xmetadata
+}
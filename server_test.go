@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"github.com/clawio/lib"
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/levels"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// recordingRegistryDriver keeps the metadata of the nodes last registered.
+type recordingRegistryDriver struct {
+	staticRegistryDriver
+	metadata []map[string]string
+}
+
+func (d *recordingRegistryDriver) Register(ctx context.Context, n lib.RegistryNode) error {
+	d.metadata = append(d.metadata, n.(registryNodeMetadata).Metadata())
+	return nil
+}
+
+func TestRegisterNodeHeartbeat(t *testing.T) {
+	d := &recordingRegistryDriver{}
+	s := &server{
+		logger:         levels.New(log.NewNopLogger()),
+		config:         &configuration{},
+		registryDriver: d,
+		webServices:    map[string]lib.WebService{"data": &testWebService{}},
+		started:        time.Now(),
+	}
+	for i := 0; i < 2; i++ {
+		if err := s.registerNode(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		if i == 0 {
+			// heartbeats are stored with a resolution of seconds
+			time.Sleep(time.Second)
+		}
+	}
+	if len(d.metadata) != 2 {
+		t.Fatalf("registered %d times, want 2", len(d.metadata))
+	}
+	first, second := d.metadata[0], d.metadata[1]
+	if first["registered"] != second["registered"] {
+		t.Errorf("registered changed from %s to %s, want the first registration", first["registered"], second["registered"])
+	}
+	if first["last_heartbeat"] != first["registered"] {
+		t.Errorf("first heartbeat %s, want the registration %s", first["last_heartbeat"], first["registered"])
+	}
+	if second["last_heartbeat"] == first["last_heartbeat"] {
+		t.Errorf("last heartbeat %s not updated by the second heartbeat", second["last_heartbeat"])
+	}
+}
+
+func TestGetDisabledNodes(t *testing.T) {
+	data := &node{xid: "node1:1502", xrol: "data-node"}
+	metaData := &node{xid: "node1:1502", xrol: "metadata-node"}
+	proxy := &node{xid: "node1:1502", xrol: "data-node-proxy"}
+	tests := []struct {
+		name     string
+		oldNodes []*node
+		newNodes []*node
+		want     []*node
+	}{
+		{"unchanged", []*node{data, metaData}, []*node{data, metaData}, []*node{}},
+		{"web service disabled", []*node{data, metaData}, []*node{data}, []*node{metaData}},
+		{"web service proxied", []*node{data, metaData}, []*node{proxy, metaData}, []*node{data}},
+		{"web service enabled", []*node{data}, []*node{data, metaData}, []*node{}},
+		{"all disabled", []*node{data, metaData}, nil, []*node{data, metaData}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := getDisabledNodes(tt.oldNodes, tt.newNodes); !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("getDisabledNodes() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,348 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/clawio/lib"
+	"github.com/go-kit/kit/log/levels"
+	"github.com/prometheus/client_golang/prometheus"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	upstreamEjected = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "clawiod",
+		Subsystem: "upstream",
+		Name:      "ejected",
+		Help:      "1 if the upstream node receives no requests because it is failing, 0 otherwise.",
+	}, []string{"role", "node"})
+
+	upstreamEjectionsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "clawiod",
+		Subsystem: "upstream",
+		Name:      "ejections_total",
+		Help:      "Number of times an upstream node was ejected by reason: health_check or outlier.",
+	}, []string{"role", "node", "reason"})
+)
+
+func init() {
+	prometheus.MustRegister(upstreamEjected, upstreamEjectionsTotal)
+}
+
+// upstreamHealthSettings controls when upstream nodes are ejected.
+type upstreamHealthSettings struct {
+	interval            time.Duration
+	timeout             time.Duration
+	consecutiveFailures int
+	cooldown            time.Duration
+}
+
+func getUpstreamHealthSettings(config *configuration) upstreamHealthSettings {
+	return upstreamHealthSettings{
+		interval:            config.GetUpstreamHealthCheckInterval(),
+		timeout:             config.GetUpstreamHealthCheckTimeout(),
+		consecutiveFailures: config.GetUpstreamOutlierConsecutiveFailures(),
+		cooldown:            config.GetUpstreamOutlierCooldown(),
+	}
+}
+
+// upstreamState is the health of an upstream node.
+type upstreamState struct {
+	rol          string
+	url          string
+	healthy      bool
+	failures     int
+	ejectedUntil time.Time
+	ejections    int
+	lastCheck    time.Time
+	lastErr      string
+}
+
+// upstreamView is the health of an upstream node as served by the upstreams endpoint.
+type upstreamView struct {
+	Role         string     `json:"role"`
+	URL          string     `json:"url"`
+	Ejected      bool       `json:"ejected"`
+	Healthy      bool       `json:"healthy"`
+	Failures     int        `json:"consecutive_failures"`
+	EjectedUntil *time.Time `json:"ejected_until,omitempty"`
+	Ejections    int        `json:"ejections"`
+	LastCheck    *time.Time `json:"last_check,omitempty"`
+	LastError    string     `json:"last_error,omitempty"`
+}
+
+// upstreamHealth keeps failing upstream nodes out of the load balancers.
+// Nodes are ejected while their /healthz endpoint fails (active checks) and,
+// like a circuit breaker, for a cooldown after consecutive failed requests
+// (passive outlier detection). After the cooldown a single failure ejects
+// the node again until a request succeeds.
+type upstreamHealth struct {
+	registryDriver lib.RegistryDriver
+	logger         levels.Levels
+	settings       upstreamHealthSettings
+	client         *http.Client
+
+	mu     sync.Mutex
+	roles  map[string]bool
+	states map[string]*upstreamState
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+func newUpstreamHealth(registryDriver lib.RegistryDriver, logger levels.Levels, settings upstreamHealthSettings, transport http.RoundTripper) *upstreamHealth {
+	h := &upstreamHealth{
+		registryDriver: registryDriver,
+		logger:         logger,
+		settings:       settings,
+		client:         &http.Client{Timeout: settings.timeout, Transport: transport},
+		roles:          map[string]bool{},
+		states:         map[string]*upstreamState{},
+		stop:           make(chan struct{}),
+		done:           make(chan struct{}),
+	}
+	go h.run()
+	return h
+}
+
+// Close stops the active health checks and removes the metrics of the nodes.
+func (h *upstreamHealth) Close() error {
+	close(h.stop)
+	<-h.done
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, state := range h.states {
+		upstreamEjected.DeleteLabelValues(state.rol, state.url)
+	}
+	return nil
+}
+
+// available returns the nodes of rol that are not ejected. If all of them are
+// ejected all are returned, a node that may fail is better than no node.
+// The role is checked actively from now on.
+func (h *upstreamHealth) available(rol string, nodes []lib.RegistryNode) []lib.RegistryNode {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.roles[rol] = true
+	now := time.Now()
+	available := []lib.RegistryNode{}
+	for _, n := range nodes {
+		if state, ok := h.states[stateKey(rol, n.URL())]; ok && h.isEjected(state, now) {
+			continue
+		}
+		available = append(available, n)
+	}
+	if len(available) == 0 {
+		return nodes
+	}
+	return available
+}
+
+// report records the outcome of a request sent to node n.
+func (h *upstreamHealth) report(rol string, n lib.RegistryNode, failed bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	state := h.getState(rol, n.URL())
+	if !failed {
+		state.failures = 0
+		h.updateMetric(state)
+		return
+	}
+	state.failures++
+	if state.failures >= h.settings.consecutiveFailures && !h.isEjected(state, time.Now()) {
+		state.ejectedUntil = time.Now().Add(h.settings.cooldown)
+		// half open: one more failure after the cooldown ejects it again
+		state.failures = h.settings.consecutiveFailures - 1
+		state.ejections++
+		upstreamEjectionsTotal.WithLabelValues(rol, state.url, "outlier").Inc()
+		h.logger.Warn().Log("msg", "upstream node ejected after consecutive failures", "rol", rol, "node", state.url, "cooldown", h.settings.cooldown)
+	}
+	h.updateMetric(state)
+}
+
+// getViews returns the health of every upstream node sorted by role and URL.
+func (h *upstreamHealth) getViews() []*upstreamView {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	now := time.Now()
+	views := []*upstreamView{}
+	for _, state := range h.states {
+		v := &upstreamView{
+			Role:      state.rol,
+			URL:       state.url,
+			Ejected:   h.isEjected(state, now),
+			Healthy:   state.healthy,
+			Failures:  state.failures,
+			Ejections: state.ejections,
+			LastError: state.lastErr,
+		}
+		if now.Before(state.ejectedUntil) {
+			t := state.ejectedUntil
+			v.EjectedUntil = &t
+		}
+		if !state.lastCheck.IsZero() {
+			t := state.lastCheck
+			v.LastCheck = &t
+		}
+		views = append(views, v)
+	}
+	sort.Slice(views, func(i, j int) bool {
+		if views[i].Role != views[j].Role {
+			return views[i].Role < views[j].Role
+		}
+		return views[i].URL < views[j].URL
+	})
+	return views
+}
+
+func (h *upstreamHealth) run() {
+	defer close(h.done)
+	ticker := time.NewTicker(h.settings.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			h.checkAll()
+		case <-h.stop:
+			return
+		}
+	}
+}
+
+// checkAll checks the nodes of every role asked to the load balancers and
+// forgets the nodes that are not in the registry anymore.
+func (h *upstreamHealth) checkAll() {
+	h.mu.Lock()
+	roles := []string{}
+	for rol := range h.roles {
+		roles = append(roles, rol)
+	}
+	h.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), h.settings.interval)
+	defer cancel()
+	seen := map[string]bool{}
+	var wg sync.WaitGroup
+	for _, rol := range roles {
+		nodes, err := h.registryDriver.GetNodesForRol(ctx, rol)
+		if err != nil {
+			h.logger.Error().Log("msg", "error getting upstream nodes to check", "rol", rol, "error", err)
+			// keep what we know about them
+			h.mu.Lock()
+			for key := range h.states {
+				if strings.HasPrefix(key, rol+" ") {
+					seen[key] = true
+				}
+			}
+			h.mu.Unlock()
+			continue
+		}
+		for _, n := range nodes {
+			seen[stateKey(rol, n.URL())] = true
+			wg.Add(1)
+			go func(rol string, n lib.RegistryNode) {
+				defer wg.Done()
+				h.check(ctx, rol, n)
+			}(rol, n)
+		}
+	}
+	wg.Wait()
+
+	h.mu.Lock()
+	for key, state := range h.states {
+		if !seen[key] {
+			upstreamEjected.DeleteLabelValues(state.rol, state.url)
+			delete(h.states, key)
+		}
+	}
+	h.mu.Unlock()
+}
+
+// check probes the /healthz endpoint of node n, served at the root of the
+// node whatever the path prefix of its web services. Any status other
+// than 2xx is a failure.
+func (h *upstreamHealth) check(ctx context.Context, rol string, n lib.RegistryNode) {
+	err := func() error {
+		u, err := url.Parse(n.URL())
+		if err != nil {
+			return err
+		}
+		req, err := http.NewRequest("GET", u.Scheme+"://"+u.Host+"/healthz", nil)
+		if err != nil {
+			return err
+		}
+		res, err := h.client.Do(req.WithContext(ctx))
+		if err != nil {
+			return err
+		}
+		res.Body.Close()
+		if res.StatusCode < 200 || res.StatusCode > 299 {
+			return fmt.Errorf("health check answered %s", res.Status)
+		}
+		return nil
+	}()
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	state := h.getState(rol, n.URL())
+	state.lastCheck = time.Now()
+	if err != nil {
+		state.lastErr = err.Error()
+		if state.healthy {
+			state.ejections++
+			upstreamEjectionsTotal.WithLabelValues(rol, state.url, "health_check").Inc()
+			h.logger.Warn().Log("msg", "upstream node ejected by failed health check", "rol", rol, "node", state.url, "error", err)
+		}
+		state.healthy = false
+	} else {
+		if !state.healthy {
+			h.logger.Info().Log("msg", "upstream node passed health check", "rol", rol, "node", state.url)
+		}
+		state.lastErr = ""
+		state.healthy = true
+	}
+	h.updateMetric(state)
+}
+
+// getState returns the state of a node, creating it healthy the first time.
+// It must be called with h.mu held.
+func (h *upstreamHealth) getState(rol, url string) *upstreamState {
+	key := stateKey(rol, url)
+	state, ok := h.states[key]
+	if !ok {
+		state = &upstreamState{rol: rol, url: url, healthy: true}
+		h.states[key] = state
+	}
+	return state
+}
+
+func (h *upstreamHealth) isEjected(state *upstreamState, now time.Time) bool {
+	return !state.healthy || now.Before(state.ejectedUntil)
+}
+
+// updateMetric must be called with h.mu held.
+func (h *upstreamHealth) updateMetric(state *upstreamState) {
+	ejected := 0.0
+	if h.isEjected(state, time.Now()) {
+		ejected = 1
+	}
+	upstreamEjected.WithLabelValues(state.rol, state.url).Set(ejected)
+}
+
+func stateKey(rol, url string) string {
+	return rol + " " + url
+}
+
+// upstreamsHandler serves the state of the upstream nodes.
+func upstreamsHandler(h *upstreamHealth) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(h.getViews())
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"github.com/clawio/lib"
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/levels"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func newTestUpstreamHealth() *upstreamHealth {
+	return &upstreamHealth{
+		logger:   levels.New(log.NewNopLogger()),
+		settings: upstreamHealthSettings{interval: time.Hour, timeout: time.Second, consecutiveFailures: 2, cooldown: time.Minute},
+		client:   &http.Client{Timeout: time.Second},
+		roles:    map[string]bool{},
+		states:   map[string]*upstreamState{},
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+}
+
+func TestUpstreamHealthCheck(t *testing.T) {
+	tests := []struct {
+		name    string
+		status  int
+		healthy bool
+	}{
+		{"ok", http.StatusOK, true},
+		{"no content", http.StatusNoContent, true},
+		{"not found", http.StatusNotFound, false},
+		{"unauthorized", http.StatusUnauthorized, false},
+		{"redirect", http.StatusMovedPermanently, false},
+		{"unavailable", http.StatusServiceUnavailable, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var path string
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				path = r.URL.Path
+				if tt.status == http.StatusMovedPermanently {
+					w.Header().Set("Location", "http://127.0.0.1:1/healthz")
+				}
+				w.WriteHeader(tt.status)
+			}))
+			defer srv.Close()
+
+			h := newTestUpstreamHealth()
+			h.client.CheckRedirect = func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }
+			// the web service is mounted on a path prefix, the health check is not
+			n := &node{xrol: "data", xurl: srv.URL + "/api/data"}
+			h.check(context.Background(), "data", n)
+
+			if path != "/healthz" {
+				t.Errorf("health check requested %q, want /healthz", path)
+			}
+			state := h.states[stateKey("data", n.URL())]
+			if state.healthy != tt.healthy {
+				t.Errorf("healthy = %t, want %t (%s)", state.healthy, tt.healthy, state.lastErr)
+			}
+			if ejected := len(h.available("data", []lib.RegistryNode{n, &node{xurl: "http://other"}})) == 1; ejected == tt.healthy {
+				t.Errorf("node ejected %t, want %t", ejected, !tt.healthy)
+			}
+		})
+	}
+}
+
+func TestUpstreamHealthCloseDeletesMetrics(t *testing.T) {
+	h := newTestUpstreamHealth()
+	close(h.done)
+	h.report("data", &node{xurl: "http://closed-node"}, true)
+	if n := countEjectedMetrics(t, "http://closed-node"); n != 1 {
+		t.Fatalf("%d metrics of the node before Close(), want 1", n)
+	}
+	h.Close()
+	if n := countEjectedMetrics(t, "http://closed-node"); n != 0 {
+		t.Fatalf("%d metrics of the node after Close(), want 0", n)
+	}
+}
+
+func countEjectedMetrics(t *testing.T, url string) int {
+	families, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	count := 0
+	for _, family := range families {
+		if family.GetName() != "clawiod_upstream_ejected" {
+			continue
+		}
+		for _, m := range family.Metric {
+			if hasLabel(m, "node", url) {
+				count++
+			}
+		}
+	}
+	return count
+}
+
+func hasLabel(m *dto.Metric, name, value string) bool {
+	for _, l := range m.Label {
+		if l.GetName() == name && l.GetValue() == value {
+			return true
+		}
+	}
+	return false
+}